@@ -8,6 +8,7 @@ import (
 	"math/rand"
 	"net"
 	"os"
+	"os/signal"
 	"path"
 	"strings"
 	"syscall"
@@ -79,6 +80,16 @@ func main() {
 	statsdUDPPortEnvVarF := flag.String("statsd-udp-port-env-var", "", "The name of the environment variable containing the port where a statsd service is listening for stats over UDP")
 	statsdFormatF := flag.String("statsd-format", "datadog", "The statsd format to use (one of: classic, datadog)")
 	statsdMaxUDPSizeF := flag.Int("statsd-max-udp-size", 1432, "The size to buffer before transmitting a statsd UDP packet")
+	ioStatsIntervalF := flag.Duration("io-stats-interval", 0, "How often the I/O statistics of the active volumes on this node are reported (e.g. 10s). If unset, they are not reported")
+	var additionalVgnamesF stringsFlag
+	flag.Var(&additionalVgnamesF, "additional-volume-group", "The name of a further volume group to manage (can be given multiple times)")
+	volumeGroupPolicyF := flag.String("volume-group-policy", csilvm.VolumeGroupPolicyPrimary, "How the volume group of a new volume is chosen if the 'volumeGroup' parameter is not set (one of: primary, mostfree)")
+	thinOvercommitRatioF := flag.Float64("thin-overcommit-ratio", 1, "How many times the size of a thin pool may be allocated to thin volumes")
+	keyProviderF := flag.String("key-provider", "", "Where the data keys of encrypted volumes are kept (file:<directory> or the http(s) URL of a key service). If unset, keys are taken from node publish secrets")
+	sedF := flag.Bool("self-encrypting-drives", false, "If set, the self-encrypting drives of the volume group are unlocked through the StoLake agent at startup")
+	lockDrivesF := flag.Bool("lock-drives", false, "If set, the self-encrypting drives of the volume group are locked and the plugin exits. No host may be using volumes of the volume group")
+	qosCgroupF := flag.String("qos-cgroup", "", "The cgroup containing the pods whose I/O controller enforces the QoS limits of volumes, e.g. /sys/fs/cgroup/kubepods.slice. If unset, the usual kubepods cgroups are tried; 'none' disables the cgroup limits")
+	retireDeviceF := flag.String("retire-device", "", "If set, the physical volume is removed from its volume group, the global locking band of a self-encrypting drive is reset, the self-encrypting drives are locked again and the plugin exits")
 	flag.String("build-version", "", version.Get().Version)
 	flag.Parse()
 	// Setup logging
@@ -218,7 +229,13 @@ func main() {
 		csilvm.DefaultVolumeSize(*defaultVolumeSizeF),
 		csilvm.ProbeModules(probeModulesF),
 		csilvm.Metrics(scope),
+		csilvm.ThinOvercommitRatio(*thinOvercommitRatioF),
+		csilvm.VolumeGroupPolicy(*volumeGroupPolicyF),
+		csilvm.QosCgroup(*qosCgroupF),
 	)
+	for _, vgname := range additionalVgnamesF {
+		opts = append(opts, csilvm.AdditionalVolumeGroup(vgname))
+	}
 	if *removeF {
 		opts = append(opts, csilvm.RemoveVolumeGroup())
 	}
@@ -228,14 +245,56 @@ func main() {
 	for _, tag := range tagsF {
 		opts = append(opts, csilvm.Tag(tag))
 	}
+	if *sedF {
+		opts = append(opts, csilvm.SelfEncryptingDrives())
+	}
+	if *keyProviderF != "" {
+		kp, err := csilvm.NewKeyProvider(*keyProviderF)
+		if err != nil {
+			logger.Fatalf("Invalid key provider: err=%v", err)
+		}
+		opts = append(opts, csilvm.EncryptionKeyProvider(kp))
+	}
+	if *lockDrivesF && !*sedF {
+		logger.Fatalf("FAILED TO START: lock-drives requires self-encrypting-drives.")
+	}
 	s := csilvm.NewServer(*vgnameF, strings.Split(*pvnamesF, ","), *defaultFsF,  opts...)
 	if err := s.Setup(); err != nil {
 		logger.Fatalf("error initializing csilvm plugin: err=%v", err)
 	}
+	if *retireDeviceF != "" {
+		if err := s.RetirePhysicalVolume(*retireDeviceF); err != nil {
+			logger.Fatalf("Failed to retire %v: err=%v", *retireDeviceF, err)
+		}
+		logger.Printf("Retired %v", *retireDeviceF)
+		// Setup unlocked the self-encrypting drives.
+		if err := s.LockDrives(); err != nil {
+			logger.Fatalf("Failed to lock self-encrypting drives: err=%v", err)
+		}
+		return
+	}
+	if *lockDrivesF {
+		if err := s.LockDrives(); err != nil {
+			logger.Fatalf("Failed to lock self-encrypting drives: err=%v", err)
+		}
+		logger.Printf("Locked self-encrypting drives")
+		return
+	}
 	defer s.ReportUptime()()
+	if *ioStatsIntervalF > 0 {
+		defer s.ReportIOStats(*ioStatsIntervalF)()
+	}
+	defer s.RegulateQos(time.Second)()
 	csi.RegisterIdentityServer(grpcServer, csilvm.IdentityServerValidator(s))
 	csi.RegisterControllerServer(grpcServer, csilvm.ControllerServerValidator(s, s.RemovingVolumeGroup(), s.SupportedFilesystems()))
 	csi.RegisterNodeServer(grpcServer, csilvm.NodeServerValidator(s, s.RemovingVolumeGroup(), s.SupportedFilesystems()))
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		logger.Printf("Received %v, shutting down", sig)
+		grpcServer.GracefulStop()
+	}()
 	if err := grpcServer.Serve(lis); err != nil {
 		logger.Fatalf("Stopped serving, err=%v", err)
 	}
@@ -0,0 +1,474 @@
+package csilvm
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Seagate/csiclvm/pkg/lvm"
+	"github.com/Seagate/csiclvm/pkg/virsh"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	tagEncrypted  = "LUKS"      // records that the volume is LUKS encrypted
+	attrEncrypted = "encrypted" // volume context key set to "true" for LUKS encrypted volumes
+
+	// secretEncryptionKey is the key of the node publish secret holding
+	// the passphrase of an encrypted volume.
+	secretEncryptionKey = "encryptionKey"
+
+	// cryptMappingPrefix prefixes the name of the dm-crypt mapping of an
+	// encrypted volume.
+	cryptMappingPrefix = "csicrypt-"
+	cryptMapperDir     = "/dev/mapper/"
+
+	tagKeyIDPrefix = "KEY." // records the ID of the volume's data key, key IDs are always tag-safe
+
+	// tagNextKeyIDPrefix records the ID of the data key the volume is
+	// being rotated to. The LUKS keyslot is re-keyed by the node that
+	// next opens the volume.
+	tagNextKeyIDPrefix = "KEYNEXT."
+
+	// tagKeyGenerationPrefix records the `rotatekey` generation the data
+	// key was last rotated for, base64 encoded as generations are
+	// arbitrary strings.
+	tagKeyGenerationPrefix = "KEYGEN+"
+)
+
+var ErrMissingEncryptionKey = status.Error(codes.InvalidArgument, "The '"+secretEncryptionKey+"' secret or a key provider is required to publish an encrypted volume.")
+var ErrUnencryptedVolume = status.Error(codes.FailedPrecondition, "The encrypted volume holds an unencrypted filesystem.")
+var ErrKeyNotRotatable = status.Error(codes.FailedPrecondition, "Only the data keys of encrypted volumes created with a key provider can be rotated.")
+
+// encryptedFromParameters returns true if volumes with the given
+// parameters are to be LUKS encrypted.
+func encryptedFromParameters(params map[string]string) (bool, error) {
+	encrypted, ok := params["encrypted"]
+	if !ok {
+		return false, nil
+	}
+	switch strings.ToLower(encrypted) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	default:
+		return false, errors.New("The 'encrypted' parameter must be 'true' or 'false'.")
+	}
+}
+
+// rotateKeyFromParameters consumes the `rotatekey` parameter of
+// ControllerModifyVolume and returns the key generation it requests, if
+// any. The data key of the volume is rotated whenever the generation
+// differs from the one it was last rotated for.
+func rotateKeyFromParameters(params map[string]string) (string, error) {
+	generation, ok := params["rotatekey"]
+	if !ok {
+		return "", nil
+	}
+	delete(params, "rotatekey")
+	if generation == "" {
+		return "", errors.New("The 'rotatekey' parameter must not be empty.")
+	}
+	return generation, nil
+}
+
+// encryptionTags returns the tags recording the encryption of the logical
+// volume, if any. A volume populated from the logical volume must carry the
+// same tags as its data is encrypted under the same key.
+func encryptionTags(lv *lvm.LogicalVolume) ([]string, error) {
+	tags, err := lv.Tags()
+	if err != nil {
+		return nil, err
+	}
+	var cryptTags []string
+	for _, tag := range tags {
+		if tag == tagEncrypted || strings.HasPrefix(tag, tagKeyIDPrefix) {
+			cryptTags = append(cryptTags, tag)
+		}
+	}
+	return cryptTags, nil
+}
+
+// keyIDFromTags returns the ID of the data key recorded in the tags, if any.
+func keyIDFromTags(tags []string) string {
+	return tagValue(tags, tagKeyIDPrefix)
+}
+
+// nextKeyIDFromTags returns the ID of the data key the volume is being
+// rotated to, if any.
+func nextKeyIDFromTags(tags []string) string {
+	return tagValue(tags, tagNextKeyIDPrefix)
+}
+
+// keyGenerationTag returns the tag recording the key generation.
+func keyGenerationTag(generation string) string {
+	return tagKeyGenerationPrefix + base64.RawURLEncoding.EncodeToString([]byte(generation))
+}
+
+// keyGenerationFromTags returns the key generation the data key of the
+// volume was last rotated for, if any.
+func keyGenerationFromTags(tags []string) string {
+	buf, err := base64.RawURLEncoding.DecodeString(tagValue(tags, tagKeyGenerationPrefix))
+	if err != nil {
+		log.Printf("Ignoring malformed key generation tag: err=%v", err)
+		return ""
+	}
+	return string(buf)
+}
+
+// tagValue returns the remainder of the first tag with the prefix, if any.
+func tagValue(tags []string, prefix string) string {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, prefix) {
+			return strings.TrimPrefix(tag, prefix)
+		}
+	}
+	return ""
+}
+
+// createVolumeKey creates a data key for the new encrypted volume and
+// records its ID on the volume.
+func (s *Server) createVolumeKey(ctx context.Context, lv *lvm.LogicalVolume) error {
+	uuid, err := lv.Uuid()
+	if err != nil {
+		return err
+	}
+	keyID, err := s.keyProvider.CreateKey(ctx, uuid)
+	if err != nil {
+		return err
+	}
+	log.Printf("Recording data key %v of volume %v", keyID, lv.Name())
+	if err := lv.AddTag(tagKeyIDPrefix + keyID); err != nil {
+		if err := s.keyProvider.DestroyKey(ctx, keyID); err != nil {
+			log.Printf("Failed to destroy unrecorded data key %v: err=%v", keyID, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// encryptionKey returns the passphrase of the encrypted volume. It is taken
+// from the secrets if present and fetched from the key provider otherwise.
+// An empty key is returned if neither holds a key for the volume.
+func (s *Server) encryptionKey(ctx context.Context, id string, secrets map[string]string) (string, error) {
+	if key := secrets[secretEncryptionKey]; key != "" || s.keyProvider == nil {
+		return key, nil
+	}
+	lv, err := s.lookupLogicalVolume(id)
+	if err != nil {
+		return "", ErrVolumeNotFound
+	}
+	tags, err := lv.Tags()
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "Error in Tags(): err=%v", err)
+	}
+	keyID := keyIDFromTags(tags)
+	if keyID == "" {
+		return "", nil
+	}
+	key, err := s.keyProvider.GetKey(ctx, keyID)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "Cannot get data key %v: err=%v", keyID, err)
+	}
+	return string(key), nil
+}
+
+// destroyVolumeKey crypto-shreds the volume by destroying its data key and
+// the key it is being rotated to, if any. The key is kept while snapshots
+// or volumes populated from the volume still use it.
+func (s *Server) destroyVolumeKey(ctx context.Context, lv *lvm.LogicalVolume) error {
+	if s.keyProvider == nil {
+		return nil
+	}
+	tags, err := lv.Tags()
+	if err != nil {
+		return err
+	}
+	for _, keyID := range []string{keyIDFromTags(tags), nextKeyIDFromTags(tags)} {
+		if keyID == "" {
+			continue
+		}
+		if err := s.destroyUnusedKey(ctx, lv, keyID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// destroyUnusedKey destroys the data key of the logical volume unless
+// another logical volume still uses it.
+func (s *Server) destroyUnusedKey(ctx context.Context, lv *lvm.LogicalVolume, keyID string) error {
+	for _, vg := range s.managedVolumeGroups() {
+		lvs, err := vg.FindLogicalVolumes(lvm.LVMatchTag(tagKeyIDPrefix + keyID))
+		if err != nil {
+			return err
+		}
+		for _, other := range lvs {
+			if other.VgName() != lv.VgName() || other.Name() != lv.Name() {
+				log.Printf("Keeping data key %v which is still used by %v", keyID, other.Name())
+				return nil
+			}
+		}
+	}
+	log.Printf("Destroying data key %v of volume %v", keyID, lv.Name())
+	return s.keyProvider.DestroyKey(ctx, keyID)
+}
+
+// rotateVolumeKey creates a new data key for the encrypted volume and
+// records it as the key the volume is being rotated to, unless the key was
+// already rotated for the generation. The LUKS keyslot can only be re-keyed
+// where the device is accessible, which is done by completeKeyRotation when
+// the volume is next opened. A rotation that is still pending covers the
+// new generation too.
+func (s *Server) rotateVolumeKey(ctx context.Context, lv *lvm.LogicalVolume, generation string) error {
+	if s.keyProvider == nil {
+		return ErrKeyNotRotatable
+	}
+	tags, err := lv.Tags()
+	if err != nil {
+		return status.Errorf(codes.Internal, "Error in Tags(): err=%v", err)
+	}
+	keyID := keyIDFromTags(tags)
+	if keyID == "" {
+		return ErrKeyNotRotatable
+	}
+	var remove []string
+	if tagValue(tags, tagKeyGenerationPrefix) != "" {
+		if keyGenerationFromTags(tags) == generation {
+			return nil
+		}
+		remove = []string{tagKeyGenerationPrefix + tagValue(tags, tagKeyGenerationPrefix)}
+	}
+	add := []string{keyGenerationTag(generation)}
+	nextKeyID := nextKeyIDFromTags(tags)
+	if nextKeyID != "" {
+		log.Printf("The data key of volume %v is already being rotated to %v", lv.Name(), nextKeyID)
+		if err := lv.ReplaceTags(remove, add); err != nil {
+			return status.Errorf(codes.Internal, "Cannot record key generation %v: err=%v", generation, err)
+		}
+		return nil
+	}
+	nextKeyID, err = s.keyProvider.RotateKey(ctx, keyID)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot rotate data key %v: err=%v", keyID, err)
+	}
+	log.Printf("Rotating data key %v of volume %v to %v for generation %v", keyID, lv.Name(), nextKeyID, generation)
+	if err := lv.ReplaceTags(remove, append(add, tagNextKeyIDPrefix+nextKeyID)); err != nil {
+		if err := s.keyProvider.DestroyKey(ctx, nextKeyID); err != nil {
+			log.Printf("Failed to destroy unrecorded data key %v: err=%v", nextKeyID, err)
+		}
+		return status.Errorf(codes.Internal, "Cannot record data key %v: err=%v", nextKeyID, err)
+	}
+	return nil
+}
+
+// completeKeyRotation re-keys the LUKS encrypted device of the volume if
+// its data key is being rotated. The new key is added to the LUKS header
+// and recorded as the data key of the volume before the old key is
+// removed from the header and destroyed, so the volume can be opened
+// with the recorded key at every step.
+func (s *Server) completeKeyRotation(ctx context.Context, id, devicePath string) error {
+	if s.keyProvider == nil {
+		return nil
+	}
+	lv, err := s.lookupLogicalVolume(id)
+	if err != nil {
+		return err
+	}
+	tags, err := lv.Tags()
+	if err != nil {
+		return err
+	}
+	keyID, nextKeyID := keyIDFromTags(tags), nextKeyIDFromTags(tags)
+	if keyID == "" || nextKeyID == "" {
+		return nil
+	}
+	key, err := s.keyProvider.GetKey(ctx, keyID)
+	if err != nil {
+		return err
+	}
+	nextKey, err := s.keyProvider.GetKey(ctx, nextKeyID)
+	if err != nil {
+		return err
+	}
+	log.Printf("Re-keying encrypted volume %v from data key %v to %v", devicePath, keyID, nextKeyID)
+	err = withKeyFile(string(key), func(keyFile string) error {
+		return withKeyFile(string(nextKey), func(nextKeyFile string) error {
+			if !keyUnlocksDevice(devicePath, nextKeyFile) {
+				if _, err := runOnNode("cryptsetup", "luksAddKey", "--batch-mode", "--key-file="+keyFile, devicePath, nextKeyFile); err != nil {
+					return err
+				}
+				if !keyUnlocksDevice(devicePath, nextKeyFile) {
+					return errors.New("cannot add the new data key to the LUKS header")
+				}
+			}
+			if err := lv.ReplaceTags(
+				[]string{tagKeyIDPrefix + keyID, tagNextKeyIDPrefix + nextKeyID},
+				[]string{tagKeyIDPrefix + nextKeyID}); err != nil {
+				return err
+			}
+			if _, err := runOnNode("cryptsetup", "luksRemoveKey", "--batch-mode", "--key-file="+keyFile, devicePath); err != nil {
+				return err
+			}
+			if keyUnlocksDevice(devicePath, keyFile) {
+				return errors.New("cannot remove the old data key from the LUKS header")
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return s.destroyUnusedKey(ctx, lv, keyID)
+}
+
+// keyUnlocksDevice returns true if the key in the key file unlocks a
+// keyslot of the LUKS encrypted device. Like isCryptMappingOpen it checks
+// the output of cryptsetup rather than its exit status.
+func keyUnlocksDevice(devicePath, keyFile string) bool {
+	output, err := runOnNode("cryptsetup", "open", "--test-passphrase", "--verbose", "--key-file="+keyFile, devicePath)
+	return err == nil && cryptKeyUnlocked(string(output))
+}
+
+// cryptKeyUnlocked returns true if the verbose output of `cryptsetup open
+// --test-passphrase` reports an unlocked keyslot, e.g., "Key slot 0
+// unlocked.\nCommand successful.".
+func cryptKeyUnlocked(output string) bool {
+	return strings.Contains(output, "Command successful.")
+}
+
+// cryptMappingName returns the name of the dm-crypt mapping an encrypted
+// volume is opened as on a node.
+func (s *Server) cryptMappingName(id string) string {
+	vgname, lvname := s.splitVolumeID(id)
+	return cryptMappingPrefix + vgname + "-" + lvname
+}
+
+// isCryptMapperPath returns true if the path is the device of a dm-crypt
+// mapping opened by this plugin.
+func isCryptMapperPath(path string) bool {
+	return strings.HasPrefix(path, cryptMapperDir+cryptMappingPrefix)
+}
+
+// isCryptMappingOpen returns true if the named dm-crypt mapping is open.
+// It checks the output of `cryptsetup status` rather than its exit status,
+// which the StoLake agent does not report in proxy mode.
+func isCryptMappingOpen(name string) bool {
+	output, err := runOnNode("cryptsetup", "status", name)
+	return err == nil && cryptStatusActive(string(output))
+}
+
+// cryptStatusActive returns true if the output of `cryptsetup status`
+// reports an open mapping, e.g., "/dev/mapper/name is active and is in
+// use." rather than "/dev/mapper/name is inactive.".
+func cryptStatusActive(output string) bool {
+	return strings.Contains(output, " is active")
+}
+
+// openEncrypted opens the LUKS encrypted device as the named dm-crypt
+// mapping and returns the path of the decrypted device. A device that
+// holds no data yet is formatted with LUKS first.
+func openEncrypted(devicePath, name, key string) (string, error) {
+	mapperPath := cryptMapperDir + name
+	if isCryptMappingOpen(name) {
+		log.Printf("The encrypted volume %v is already open as %v", devicePath, mapperPath)
+		return mapperPath, nil
+	}
+	log.Printf("Determining filesystem type at %v", devicePath)
+	fstype, err := determineFilesystemType(devicePath)
+	if err != nil {
+		return "", status.Errorf(
+			codes.Internal,
+			"Cannot determine filesystem type: err=%v",
+			err)
+	}
+	err = withKeyFile(key, func(keyFile string) error {
+		switch fstype {
+		case "crypto_LUKS":
+		case "":
+			log.Printf("The device %v holds no data, formatting with LUKS", devicePath)
+			if _, err := runOnNode("cryptsetup", "luksFormat", "--batch-mode", "--type=luks2", "--key-file="+keyFile, devicePath); err != nil {
+				return status.Errorf(
+					codes.Internal,
+					"luksFormat failed: err=%v",
+					err)
+			}
+		default:
+			return ErrUnencryptedVolume
+		}
+		log.Printf("Opening encrypted volume %v as %v", devicePath, mapperPath)
+		if _, err := runOnNode("cryptsetup", "open", "--type=luks", "--key-file="+keyFile, devicePath, name); err != nil {
+			return status.Errorf(
+				codes.Internal,
+				"Failed to open encrypted volume: err=%v",
+				err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return mapperPath, nil
+}
+
+// closeEncrypted closes the named dm-crypt mapping. It succeeds if the
+// mapping is not open.
+func closeEncrypted(name string) error {
+	if !isCryptMappingOpen(name) {
+		log.Printf("The encrypted volume %v is not open", name)
+		return nil
+	}
+	log.Printf("Closing encrypted volume %v", name)
+	if _, err := runOnNode("cryptsetup", "close", name); err != nil {
+		return err
+	}
+	return nil
+}
+
+// resizeEncrypted grows the named dm-crypt mapping to fill its device. The
+// key may be empty if the volume key is still held by the kernel.
+func resizeEncrypted(name, key string) error {
+	if key == "" {
+		_, err := runOnNode("cryptsetup", "resize", name)
+		return err
+	}
+	return withKeyFile(key, func(keyFile string) error {
+		_, err := runOnNode("cryptsetup", "resize", "--key-file="+keyFile, name)
+		return err
+	})
+}
+
+// withKeyFile writes the key to a private temporary file, calls fn with
+// its path and removes the file again. The key is never passed on the
+// command-line where it would be visible to other processes.
+func withKeyFile(key string, fn func(keyFile string) error) error {
+	file, err := ioutil.TempFile(keyFileDir(), "csilvm-key-")
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot create key file: err=%v", err)
+	}
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(key)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot write key file: err=%v", err)
+	}
+	return fn(file.Name())
+}
+
+// keyFileDir returns the directory key files are written to. In proxy mode
+// cryptsetup is run by the StoLake agent, which shares the directory of its
+// socket with the plugin.
+func keyFileDir() string {
+	if virsh.ProxyMode() {
+		return filepath.Dir(virsh.GetProxyURL())
+	}
+	return ""
+}
@@ -120,12 +120,18 @@ func TestGetPluginCapabilities(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if x := resp.GetCapabilities(); len(x) != 1 {
-		t.Fatalf("Expected 1 capability, but got %v", x)
+	if x := resp.GetCapabilities(); len(x) != 3 {
+		t.Fatalf("Expected 3 capabilities, but got %v", x)
 	}
 	if x := resp.GetCapabilities()[0].GetService().Type; x != csi.PluginCapability_Service_CONTROLLER_SERVICE {
 		t.Fatalf("Expected plugin to have capability CONTROLLER_SERVICE but had %v", x)
 	}
+	if x := resp.GetCapabilities()[1].GetVolumeExpansion().Type; x != csi.PluginCapability_VolumeExpansion_ONLINE {
+		t.Fatalf("Expected plugin to have capability VolumeExpansion ONLINE but had %v", x)
+	}
+	if x := resp.GetCapabilities()[2].GetService().Type; x != csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS {
+		t.Fatalf("Expected plugin to have capability VOLUME_ACCESSIBILITY_CONSTRAINTS but had %v", x)
+	}
 }
 
 func TestGetPluginCapabilitiesRemoveVolumeGroup(t *testing.T) {
@@ -139,12 +145,18 @@ func TestGetPluginCapabilitiesRemoveVolumeGroup(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if x := resp.GetCapabilities(); len(x) != 1 {
-		t.Fatalf("Expected 1 capability, but got %v", x)
+	if x := resp.GetCapabilities(); len(x) != 3 {
+		t.Fatalf("Expected 3 capabilities, but got %v", x)
 	}
 	if x := resp.GetCapabilities()[0].GetService().Type; x != csi.PluginCapability_Service_CONTROLLER_SERVICE {
 		t.Fatalf("Expected plugin to have capability CONTROLLER_SERVICE but had %v", x)
 	}
+	if x := resp.GetCapabilities()[1].GetVolumeExpansion().Type; x != csi.PluginCapability_VolumeExpansion_ONLINE {
+		t.Fatalf("Expected plugin to have capability VolumeExpansion ONLINE but had %v", x)
+	}
+	if x := resp.GetCapabilities()[2].GetService().Type; x != csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS {
+		t.Fatalf("Expected plugin to have capability VOLUME_ACCESSIBILITY_CONSTRAINTS but had %v", x)
+	}
 }
 
 // ControllerService RPCs
@@ -598,238 +610,950 @@ func TestCreateVolume_VolumeLayout_RAID1_Mirror2(t *testing.T) {
 	checkVolumeContextIncludeVolumeTag(t, info, req.GetName())
 }
 
-func TestCreateVolume_VolumeLayout_TooFewDisks(t *testing.T) {
+func TestCreateVolume_VolumeLayout_RAID0(t *testing.T) {
 	vgname := testvgname()
-	pvname, pvclean := testpv()
-	defer check(pvclean)
-	client, clean := startTest(vgname, []string{pvname})
+	pvname1, pvclean1 := testpv()
+	defer check(pvclean1)
+	pvname2, pvclean2 := testpv()
+	defer check(pvclean2)
+	client, clean := startTest(vgname, []string{pvname1, pvname2})
 	defer clean()
 	req := testCreateVolumeRequest()
 	req.Parameters = map[string]string{
-		"type": "raid1",
+		"type":       "raid0",
+		"stripesize": "65536",
 	}
-	_, err := client.CreateVolume(context.Background(), req)
-	if !grpcErrorEqual(err, ErrInsufficientCapacity) {
-		// We expect ErrInsufficientCapacity as CreateVolume checks
-		// whether there is sufficient capacity to create the volume.
+	resp, err := client.CreateVolume(context.Background(), req)
+	if err != nil {
 		t.Fatal(err)
 	}
+	info := resp.GetVolume()
+	if info.GetCapacityBytes() != req.GetCapacityRange().GetRequiredBytes() {
+		t.Fatalf("Expected required_bytes (%v) to match volume size (%v).", req.GetCapacityRange().GetRequiredBytes(), info.GetCapacityBytes())
+	}
+	checkVolumeContextIncludeVolumeTag(t, info, req.GetName())
 }
 
-func testDeleteVolumeRequest(volumeId string) *csi.DeleteVolumeRequest {
-	req := &csi.DeleteVolumeRequest{
-		VolumeId: volumeId,
+func TestCreateVolume_VolumeLayout_RAID4(t *testing.T) {
+	vgname := testvgname()
+	pvname1, pvclean1 := testpv()
+	defer check(pvclean1)
+	pvname2, pvclean2 := testpv()
+	defer check(pvclean2)
+	pvname3, pvclean3 := testpv()
+	defer check(pvclean3)
+	client, clean := startTest(vgname, []string{pvname1, pvname2, pvname3})
+	defer clean()
+	req := testCreateVolumeRequest()
+	req.Parameters = map[string]string{
+		"type":       "raid4",
+		"regionsize": "1048576",
 	}
-	return req
+	resp, err := client.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := resp.GetVolume()
+	if info.GetCapacityBytes() != req.GetCapacityRange().GetRequiredBytes() {
+		t.Fatalf("Expected required_bytes (%v) to match volume size (%v).", req.GetCapacityRange().GetRequiredBytes(), info.GetCapacityBytes())
+	}
+	checkVolumeContextIncludeVolumeTag(t, info, req.GetName())
 }
 
-func TestDeleteVolume(t *testing.T) {
+func TestCreateVolume_Cache(t *testing.T) {
 	vgname := testvgname()
-	pvname, pvclean := testpv()
-	defer check(pvclean)
-	client, clean := startTest(vgname, []string{pvname})
+	pvname1, pvclean1 := testpv()
+	defer check(pvclean1)
+	pvname2, pvclean2 := testpv()
+	defer check(pvclean2)
+	client, clean := startTest(vgname, []string{pvname1, pvname2})
 	defer clean()
-	createReq := testCreateVolumeRequest()
-	createResp, err := client.CreateVolume(context.Background(), createReq)
+	req := testCreateVolumeRequest()
+	req.Parameters = map[string]string{
+		"cache":     "writethrough",
+		"cachesize": "20971520",
+	}
+	resp, err := client.CreateVolume(context.Background(), req)
 	if err != nil {
 		t.Fatal(err)
 	}
-	volumeId := createResp.GetVolume().GetVolumeId()
-	req := testDeleteVolumeRequest(volumeId)
-	_, err = client.DeleteVolume(context.Background(), req)
+	info := resp.GetVolume()
+	if info.GetCapacityBytes() != req.GetCapacityRange().GetRequiredBytes() {
+		t.Fatalf("Expected required_bytes (%v) to match volume size (%v).", req.GetCapacityRange().GetRequiredBytes(), info.GetCapacityBytes())
+	}
+	// The cache volume is hidden and not listed as a volume.
+	listResp, err := client.ListVolumes(context.Background(), testListVolumesRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(listResp.GetEntries()); n != 1 {
+		t.Fatalf("Expected 1 volume but got %d", n)
+	}
+	_, err = client.DeleteVolume(context.Background(), testDeleteVolumeRequest(info.GetVolumeId()))
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
-func TestDeleteVolume_Idempotent(t *testing.T) {
+func TestCreateVolume_Encrypted(t *testing.T) {
 	vgname := testvgname()
 	pvname, pvclean := testpv()
 	defer check(pvclean)
 	client, clean := startTest(vgname, []string{pvname})
 	defer clean()
-	createReq := testCreateVolumeRequest()
-	createResp, err := client.CreateVolume(context.Background(), createReq)
+	req := testCreateVolumeRequest()
+	req.Parameters = map[string]string{
+		"encrypted": "true",
+	}
+	resp, err := client.CreateVolume(context.Background(), req)
 	if err != nil {
 		t.Fatal(err)
 	}
-	volumeId := createResp.GetVolume().GetVolumeId()
-	req := testDeleteVolumeRequest(volumeId)
-	_, err = client.DeleteVolume(context.Background(), req)
+	info := resp.GetVolume()
+	if info.GetVolumeContext()[attrEncrypted] != "true" {
+		t.Fatalf("Expected the volume context to mark the volume encrypted: %v", info.GetVolumeContext())
+	}
+	// Snapshots of an encrypted volume and volumes restored from them
+	// hold encrypted data.
+	snapResp, err := client.CreateSnapshot(context.Background(), testCreateSnapshotRequest(info.GetVolumeId()))
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = client.DeleteVolume(context.Background(), req)
+	restoreReq := testCreateVolumeRequest()
+	restoreReq.Name = "test-volume-restored"
+	restoreReq.VolumeContentSource = &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{
+				SnapshotId: snapResp.GetSnapshot().GetSnapshotId(),
+			},
+		},
+	}
+	restoreResp, err := client.CreateVolume(context.Background(), restoreReq)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if restoreResp.GetVolume().GetVolumeContext()[attrEncrypted] != "true" {
+		t.Fatalf("Expected the restored volume to be encrypted: %v", restoreResp.GetVolume().GetVolumeContext())
+	}
 }
 
-func TestDeleteVolumeUnknownVolume(t *testing.T) {
+func TestNodePublishVolume_Encrypted_MissingKey(t *testing.T) {
 	vgname := testvgname()
 	pvname, pvclean := testpv()
 	defer check(pvclean)
 	client, clean := startTest(vgname, []string{pvname})
 	defer clean()
-	req := testDeleteVolumeRequest("missing-volume")
-	_, err := client.DeleteVolume(context.Background(), req)
+	req := testCreateVolumeRequest()
+	req.Parameters = map[string]string{
+		"encrypted": "true",
+	}
+	resp, err := client.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeId := resp.GetVolume().GetVolumeId()
+	tmpdirPath, err := ioutil.TempDir("", "csilvm_tests")
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer os.RemoveAll(tmpdirPath)
+	targetPath := filepath.Join(tmpdirPath, volumeId)
+	publishReq := testNodePublishVolumeRequest(volumeId, targetPath, "xfs", nil)
+	publishReq.PublishContext = map[string]string{"datapath": "direct"}
+	publishReq.VolumeContext = resp.GetVolume().GetVolumeContext()
+	_, err = client.NodePublishVolume(context.Background(), publishReq)
+	if !grpcErrorEqual(err, ErrMissingEncryptionKey) {
+		t.Fatal(err)
+	}
 }
 
-func TestDeleteVolumeAfterDeviceDisappears(t *testing.T) {
+func TestCreateVolume_Encrypted_KeyProvider(t *testing.T) {
+	keyDir, err := ioutil.TempDir("", "csilvm_tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(keyDir)
+	kp, err := NewFileKeyProvider(keyDir)
+	if err != nil {
+		t.Fatal(err)
+	}
 	vgname := testvgname()
 	pvname, pvclean := testpv()
 	defer check(pvclean)
-	client, clean := startTest(vgname, []string{pvname})
+	client, clean := startTest(vgname, []string{pvname}, EncryptionKeyProvider(kp))
 	defer clean()
-	// Create the volume that we'll be publishing.
-	createReq := testCreateVolumeRequest()
-	createResp, err := client.CreateVolume(context.Background(), createReq)
+	req := testCreateVolumeRequest()
+	req.Parameters = map[string]string{
+		"encrypted": "true",
+	}
+	resp, err := client.CreateVolume(context.Background(), req)
 	if err != nil {
 		t.Fatal(err)
 	}
-	volumeId := createResp.GetVolume().GetVolumeId()
-	// Remove the device node.
+	volumeId := resp.GetVolume().GetVolumeId()
 	vg, err := lvm.LookupVolumeGroup(vgname)
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
 	lv, err := vg.LookupLogicalVolume(volumeId)
 	if err != nil {
 		t.Fatal(err)
 	}
-	path, err := lv.Path()
+	tags, err := lv.Tags()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := os.Remove(path); err != nil {
+	keyID := keyIDFromTags(tags)
+	if keyID == "" {
+		t.Fatalf("Expected the volume to record its data key: %v", tags)
+	}
+	uuid, err := lv.Uuid()
+	if err != nil {
 		t.Fatal(err)
 	}
-	// Delete the volume, even though the device node has already been
-	// removed, and expect it to succeed.
-	expErr := status.Errorf(codes.Internal,
-		"The device path does not exist, cannot zero volume contents. To bypass the zeroing of the volume contents, ensure the file exists, or create it by hand, and reissue the DeleteVolume operation. path=%s",
-		path)
-	deleteReq := testDeleteVolumeRequest(volumeId)
-	_, err = client.DeleteVolume(context.Background(), deleteReq)
-	if !grpcErrorEqual(err, expErr) {
-		t.Fatalf("expected %v got %v", expErr, err)
+	if keyIDVolume(keyID) != uuid {
+		t.Fatalf("Expected the data key %v to belong to LV UUID %v", keyID, uuid)
+	}
+	if _, err := kp.GetKey(context.Background(), keyID); err != nil {
+		t.Fatal(err)
+	}
+	// Deleting the volume crypto-shreds it.
+	if _, err := client.DeleteVolume(context.Background(), testDeleteVolumeRequest(volumeId)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kp.GetKey(context.Background(), keyID); err != ErrKeyNotFound {
+		t.Fatalf("Expected the data key to be destroyed but got %v", err)
 	}
 }
 
-func TestDeleteVolumeErasesData(t *testing.T) {
+func TestControllerModifyVolume_RotateKey(t *testing.T) {
+	keyDir, err := ioutil.TempDir("", "csilvm_tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(keyDir)
+	kp, err := NewFileKeyProvider(keyDir)
+	if err != nil {
+		t.Fatal(err)
+	}
 	vgname := testvgname()
 	pvname, pvclean := testpv()
 	defer check(pvclean)
-	client, clean := startTest(vgname, []string{pvname})
+	client, clean := startTest(vgname, []string{pvname}, EncryptionKeyProvider(kp))
 	defer clean()
-	// Create the volume that we'll be publishing.
-	createReq := testCreateVolumeRequest()
-	createResp, err := client.CreateVolume(context.Background(), createReq)
+	req := testCreateVolumeRequest()
+	req.Parameters = map[string]string{
+		"encrypted": "true",
+	}
+	resp, err := client.CreateVolume(context.Background(), req)
 	if err != nil {
 		t.Fatal(err)
 	}
-	volumeId := createResp.GetVolume().GetVolumeId()
-	capacityBytes := createResp.GetVolume().GetCapacityBytes()
-	// Prepare a temporary mount directory.
+	volumeId := resp.GetVolume().GetVolumeId()
+	vg, err := lvm.LookupVolumeGroup(vgname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lv, err := vg.LookupLogicalVolume(volumeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags, err := lv.Tags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID := keyIDFromTags(tags)
+	// Format the volume with its current key.
 	tmpdirPath, err := ioutil.TempDir("", "csilvm_tests")
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer os.RemoveAll(tmpdirPath)
 	targetPath := filepath.Join(tmpdirPath, volumeId)
-	// Publish the volume to /the/tmp/dir/volume-id
-	publishReq := testNodePublishVolumeRequest(volumeId, targetPath, "xfs", nil)
-	_, err = client.NodePublishVolume(context.Background(), publishReq)
-	if err != nil {
+	publishReq := testNodePublishVolumeRequest(volumeId, targetPath, "block", nil)
+	publishReq.PublishContext = map[string]string{"datapath": "direct"}
+	publishReq.VolumeContext = resp.GetVolume().GetVolumeContext()
+	if _, err := client.NodePublishVolume(context.Background(), publishReq); err != nil {
 		t.Fatal(err)
 	}
-	// Unpublish the volume when the test ends unless the test
-	// called unpublish already.
-	alreadyUnpublished := false
-	defer func() {
-		if alreadyUnpublished {
-			return
-		}
-		req := testNodeUnpublishVolumeRequest(volumeId, publishReq.TargetPath)
-		_, err = client.NodeUnpublishVolume(context.Background(), req)
-		if err != nil {
-			t.Fatal(err)
-		}
-	}()
-	// Ensure that the device was mounted.
-	if !targetPathIsMountPoint(publishReq.TargetPath) {
-		t.Fatalf("Expected volume to be mounted at %v.", publishReq.TargetPath)
+	if _, err := client.NodeUnpublishVolume(context.Background(), testNodeUnpublishVolumeRequest(volumeId, targetPath)); err != nil {
+		t.Fatal(err)
 	}
-	// Create a file on the mounted volume.
-	file, err := os.Create(filepath.Join(targetPath, "test"))
+	modifyReq := &csi.ControllerModifyVolumeRequest{
+		VolumeId:          volumeId,
+		MutableParameters: map[string]string{"rotatekey": "1"},
+	}
+	if _, err := client.ControllerModifyVolume(context.Background(), modifyReq); err != nil {
+		t.Fatal(err)
+	}
+	tags, err = lv.Tags()
 	if err != nil {
 		t.Fatal(err)
 	}
-	// Fill the file with 1's.
-	ones := repeater{1}
-	wrote, err := io.CopyN(file, ones, int64(capacityBytes))
-	if err.(*os.PathError).Err != syscall.ENOSPC {
-		t.Fatalf("Expected ENOSPC but got %v", err)
+	nextKeyID := nextKeyIDFromTags(tags)
+	if nextKeyID == "" || keyIDFromTags(tags) != keyID {
+		t.Fatalf("Expected the volume to record a pending rotation of key %v: %v", keyID, tags)
 	}
-	file.Close()
-	// Check that we wrote at least half the volume's capacity full of ones.
-	// We can't check for equality due to filesystem metadata, etc.
-	if int64(wrote) < capacityBytes/2 {
-		t.Fatalf("Failed to write even half of the volume: %v of %v", wrote, capacityBytes)
+	// Rotating again while the rotation is pending does nothing.
+	if _, err := client.ControllerModifyVolume(context.Background(), modifyReq); err != nil {
+		t.Fatal(err)
 	}
-	// Unpublish the volume.
-	req := testNodeUnpublishVolumeRequest(volumeId, publishReq.TargetPath)
-	_, err = client.NodeUnpublishVolume(context.Background(), req)
+	tags, err = lv.Tags()
 	if err != nil {
 		t.Fatal(err)
 	}
-	alreadyUnpublished = true
-	deleteReq := testDeleteVolumeRequest(volumeId)
-	_, err = client.DeleteVolume(context.Background(), deleteReq)
-	if err != nil {
+	if nextKeyIDFromTags(tags) != nextKeyID {
+		t.Fatalf("Expected the pending rotation to %v to be kept: %v", nextKeyID, tags)
+	}
+	// The node re-keys the volume when it next opens it.
+	if _, err := client.NodePublishVolume(context.Background(), publishReq); err != nil {
 		t.Fatal(err)
 	}
-	// Create a new volume and check that it contains only zeros.
-	createReq.Name += "-2"
-	createResp, err = client.CreateVolume(context.Background(), createReq)
-	if err != nil {
+	if _, err := client.NodeUnpublishVolume(context.Background(), testNodeUnpublishVolumeRequest(volumeId, targetPath)); err != nil {
 		t.Fatal(err)
 	}
-	volumeId = createResp.GetVolume().GetVolumeId()
-	capacityBytes = createResp.GetVolume().GetCapacityBytes()
-	targetPath = filepath.Join(tmpdirPath, volumeId)
-	publishReq = testNodePublishVolumeRequest(volumeId, targetPath, "block", nil)
-	_, err = client.NodePublishVolume(context.Background(), publishReq)
+	tags, err = lv.Tags()
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer func() {
-		req := testNodeUnpublishVolumeRequest(volumeId, publishReq.TargetPath)
-		_, err = client.NodeUnpublishVolume(context.Background(), req)
-		if err != nil {
-			t.Fatal(err)
-		}
-	}()
-	// Check that the device is filled with zeros.
-	n, ok := containsOnly(targetPath, 0)
-	if !ok {
-		t.Fatal("Expected device to consists of zeros only.")
+	if keyIDFromTags(tags) != nextKeyID || nextKeyIDFromTags(tags) != "" {
+		t.Fatalf("Expected the volume to record the rotated key %v: %v", nextKeyID, tags)
 	}
-	if int64(n) != capacityBytes {
-		t.Fatalf("Bad read, expected device to have size %d but read only %d bytes", capacityBytes, n)
+	if _, err := kp.GetKey(context.Background(), keyID); err != ErrKeyNotFound {
+		t.Fatalf("Expected the old data key to be destroyed but got %v", err)
 	}
-}
-
-func containsOnly(devicePath string, i byte) (uint64, bool) {
-	file, err := os.Open(devicePath)
+	// The volume can still be opened with the rotated key.
+	if _, err := client.NodePublishVolume(context.Background(), publishReq); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.NodeUnpublishVolume(context.Background(), testNodeUnpublishVolumeRequest(volumeId, targetPath)); err != nil {
+		t.Fatal(err)
+	}
+	// The key is rotated once per generation.
+	if _, err := client.ControllerModifyVolume(context.Background(), modifyReq); err != nil {
+		t.Fatal(err)
+	}
+	tags, err = lv.Tags()
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
-	defer file.Close()
-	br := bufio.NewReader(file)
+	if nextKeyIDFromTags(tags) != "" {
+		t.Fatalf("Expected no rotation for the same generation: %v", tags)
+	}
+	modifyReq.MutableParameters = map[string]string{"rotatekey": "2"}
+	if _, err := client.ControllerModifyVolume(context.Background(), modifyReq); err != nil {
+		t.Fatal(err)
+	}
+	tags, err = lv.Tags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nextKeyIDFromTags(tags) == "" || keyGenerationFromTags(tags) != "2" {
+		t.Fatalf("Expected a pending rotation for generation 2: %v", tags)
+	}
+	// Only the keys of volumes encrypted with a key provider can be
+	// rotated.
+	req = testCreateVolumeRequest()
+	req.Name = "test-volume-unencrypted"
+	resp, err = client.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modifyReq.VolumeId = resp.GetVolume().GetVolumeId()
+	if _, err := client.ControllerModifyVolume(context.Background(), modifyReq); !grpcErrorEqual(err, ErrKeyNotRotatable) {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateVolume_Qos(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	req := testCreateVolumeRequest()
+	req.Parameters = map[string]string{
+		"iopspergb": "6",
+		"mbpspergb": "0.48",
+		"burstiops": "3000",
+	}
+	resp, err := client.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := resp.GetVolume()
+	for key, value := range req.Parameters {
+		if info.GetVolumeContext()[key] != value {
+			t.Fatalf("Expected the volume context to pass on %v=%v: %v", key, value, info.GetVolumeContext())
+		}
+	}
+	vg, err := lvm.LookupVolumeGroup(vgname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lv, err := vg.LookupLogicalVolume(info.GetVolumeId())
+	if err != nil {
+		t.Fatal(err)
+	}
+	countQosTags := func() (qosSpec, int) {
+		tags, err := lv.Tags()
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := 0
+		for _, tag := range tags {
+			if strings.HasPrefix(tag, tagQosPrefix) || strings.HasPrefix(tag, tagLegacyQosPrefix) {
+				count++
+			}
+		}
+		spec, _ := parseQosTag(tags)
+		return spec, count
+	}
+	exp := qosSpec{IOPSPerGB: 6, MBpsPerGB: 0.48, BurstIOPS: 3000, BurstSeconds: defaultBurstSeconds}
+	if spec, count := countQosTags(); spec != exp || count != 1 {
+		t.Fatalf("Expected a single QoS record %+v, got %+v in %d tags", exp, spec, count)
+	}
+	// A record of an earlier release is replaced.
+	if err := lv.AddTag("qos-6-0.48"); err != nil {
+		t.Fatal(err)
+	}
+	exp = qosSpec{IOPS: 100}
+	if err := recordQos(lv, exp); err != nil {
+		t.Fatal(err)
+	}
+	if spec, count := countQosTags(); spec != exp || count != 1 {
+		t.Fatalf("Expected a single QoS record %+v, got %+v in %d tags", exp, spec, count)
+	}
+	req = testCreateVolumeRequest()
+	req.Name = "test-volume-bad-qos"
+	req.Parameters = map[string]string{"burstiops": "3000"}
+	if _, err := client.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument, got %v", err)
+	}
+}
+
+func TestControllerModifyVolume(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	req := testCreateVolumeRequest()
+	req.Parameters = map[string]string{"iopspergb": "6", "iops": "100"}
+	resp, err := client.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := resp.GetVolume().GetVolumeId()
+	modifyReq := &csi.ControllerModifyVolumeRequest{
+		VolumeId:          id,
+		MutableParameters: map[string]string{"iopspergb": "10", "iops": "0"},
+	}
+	if _, err := client.ControllerModifyVolume(context.Background(), modifyReq); err != nil {
+		t.Fatal(err)
+	}
+	vg, err := lvm.LookupVolumeGroup(vgname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lv, err := vg.LookupLogicalVolume(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags, err := lv.Tags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := qosSpec{IOPSPerGB: 10}
+	if spec, _ := parseQosTag(tags); spec != exp {
+		t.Fatalf("Expected the QoS record %+v, got %+v", exp, spec)
+	}
+	// The layout of a volume cannot be changed in place.
+	modifyReq.MutableParameters = map[string]string{"type": "raid1"}
+	if _, err := client.ControllerModifyVolume(context.Background(), modifyReq); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument, got %v", err)
+	}
+	// A linear volume has no cache mode to change.
+	modifyReq.MutableParameters = map[string]string{"cache": "writeback"}
+	if _, err := client.ControllerModifyVolume(context.Background(), modifyReq); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument, got %v", err)
+	}
+	modifyReq.VolumeId = "csilv-missing"
+	modifyReq.MutableParameters = map[string]string{"iops": "100"}
+	if _, err := client.ControllerModifyVolume(context.Background(), modifyReq); status.Code(err) != codes.NotFound {
+		t.Fatalf("Expected NotFound, got %v", err)
+	}
+}
+
+func TestCreateVolume_VolumeLayout_Thin(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	req := testCreateVolumeRequest()
+	req.Parameters = map[string]string{
+		"type":         "thin",
+		"thinpool":     "test-pool",
+		"thinpoolsize": fmt.Sprintf("%d", 40<<20),
+	}
+	req.CapacityRange.RequiredBytes = 20 << 20
+	resp, err := client.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := resp.GetVolume()
+	if info.GetCapacityBytes() != req.GetCapacityRange().GetRequiredBytes() {
+		t.Fatalf("Expected required_bytes (%v) to match volume size (%v).", req.GetCapacityRange().GetRequiredBytes(), info.GetCapacityBytes())
+	}
+	checkVolumeContextIncludeVolumeTag(t, info, req.GetName())
+	// The thin pool is not reported as a volume.
+	listResp, err := client.ListVolumes(context.Background(), testListVolumesRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries := listResp.GetEntries(); len(entries) != 1 || entries[0].GetVolume().GetVolumeId() != info.GetVolumeId() {
+		t.Fatalf("Expected only volume %v to be listed but got %v", info.GetVolumeId(), entries)
+	}
+	// Nor can it be deleted as a volume.
+	if _, err := client.DeleteVolume(context.Background(), testDeleteVolumeRequest("test-pool")); err != nil {
+		t.Fatal(err)
+	}
+	vg, err := lvm.LookupVolumeGroup(vgname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vg.LookupLogicalVolume("test-pool"); err != nil {
+		t.Fatalf("Expected the thin pool to be kept: err=%v", err)
+	}
+}
+
+func TestCreateVolume_VolumeLayout_Thin_MissingPool(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	req := testCreateVolumeRequest()
+	req.Parameters = map[string]string{
+		"type":     "thin",
+		"thinpool": "test-pool",
+	}
+	_, err := client.CreateVolume(context.Background(), req)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument but got %v", err)
+	}
+}
+
+func TestCreateVolume_AccessibleTopology(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	tenant := vgname[5:]
+	vgSegment := map[string]string{tenant + topologyVolumeGroupKey + vgname: "true"}
+	// Direct SAS volumes are only accessible from nodes that see the
+	// volume group.
+	req := testCreateVolumeRequest()
+	req.AccessibilityRequirements = &csi.TopologyRequirement{
+		Requisite: []*csi.Topology{
+			{Segments: map[string]string{tenant + topologyKey: "other-node"}},
+			{Segments: map[string]string{tenant + topologyKey: "this-node", tenant + topologyVolumeGroupKey + vgname: "true"}},
+		},
+	}
+	resp, err := client.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topology := resp.GetVolume().GetAccessibleTopology()
+	if len(topology) != 1 || !reflect.DeepEqual(topology[0].GetSegments(), vgSegment) {
+		t.Fatalf("Expected accessible topology %v but got %v", vgSegment, topology)
+	}
+	// iSCSI volumes are accessible from any node.
+	req = testCreateVolumeRequest()
+	req.Name = "test-volume-2"
+	req.Parameters = map[string]string{"datapath": "iscsi"}
+	req.AccessibilityRequirements = &csi.TopologyRequirement{
+		Requisite: []*csi.Topology{
+			{Segments: map[string]string{tenant + topologyKey: "other-node"}},
+		},
+	}
+	resp, err = client.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topology := resp.GetVolume().GetAccessibleTopology(); topology != nil {
+		t.Fatalf("Expected no accessible topology but got %v", topology)
+	}
+}
+
+func TestCreateVolume_TopologyUnreachable(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	tenant := vgname[5:]
+	req := testCreateVolumeRequest()
+	req.AccessibilityRequirements = &csi.TopologyRequirement{
+		Requisite: []*csi.Topology{
+			{Segments: map[string]string{tenant + topologyKey: "other-node"}},
+		},
+	}
+	_, err := client.CreateVolume(context.Background(), req)
+	if !grpcErrorEqual(err, ErrTopologyUnreachable) {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateVolume_VolumeGroupParameter(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	vgname2, vgclean := testvg()
+	defer check(vgclean)
+	client, clean := startTest(vgname, []string{pvname}, AdditionalVolumeGroup(vgname2))
+	defer clean()
+	req := testCreateVolumeRequest()
+	req.Parameters = map[string]string{
+		"volumeGroup": vgname2,
+	}
+	resp, err := client.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeID := resp.GetVolume().GetVolumeId()
+	if !strings.HasPrefix(volumeID, vgname2+"/") {
+		t.Fatalf("Expected the volume ID %v to encode volume group %v", volumeID, vgname2)
+	}
+	vg2, err := lvm.LookupVolumeGroup(vgname2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vg2.LookupLogicalVolume(strings.TrimPrefix(volumeID, vgname2+"/")); err != nil {
+		t.Fatalf("Expected the volume to be created in %v: err=%v", vgname2, err)
+	}
+	// The volume is listed alongside the volumes of the primary
+	// volume group.
+	req = testCreateVolumeRequest()
+	req.Name = "test-volume-2"
+	resp, err = client.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listResp, err := client.ListVolumes(context.Background(), testListVolumesRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, entry := range listResp.GetEntries() {
+		ids = append(ids, entry.GetVolume().GetVolumeId())
+	}
+	sort.Strings(ids)
+	exp := []string{resp.GetVolume().GetVolumeId(), volumeID}
+	sort.Strings(exp)
+	if !reflect.DeepEqual(ids, exp) {
+		t.Fatalf("Expected volumes %v but got %v", exp, ids)
+	}
+	// The capacity of the requested volume group is reported.
+	capReq := testGetCapacityRequest("xfs")
+	capReq.Parameters = map[string]string{"volumeGroup": vgname2}
+	capResp, err := client.GetCapacity(context.Background(), capReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bytesFree, err := vg2.BytesFree(lvm.VolumeLayout{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := capResp.GetAvailableCapacity(); uint64(got) != bytesFree {
+		t.Fatalf("Expected %d bytes free but got %d", bytesFree, got)
+	}
+	if _, err := client.DeleteVolume(context.Background(), testDeleteVolumeRequest(volumeID)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vg2.LookupLogicalVolume(strings.TrimPrefix(volumeID, vgname2+"/")); err != lvm.ErrLogicalVolumeNotFound {
+		t.Fatalf("Expected the volume to be deleted but got %v", err)
+	}
+}
+
+func TestCreateVolume_VolumeGroupParameter_Unknown(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	req := testCreateVolumeRequest()
+	req.Parameters = map[string]string{
+		"volumeGroup": "unknown-vg",
+	}
+	_, err := client.CreateVolume(context.Background(), req)
+	if !grpcErrorEqual(err, ErrVolumeGroupNotFound) {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateVolume_VolumeGroupPolicyMostFree(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	vgname2, vgclean := testvg()
+	defer check(vgclean)
+	client, clean := startTest(vgname, []string{pvname}, AdditionalVolumeGroup(vgname2), VolumeGroupPolicy(VolumeGroupPolicyMostFree))
+	defer clean()
+	req := testCreateVolumeRequest()
+	resp, err := client.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := resp.GetVolume().GetVolumeId()
+	// The second volume goes to the volume group the first volume
+	// did not use.
+	req = testCreateVolumeRequest()
+	req.Name = "test-volume-2"
+	resp, err = client.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := resp.GetVolume().GetVolumeId()
+	if strings.Contains(first, "/") == strings.Contains(second, "/") {
+		t.Fatalf("Expected volumes %v and %v to be in different volume groups", first, second)
+	}
+}
+
+func TestCreateVolume_VolumeLayout_TooFewDisks(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	req := testCreateVolumeRequest()
+	req.Parameters = map[string]string{
+		"type": "raid1",
+	}
+	_, err := client.CreateVolume(context.Background(), req)
+	if !grpcErrorEqual(err, ErrInsufficientCapacity) {
+		// We expect ErrInsufficientCapacity as CreateVolume checks
+		// whether there is sufficient capacity to create the volume.
+		t.Fatal(err)
+	}
+}
+
+func testDeleteVolumeRequest(volumeId string) *csi.DeleteVolumeRequest {
+	req := &csi.DeleteVolumeRequest{
+		VolumeId: volumeId,
+	}
+	return req
+}
+
+func TestDeleteVolume(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	createReq := testCreateVolumeRequest()
+	createResp, err := client.CreateVolume(context.Background(), createReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeId := createResp.GetVolume().GetVolumeId()
+	req := testDeleteVolumeRequest(volumeId)
+	_, err = client.DeleteVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteVolume_Idempotent(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	createReq := testCreateVolumeRequest()
+	createResp, err := client.CreateVolume(context.Background(), createReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeId := createResp.GetVolume().GetVolumeId()
+	req := testDeleteVolumeRequest(volumeId)
+	_, err = client.DeleteVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.DeleteVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteVolumeUnknownVolume(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	req := testDeleteVolumeRequest("missing-volume")
+	_, err := client.DeleteVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteVolumeAfterDeviceDisappears(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	// Create the volume that we'll be publishing.
+	createReq := testCreateVolumeRequest()
+	createResp, err := client.CreateVolume(context.Background(), createReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeId := createResp.GetVolume().GetVolumeId()
+	// Remove the device node.
+	vg, err := lvm.LookupVolumeGroup(vgname)
+	if err != nil {
+		panic(err)
+	}
+	lv, err := vg.LookupLogicalVolume(volumeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, err := lv.Path()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	// Delete the volume, even though the device node has already been
+	// removed, and expect it to succeed.
+	expErr := status.Errorf(codes.Internal,
+		"The device path does not exist, cannot zero volume contents. To bypass the zeroing of the volume contents, ensure the file exists, or create it by hand, and reissue the DeleteVolume operation. path=%s",
+		path)
+	deleteReq := testDeleteVolumeRequest(volumeId)
+	_, err = client.DeleteVolume(context.Background(), deleteReq)
+	if !grpcErrorEqual(err, expErr) {
+		t.Fatalf("expected %v got %v", expErr, err)
+	}
+}
+
+func TestDeleteVolumeErasesData(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	// Create the volume that we'll be publishing.
+	createReq := testCreateVolumeRequest()
+	createResp, err := client.CreateVolume(context.Background(), createReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeId := createResp.GetVolume().GetVolumeId()
+	capacityBytes := createResp.GetVolume().GetCapacityBytes()
+	// Prepare a temporary mount directory.
+	tmpdirPath, err := ioutil.TempDir("", "csilvm_tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdirPath)
+	targetPath := filepath.Join(tmpdirPath, volumeId)
+	// Publish the volume to /the/tmp/dir/volume-id
+	publishReq := testNodePublishVolumeRequest(volumeId, targetPath, "xfs", nil)
+	_, err = client.NodePublishVolume(context.Background(), publishReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Unpublish the volume when the test ends unless the test
+	// called unpublish already.
+	alreadyUnpublished := false
+	defer func() {
+		if alreadyUnpublished {
+			return
+		}
+		req := testNodeUnpublishVolumeRequest(volumeId, publishReq.TargetPath)
+		_, err = client.NodeUnpublishVolume(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	// Ensure that the device was mounted.
+	if !targetPathIsMountPoint(publishReq.TargetPath) {
+		t.Fatalf("Expected volume to be mounted at %v.", publishReq.TargetPath)
+	}
+	// Create a file on the mounted volume.
+	file, err := os.Create(filepath.Join(targetPath, "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Fill the file with 1's.
+	ones := repeater{1}
+	wrote, err := io.CopyN(file, ones, int64(capacityBytes))
+	if err.(*os.PathError).Err != syscall.ENOSPC {
+		t.Fatalf("Expected ENOSPC but got %v", err)
+	}
+	file.Close()
+	// Check that we wrote at least half the volume's capacity full of ones.
+	// We can't check for equality due to filesystem metadata, etc.
+	if int64(wrote) < capacityBytes/2 {
+		t.Fatalf("Failed to write even half of the volume: %v of %v", wrote, capacityBytes)
+	}
+	// Unpublish the volume.
+	req := testNodeUnpublishVolumeRequest(volumeId, publishReq.TargetPath)
+	_, err = client.NodeUnpublishVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alreadyUnpublished = true
+	deleteReq := testDeleteVolumeRequest(volumeId)
+	_, err = client.DeleteVolume(context.Background(), deleteReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Create a new volume and check that it contains only zeros.
+	createReq.Name += "-2"
+	createResp, err = client.CreateVolume(context.Background(), createReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeId = createResp.GetVolume().GetVolumeId()
+	capacityBytes = createResp.GetVolume().GetCapacityBytes()
+	targetPath = filepath.Join(tmpdirPath, volumeId)
+	publishReq = testNodePublishVolumeRequest(volumeId, targetPath, "block", nil)
+	_, err = client.NodePublishVolume(context.Background(), publishReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		req := testNodeUnpublishVolumeRequest(volumeId, publishReq.TargetPath)
+		_, err = client.NodeUnpublishVolume(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	// Check that the device is filled with zeros.
+	n, ok := containsOnly(targetPath, 0)
+	if !ok {
+		t.Fatal("Expected device to consists of zeros only.")
+	}
+	if int64(n) != capacityBytes {
+		t.Fatalf("Bad read, expected device to have size %d but read only %d bytes", capacityBytes, n)
+	}
+}
+
+func containsOnly(devicePath string, i byte) (uint64, bool) {
+	file, err := os.Open(devicePath)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	br := bufio.NewReader(file)
 	idx := uint64(0)
 	for {
 		b, err := br.ReadByte()
@@ -844,33 +1568,630 @@ func containsOnly(devicePath string, i byte) (uint64, bool) {
 		}
 		idx++
 	}
-	return idx, true
+	return idx, true
+}
+
+func testCreateSnapshotRequest(sourceVolumeId string) *csi.CreateSnapshotRequest {
+	req := &csi.CreateSnapshotRequest{
+		SourceVolumeId: sourceVolumeId,
+		Name:           "test-snapshot",
+	}
+	return req
+}
+
+func TestCreateSnapshot(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	createReq := testCreateVolumeRequest()
+	createReq.CapacityRange.RequiredBytes /= 2
+	createResp, err := client.CreateVolume(context.Background(), createReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeId := createResp.GetVolume().GetVolumeId()
+	req := testCreateSnapshotRequest(volumeId)
+	resp, err := client.CreateSnapshot(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := resp.GetSnapshot()
+	if snapshot.GetSourceVolumeId() != volumeId {
+		t.Fatalf("Expected source volume %v but got %v", volumeId, snapshot.GetSourceVolumeId())
+	}
+	if snapshot.GetSizeBytes() != createResp.GetVolume().GetCapacityBytes() {
+		t.Fatalf("Expected snapshot size %v but got %v", createResp.GetVolume().GetCapacityBytes(), snapshot.GetSizeBytes())
+	}
+	if !snapshot.GetReadyToUse() {
+		t.Fatal("Expected snapshot to be ready to use")
+	}
+	if snapshot.GetCreationTime().AsTime().IsZero() {
+		t.Fatal("Expected snapshot to have a creation time")
+	}
+	// The snapshot must not be reported as a volume.
+	listResp, err := client.ListVolumes(context.Background(), testListVolumesRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listResp.GetEntries()) != 1 {
+		t.Fatalf("Expected 1 volume but got %v", listResp.GetEntries())
+	}
+}
+
+func TestCreateSnapshot_Idempotent(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	createReq := testCreateVolumeRequest()
+	createReq.CapacityRange.RequiredBytes /= 4
+	createResp, err := client.CreateVolume(context.Background(), createReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeId := createResp.GetVolume().GetVolumeId()
+	req := testCreateSnapshotRequest(volumeId)
+	resp1, err := client.CreateSnapshot(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp2, err := client.CreateSnapshot(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(resp1.GetSnapshot(), resp2.GetSnapshot()) {
+		t.Fatalf("Expected %+v but got %+v", resp1.GetSnapshot(), resp2.GetSnapshot())
+	}
+	// The same name with a different source must be rejected.
+	createReq.Name = "test-volume-2"
+	createResp, err = client.CreateVolume(context.Background(), createReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = testCreateSnapshotRequest(createResp.GetVolume().GetVolumeId())
+	_, err = client.CreateSnapshot(context.Background(), req)
+	if !grpcErrorEqual(err, ErrSnapshotAlreadyExists) {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateSnapshot_MissingSourceVolume(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	req := testCreateSnapshotRequest("missing-volume")
+	_, err := client.CreateSnapshot(context.Background(), req)
+	if !grpcErrorEqual(err, ErrVolumeNotFound) {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteSnapshot(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	createReq := testCreateVolumeRequest()
+	createReq.CapacityRange.RequiredBytes /= 2
+	createResp, err := client.CreateVolume(context.Background(), createReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeId := createResp.GetVolume().GetVolumeId()
+	snapResp, err := client.CreateSnapshot(context.Background(), testCreateSnapshotRequest(volumeId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The origin of a copy-on-write snapshot cannot be deleted.
+	_, err = client.DeleteVolume(context.Background(), testDeleteVolumeRequest(volumeId))
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatal(err)
+	}
+	req := &csi.DeleteSnapshotRequest{SnapshotId: snapResp.GetSnapshot().GetSnapshotId()}
+	if _, err = client.DeleteSnapshot(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	// DeleteSnapshot is idempotent.
+	if _, err = client.DeleteSnapshot(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.DeleteVolume(context.Background(), testDeleteVolumeRequest(volumeId)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListSnapshots(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	var volumeIds, snapshotIds []string
+	for i := 0; i < 2; i++ {
+		createReq := testCreateVolumeRequest()
+		createReq.Name = fmt.Sprintf("test-volume-%d", i)
+		createReq.CapacityRange.RequiredBytes /= 8
+		createResp, err := client.CreateVolume(context.Background(), createReq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		volumeId := createResp.GetVolume().GetVolumeId()
+		snapReq := testCreateSnapshotRequest(volumeId)
+		snapReq.Name = fmt.Sprintf("test-snapshot-%d", i)
+		snapResp, err := client.CreateSnapshot(context.Background(), snapReq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		volumeIds = append(volumeIds, volumeId)
+		snapshotIds = append(snapshotIds, snapResp.GetSnapshot().GetSnapshotId())
+	}
+	resp, err := client.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.GetEntries()) != 2 {
+		t.Fatalf("Expected 2 snapshots but got %v", resp.GetEntries())
+	}
+	// Filter by source volume.
+	resp, err = client.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SourceVolumeId: volumeIds[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.GetEntries()) != 1 || resp.GetEntries()[0].GetSnapshot().GetSnapshotId() != snapshotIds[1] {
+		t.Fatalf("Expected snapshot %v but got %v", snapshotIds[1], resp.GetEntries())
+	}
+	// Filter by snapshot ID.
+	resp, err = client.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SnapshotId: snapshotIds[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.GetEntries()) != 1 || resp.GetEntries()[0].GetSnapshot().GetSourceVolumeId() != volumeIds[0] {
+		t.Fatalf("Expected snapshot of %v but got %v", volumeIds[0], resp.GetEntries())
+	}
+	// Unknown snapshot IDs produce an empty response.
+	resp, err = client.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SnapshotId: "missing-snapshot"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.GetEntries()) != 0 {
+		t.Fatalf("Expected no snapshots but got %v", resp.GetEntries())
+	}
+}
+
+func testCreateVolumeFromSnapshotRequest(snapshotId string) *csi.CreateVolumeRequest {
+	req := testCreateVolumeRequest()
+	req.Name = "test-volume-restored"
+	req.VolumeContentSource = &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{
+				SnapshotId: snapshotId,
+			},
+		},
+	}
+	return req
+}
+
+func TestCreateVolumeFromSnapshot(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	createReq := testCreateVolumeRequest()
+	createReq.CapacityRange.RequiredBytes /= 4
+	createResp, err := client.CreateVolume(context.Background(), createReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeId := createResp.GetVolume().GetVolumeId()
+	snapResp, err := client.CreateSnapshot(context.Background(), testCreateSnapshotRequest(volumeId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotId := snapResp.GetSnapshot().GetSnapshotId()
+	req := testCreateVolumeFromSnapshotRequest(snapshotId)
+	req.CapacityRange = nil
+	resp, err := client.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volume := resp.GetVolume()
+	if volume.GetCapacityBytes() != snapResp.GetSnapshot().GetSizeBytes() {
+		t.Fatalf("Expected capacity %v but got %v", snapResp.GetSnapshot().GetSizeBytes(), volume.GetCapacityBytes())
+	}
+	if volume.GetContentSource().GetSnapshot().GetSnapshotId() != snapshotId {
+		t.Fatalf("Expected content source %v but got %v", snapshotId, volume.GetContentSource())
+	}
+	// CreateVolume is idempotent.
+	resp2, err := client.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp2.GetVolume().GetVolumeId() != volume.GetVolumeId() {
+		t.Fatalf("Expected volume %v but got %v", volume.GetVolumeId(), resp2.GetVolume().GetVolumeId())
+	}
+	// The restored volume does not depend on the snapshot.
+	req2 := &csi.DeleteSnapshotRequest{SnapshotId: snapshotId}
+	if _, err = client.DeleteSnapshot(context.Background(), req2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateVolumeFromSnapshot_CapacityTooSmall(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	createReq := testCreateVolumeRequest()
+	createReq.CapacityRange.RequiredBytes /= 4
+	createResp, err := client.CreateVolume(context.Background(), createReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapResp, err := client.CreateSnapshot(context.Background(), testCreateSnapshotRequest(createResp.GetVolume().GetVolumeId()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := testCreateVolumeFromSnapshotRequest(snapResp.GetSnapshot().GetSnapshotId())
+	req.CapacityRange = &csi.CapacityRange{
+		RequiredBytes: snapResp.GetSnapshot().GetSizeBytes() / 2,
+		LimitBytes:    snapResp.GetSnapshot().GetSizeBytes() / 2,
+	}
+	_, err = client.CreateVolume(context.Background(), req)
+	if !grpcErrorEqual(err, ErrContentSourceTooLarge) {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateVolumeFromSnapshot_MissingSnapshot(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	req := testCreateVolumeFromSnapshotRequest("csisnapmissing")
+	_, err := client.CreateVolume(context.Background(), req)
+	if !grpcErrorEqual(err, ErrSnapshotNotFound) {
+		t.Fatal(err)
+	}
+}
+
+func testCreateVolumeFromVolumeRequest(volumeId string) *csi.CreateVolumeRequest {
+	req := testCreateVolumeRequest()
+	req.Name = "test-volume-clone"
+	req.VolumeContentSource = &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Volume{
+			Volume: &csi.VolumeContentSource_VolumeSource{
+				VolumeId: volumeId,
+			},
+		},
+	}
+	return req
+}
+
+func TestCreateVolumeFromVolume(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	createReq := testCreateVolumeRequest()
+	createReq.CapacityRange.RequiredBytes /= 4
+	createResp, err := client.CreateVolume(context.Background(), createReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeId := createResp.GetVolume().GetVolumeId()
+	req := testCreateVolumeFromVolumeRequest(volumeId)
+	req.CapacityRange.RequiredBytes = createResp.GetVolume().GetCapacityBytes()
+	resp, err := client.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volume := resp.GetVolume()
+	if volume.GetCapacityBytes() != createResp.GetVolume().GetCapacityBytes() {
+		t.Fatalf("Expected capacity %v but got %v", createResp.GetVolume().GetCapacityBytes(), volume.GetCapacityBytes())
+	}
+	if volume.GetContentSource().GetVolume().GetVolumeId() != volumeId {
+		t.Fatalf("Expected content source %v but got %v", volumeId, volume.GetContentSource())
+	}
+	// The clone does not depend on its source.
+	if _, err = client.DeleteVolume(context.Background(), testDeleteVolumeRequest(volumeId)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateVolumeFromVolume_CapacityTooSmall(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	createReq := testCreateVolumeRequest()
+	createReq.CapacityRange.RequiredBytes /= 4
+	createResp, err := client.CreateVolume(context.Background(), createReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sourceSize := createResp.GetVolume().GetCapacityBytes()
+	// A clone smaller than its source is rejected.
+	req := testCreateVolumeFromVolumeRequest(createResp.GetVolume().GetVolumeId())
+	req.CapacityRange.RequiredBytes = sourceSize / 2
+	_, err = client.CreateVolume(context.Background(), req)
+	if !grpcErrorEqual(err, ErrContentSourceTooLarge) {
+		t.Fatal(err)
+	}
+	// Even if limit_bytes would allow the size of the source.
+	req.CapacityRange.LimitBytes = sourceSize
+	_, err = client.CreateVolume(context.Background(), req)
+	if !grpcErrorEqual(err, ErrContentSourceTooLarge) {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateVolumeFromVolume_MissingSource(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	req := testCreateVolumeFromVolumeRequest("missing-volume")
+	_, err := client.CreateVolume(context.Background(), req)
+	if !grpcErrorEqual(err, ErrVolumeNotFound) {
+		t.Fatal(err)
+	}
+}
+
+func testControllerExpandVolumeRequest(volumeId string, requiredBytes int64) *csi.ControllerExpandVolumeRequest {
+	req := &csi.ControllerExpandVolumeRequest{
+		VolumeId: volumeId,
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: requiredBytes,
+		},
+	}
+	return req
+}
+
+func TestControllerExpandVolume(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	createReq := testCreateVolumeRequest()
+	createResp, err := client.CreateVolume(context.Background(), createReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeId := createResp.GetVolume().GetVolumeId()
+	size := createResp.GetVolume().GetCapacityBytes()
+	req := testControllerExpandVolumeRequest(volumeId, size*2)
+	resp, err := client.ControllerExpandVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetCapacityBytes() != size*2 {
+		t.Fatalf("Expected capacity %v but got %v", size*2, resp.GetCapacityBytes())
+	}
+	if !resp.GetNodeExpansionRequired() {
+		t.Fatal("Expected node expansion to be required")
+	}
+	// Requests for less than the current size leave the volume as is.
+	req = testControllerExpandVolumeRequest(volumeId, size)
+	resp, err = client.ControllerExpandVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetCapacityBytes() != size*2 {
+		t.Fatalf("Expected capacity %v but got %v", size*2, resp.GetCapacityBytes())
+	}
+	listResp, err := client.ListVolumes(context.Background(), testListVolumesRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x := listResp.GetEntries()[0].GetVolume().GetCapacityBytes(); x != size*2 {
+		t.Fatalf("Expected listed capacity %v but got %v", size*2, x)
+	}
+}
+
+func TestControllerExpandVolume_InsufficientCapacity(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	createReq := testCreateVolumeRequest()
+	createResp, err := client.CreateVolume(context.Background(), createReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := testControllerExpandVolumeRequest(createResp.GetVolume().GetVolumeId(), 1<<40)
+	_, err = client.ControllerExpandVolume(context.Background(), req)
+	if !grpcErrorEqual(err, ErrInsufficientCapacity) {
+		t.Fatal(err)
+	}
+}
+
+func TestControllerExpandVolume_ThinPoolCapacity(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	req := testCreateVolumeRequest()
+	req.Parameters = map[string]string{
+		"type":         "thin",
+		"thinpool":     "test-pool",
+		"thinpoolsize": fmt.Sprintf("%d", 40<<20),
+	}
+	req.CapacityRange.RequiredBytes = 20 << 20
+	resp, err := client.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeId := resp.GetVolume().GetVolumeId()
+	// The thin volume can grow to the size of the pool.
+	expandResp, err := client.ControllerExpandVolume(context.Background(), testControllerExpandVolumeRequest(volumeId, 40<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expandResp.GetCapacityBytes() != 40<<20 {
+		t.Fatalf("Expected capacity %v but got %v", 40<<20, expandResp.GetCapacityBytes())
+	}
+	// But not beyond it without an overcommit ratio.
+	_, err = client.ControllerExpandVolume(context.Background(), testControllerExpandVolumeRequest(volumeId, 80<<20))
+	if !grpcErrorEqual(err, ErrInsufficientCapacity) {
+		t.Fatal(err)
+	}
+}
+
+func TestControllerExpandVolume_MissingVolume(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	req := testControllerExpandVolumeRequest("missing-volume", 100<<20)
+	_, err := client.ControllerExpandVolume(context.Background(), req)
+	if !grpcErrorEqual(err, ErrVolumeNotFound) {
+		t.Fatal(err)
+	}
+}
+
+func TestControllerGetVolume(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	createReq := testCreateVolumeRequest()
+	createResp, err := client.CreateVolume(context.Background(), createReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeId := createResp.GetVolume().GetVolumeId()
+	req := &csi.ControllerGetVolumeRequest{VolumeId: volumeId}
+	resp, err := client.ControllerGetVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetVolume().GetCapacityBytes() != createResp.GetVolume().GetCapacityBytes() {
+		t.Fatalf("Expected capacity %v but got %v", createResp.GetVolume().GetCapacityBytes(), resp.GetVolume().GetCapacityBytes())
+	}
+	if condition := resp.GetStatus().GetVolumeCondition(); condition == nil || condition.GetAbnormal() {
+		t.Fatalf("Expected a normal volume condition but got %v", condition)
+	}
+	// ListVolumes reports the same condition.
+	listResp, err := client.ListVolumes(context.Background(), testListVolumesRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if condition := listResp.GetEntries()[0].GetStatus().GetVolumeCondition(); condition == nil || condition.GetAbnormal() {
+		t.Fatalf("Expected a normal volume condition but got %v", condition)
+	}
+}
+
+func TestControllerGetVolume_MissingVolume(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	req := &csi.ControllerGetVolumeRequest{VolumeId: "missing-volume"}
+	_, err := client.ControllerGetVolume(context.Background(), req)
+	if !grpcErrorEqual(err, ErrVolumeNotFound) {
+		t.Fatal(err)
+	}
+}
+
+func testControllerPublishVolumeRequest(volumeId, nodeId string, volumeContext map[string]string) *csi.ControllerPublishVolumeRequest {
+	req := &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeId,
+		NodeId:           nodeId,
+		VolumeCapability: testCreateVolumeRequest().GetVolumeCapabilities()[0],
+		VolumeContext:    volumeContext,
+	}
+	return req
+}
+
+func TestControllerPublishVolume_MissingNodeId(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	req := testControllerPublishVolumeRequest("test-volume", "", nil)
+	_, err := client.ControllerPublishVolume(context.Background(), req)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatal(err)
+	}
 }
 
-func TestControllerPublishVolumeNotSupported(t *testing.T) {
+func TestControllerPublishVolume_MissingVolume(t *testing.T) {
 	vgname := testvgname()
 	pvname, pvclean := testpv()
 	defer check(pvclean)
 	client, clean := startTest(vgname, []string{pvname})
 	defer clean()
-	req := &csi.ControllerPublishVolumeRequest{}
+	req := testControllerPublishVolumeRequest("missing-volume", "node-1", nil)
 	_, err := client.ControllerPublishVolume(context.Background(), req)
-	if !grpcErrorEqual(err, ErrCallNotImplemented) {
+	if !grpcErrorEqual(err, ErrVolumeNotFound) {
 		t.Fatal(err)
 	}
 }
 
-func TestControllerUnpublishVolumeNotSupported(t *testing.T) {
+func TestControllerPublishVolume_PublishedNodeIds(t *testing.T) {
 	vgname := testvgname()
 	pvname, pvclean := testpv()
 	defer check(pvclean)
 	client, clean := startTest(vgname, []string{pvname})
 	defer clean()
-	req := &csi.ControllerUnpublishVolumeRequest{}
-	_, err := client.ControllerUnpublishVolume(context.Background(), req)
-	if !grpcErrorEqual(err, ErrCallNotImplemented) {
+	createResp, err := client.CreateVolume(context.Background(), testCreateVolumeRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	volume := createResp.GetVolume()
+	publishedNodeIds := func() []string {
+		resp, err := client.ListVolumes(context.Background(), testListVolumesRequest())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := resp.GetEntries()[0].GetStatus().GetPublishedNodeIds()
+		sort.Strings(ids)
+		return ids
+	}
+	// Node IDs need not be tag-safe.
+	nodeIds := []string{"iqn.1994-05.com.redhat:node-1", "node-2"}
+	for _, nodeId := range nodeIds {
+		req := testControllerPublishVolumeRequest(volume.GetVolumeId(), nodeId, volume.GetVolumeContext())
+		if _, err := client.ControllerPublishVolume(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		// ControllerPublishVolume is idempotent.
+		if _, err := client.ControllerPublishVolume(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ids := publishedNodeIds(); !reflect.DeepEqual(ids, nodeIds) {
+		t.Fatalf("Expected published node ids %v but got %v", nodeIds, ids)
+	}
+	req := &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: volume.GetVolumeId(),
+		NodeId:   nodeIds[0],
+	}
+	if _, err := client.ControllerUnpublishVolume(context.Background(), req); err != nil {
 		t.Fatal(err)
 	}
+	if ids := publishedNodeIds(); !reflect.DeepEqual(ids, nodeIds[1:]) {
+		t.Fatalf("Expected published node ids %v but got %v", nodeIds[1:], ids)
+	}
 }
 
 func testValidateVolumeCapabilitiesRequest(volumeId string, filesystem string, mountOpts []string) *csi.ValidateVolumeCapabilitiesRequest {
@@ -1068,35 +2389,133 @@ func TestListVolumes_TwoVolumes(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	entries := listResp.GetEntries()
-	if len(entries) != len(infos) {
-		t.Fatalf("ListVolumes returned %v entries, expected %d.", len(entries), len(infos))
+	entries := listResp.GetEntries()
+	if len(entries) != len(infos) {
+		t.Fatalf("ListVolumes returned %v entries, expected %d.", len(entries), len(infos))
+	}
+	nameTags := []string{"VN.test-volume-1", "VN.test-volume-2"}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].GetVolume().GetCapacityBytes() < entries[j].GetVolume().GetCapacityBytes()
+	})
+	for i, entry := range entries {
+		had := false
+		for _, info := range infos {
+			if reflect.DeepEqual(info, entry.GetVolume()) {
+				had = true
+				break
+			}
+		}
+		if !had {
+			t.Fatalf("Cannot find volume info %+v in %+v.", entry.GetVolume(), infos)
+		}
+
+		// This validates that create and list both properly return the tags attribute.
+		context := entry.GetVolume().GetVolumeContext()
+		tags := tagsFromVolumeContext(t, context)
+		expected := []string{tag, nameTags[i]}
+		sort.Strings(expected)
+		sort.Strings(tags)
+		if !reflect.DeepEqual(tags, expected) {
+			t.Fatalf("unexpected tags: %v", tags)
+		}
+	}
+}
+
+func TestListVolumes_Paginated(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	volumeIds := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		req := testCreateVolumeRequest()
+		req.Name = fmt.Sprintf("test-volume-%d", i)
+		req.CapacityRange.RequiredBytes /= 8
+		resp, err := client.CreateVolume(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		volumeIds[resp.GetVolume().GetVolumeId()] = true
+	}
+	req := testListVolumesRequest()
+	req.MaxEntries = 2
+	resp, err := client.ListVolumes(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.GetEntries()) != 2 || resp.GetNextToken() == "" {
+		t.Fatalf("Expected 2 entries and a next token but got %v", resp)
+	}
+	entries := resp.GetEntries()
+	req.StartingToken = resp.GetNextToken()
+	resp, err = client.ListVolumes(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.GetEntries()) != 1 || resp.GetNextToken() != "" {
+		t.Fatalf("Expected 1 entry and no next token but got %v", resp)
+	}
+	entries = append(entries, resp.GetEntries()...)
+	for _, entry := range entries {
+		id := entry.GetVolume().GetVolumeId()
+		if !volumeIds[id] {
+			t.Fatalf("Unexpected or duplicate volume %v", id)
+		}
+		delete(volumeIds, id)
+	}
+	// Tokens that were not issued by the plugin are rejected.
+	req.StartingToken = "invalid-token"
+	_, err = client.ListVolumes(context.Background(), req)
+	if !grpcErrorEqual(err, ErrInvalidStartingToken) {
+		t.Fatal(err)
+	}
+}
+
+func TestListVolumes_PaginatedVolumeGroups(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	vgname2, vgclean := testvg()
+	defer check(vgclean)
+	client, clean := startTest(vgname, []string{pvname}, AdditionalVolumeGroup(vgname2))
+	defer clean()
+	volumeIds := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		req := testCreateVolumeRequest()
+		req.Name = fmt.Sprintf("test-volume-%d", i)
+		req.CapacityRange.RequiredBytes /= 8
+		if i%2 == 1 {
+			req.Parameters = map[string]string{"volumeGroup": vgname2}
+		}
+		resp, err := client.CreateVolume(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		volumeIds[resp.GetVolume().GetVolumeId()] = true
 	}
-	nameTags := []string{"VN.test-volume-1", "VN.test-volume-2"}
-	sort.Slice(entries, func(i, j int) bool {
-		return entries[i].GetVolume().GetCapacityBytes() < entries[j].GetVolume().GetCapacityBytes()
-	})
-	for i, entry := range entries {
-		had := false
-		for _, info := range infos {
-			if reflect.DeepEqual(info, entry.GetVolume()) {
-				had = true
-				break
-			}
+	// Every page ends on a volume of either volume group.
+	req := testListVolumesRequest()
+	req.MaxEntries = 1
+	for {
+		resp, err := client.ListVolumes(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
 		}
-		if !had {
-			t.Fatalf("Cannot find volume info %+v in %+v.", entry.GetVolume(), infos)
+		for _, entry := range resp.GetEntries() {
+			id := entry.GetVolume().GetVolumeId()
+			if !volumeIds[id] {
+				t.Fatalf("Unexpected or duplicate volume %v", id)
+			}
+			delete(volumeIds, id)
 		}
-
-		// This validates that create and list both properly return the tags attribute.
-		context := entry.GetVolume().GetVolumeContext()
-		tags := tagsFromVolumeContext(t, context)
-		expected := []string{tag, nameTags[i]}
-		sort.Strings(expected)
-		sort.Strings(tags)
-		if !reflect.DeepEqual(tags, expected) {
-			t.Fatalf("unexpected tags: %v", tags)
+		if resp.GetNextToken() == "" {
+			break
 		}
+		req.StartingToken = resp.GetNextToken()
+	}
+	if len(volumeIds) != 0 {
+		t.Fatalf("Expected every volume to be listed, missing %v", volumeIds)
 	}
 }
 
@@ -1293,6 +2712,118 @@ func TestGetCapacity_OneVolume_FourDisks_VolumeLayout_Mirror2(t *testing.T) {
 	}.test(t)
 }
 
+func TestGetCapacity_VolumeLayout_VDO(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	req := testGetCapacityRequest("xfs")
+	resp, err := client.GetCapacity(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	linearFree := resp.GetAvailableCapacity()
+	req.Parameters = map[string]string{
+		"type":            "vdo",
+		"vdovirtualratio": "3",
+	}
+	resp, err = client.GetCapacity(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The physical free space is reported separately from the virtual
+	// size of the largest volume.
+	if got := resp.GetAvailableCapacity(); got != linearFree {
+		t.Fatalf("Expected %d bytes free but got %v.", linearFree, got)
+	}
+	if got := resp.GetMaximumVolumeSize().GetValue(); got != 3*linearFree {
+		t.Fatalf("Expected a maximum volume size of %d bytes but got %v.", 3*linearFree, got)
+	}
+}
+
+func TestGetCapacity_VolumeLayout_Thin_Overcommit(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname}, ThinOvercommitRatio(2))
+	defer clean()
+	const poolsize = 40 << 20
+	params := map[string]string{
+		"type":         "thin",
+		"thinpool":     "test-pool",
+		"thinpoolsize": fmt.Sprintf("%d", poolsize),
+	}
+	req := testGetCapacityRequest("xfs")
+	req.Parameters = params
+	resp, err := client.GetCapacity(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The pool does not exist yet so its prospective size is reported.
+	if got := resp.GetAvailableCapacity(); got != 2*poolsize {
+		t.Fatalf("Expected %d bytes free but got %v.", 2*poolsize, got)
+	}
+	createReq := testCreateVolumeRequest()
+	createReq.CapacityRange.RequiredBytes = 60 << 20
+	createReq.Parameters = params
+	if _, err := client.CreateVolume(context.Background(), createReq); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client.GetCapacity(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, exp := resp.GetAvailableCapacity(), int64(2*poolsize-(60<<20)); got != exp {
+		t.Fatalf("Expected %d bytes free but got %v.", exp, got)
+	}
+	createReq = testCreateVolumeRequest()
+	createReq.Name = "test-volume-2"
+	createReq.CapacityRange.RequiredBytes = 40 << 20
+	createReq.Parameters = params
+	_, err = client.CreateVolume(context.Background(), createReq)
+	if !grpcErrorEqual(err, ErrInsufficientCapacity) {
+		t.Fatal(err)
+	}
+}
+
+func TestGetCapacity_AccessibleTopology(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	tenant := vgname[5:]
+	req := testGetCapacityRequest("xfs")
+	req.AccessibleTopology = &csi.Topology{
+		Segments: map[string]string{tenant + topologyKey: "other-node"},
+	}
+	resp, err := client.GetCapacity(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.GetAvailableCapacity(); got != 0 {
+		t.Fatalf("Expected 0 bytes free for a node that cannot see the volume group but got %v", got)
+	}
+	req.Parameters = map[string]string{"datapath": "iscsi"}
+	resp, err = client.GetCapacity(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.GetAvailableCapacity(); got == 0 {
+		t.Fatal("Expected iSCSI volumes to be accessible from any node")
+	}
+	req.Parameters = nil
+	req.AccessibleTopology.Segments[tenant+topologyVolumeGroupKey+vgname] = "true"
+	resp, err = client.GetCapacity(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.GetAvailableCapacity(); got == 0 {
+		t.Fatal("Expected direct volumes to be accessible from a node that sees the volume group")
+	}
+}
+
 func TestGetCapacity_RemoveVolumeGroup(t *testing.T) {
 	vgname := testvgname()
 	pvname, pvclean := testpv()
@@ -1322,8 +2853,17 @@ func TestControllerGetCapabilities(t *testing.T) {
 	}
 	expected := []csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
 		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
 		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+		csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
 	}
 	got := []csi.ControllerServiceCapability_RPC_Type{}
 	for _, capability := range resp.GetCapabilities() {
@@ -1347,8 +2887,17 @@ func TestControllerGetCapabilitiesRemoveVolumeGroup(t *testing.T) {
 	}
 	expected := []csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
 		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
 		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+		csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
 	}
 	got := []csi.ControllerServiceCapability_RPC_Type{}
 	for _, capability := range resp.GetCapabilities() {
@@ -1395,6 +2944,17 @@ func testNodePublishVolumeRequest(volumeId string, targetPath string, filesystem
 	return req
 }
 
+func testNodeStageVolumeRequest(volumeId string, stagingPath string, filesystem string) *csi.NodeStageVolumeRequest {
+	publishReq := testNodePublishVolumeRequest(volumeId, "", filesystem, nil)
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          volumeId,
+		PublishContext:    map[string]string{"datapath": "direct"},
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  publishReq.GetVolumeCapability(),
+	}
+	return req
+}
+
 func testNodeUnpublishVolumeRequest(volumeId string, targetPath string) *csi.NodeUnpublishVolumeRequest {
 	req := &csi.NodeUnpublishVolumeRequest{
 		VolumeId:   volumeId,
@@ -1556,6 +3116,90 @@ func TestNodePublishVolumeNodeUnpublishVolume_MountVolume(t *testing.T) {
 	}
 }
 
+func TestNodeStageVolume_MountVolume_MultiplePods(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	createResp, err := client.CreateVolume(context.Background(), testCreateVolumeRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeId := createResp.GetVolume().GetVolumeId()
+	tmpdirPath, err := ioutil.TempDir("", "csilvm_tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdirPath)
+	stagingPath := filepath.Join(tmpdirPath, "staging")
+	if err := os.Mkdir(stagingPath, 0750); err != nil {
+		t.Fatal(err)
+	}
+	stageReq := testNodeStageVolumeRequest(volumeId, stagingPath, "xfs")
+	if _, err := client.NodeStageVolume(context.Background(), stageReq); err != nil {
+		t.Fatal(err)
+	}
+	// Staging is idempotent.
+	if _, err := client.NodeStageVolume(context.Background(), stageReq); err != nil {
+		t.Fatal(err)
+	}
+	if !targetPathIsMountPoint(stagingPath) {
+		t.Fatalf("Expected volume to be mounted at %v.", stagingPath)
+	}
+	// Publish the staged volume to two pods.
+	var targetPaths []string
+	for _, pod := range []string{"pod1", "pod2"} {
+		targetPath := filepath.Join(tmpdirPath, pod)
+		publishReq := testNodePublishVolumeRequest(volumeId, targetPath, "xfs", nil)
+		publishReq.StagingTargetPath = stagingPath
+		if _, err := client.NodePublishVolume(context.Background(), publishReq); err != nil {
+			t.Fatal(err)
+		}
+		if !targetPathIsMountPoint(targetPath) {
+			t.Fatalf("Expected volume to be mounted at %v.", targetPath)
+		}
+		targetPaths = append(targetPaths, targetPath)
+	}
+	// A file written by one pod is seen by the other.
+	file, err := os.Create(filepath.Join(targetPaths[0], "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if _, err := os.Stat(filepath.Join(targetPaths[1], "test")); err != nil {
+		t.Fatal(err)
+	}
+	// The volume cannot be unstaged while it is published.
+	unstageReq := &csi.NodeUnstageVolumeRequest{VolumeId: volumeId, StagingTargetPath: stagingPath}
+	if _, err := client.NodeUnstageVolume(context.Background(), unstageReq); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("Expected FailedPrecondition but got %v", err)
+	}
+	// Unpublishing one pod leaves the volume attached for the other.
+	if _, err := client.NodeUnpublishVolume(context.Background(), testNodeUnpublishVolumeRequest(volumeId, targetPaths[0])); err != nil {
+		t.Fatal(err)
+	}
+	if targetPathIsMountPoint(targetPaths[0]) {
+		t.Fatalf("Expected target path %v not to be a mountpoint.", targetPaths[0])
+	}
+	if _, err := os.Stat(filepath.Join(targetPaths[1], "test")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.NodeUnpublishVolume(context.Background(), testNodeUnpublishVolumeRequest(volumeId, targetPaths[1])); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.NodeUnstageVolume(context.Background(), unstageReq); err != nil {
+		t.Fatal(err)
+	}
+	if targetPathIsMountPoint(stagingPath) {
+		t.Fatalf("Expected staging path %v not to be a mountpoint.", stagingPath)
+	}
+	// Unstaging is idempotent.
+	if _, err := client.NodeUnstageVolume(context.Background(), unstageReq); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestNodePublishVolumeNodeUnpublishVolume_MountVolume_UnspecifiedFS(t *testing.T) {
 	vgname := testvgname()
 	pvname, pvclean := testpv()
@@ -2865,6 +4509,123 @@ func TestSetup_ExistingVolumeGroup_MissingTag(t *testing.T) {
 	}
 }
 
+func TestNodeExpandVolume_MountVolume(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	createReq := testCreateVolumeRequest()
+	createResp, err := client.CreateVolume(context.Background(), createReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeId := createResp.GetVolume().GetVolumeId()
+	size := createResp.GetVolume().GetCapacityBytes()
+	tmpdirPath, err := ioutil.TempDir("", "csilvm_tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdirPath)
+	targetPath := filepath.Join(tmpdirPath, volumeId)
+	publishReq := testNodePublishVolumeRequest(volumeId, targetPath, "xfs", nil)
+	publishReq.PublishContext = map[string]string{"datapath": "direct"}
+	_, err = client.NodePublishVolume(context.Background(), publishReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		req := testNodeUnpublishVolumeRequest(volumeId, publishReq.TargetPath)
+		_, err = client.NodeUnpublishVolume(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	var before syscall.Statfs_t
+	if err := syscall.Statfs(targetPath, &before); err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.ControllerExpandVolume(context.Background(), testControllerExpandVolumeRequest(volumeId, size*2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &csi.NodeExpandVolumeRequest{
+		VolumeId:         volumeId,
+		VolumePath:       targetPath,
+		VolumeCapability: publishReq.GetVolumeCapability(),
+	}
+	resp, err := client.NodeExpandVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetCapacityBytes() != size*2 {
+		t.Fatalf("Expected capacity %v but got %v", size*2, resp.GetCapacityBytes())
+	}
+	var after syscall.Statfs_t
+	if err := syscall.Statfs(targetPath, &after); err != nil {
+		t.Fatal(err)
+	}
+	if after.Blocks <= before.Blocks {
+		t.Fatalf("Expected filesystem to grow from %v blocks but got %v", before.Blocks, after.Blocks)
+	}
+}
+
+func TestNodeGetVolumeStats_MountVolume(t *testing.T) {
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer check(pvclean)
+	client, clean := startTest(vgname, []string{pvname})
+	defer clean()
+	createResp, err := client.CreateVolume(context.Background(), testCreateVolumeRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeId := createResp.GetVolume().GetVolumeId()
+	tmpdirPath, err := ioutil.TempDir("", "csilvm_tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdirPath)
+	targetPath := filepath.Join(tmpdirPath, volumeId)
+	publishReq := testNodePublishVolumeRequest(volumeId, targetPath, "xfs", nil)
+	publishReq.PublishContext = map[string]string{"datapath": "direct"}
+	if _, err := client.NodePublishVolume(context.Background(), publishReq); err != nil {
+		t.Fatal(err)
+	}
+	statsReq := &csi.NodeGetVolumeStatsRequest{VolumeId: volumeId, VolumePath: targetPath}
+	resp, err := client.NodeGetVolumeStats(context.Background(), statsReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bytes, inodes *csi.VolumeUsage
+	for _, usage := range resp.GetUsage() {
+		switch usage.GetUnit() {
+		case csi.VolumeUsage_BYTES:
+			bytes = usage
+		case csi.VolumeUsage_INODES:
+			inodes = usage
+		}
+	}
+	if bytes == nil || bytes.GetTotal() == 0 || bytes.GetTotal() > createResp.GetVolume().GetCapacityBytes() {
+		t.Fatalf("Unexpected byte usage %+v", bytes)
+	}
+	if inodes == nil || inodes.GetTotal() == 0 {
+		t.Fatalf("Unexpected inode usage %+v", inodes)
+	}
+	if resp.GetVolumeCondition().GetAbnormal() {
+		t.Fatalf("Expected a normal volume condition but got %+v", resp.GetVolumeCondition())
+	}
+	if _, err := client.NodeUnpublishVolume(context.Background(), testNodeUnpublishVolumeRequest(volumeId, targetPath)); err != nil {
+		t.Fatal(err)
+	}
+	// Once unpublished the target path is removed or no longer backed
+	// by the volume.
+	resp, err = client.NodeGetVolumeStats(context.Background(), statsReq)
+	if status.Code(err) != codes.NotFound && !resp.GetVolumeCondition().GetAbnormal() {
+		t.Fatalf("Expected NotFound or an abnormal condition but got %v, %+v", err, resp)
+	}
+}
+
 func testNodeGetCapabilitiesRequest() *csi.NodeGetCapabilitiesRequest {
 	req := &csi.NodeGetCapabilitiesRequest{}
 	return req
@@ -3015,6 +4776,46 @@ func testpv() (pvname string, cleanup func() error) {
 	return loop.Path(), loop.Close
 }
 
+// testvg creates a volume group on a new loop device. It is used as an
+// additional volume group by tests that manage several volume groups.
+func testvg() (vgname string, cleanup func() error) {
+	pvname, pvclean := testpv()
+	pv, err := lvm.CreatePhysicalVolume(pvname)
+	if err != nil {
+		pvclean()
+		panic(err)
+	}
+	vgname = testvgname()
+	vg, err := lvm.CreateVolumeGroup(vgname, []*lvm.PhysicalVolume{pv}, nil)
+	if err != nil {
+		pv.Remove()
+		pvclean()
+		panic(err)
+	}
+	return vgname, func() error {
+		lvnames, err := vg.ListLogicalVolumeNames()
+		if err != nil {
+			return err
+		}
+		for _, lvname := range lvnames {
+			lv, err := vg.LookupLogicalVolume(lvname)
+			if err != nil {
+				return err
+			}
+			if err := lv.Remove(); err != nil {
+				return err
+			}
+		}
+		if err := vg.Remove(); err != nil {
+			return err
+		}
+		if err := pv.Remove(); err != nil {
+			return err
+		}
+		return pvclean()
+	}
+}
+
 func startTest(vgname string, pvnames []string, serverOpts ...ServerOpt) (client *Client, cleanupFn func()) {
 	var clean cleanup.Steps
 	defer func() {
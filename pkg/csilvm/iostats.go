@@ -0,0 +1,360 @@
+package csilvm
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Seagate/csiclvm/pkg/virsh"
+)
+
+// sectorSize is the unit of the sector counters in /sys/block/<dev>/stat,
+// regardless of the logical block size of the device.
+const sectorSize = 512
+
+// diskStats is a sample of the I/O counters of a block device as reported
+// in /sys/block/<dev>/stat. See the kernel's Documentation/block/stat.rst.
+type diskStats struct {
+	readIOs      uint64
+	readSectors  uint64
+	readTicks    uint64 // milliseconds
+	writeIOs     uint64
+	writeSectors uint64
+	writeTicks   uint64 // milliseconds
+	inFlight     uint64
+}
+
+// parseDiskStats parses the contents of /sys/block/<dev>/stat.
+func parseDiskStats(output string) (diskStats, error) {
+	fields := strings.Fields(output)
+	// Kernels before 4.18 report 11 fields, later kernels append
+	// discard and flush counters.
+	if len(fields) < 11 {
+		return diskStats{}, fmt.Errorf("cannot parse block device stat %q", output)
+	}
+	var values [11]uint64
+	for i := range values {
+		value, err := strconv.ParseUint(fields[i], 10, 64)
+		if err != nil {
+			return diskStats{}, fmt.Errorf("cannot parse block device stat %q: %v", output, err)
+		}
+		values[i] = value
+	}
+	return diskStats{
+		readIOs:      values[0],
+		readSectors:  values[2],
+		readTicks:    values[3],
+		writeIOs:     values[4],
+		writeSectors: values[6],
+		writeTicks:   values[7],
+		inFlight:     values[8],
+	}, nil
+}
+
+// ioRates are the I/O rates of a block device between two samples.
+type ioRates struct {
+	readIOPS            float64
+	writeIOPS           float64
+	readBytesPerSecond  float64
+	writeBytesPerSecond float64
+	// readLatency and writeLatency are the average time in
+	// milliseconds spent on a request completed between the samples.
+	readLatency  float64
+	writeLatency float64
+}
+
+// ratesSince returns the I/O rates between the earlier sample prev and st,
+// taken elapsed apart. It returns false if the counters went backwards,
+// which happens if the device was replaced between the samples.
+func (st diskStats) ratesSince(prev diskStats, elapsed time.Duration) (ioRates, bool) {
+	if elapsed <= 0 ||
+		st.readIOs < prev.readIOs || st.writeIOs < prev.writeIOs ||
+		st.readSectors < prev.readSectors || st.writeSectors < prev.writeSectors ||
+		st.readTicks < prev.readTicks || st.writeTicks < prev.writeTicks {
+		return ioRates{}, false
+	}
+	seconds := elapsed.Seconds()
+	reads := st.readIOs - prev.readIOs
+	writes := st.writeIOs - prev.writeIOs
+	rates := ioRates{
+		readIOPS:            float64(reads) / seconds,
+		writeIOPS:           float64(writes) / seconds,
+		readBytesPerSecond:  float64((st.readSectors-prev.readSectors)*sectorSize) / seconds,
+		writeBytesPerSecond: float64((st.writeSectors-prev.writeSectors)*sectorSize) / seconds,
+	}
+	if reads > 0 {
+		rates.readLatency = float64(st.readTicks-prev.readTicks) / float64(reads)
+	}
+	if writes > 0 {
+		rates.writeLatency = float64(st.writeTicks-prev.writeTicks) / float64(writes)
+	}
+	return rates, true
+}
+
+// parseDeviceMapperName splits the name lvm gives the device-mapper device
+// of a logical volume into the volume group and logical volume names. lvm
+// joins the names with a dash and doubles the dashes within them. It
+// returns false for the devices of internal layers such as the "-real"
+// and "-cow" devices of snapshot origins.
+func parseDeviceMapperName(name string) (vgname, lvname string, ok bool) {
+	var parts []string
+	var part strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '-' {
+			part.WriteByte(name[i])
+			continue
+		}
+		if i+1 < len(name) && name[i+1] == '-' {
+			part.WriteByte('-')
+			i++
+			continue
+		}
+		parts = append(parts, part.String())
+		part.Reset()
+	}
+	parts = append(parts, part.String())
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// parseDeviceMapperDevices parses the output of listDeviceMapperDevices
+// into a map from device-mapper name to kernel device name.
+func parseDeviceMapperDevices(output string) map[string]string {
+	devices := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		devices[fields[0]] = fields[1]
+	}
+	return devices
+}
+
+// listDeviceMapperDevices returns the kernel device names, e.g. "dm-3", of
+// the device-mapper devices on this node keyed by their names.
+func listDeviceMapperDevices() (map[string]string, error) {
+	output, err := runOnNode("dmsetup", "info", "--columns", "--noheadings", "--separator= ", "--options=name,blkdevname")
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(string(output), "No devices found") {
+		return nil, nil
+	}
+	return parseDeviceMapperDevices(string(output)), nil
+}
+
+// raidStatus is the state of a dm-raid array.
+type raidStatus struct {
+	syncAction string
+	mismatches uint64
+}
+
+// raidSyncActions are the sync actions reported by dm-raid.
+var raidSyncActions = []string{"idle", "frozen", "resync", "recover", "check", "repair", "reshape", "undef"}
+
+// syncActionGauges returns the value of the raid-sync-action gauge of each
+// sync action: 1 for the current action and 0 for every other action, so
+// that the gauge of the previous action does not keep reporting 1.
+func syncActionGauges(current string) map[string]float64 {
+	gauges := map[string]float64{current: 1}
+	for _, action := range raidSyncActions {
+		if action != current {
+			gauges[action] = 0
+		}
+	}
+	return gauges
+}
+
+// parseRaidStatus parses the output of `dmsetup status --target raid` into
+// a map from device-mapper name to the state of the array. A status line
+// reads "<name>: <start> <length> raid <type> <#devices> <health>
+// <sync ratio> <sync action> <mismatch count> ...".
+func parseRaidStatus(output string) map[string]raidStatus {
+	statuses := make(map[string]raidStatus)
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 10 || fields[3] != "raid" {
+			continue
+		}
+		mismatches, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil {
+			continue
+		}
+		statuses[strings.TrimSuffix(fields[0], ":")] = raidStatus{
+			syncAction: fields[8],
+			mismatches: mismatches,
+		}
+	}
+	return statuses
+}
+
+// listRaidStatus returns the state of the dm-raid arrays on this node keyed
+// by their device-mapper names. dm-raid does not register the md sysfs
+// attributes (md/sync_action, md/mismatch_cnt) of its arrays, so they are
+// read from the status of the dm-raid target instead.
+func listRaidStatus() (map[string]raidStatus, error) {
+	output, err := runOnNode("dmsetup", "status", "--target", "raid")
+	if err != nil {
+		return nil, err
+	}
+	return parseRaidStatus(string(output)), nil
+}
+
+// readNodeFile returns the contents of a file on this node, through the
+// StoLake agent in proxy mode.
+func readNodeFile(path string) ([]byte, error) {
+	if virsh.ProxyMode() {
+		return runOnNode("cat", path)
+	}
+	return ioutil.ReadFile(path)
+}
+
+// ioSample is the last sample of the I/O counters of a device.
+type ioSample struct {
+	stats diskStats
+	at    time.Time
+}
+
+// ioStatsCollector reports the I/O statistics of the active volumes on
+// this node.
+type ioStatsCollector struct {
+	s *Server
+	// samples holds the last sample of each device, keyed by its
+	// kernel device name.
+	samples map[string]ioSample
+	// pvcs caches the persistent volume claim of each volume, keyed
+	// by volume ID. Volumes not provisioned with the claim metadata
+	// map to "".
+	pvcs map[string]string
+}
+
+// ReportIOStats reports the I/O statistics of every active volume on this
+// node at the given interval. The statistics are read from the
+// device-mapper device of each logical volume. Rates are reported from the
+// second sample of a device on.
+func (s *Server) ReportIOStats(interval time.Duration) context.CancelFunc {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer wg.Done()
+		defer ticker.Stop()
+		collector := &ioStatsCollector{
+			s:       s,
+			samples: make(map[string]ioSample),
+			pvcs:    make(map[string]string),
+		}
+		for {
+			select {
+			case <-ticker.C:
+				collector.collect()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+func (c *ioStatsCollector) collect() {
+	devices, err := listDeviceMapperDevices()
+	if err != nil {
+		log.Printf("failed to report io stats: cannot list device-mapper devices: err=%v", err)
+		return
+	}
+	raids, err := listRaidStatus()
+	if err != nil {
+		log.Printf("failed to report raid status: err=%v", err)
+	}
+	managed := make(map[string]bool)
+	for _, vg := range c.s.managedVolumeGroups() {
+		managed[vg.Name()] = true
+	}
+	seen := make(map[string]bool)
+	seenIDs := make(map[string]bool)
+	for name, dev := range devices {
+		vgname, lvname, ok := parseDeviceMapperName(name)
+		if !ok || !managed[vgname] || !strings.HasPrefix(lvname, lvPrefix) || strings.Contains(lvname, "_") {
+			// Skip snapshots, pools and the sub-volumes of
+			// RAID, cache and integrity volumes.
+			continue
+		}
+		id := c.s.volumeID(vgname, lvname)
+		buf, err := readNodeFile("/sys/block/" + dev + "/stat")
+		if err != nil {
+			log.Printf("failed to report io stats of volume %v: err=%v", id, err)
+			continue
+		}
+		stats, err := parseDiskStats(string(buf))
+		if err != nil {
+			log.Printf("failed to report io stats of volume %v: err=%v", id, err)
+			continue
+		}
+		now := time.Now()
+		seen[dev] = true
+		seenIDs[id] = true
+		scope := c.s.metrics.Tagged(c.volumeTags(vgname, id))
+		scope.Gauge("io-in-flight").Update(float64(stats.inFlight))
+		if prev, ok := c.samples[dev]; ok {
+			if rates, ok := stats.ratesSince(prev.stats, now.Sub(prev.at)); ok {
+				scope.Gauge("io-read-iops").Update(rates.readIOPS)
+				scope.Gauge("io-write-iops").Update(rates.writeIOPS)
+				scope.Gauge("io-read-bytes-per-second").Update(rates.readBytesPerSecond)
+				scope.Gauge("io-write-bytes-per-second").Update(rates.writeBytesPerSecond)
+				scope.Gauge("io-read-latency").Update(rates.readLatency)
+				scope.Gauge("io-write-latency").Update(rates.writeLatency)
+			}
+		}
+		c.samples[dev] = ioSample{stats: stats, at: now}
+		if raid, ok := raids[name]; ok {
+			scope.Gauge("raid-mismatch-count").Update(float64(raid.mismatches))
+			for action, value := range syncActionGauges(raid.syncAction) {
+				scope.Tagged(map[string]string{"sync-action": action}).Gauge("raid-sync-action").Update(value)
+			}
+		}
+	}
+	// Forget the devices and volumes that went away.
+	for dev := range c.samples {
+		if !seen[dev] {
+			delete(c.samples, dev)
+		}
+	}
+	for id := range c.pvcs {
+		if !seenIDs[id] {
+			delete(c.pvcs, id)
+		}
+	}
+}
+
+// volumeTags returns the metrics tags of a volume. The persistent volume
+// claim is looked up once per volume as it requires an lvs invocation.
+func (c *ioStatsCollector) volumeTags(vgname, id string) map[string]string {
+	tags := map[string]string{
+		"volume-group": vgname,
+		"volume":       id,
+	}
+	pvc, ok := c.pvcs[id]
+	if !ok {
+		if lv, err := c.s.lookupLogicalVolume(id); err == nil {
+			if lvtags, err := lv.Tags(); err == nil {
+				pvc = pvcFromTags(lvtags)
+				c.pvcs[id] = pvc
+			}
+		}
+	}
+	if pvc != "" {
+		tags["pvc"] = pvc
+	}
+	return tags
+}
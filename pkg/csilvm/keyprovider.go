@@ -0,0 +1,288 @@
+package csilvm
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// KeyProvider manages the data keys of encrypted volumes. Each volume has
+// its own key, created for the LV UUID of the volume. The returned key ID is
+// recorded in a tag on the volume so that the key can be recovered by any
+// node. Destroying the key crypto-shreds the volume.
+type KeyProvider interface {
+	// CreateKey creates a new data key for the volume with the given LV
+	// UUID and returns its ID.
+	CreateKey(ctx context.Context, uuid string) (keyID string, err error)
+	// GetKey returns the data key with the given ID. It returns
+	// ErrKeyNotFound if there is no such key.
+	GetKey(ctx context.Context, keyID string) ([]byte, error)
+	// RotateKey creates a new data key for the volume the key with the
+	// given ID belongs to and returns the new key's ID. The old key is
+	// kept until it is destroyed.
+	RotateKey(ctx context.Context, keyID string) (newKeyID string, err error)
+	// DestroyKey destroys the data key with the given ID. It succeeds if
+	// there is no such key.
+	DestroyKey(ctx context.Context, keyID string) error
+}
+
+var ErrKeyNotFound = errors.New("csilvm: key not found")
+
+// dataKeySize is the size in bytes of generated data keys.
+const dataKeySize = 32
+
+// NewKeyProvider returns the KeyProvider for the given specification. It is
+// either `file:<directory>` for a FileKeyProvider or an http or https URL
+// for an HTTPKeyProvider.
+func NewKeyProvider(spec string) (KeyProvider, error) {
+	switch {
+	case strings.HasPrefix(spec, "file:"):
+		return NewFileKeyProvider(strings.TrimPrefix(spec, "file:"))
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return NewHTTPKeyProvider(spec, nil)
+	default:
+		return nil, fmt.Errorf("csilvm: unsupported key provider %q", spec)
+	}
+}
+
+// newKeyID returns a new key ID for the volume with the given LV UUID. LV
+// UUIDs consist of alphanumerics and dashes, so the key ID is tag-safe.
+func newKeyID(uuid string) (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return uuid + "." + hex.EncodeToString(buf), nil
+}
+
+// keyIDVolume returns the LV UUID the key with the given ID was created for.
+func keyIDVolume(keyID string) string {
+	if i := strings.LastIndex(keyID, "."); i >= 0 {
+		return keyID[:i]
+	}
+	return keyID
+}
+
+// FileKeyProvider keeps data keys in files in a local directory, which is
+// typically a tmpfs, a mounted Kubernetes secret or a keyring mount.
+type FileKeyProvider struct {
+	dir string
+}
+
+// NewFileKeyProvider returns a FileKeyProvider that keeps its keys in dir.
+// The directory is created if it does not exist.
+func NewFileKeyProvider(dir string) (*FileKeyProvider, error) {
+	if dir == "" {
+		return nil, errors.New("csilvm: NewFileKeyProvider: no directory specified")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileKeyProvider{dir: dir}, nil
+}
+
+func (p *FileKeyProvider) path(keyID string) (string, error) {
+	if keyID == "" || strings.ContainsAny(keyID, "/\\") || keyID == "." || keyID == ".." {
+		return "", fmt.Errorf("csilvm: invalid key ID %q", keyID)
+	}
+	return filepath.Join(p.dir, keyID), nil
+}
+
+func (p *FileKeyProvider) CreateKey(ctx context.Context, uuid string) (string, error) {
+	keyID, err := newKeyID(uuid)
+	if err != nil {
+		return "", err
+	}
+	path, err := p.path(keyID)
+	if err != nil {
+		return "", err
+	}
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Write(key)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return keyID, nil
+}
+
+func (p *FileKeyProvider) GetKey(ctx context.Context, keyID string) ([]byte, error) {
+	path, err := p.path(keyID)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrKeyNotFound
+	}
+	return key, err
+}
+
+func (p *FileKeyProvider) RotateKey(ctx context.Context, keyID string) (string, error) {
+	if _, err := p.GetKey(ctx, keyID); err != nil {
+		return "", err
+	}
+	return p.CreateKey(ctx, keyIDVolume(keyID))
+}
+
+// DestroyKey overwrites the key file before removing it.
+func (p *FileKeyProvider) DestroyKey(ctx context.Context, keyID string) error {
+	path, err := p.path(keyID)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(make([]byte, dataKeySize))
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// HTTPKeyProvider is a client of a KMIP-like key management service with a
+// JSON over HTTP interface:
+//
+//	POST   <url>/keys              {"uuid": ...} creates a key, returns {"id": ...}
+//	GET    <url>/keys/<id>         returns {"id": ..., "key": <base64>}
+//	POST   <url>/keys/<id>/rotate  creates a new key, returns {"id": ...}
+//	DELETE <url>/keys/<id>         destroys the key
+//
+// Key IDs issued by the service must be LVM tag-safe.
+type HTTPKeyProvider struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPKeyProvider returns an HTTPKeyProvider for the service at the
+// given URL. The default HTTP client is used if client is nil.
+func NewHTTPKeyProvider(serviceURL string, client *http.Client) (*HTTPKeyProvider, error) {
+	if _, err := url.Parse(serviceURL); err != nil {
+		return nil, err
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPKeyProvider{url: strings.TrimSuffix(serviceURL, "/"), client: client}, nil
+}
+
+type httpKey struct {
+	UUID string `json:"uuid,omitempty"`
+	ID   string `json:"id,omitempty"`
+	Key  []byte `json:"key,omitempty"`
+}
+
+// do issues the request and decodes the response into result, if not nil.
+// It returns ErrKeyNotFound if the service responds with 404 Not Found.
+func (p *HTTPKeyProvider) do(ctx context.Context, method, path string, body, result interface{}) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, p.url+path, &reqBody)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrKeyNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("csilvm: %v %v: %v: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// keyIDFromResponse validates the key ID issued by the service.
+func keyIDFromResponse(key httpKey) (string, error) {
+	if key.ID == "" {
+		return "", errors.New("csilvm: the key service returned no key ID")
+	}
+	for _, r := range key.ID {
+		if _, ok := tagSafeChars[r]; !ok {
+			return "", fmt.Errorf("csilvm: the key service returned key ID %q which is not tag-safe", key.ID)
+		}
+	}
+	return key.ID, nil
+}
+
+func (p *HTTPKeyProvider) CreateKey(ctx context.Context, uuid string) (string, error) {
+	var key httpKey
+	if err := p.do(ctx, http.MethodPost, "/keys", httpKey{UUID: uuid}, &key); err != nil {
+		return "", err
+	}
+	return keyIDFromResponse(key)
+}
+
+func (p *HTTPKeyProvider) GetKey(ctx context.Context, keyID string) ([]byte, error) {
+	var key httpKey
+	if err := p.do(ctx, http.MethodGet, "/keys/"+url.PathEscape(keyID), nil, &key); err != nil {
+		return nil, err
+	}
+	if len(key.Key) == 0 {
+		return nil, fmt.Errorf("csilvm: the key service returned an empty key for %v", keyID)
+	}
+	return key.Key, nil
+}
+
+func (p *HTTPKeyProvider) RotateKey(ctx context.Context, keyID string) (string, error) {
+	var key httpKey
+	if err := p.do(ctx, http.MethodPost, "/keys/"+url.PathEscape(keyID)+"/rotate", nil, &key); err != nil {
+		return "", err
+	}
+	return keyIDFromResponse(key)
+}
+
+func (p *HTTPKeyProvider) DestroyKey(ctx context.Context, keyID string) error {
+	err := p.do(ctx, http.MethodDelete, "/keys/"+url.PathEscape(keyID), nil, nil)
+	if err == ErrKeyNotFound {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,162 @@
+package csilvm
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+const testLVUUID = "Yt1b2S-Qn3C-8ZkR-m1Uc-Bw0R-eXw4-5dQpGd"
+
+// testKeyProvider exercises the KeyProvider contract.
+func testKeyProvider(t *testing.T, kp KeyProvider) {
+	ctx := context.Background()
+	keyID, err := kp.CreateKey(ctx, testLVUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag := tagKeyIDPrefix + keyID; keyIDFromTags([]string{tagEncrypted, tag}) != keyID {
+		t.Fatalf("Expected key ID %q to round-trip through tag %q", keyID, tag)
+	}
+	key, err := kp.GetKey(ctx, keyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) == 0 {
+		t.Fatalf("Expected a non-empty key")
+	}
+	rotatedID, err := kp.RotateKey(ctx, keyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotatedID == keyID {
+		t.Fatalf("Expected rotation to return a new key ID")
+	}
+	rotated, err := kp.GetKey(ctx, rotatedID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rotated) == string(key) {
+		t.Fatalf("Expected rotation to create a new key")
+	}
+	// The old key is kept until it is destroyed.
+	if _, err := kp.GetKey(ctx, keyID); err != nil {
+		t.Fatal(err)
+	}
+	if err := kp.DestroyKey(ctx, keyID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kp.GetKey(ctx, keyID); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound but got %v", err)
+	}
+	// Destroying a key is idempotent.
+	if err := kp.DestroyKey(ctx, keyID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileKeyProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csilvm_tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kp, err := NewFileKeyProvider(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testKeyProvider(t, kp)
+	if _, err := kp.GetKey(context.Background(), "../etc/passwd"); err == nil {
+		t.Fatalf("Expected an error for a key ID outside the key directory")
+	}
+}
+
+// keyServiceStub is a minimal in-memory key service.
+type keyServiceStub struct {
+	mu   sync.Mutex
+	next int
+	keys map[string][]byte
+}
+
+func (k *keyServiceStub) create(w http.ResponseWriter) {
+	k.next++
+	id := "stub-" + strings.Repeat("k", k.next)
+	k.keys[id] = []byte(id + "-secret")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(httpKey{ID: id})
+}
+
+func (k *keyServiceStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/kms/keys")
+	switch {
+	case path == "" && r.Method == http.MethodPost:
+		var req httpKey
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UUID == "" {
+			http.Error(w, "missing uuid", http.StatusBadRequest)
+			return
+		}
+		k.create(w)
+		return
+	case strings.HasSuffix(path, "/rotate") && r.Method == http.MethodPost:
+		if _, ok := k.keys[strings.TrimSuffix(path[1:], "/rotate")]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		k.create(w)
+		return
+	}
+	id := strings.TrimPrefix(path, "/")
+	key, ok := k.keys[id]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(httpKey{ID: id, Key: key})
+	case http.MethodDelete:
+		delete(k.keys, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestHTTPKeyProvider(t *testing.T) {
+	srv := httptest.NewServer(&keyServiceStub{keys: make(map[string][]byte)})
+	defer srv.Close()
+	kp, err := NewKeyProvider(srv.URL + "/kms/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testKeyProvider(t, kp)
+}
+
+func TestHTTPKeyProvider_UnsafeKeyID(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(httpKey{ID: "kms/key 1"})
+	}))
+	defer srv.Close()
+	kp, err := NewHTTPKeyProvider(srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kp.CreateKey(context.Background(), testLVUUID); err == nil {
+		t.Fatalf("Expected an error for a key ID that is not tag-safe")
+	}
+}
+
+func TestNewKeyProvider_Unsupported(t *testing.T) {
+	if _, err := NewKeyProvider("vault:secret/csilvm"); err == nil {
+		t.Fatalf("Expected an error")
+	}
+}
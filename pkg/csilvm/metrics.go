@@ -2,6 +2,7 @@ package csilvm
 
 import (
 	"context"
+	"strings"
 	"sync"
 	"time"
 
@@ -60,35 +61,106 @@ func (s *Server) ReportUptime() context.CancelFunc {
 	}
 }
 
-// reportStorageMetrics sets various metrics gauges. It performs LVM2 CLI commands and
-// is considered a somewhat costly operation. To avoid concurrent LVM2
-// operations (specifically lvs concurrent with lvcreate) triggering latent
-// issues we've run into this should probably not be called concurrently with
-// other RPCs.
+// reportStorageMetrics sets various metrics gauges for each managed volume
+// group. It performs LVM2 CLI commands and is considered a somewhat costly
+// operation. To avoid concurrent LVM2 operations (specifically lvs
+// concurrent with lvcreate) triggering latent issues we've run into this
+// should probably not be called concurrently with other RPCs.
 func (s *Server) reportStorageMetrics() {
+	for _, vg := range s.managedVolumeGroups() {
+		scope := s.metrics.Tagged(map[string]string{
+			"volume-group": vg.Name(),
+		})
+		reportVolumeGroupMetrics(scope, vg)
+	}
+}
+
+func reportVolumeGroupMetrics(scope tally.Scope, vg *lvm.VolumeGroup) {
 	// Report the number of volumes
-	volNames, err := s.volumeGroup.ListLogicalVolumeNames()
+	volNames, err := vg.ListLogicalVolumeNames()
 	if err != nil {
 		log.Printf("failed to report metrics: cannot load lv names: err=%v", err)
 		return
 	}
-	s.metrics.Gauge("volumes").Update(float64(len(volNames)))
+	pools, err := vg.ListThinPools()
+	if err != nil {
+		log.Printf("failed to report metrics: cannot list thin pools: err=%v", err)
+		return
+	}
+	vdoPools, err := vg.ListVDOPools()
+	if err != nil {
+		log.Printf("failed to report metrics: cannot list VDO pools: err=%v", err)
+		return
+	}
+	// Thin and VDO pools are logical volumes but not volumes of their
+	// own, and snapshots are not volumes.
+	isPool := make(map[string]bool)
+	for _, pool := range pools {
+		isPool[pool.Name] = true
+	}
+	for _, pool := range vdoPools {
+		isPool[pool.Name] = true
+	}
+	volumes := 0
+	for _, name := range volNames {
+		if strings.HasPrefix(name, lvPrefix) && isVolumeName(name) && !isPool[name] {
+			volumes++
+		}
+	}
+	scope.Gauge("volumes").Update(float64(volumes))
+	// Report the usage of each thin pool.
+	for _, pool := range pools {
+		poolScope := scope.Tagged(map[string]string{"thinpool": pool.Name})
+		poolScope.Gauge("thinpool-bytes-total").Update(float64(pool.SizeInBytes))
+		poolScope.Gauge("thinpool-bytes-virtual").Update(float64(pool.VirtualSizeInBytes))
+		poolScope.Gauge("thinpool-data-percent").Update(pool.DataPercent)
+		poolScope.Gauge("thinpool-bytes-used").Update(float64(pool.SizeInBytes) * pool.DataPercent / 100)
+		poolScope.Gauge("thinpool-metadata-percent").Update(pool.MetadataPercent)
+	}
+	// Report the space savings of each VDO pool.
+	for _, pool := range vdoPools {
+		poolScope := scope.Tagged(map[string]string{"vdopool": pool.Name})
+		poolScope.Gauge("vdopool-bytes-total").Update(float64(pool.SizeInBytes))
+		poolScope.Gauge("vdopool-bytes-virtual").Update(float64(pool.VirtualSizeInBytes))
+		poolScope.Gauge("vdopool-bytes-used").Update(float64(pool.UsedSizeInBytes))
+		poolScope.Gauge("vdopool-saving-percent").Update(pool.SavingPercent)
+		poolScope.Gauge("vdopool-savings-ratio").Update(pool.SavingsRatio())
+	}
+	// Report the statistics of each active cache.
+	caches, err := vg.ListCacheStats()
+	if err != nil {
+		log.Printf("failed to report metrics: cannot list caches: err=%v", err)
+		return
+	}
+	for _, cache := range caches {
+		cacheScope := scope.Tagged(map[string]string{
+			"volume":     cache.Name,
+			"cache-mode": cache.Mode.String(),
+		})
+		cacheScope.Gauge("cache-read-hits").Update(float64(cache.ReadHits))
+		cacheScope.Gauge("cache-read-misses").Update(float64(cache.ReadMisses))
+		cacheScope.Gauge("cache-write-hits").Update(float64(cache.WriteHits))
+		cacheScope.Gauge("cache-write-misses").Update(float64(cache.WriteMisses))
+		cacheScope.Gauge("cache-dirty-blocks").Update(float64(cache.DirtyBlocks))
+		cacheScope.Gauge("cache-used-blocks").Update(float64(cache.UsedBlocks))
+		cacheScope.Gauge("cache-total-blocks").Update(float64(cache.TotalBlocks))
+	}
 	// Report the total bytes free for the volume group.
-	bytesTotal, err := s.volumeGroup.BytesTotal()
+	bytesTotal, err := vg.BytesTotal()
 	if err != nil {
 		log.Printf("failed to report metrics: cannot read total bytes: err=%v", err)
 		return
 	}
-	s.metrics.Gauge("bytes-total").Update(float64(bytesTotal))
+	scope.Gauge("bytes-total").Update(float64(bytesTotal))
 	// Report the number of bytes free for the volume group.
-	bytesFree, err := s.volumeGroup.BytesFree(lvm.VolumeLayout{
+	bytesFree, err := vg.BytesFree(lvm.VolumeLayout{
 		Type: lvm.VolumeTypeLinear,
 	})
 	if err != nil {
 		log.Printf("failed to report metrics: cannot read free bytes: err=%v", err)
 		return
 	}
-	s.metrics.Gauge("bytes-free").Update(float64(bytesFree))
+	scope.Gauge("bytes-free").Update(float64(bytesFree))
 	// Report the number of bytes used.
-	s.metrics.Gauge("bytes-used").Update(float64(bytesTotal - bytesFree))
+	scope.Gauge("bytes-used").Update(float64(bytesTotal - bytesFree))
 }
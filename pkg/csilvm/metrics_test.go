@@ -208,6 +208,37 @@ func TestReportStorageMetrics(t *testing.T) {
 	})
 }
 
+func TestReportStorageMetrics_AdditionalVolumeGroup(t *testing.T) {
+	// We set an empty prefix as it adds noise to the metric names.
+	const prefix = ""
+	scope := tally.NewTestScope(prefix, nil)
+
+	vgname := testvgname()
+	pvname, pvclean := testpv()
+	defer pvclean()
+	vgname2, vgclean := testvg()
+	defer vgclean()
+	client, clean := startTest(vgname, []string{pvname}, Metrics(scope), AdditionalVolumeGroup(vgname2))
+	defer clean()
+
+	createVolumeReq := testCreateVolumeRequest()
+	createVolumeReq.Parameters = map[string]string{"volumeGroup": vgname2}
+	_, err := client.CreateVolume(context.Background(), createVolumeReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each volume group reports its own storage metrics.
+	gauges := gaugeMap(scope.Snapshot().Gauges())
+	for vg, exp := range map[string]int{vgname: 0, vgname2: 1} {
+		filter := filterMetricsTags(map[string]string{"volume-group": vg})
+		volumes := int(gauges.mustGet(t, "volumes", filter).Value())
+		if volumes != exp {
+			t.Fatalf("expected %d volumes in %v but got %d", exp, vg, volumes)
+		}
+	}
+}
+
 type getOpts struct {
 	tags map[string]string
 }
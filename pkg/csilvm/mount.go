@@ -141,8 +141,33 @@ func getMountsAt(path string) ([]mountpoint, error) {
 	return mps, nil
 }
 
+// isMountPoint returns true if anything is mounted at the given path,
+// including mounts that listMounts skips as they have no block path.
+func isMountPoint(path string) (bool, error) {
+	var buf []byte
+	var err error
+	if virsh.ProxyMode() {
+		buf, err = virsh.MountInfo()
+	} else {
+		buf, err = ioutil.ReadFile("/proc/self/mountinfo")
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(string(buf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 4 && fields[4] == path {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func getBlockPath(blkdev string) string {
 	// if LVM2 LV then return blkdev and blockpath
+	if isCryptMapperPath(blkdev) {
+		return blkdev
+	}
 	if len(blkdev) > 10 {
 		if blkdev[0:10] == "/dev/sbvg_" {
 			return blkdev 
@@ -176,6 +201,10 @@ func getBlockPath(blkdev string) string {
 }
 
 func dataPathType(path string) string {
+	// If blockpath is an encrypted volume then return crypt
+	if isCryptMapperPath(path) {
+		return "crypt"
+	}
 	// If blockpath is LVM2 LV then return sas
 	if len(path) > 10 {
 		if path[0:10] == "/dev/sbvg_" {
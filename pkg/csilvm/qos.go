@@ -0,0 +1,820 @@
+package csilvm
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Seagate/csiclvm/pkg/lvm"
+	"github.com/Seagate/csiclvm/pkg/virsh"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The QoS parameters of a volume.
+const (
+	paramIOPSPerGB    = "iopspergb"
+	paramMBpsPerGB    = "mbpspergb"
+	paramIOPS         = "iops"
+	paramMBps         = "mbps"
+	paramBurstIOPS    = "burstiops"
+	paramBurstMBps    = "burstmbps"
+	paramBurstSeconds = "burstseconds"
+)
+
+// qosParameters are passed on from the CreateVolume parameters to the
+// volume context.
+var qosParameters = []string{
+	paramIOPSPerGB,
+	paramMBpsPerGB,
+	paramIOPS,
+	paramMBps,
+	paramBurstIOPS,
+	paramBurstMBps,
+	paramBurstSeconds,
+}
+
+// defaultBurstSeconds is how long a volume that has not used its burst
+// allowance may run at its burst limits.
+const defaultBurstSeconds = 60
+
+// qosSpec holds the QoS parameters of a volume. A GB is 2^30 bytes and a
+// MB is 2^20 bytes.
+type qosSpec struct {
+	IOPSPerGB    float64 `json:"ig,omitempty"`
+	MBpsPerGB    float64 `json:"mg,omitempty"`
+	IOPS         uint64  `json:"i,omitempty"`
+	MBps         uint64  `json:"m,omitempty"`
+	BurstIOPS    uint64  `json:"bi,omitempty"`
+	BurstMBps    uint64  `json:"bm,omitempty"`
+	BurstSeconds uint64  `json:"bs,omitempty"`
+}
+
+func (q qosSpec) isZero() bool {
+	return q == qosSpec{}
+}
+
+// takeQosFromParameters removes the QoS parameters from params and returns
+// the QoS spec they describe.
+func takeQosFromParameters(params map[string]string) (spec qosSpec, err error) {
+	takeFloat := func(key string) (float64, error) {
+		value, ok := params[key]
+		if !ok {
+			return 0, nil
+		}
+		delete(params, key)
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || f <= 0 || math.IsInf(f, 0) {
+			return 0, fmt.Errorf("The '%v' parameter must be a positive number, got %q.", key, value)
+		}
+		return f, nil
+	}
+	takeUint := func(key string) (uint64, error) {
+		value, ok := params[key]
+		if !ok {
+			return 0, nil
+		}
+		delete(params, key)
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil || n == 0 {
+			return 0, fmt.Errorf("The '%v' parameter must be a positive integer, got %q.", key, value)
+		}
+		return n, nil
+	}
+	if spec.IOPSPerGB, err = takeFloat(paramIOPSPerGB); err != nil {
+		return qosSpec{}, err
+	}
+	if spec.MBpsPerGB, err = takeFloat(paramMBpsPerGB); err != nil {
+		return qosSpec{}, err
+	}
+	if spec.IOPS, err = takeUint(paramIOPS); err != nil {
+		return qosSpec{}, err
+	}
+	if spec.MBps, err = takeUint(paramMBps); err != nil {
+		return qosSpec{}, err
+	}
+	if spec.BurstIOPS, err = takeUint(paramBurstIOPS); err != nil {
+		return qosSpec{}, err
+	}
+	if spec.BurstMBps, err = takeUint(paramBurstMBps); err != nil {
+		return qosSpec{}, err
+	}
+	if spec.BurstSeconds, err = takeUint(paramBurstSeconds); err != nil {
+		return qosSpec{}, err
+	}
+	if spec.BurstIOPS != 0 && spec.IOPSPerGB == 0 && spec.IOPS == 0 {
+		return qosSpec{}, fmt.Errorf("The '%v' parameter requires the '%v' or '%v' parameter.", paramBurstIOPS, paramIOPSPerGB, paramIOPS)
+	}
+	if spec.BurstMBps != 0 && spec.MBpsPerGB == 0 && spec.MBps == 0 {
+		return qosSpec{}, fmt.Errorf("The '%v' parameter requires the '%v' or '%v' parameter.", paramBurstMBps, paramMBpsPerGB, paramMBps)
+	}
+	if spec.BurstIOPS == 0 && spec.BurstMBps == 0 {
+		if spec.BurstSeconds != 0 {
+			return qosSpec{}, fmt.Errorf("The '%v' parameter requires the '%v' or '%v' parameter.", paramBurstSeconds, paramBurstIOPS, paramBurstMBps)
+		}
+	} else if spec.BurstSeconds == 0 {
+		spec.BurstSeconds = defaultBurstSeconds
+	}
+	return spec, nil
+}
+
+// qosFromContext returns the QoS spec passed on in a volume or publish
+// context.
+func qosFromContext(context map[string]string) qosSpec {
+	spec, err := takeQosFromParameters(dupParams(context))
+	if err != nil {
+		log.Printf("Ignoring invalid QoS parameters: err=%v", err)
+		return qosSpec{}
+	}
+	return spec
+}
+
+// passQos replaces the QoS parameters of a publish context with the record
+// of the logical volume, which ControllerModifyVolume may have changed
+// since the volume context was created.
+func passQos(context map[string]string, lv *lvm.LogicalVolume) {
+	tags, err := lv.Tags()
+	if err != nil {
+		return
+	}
+	spec, ok := parseQosTag(tags)
+	if !ok {
+		return
+	}
+	for _, key := range qosParameters {
+		delete(context, key)
+	}
+	for key, value := range spec.parameters() {
+		context[key] = value
+	}
+}
+
+// parameters returns the QoS parameters describing the spec. The default
+// burst duration is omitted.
+func (q qosSpec) parameters() map[string]string {
+	params := make(map[string]string)
+	setFloat := func(key string, value float64) {
+		if value != 0 {
+			params[key] = strconv.FormatFloat(value, 'f', -1, 64)
+		}
+	}
+	setUint := func(key string, value uint64) {
+		if value != 0 {
+			params[key] = strconv.FormatUint(value, 10)
+		}
+	}
+	setFloat(paramIOPSPerGB, q.IOPSPerGB)
+	setFloat(paramMBpsPerGB, q.MBpsPerGB)
+	setUint(paramIOPS, q.IOPS)
+	setUint(paramMBps, q.MBps)
+	setUint(paramBurstIOPS, q.BurstIOPS)
+	setUint(paramBurstMBps, q.BurstMBps)
+	if q.BurstSeconds != defaultBurstSeconds {
+		setUint(paramBurstSeconds, q.BurstSeconds)
+	}
+	return params
+}
+
+// modifyQos removes the QoS parameters from params and returns the spec
+// with those parameters changed. A parameter set to "0" removes the limit.
+func modifyQos(spec qosSpec, params map[string]string) (qosSpec, error) {
+	merged := spec.parameters()
+	for _, key := range qosParameters {
+		value, ok := params[key]
+		if !ok {
+			continue
+		}
+		delete(params, key)
+		if value == "0" {
+			delete(merged, key)
+			continue
+		}
+		merged[key] = value
+	}
+	return takeQosFromParameters(merged)
+}
+
+const (
+	tagQosPrefix       = "QOS+" // records the QoS spec, base64 encoded
+	tagLegacyQosPrefix = "qos-" // recorded by NodePublishVolume in earlier releases
+)
+
+func qosToTag(spec qosSpec) string {
+	buf, err := json.Marshal(spec)
+	if err != nil {
+		panic(err)
+	}
+	return tagQosPrefix + base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// parseQosTag returns the QoS spec recorded in the tags.
+func parseQosTag(tags []string) (spec qosSpec, ok bool) {
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, tagQosPrefix) {
+			continue
+		}
+		buf, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(tag, tagQosPrefix))
+		if err != nil {
+			log.Printf("Ignoring malformed QoS tag %v: err=%v", tag, err)
+			continue
+		}
+		if err := json.Unmarshal(buf, &spec); err != nil {
+			log.Printf("Ignoring malformed QoS tag %v: err=%v", tag, err)
+			continue
+		}
+		return spec, true
+	}
+	return qosSpec{}, false
+}
+
+// recordQos makes spec the only QoS record of the logical volume, replacing
+// any other record including those of earlier releases. A zero spec removes
+// the record.
+func recordQos(lv *lvm.LogicalVolume, spec qosSpec) error {
+	tags, err := lv.Tags()
+	if err != nil {
+		return err
+	}
+	var want string
+	if !spec.isZero() {
+		want = qosToTag(spec)
+	}
+	var remove, add []string
+	found := false
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, tagQosPrefix) && !strings.HasPrefix(tag, tagLegacyQosPrefix) {
+			continue
+		}
+		if tag == want {
+			found = true
+			continue
+		}
+		remove = append(remove, tag)
+	}
+	if want != "" && !found {
+		add = append(add, want)
+	}
+	return lv.ReplaceTags(remove, add)
+}
+
+// qosLimits are the limits of a volume of a given size. A zero limit is
+// unlimited. The burst limits are zero unless they exceed the baseline
+// limits.
+type qosLimits struct {
+	iops      uint64
+	bps       uint64
+	burstIOPS uint64
+	burstBps  uint64
+}
+
+// limits returns the limits of a volume of the given size in bytes. The
+// absolute limits cap the limits sized from the capacity.
+func (q qosSpec) limits(size uint64) qosLimits {
+	gb := float64(size) / (1 << 30)
+	perGB := func(rate float64, unit uint64) uint64 {
+		if rate == 0 {
+			return 0
+		}
+		// Round up so that a small volume is never stalled.
+		return uint64(math.Ceil(rate*gb)) * unit
+	}
+	capped := func(limit, ceiling uint64) uint64 {
+		if limit == 0 || (ceiling != 0 && ceiling < limit) {
+			return ceiling
+		}
+		return limit
+	}
+	burst := func(burst, baseline uint64) uint64 {
+		if baseline == 0 || burst <= baseline {
+			return 0
+		}
+		return burst
+	}
+	var l qosLimits
+	l.iops = capped(perGB(q.IOPSPerGB, 1), q.IOPS)
+	l.bps = capped(perGB(q.MBpsPerGB, 1<<20), q.MBps<<20)
+	l.burstIOPS = burst(q.BurstIOPS, l.iops)
+	l.burstBps = burst(q.BurstMBps<<20, l.bps)
+	return l
+}
+
+// qosCgroupCandidates are the cgroups that contain the pods under the
+// systemd and cgroupfs cgroup drivers, for cgroup v2 and v1.
+var qosCgroupCandidates = []string{
+	"/sys/fs/cgroup/kubepods.slice",
+	"/sys/fs/cgroup/kubepods",
+	"/sys/fs/cgroup/blkio/kubepods.slice",
+	"/sys/fs/cgroup/blkio/kubepods",
+}
+
+// The files of the cgroup v1 blkio controller, see blkio-controller.rst.
+const (
+	blkioReadIOPS  = "blkio.throttle.read_iops_device"
+	blkioWriteIOPS = "blkio.throttle.write_iops_device"
+	blkioReadBps   = "blkio.throttle.read_bps_device"
+	blkioWriteBps  = "blkio.throttle.write_bps_device"
+)
+
+// nodeFileExists returns whether the path exists on this node, through the
+// StoLake agent in proxy mode.
+func nodeFileExists(path string) bool {
+	if virsh.ProxyMode() {
+		// The StoLake agent does not report the exit status, stat
+		// prints the path only if it exists.
+		output, err := runOnNode("stat", "--format=%n", path)
+		return err == nil && strings.TrimSpace(string(output)) != ""
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// writeNodeFile writes a line to a file on this node, through the StoLake
+// agent in proxy mode.
+func writeNodeFile(path, line string) error {
+	if virsh.ProxyMode() {
+		_, err := runOnNode("sh", "-c", `printf '%s\n' "$1" > "$2"`, "sh", line, path)
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(line+"\n"), 0644)
+}
+
+// setupQos finds the cgroup through which QoS limits are enforced and
+// applies the limits of the volumes that are active on this node.
+func (s *Server) setupQos() {
+	candidates := qosCgroupCandidates
+	switch s.qosCgroup {
+	case "none":
+		candidates = nil
+	case "":
+	default:
+		candidates = []string{s.qosCgroup}
+	}
+	s.qosCgroup, s.qosCgroupVersion = "", 0
+	for _, path := range candidates {
+		if nodeFileExists(path + "/io.max") {
+			s.qosCgroup, s.qosCgroupVersion = path, 2
+			break
+		}
+		if nodeFileExists(path + "/" + blkioReadIOPS) {
+			s.qosCgroup, s.qosCgroupVersion = path, 1
+			break
+		}
+	}
+	if s.qosCgroupVersion == 0 {
+		log.Printf("No cgroup with an I/O controller found among %v, QoS limits are not enforced through cgroups", candidates)
+		return
+	}
+	log.Printf("Enforcing QoS limits through cgroup v%d %v", s.qosCgroupVersion, s.qosCgroup)
+	s.reapplyQos()
+}
+
+// ioMaxLine returns the cgroup v2 io.max line limiting the device to the
+// given IOPS and bytes per second in each direction.
+func ioMaxLine(device string, iops, bps uint64) string {
+	limit := func(v uint64) string {
+		if v == 0 {
+			return "max"
+		}
+		return strconv.FormatUint(v, 10)
+	}
+	return fmt.Sprintf("%s riops=%s wiops=%s rbps=%s wbps=%s", device, limit(iops), limit(iops), limit(bps), limit(bps))
+}
+
+// throttle limits the I/O of the pods to the device, given by its
+// major:minor number, to the given IOPS and bytes per second in each
+// direction. Zero limits lift the limits.
+func (s *Server) throttle(device string, iops, bps uint64) error {
+	switch s.qosCgroupVersion {
+	case 2:
+		return writeNodeFile(s.qosCgroup+"/io.max", ioMaxLine(device, iops, bps))
+	case 1:
+		// Writing a zero limit removes the rule.
+		for file, limit := range map[string]uint64{
+			blkioReadIOPS:  iops,
+			blkioWriteIOPS: iops,
+			blkioReadBps:   bps,
+			blkioWriteBps:  bps,
+		} {
+			if err := writeNodeFile(s.qosCgroup+"/"+file, device+" "+strconv.FormatUint(limit, 10)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// majorMinor returns the major:minor device number of the device node at
+// path in the decimal form used by the cgroup I/O controllers.
+func majorMinor(path string) (string, error) {
+	number, err := deviceNumber(path)
+	if err != nil {
+		return "", err
+	}
+	var major, minor uint64
+	if _, err := fmt.Sscanf(number, "%x:%x", &major, &minor); err != nil {
+		return "", fmt.Errorf("cannot parse device number %q: %v", number, err)
+	}
+	return fmt.Sprintf("%d:%d", major, minor), nil
+}
+
+// appliedQos holds the QoS limits applied to the device of a volume on this
+// node and the state of its burst allowance.
+type appliedQos struct {
+	// device is the major:minor number of the device at path.
+	device string
+	path   string
+	size   uint64
+	// lv is nil if the volume group is not visible on this node.
+	lv     *lvm.LogicalVolume
+	spec   qosSpec
+	limits qosLimits
+	// staged is set if the limits were applied by NodeStageVolume
+	// rather than NodePublishVolume. They are lifted when the
+	// volume is unstaged.
+	staged bool
+	// The burst credits are in excess I/O requests and bytes. The
+	// volume runs at its burst limits while it has credits left.
+	iopsCredits  float64
+	bpsCredits   float64
+	burstingIOPS bool
+	burstingBps  bool
+	sample       ioSample
+	sampled      bool
+}
+
+// update sets the spec and size of the volume and resets its burst
+// allowance. It returns whether the limits changed.
+func (q *appliedQos) update(spec qosSpec, size uint64) bool {
+	limits := spec.limits(size)
+	changed := limits != q.limits
+	q.spec, q.size, q.limits = spec, size, limits
+	q.iopsCredits, q.burstingIOPS = q.iopsCreditLimit(), q.limits.burstIOPS != 0
+	q.bpsCredits, q.burstingBps = q.bpsCreditLimit(), q.limits.burstBps != 0
+	return changed
+}
+
+func (q *appliedQos) iopsCreditLimit() float64 {
+	if q.limits.burstIOPS == 0 {
+		return 0
+	}
+	return float64((q.limits.burstIOPS - q.limits.iops) * q.spec.BurstSeconds)
+}
+
+func (q *appliedQos) bpsCreditLimit() float64 {
+	if q.limits.burstBps == 0 {
+		return 0
+	}
+	return float64((q.limits.burstBps - q.limits.bps) * q.spec.BurstSeconds)
+}
+
+// current returns the limits the volume runs at.
+func (q *appliedQos) current() (iops, bps uint64) {
+	iops, bps = q.limits.iops, q.limits.bps
+	if q.burstingIOPS {
+		iops = q.limits.burstIOPS
+	}
+	if q.burstingBps {
+		bps = q.limits.burstBps
+	}
+	return iops, bps
+}
+
+// updateCredits charges the burst allowance for the I/O above the baseline
+// limits and refills it by the I/O below. The busier direction is charged
+// as the limits apply to each direction. It returns whether the volume
+// started or stopped bursting.
+func (q *appliedQos) updateCredits(rates ioRates, elapsed time.Duration) bool {
+	update := func(credits *float64, used float64, baseline uint64, limit float64) bool {
+		*credits += (float64(baseline) - used) * elapsed.Seconds()
+		*credits = math.Max(0, math.Min(*credits, limit))
+		return *credits > 0
+	}
+	iops, bps := q.burstingIOPS, q.burstingBps
+	if q.limits.burstIOPS != 0 {
+		used := math.Max(rates.readIOPS, rates.writeIOPS)
+		q.burstingIOPS = update(&q.iopsCredits, used, q.limits.iops, q.iopsCreditLimit())
+	}
+	if q.limits.burstBps != 0 {
+		used := math.Max(rates.readBytesPerSecond, rates.writeBytesPerSecond)
+		q.burstingBps = update(&q.bpsCredits, used, q.limits.bps, q.bpsCreditLimit())
+	}
+	return iops != q.burstingIOPS || bps != q.burstingBps
+}
+
+// lookupQos returns the QoS spec of the volume. It is read from the QoS record
+// of the logical volume if the volume group is visible on this node and
+// taken from the first of the contexts that carries one otherwise. A
+// record of an earlier release is replaced by the spec of the contexts.
+func (s *Server) lookupQos(id string, contexts ...map[string]string) (qosSpec, *lvm.LogicalVolume) {
+	lv, err := s.lookupLogicalVolume(id)
+	if err != nil {
+		lv = nil
+	} else if tags, err := lv.Tags(); err == nil {
+		if spec, ok := parseQosTag(tags); ok {
+			return spec, lv
+		}
+	}
+	for _, context := range contexts {
+		spec := qosFromContext(context)
+		if spec.isZero() {
+			continue
+		}
+		if lv != nil {
+			if err := recordQos(lv, spec); err != nil {
+				log.Printf("Cannot record the QoS of %v: err=%v", id, err)
+			}
+		}
+		return spec, lv
+	}
+	return qosSpec{}, lv
+}
+
+// applyQos limits the I/O to the volume attached at devicePath to its QoS
+// limits, sized from the capacity of the device.
+func (s *Server) applyQos(id, devicePath string, staged bool, contexts ...map[string]string) error {
+	spec, lv := s.lookupQos(id, contexts...)
+	if spec.isZero() {
+		return nil
+	}
+	size, err := blockDeviceSize(devicePath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot determine the size of %v: err=%v", devicePath, err)
+	}
+	device, err := majorMinor(devicePath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot stat %v: err=%v", devicePath, err)
+	}
+	q := &appliedQos{
+		device: device,
+		path:   devicePath,
+		lv:     lv,
+		staged: staged,
+	}
+	q.update(spec, size)
+	s.qosMu.Lock()
+	defer s.qosMu.Unlock()
+	if s.qos == nil {
+		s.qos = make(map[string]*appliedQos)
+	}
+	if prev, ok := s.qos[id]; ok && prev.device == device && prev.spec == spec {
+		// The volume is published again, keep its burst state.
+		prev.staged = prev.staged || staged
+		return nil
+	}
+	log.Printf("Applying QoS limits %+v to volume %v on %v", q.limits, id, device)
+	if err := s.enforceQos(id, q); err != nil {
+		return status.Errorf(codes.Internal, "Failed to apply QoS limits: err=%v", err)
+	}
+	s.qos[id] = q
+	return nil
+}
+
+// enforceQos applies the current limits of the volume. Without a cgroup the
+// StoLake agent applies the per-GB limits in proxy mode. The caller must
+// hold qosMu.
+func (s *Server) enforceQos(id string, q *appliedQos) error {
+	if s.qosCgroupVersion != 0 {
+		iops, bps := q.current()
+		return s.throttle(q.device, iops, bps)
+	}
+	if virsh.ProxyMode() && q.lv != nil {
+		return virsh.SetQos(q.lv.VgName(), q.lv.Name(),
+			strconv.FormatFloat(q.spec.IOPSPerGB, 'f', -1, 64),
+			strconv.FormatFloat(q.spec.MBpsPerGB, 'f', -1, 64))
+	}
+	log.Printf("Not enforcing the QoS limits of volume %v: no cgroup with an I/O controller was found", id)
+	return nil
+}
+
+// clearQos lifts the QoS limits of the volume before its device at
+// devicePath is released. The device is only needed if the limits were
+// applied before the plugin restarted. The limits are forgotten under
+// qosMu and lifted without holding it, the bursts of a forgotten volume
+// are no longer regulated.
+func (s *Server) clearQos(id, devicePath string) {
+	s.qosMu.Lock()
+	q, ok := s.qos[id]
+	delete(s.qos, id)
+	s.qosMu.Unlock()
+	if !ok {
+		if devicePath == "" {
+			return
+		}
+		device, err := majorMinor(devicePath)
+		if err != nil {
+			log.Printf("Cannot lift the QoS limits of volume %v: err=%v", id, err)
+			return
+		}
+		q = &appliedQos{device: device}
+		if lv, err := s.lookupLogicalVolume(id); err == nil {
+			q.lv = lv
+		}
+	}
+	log.Printf("Lifting the QoS limits of volume %v on %v", id, q.device)
+	var err error
+	if s.qosCgroupVersion != 0 {
+		err = s.throttle(q.device, 0, 0)
+	} else if virsh.ProxyMode() && q.lv != nil {
+		err = virsh.SetQos(q.lv.VgName(), q.lv.Name(), "0", "0")
+	}
+	if err != nil {
+		log.Printf("Failed to lift the QoS limits of volume %v: err=%v", id, err)
+	}
+}
+
+// clearPublishedQos lifts the QoS limits of the volume if they were applied
+// by NodePublishVolume rather than NodeStageVolume.
+func (s *Server) clearPublishedQos(id string) {
+	s.qosMu.Lock()
+	q, ok := s.qos[id]
+	s.qosMu.Unlock()
+	if ok && !q.staged {
+		s.clearQos(id, "")
+	}
+}
+
+// reapplyQos applies the QoS limits recorded on the volumes that are active
+// on this node. The limits are lost when the node reboots and the burst
+// state when the plugin restarts. The limits are treated as staged as it is
+// not known whether the volume was staged, they are lifted at the latest
+// when the volume is deactivated and its device removed.
+func (s *Server) reapplyQos() {
+	for _, vg := range s.managedVolumeGroups() {
+		names, err := vg.ListActiveLogicalVolumeNames()
+		if err != nil {
+			log.Printf("Cannot reapply QoS limits: cannot list active volumes in %v: err=%v", vg.Name(), err)
+			continue
+		}
+		for _, name := range names {
+			if !strings.HasPrefix(name, lvPrefix) {
+				continue
+			}
+			lv, err := vg.LookupLogicalVolume(name)
+			if err != nil {
+				continue
+			}
+			tags, err := lv.Tags()
+			if err != nil {
+				continue
+			}
+			if _, ok := parseQosTag(tags); !ok {
+				continue
+			}
+			id := s.volumeID(vg.Name(), name)
+			devicePath, err := lv.Path()
+			if err != nil {
+				continue
+			}
+			if cryptPath := cryptMapperDir + s.cryptMappingName(id); nodeFileExists(cryptPath) {
+				devicePath = cryptPath
+			}
+			const staged = true
+			if err := s.applyQos(id, devicePath, staged); err != nil {
+				log.Printf("Cannot reapply the QoS limits of volume %v: err=%v", id, err)
+			}
+		}
+	}
+}
+
+// qosRefreshInterval is how often RegulateQos looks for QoS records
+// modified by ControllerModifyVolume and for expanded volumes.
+const qosRefreshInterval = 30 * time.Second
+
+// RegulateQos lets the volumes with burst limits on this node run at those
+// limits while they have burst credits left. The I/O of each volume is
+// sampled at the given interval. It also applies the QoS records modified
+// by ControllerModifyVolume and resizes the limits of expanded volumes.
+func (s *Server) RegulateQos(interval time.Duration) context.CancelFunc {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer wg.Done()
+		defer ticker.Stop()
+		refreshed := time.Now()
+		for {
+			select {
+			case now := <-ticker.C:
+				if now.Sub(refreshed) >= qosRefreshInterval {
+					s.refreshQos()
+					refreshed = now
+				}
+				s.regulateQosBursts(now)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// refreshQos applies the current QoS records and sizes of the given
+// volumes, or of every volume whose limits are applied on this node if
+// none are given. Volumes whose volume group is not visible on this node
+// keep their limits until they are published again.
+func (s *Server) refreshQos(ids ...string) {
+	s.qosMu.Lock()
+	applied := make(map[string]*appliedQos)
+	for id, q := range s.qos {
+		applied[id] = q
+	}
+	s.qosMu.Unlock()
+	if len(ids) > 0 {
+		selected := make(map[string]*appliedQos)
+		for _, id := range ids {
+			if q, ok := applied[id]; ok {
+				selected[id] = q
+			}
+		}
+		applied = selected
+	}
+	for id, q := range applied {
+		if q.lv == nil {
+			continue
+		}
+		// lvs and the size lookup run without holding qosMu.
+		tags, err := q.lv.Tags()
+		if err != nil {
+			log.Printf("Cannot refresh the QoS limits of volume %v: err=%v", id, err)
+			continue
+		}
+		spec, _ := parseQosTag(tags)
+		size, err := blockDeviceSize(q.path)
+		if err != nil {
+			log.Printf("Cannot refresh the QoS limits of volume %v: err=%v", id, err)
+			continue
+		}
+		s.qosMu.Lock()
+		if s.qos[id] == q && (spec != q.spec || size != q.size) && q.update(spec, size) {
+			log.Printf("Applying QoS limits %+v to volume %v on %v", q.limits, id, q.device)
+			if err := s.enforceQos(id, q); err != nil {
+				log.Printf("Failed to apply QoS limits of volume %v: err=%v", id, err)
+			}
+		}
+		s.qosMu.Unlock()
+	}
+}
+
+// regulateQosBursts samples the I/O of the volumes with burst limits and
+// applies their burst or baseline limits as their credits run out or
+// refill. The devices are read without holding qosMu, which is only held
+// to update the burst state and to apply the limits of the volumes that
+// started or stopped bursting, as for refreshQos.
+func (s *Server) regulateQosBursts(now time.Time) {
+	if s.qosCgroupVersion == 0 {
+		return
+	}
+	s.qosMu.Lock()
+	bursting := make(map[string]*appliedQos)
+	for id, q := range s.qos {
+		if q.limits.burstIOPS != 0 || q.limits.burstBps != 0 {
+			bursting[id] = q
+		}
+	}
+	s.qosMu.Unlock()
+	for id, q := range bursting {
+		// The device number of an applied volume does not change.
+		buf, err := readNodeFile("/sys/dev/block/" + q.device + "/stat")
+		if err != nil {
+			log.Printf("Cannot regulate the QoS bursts of volume %v: err=%v", id, err)
+			continue
+		}
+		stats, err := parseDiskStats(string(buf))
+		if err != nil {
+			log.Printf("Cannot regulate the QoS bursts of volume %v: err=%v", id, err)
+			continue
+		}
+		s.qosMu.Lock()
+		if s.qos[id] == q {
+			s.regulateQosBurst(id, q, stats, now)
+		}
+		s.qosMu.Unlock()
+	}
+}
+
+// regulateQosBurst updates the burst credits of the volume from its I/O
+// since the last sample. The caller must hold qosMu.
+func (s *Server) regulateQosBurst(id string, q *appliedQos, stats diskStats, now time.Time) {
+	if q.sampled {
+		elapsed := now.Sub(q.sample.at)
+		if rates, ok := stats.ratesSince(q.sample.stats, elapsed); ok && q.updateCredits(rates, elapsed) {
+			if err := s.enforceQos(id, q); err != nil {
+				log.Printf("Failed to apply QoS limits of volume %v: err=%v", id, err)
+			}
+		}
+	}
+	q.sample = ioSample{stats: stats, at: now}
+	q.sampled = true
+}
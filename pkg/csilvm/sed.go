@@ -0,0 +1,194 @@
+package csilvm
+
+import (
+	"fmt"
+
+	"github.com/Seagate/csiclvm/pkg/lvm"
+	"github.com/Seagate/csiclvm/pkg/virsh"
+)
+
+// SelfEncryptingDrives configures the Server to manage the self-encrypting
+// drives of the volume group through the StoLake agent. The agent takes
+// ownership of the drives and unlocks them during Setup. The drives are
+// only locked again by LockDrives.
+func SelfEncryptingDrives() ServerOpt {
+	return func(s *Server) {
+		s.sed = virshSedAgent{}
+	}
+}
+
+// sedAgent manages self-encrypting drives. It is implemented by the
+// StoLake agent and faked in tests.
+type sedAgent interface {
+	// Drives returns the device paths of the self-encrypting drives.
+	Drives() ([]string, error)
+	// Owned returns true if the agent owns the drive.
+	Owned(dev string) (bool, error)
+	TakeOwnership(dev string) error
+	Unlock(dev string) error
+	Lock(dev string) error
+	// ResetGlobalBand reconfigures the locking band covering the whole
+	// drive and leaves the drive locked.
+	ResetGlobalBand(dev string) error
+}
+
+// virshSedAgent is the sedAgent of the StoLake agent.
+type virshSedAgent struct{}
+
+func (virshSedAgent) Drives() ([]string, error)      { return virsh.RetrieveSedDrives() }
+func (virshSedAgent) Owned(dev string) (bool, error) { return virsh.CheckSed(dev) }
+func (virshSedAgent) TakeOwnership(dev string) error { return virsh.TakeOwnershipSed(dev) }
+func (virshSedAgent) Unlock(dev string) error        { return virsh.UnlockSed(dev) }
+func (virshSedAgent) Lock(dev string) error          { return virsh.LockSed(dev) }
+func (virshSedAgent) ResetGlobalBand(dev string) error {
+	return virsh.ResetSedGlobalBand(dev)
+}
+
+// selectSedDrives returns the self-encrypting drives among the devices. All
+// self-encrypting drives are selected if no devices are given as the
+// physical volumes of a locked drive cannot be discovered.
+func selectSedDrives(devices, seds []string) []string {
+	var selected []string
+	given := false
+	for _, dev := range devices {
+		if dev == "" {
+			continue
+		}
+		given = true
+		for _, sed := range seds {
+			if sed == dev {
+				selected = append(selected, dev)
+				break
+			}
+		}
+	}
+	if !given {
+		return seds
+	}
+	return selected
+}
+
+// sedDrives returns the self-encrypting drives managed by the Server.
+func (s *Server) sedDrives() ([]string, error) {
+	seds, err := s.sed.Drives()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list self-encrypting drives: err=%v", err)
+	}
+	return selectSedDrives(s.pvnames, seds), nil
+}
+
+// unlockDrives takes ownership of and unlocks the managed self-encrypting
+// drives. It must be called before the volume groups are activated.
+func (s *Server) unlockDrives() error {
+	drives, err := s.sedDrives()
+	if err != nil {
+		return err
+	}
+	for _, dev := range drives {
+		owned, err := s.sed.Owned(dev)
+		if err != nil {
+			return fmt.Errorf("Cannot check self-encrypting drive %v: err=%v", dev, err)
+		}
+		if !owned {
+			log.Printf("Taking ownership of self-encrypting drive %v", dev)
+			if err := s.sed.TakeOwnership(dev); err != nil {
+				return fmt.Errorf("Cannot take ownership of self-encrypting drive %v: err=%v", dev, err)
+			}
+		}
+		log.Printf("Unlocking self-encrypting drive %v", dev)
+		if err := s.sed.Unlock(dev); err != nil {
+			return fmt.Errorf("Cannot unlock self-encrypting drive %v: err=%v", dev, err)
+		}
+	}
+	return nil
+}
+
+// LockDrives locks the managed self-encrypting drives. It does nothing if
+// no drives are managed. The lock covers whole drives that are shared by
+// every host of the volume groups, so it is left to the operator to make
+// sure that no other host uses any of their volumes. LockDrives only
+// refuses to lock the drives while volumes are active on this host.
+func (s *Server) LockDrives() error {
+	if s.sed == nil {
+		return nil
+	}
+	for _, vg := range s.managedVolumeGroups() {
+		active, err := vg.ListActiveLogicalVolumeNames()
+		if err != nil {
+			return err
+		}
+		if len(active) > 0 {
+			return fmt.Errorf("Cannot lock self-encrypting drives, volumes %v of %v are active", active, vg.Name())
+		}
+	}
+	for _, vg := range s.managedVolumeGroups() {
+		if err := virsh.VgDeActivate(vg.Name()); err != nil {
+			log.Printf("FAILED to stop VG lock for %v :: err=%v", vg.Name(), err)
+		}
+	}
+	drives, err := s.sedDrives()
+	if err != nil {
+		return err
+	}
+	for _, dev := range drives {
+		log.Printf("Locking self-encrypting drive %v", dev)
+		if err := s.sed.Lock(dev); err != nil {
+			return fmt.Errorf("Cannot lock self-encrypting drive %v: err=%v", dev, err)
+		}
+	}
+	return nil
+}
+
+// RetirePhysicalVolume removes the physical volume from its managed volume
+// group. No extents of the physical volume may be allocated. The global
+// locking band of a managed self-encrypting drive is reset afterwards.
+func (s *Server) RetirePhysicalVolume(pvname string) error {
+	var vg *lvm.VolumeGroup
+	for _, candidate := range s.managedVolumeGroups() {
+		pvnames, err := candidate.ListPhysicalVolumeNames()
+		if err != nil {
+			return err
+		}
+		for _, name := range pvnames {
+			if name == pvname {
+				vg = candidate
+			}
+		}
+	}
+	if vg == nil {
+		return fmt.Errorf("%v is not a physical volume of a managed volume group", pvname)
+	}
+	log.Printf("Removing physical volume %v from volume group %v", pvname, vg.Name())
+	if err := vg.ReducePhysicalVolume(pvname); err != nil {
+		return err
+	}
+	pv, err := lvm.LookupPhysicalVolume(pvname)
+	if err != nil {
+		return err
+	}
+	if err := pv.Remove(); err != nil {
+		return err
+	}
+	return s.retireDrive(pvname)
+}
+
+// retireDrive resets the global locking band of the device if it is a
+// managed self-encrypting drive. See virsh.ResetSedGlobalBand for what
+// this guarantees.
+func (s *Server) retireDrive(pvname string) error {
+	if s.sed == nil {
+		return nil
+	}
+	seds, err := s.sed.Drives()
+	if err != nil {
+		return err
+	}
+	for _, sed := range seds {
+		if sed == pvname {
+			log.Printf("Resetting the global locking band of self-encrypting drive %v", pvname)
+			return s.sed.ResetGlobalBand(pvname)
+		}
+	}
+	log.Printf("%v is not a self-encrypting drive, skipping the locking band reset", pvname)
+	return nil
+}
@@ -8,13 +8,18 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
+	"unicode"
 	"github.com/Seagate/csiclvm/pkg/lvm"
 	"github.com/Seagate/csiclvm/pkg/version"
 	"github.com/Seagate/csiclvm/pkg/virsh"
@@ -25,11 +30,17 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 	"k8s.io/klog"
 )
 
 const (
 	topologyKey = ".speedboat.seagate.com/nodeId"
+	// topologyVolumeGroupKey followed by the volume group name is
+	// reported by nodes that can see the volume group. Direct SAS
+	// volumes are only accessible from those nodes.
+	topologyVolumeGroupKey = ".speedboat.seagate.com/volumeGroup."
 )
 
 type Server struct {
@@ -44,6 +55,31 @@ type Server struct {
 	probeModules         map[string]struct{}
 	nodeID               string
 	metrics              tally.Scope
+	thinOvercommitRatio  float64
+	// additionalVgnames are the names of the volume groups managed in
+	// addition to vgname.
+	additionalVgnames []string
+	// volumeGroups holds every managed volume group that was found,
+	// including volumeGroup. Volume groups found after Setup are added
+	// by concurrent requests, so vgMu guards both fields.
+	vgMu              sync.RWMutex
+	volumeGroups      map[string]*lvm.VolumeGroup
+	volumeGroupPolicy string
+	// keyProvider manages the data keys of encrypted volumes. If nil
+	// the keys are taken from node publish secrets.
+	keyProvider KeyProvider
+	// sed manages the self-encrypting drives of the volume group. If nil
+	// no self-encrypting drives are managed.
+	sed sedAgent
+	// qosCgroup is the cgroup whose I/O controller enforces the QoS
+	// limits of the volumes, qosCgroupVersion its cgroup version or 0
+	// if none was found.
+	qosCgroup        string
+	qosCgroupVersion int
+	// qos holds the QoS limits applied on this node, keyed by volume
+	// ID.
+	qosMu sync.Mutex
+	qos   map[string]*appliedQos
 }
 
 // NewServer returns a new Server that will manage the given LVM volume
@@ -66,7 +102,9 @@ func NewServer(vgname string, pvnames []string, defaultFs string, opts ...Server
 			"":        defaultFs,
 			defaultFs: defaultFs,
 		},
-		metrics:   tally.NoopScope,
+		metrics:             tally.NoopScope,
+		thinOvercommitRatio: 1,
+		volumeGroupPolicy:   VolumeGroupPolicyPrimary,
 	}
 	for _, opt := range opts {
 		if opt == nil {
@@ -159,6 +197,70 @@ func Metrics(scope tally.Scope) ServerOpt {
 	}
 }
 
+// ThinOvercommitRatio sets how many times the size of a thin pool may be
+// allocated to thin volumes. A ratio of 1 means the pool is never
+// overcommitted.
+func ThinOvercommitRatio(ratio float64) ServerOpt {
+	if ratio <= 0 {
+		panic("csilvm: ThinOvercommitRatio: ratio must be positive")
+	}
+	return func(s *Server) {
+		s.thinOvercommitRatio = ratio
+	}
+}
+
+// EncryptionKeyProvider configures the Server to create a data key for
+// each new encrypted volume with the given KeyProvider and to destroy it
+// when the volume is deleted.
+func EncryptionKeyProvider(kp KeyProvider) ServerOpt {
+	return func(s *Server) {
+		s.keyProvider = kp
+	}
+}
+
+// AdditionalVolumeGroup configures the Server to manage the given volume
+// group in addition to the one passed to NewServer. This option may be
+// specified multiple times.
+func AdditionalVolumeGroup(vgname string) ServerOpt {
+	return func(s *Server) {
+		s.additionalVgnames = append(s.additionalVgnames, vgname)
+	}
+}
+
+const (
+	// VolumeGroupPolicyPrimary creates volumes in the volume group
+	// passed to NewServer, or in the first additional volume group if
+	// the volume would not be accessible from the requisite topology.
+	VolumeGroupPolicyPrimary = "primary"
+	// VolumeGroupPolicyMostFree creates volumes in the volume group with
+	// the most free space for the requested layout.
+	VolumeGroupPolicyMostFree = "mostfree"
+)
+
+// QosCgroup sets the cgroup whose I/O controller limits the I/O of the pods
+// on this node to the QoS limits of their volumes. It must contain every
+// pod, e.g., /sys/fs/cgroup/kubepods.slice. If unset the cgroup is looked
+// up among the usual kubepods cgroups during Setup. The special value
+// "none" disables the cgroup limits.
+func QosCgroup(path string) ServerOpt {
+	return func(s *Server) {
+		s.qosCgroup = path
+	}
+}
+
+// VolumeGroupPolicy sets how the volume group of a new volume is chosen if
+// the 'volumeGroup' parameter is not set.
+func VolumeGroupPolicy(policy string) ServerOpt {
+	switch policy {
+	case VolumeGroupPolicyPrimary, VolumeGroupPolicyMostFree:
+	default:
+		panic("csilvm: VolumeGroupPolicy: unknown policy " + policy)
+	}
+	return func(s *Server) {
+		s.volumeGroupPolicy = policy
+	}
+}
+
 // ProbeModules configures the server to query the loaded kernel modules to ensure
 // that prerequisite modules are loaded before any operations are executed.
 // This option may be specified multiple times to append additional module requirements.
@@ -200,6 +302,12 @@ func (s *Server) Setup() error {
 		return fmt.Errorf( "Stolake Agent not found  err=%v", err)
 	}
 	log.Printf("STOLAKE VERSION: %s", stolakeVer)
+	if s.sed != nil {
+		// The volume groups cannot be found while their drives are locked.
+		if err := s.unlockDrives(); err != nil {
+			return err
+		}
+	}
 	log.Printf("Looking up volume group %v", s.vgname)
 	volumeGroup, err2 := lvm.LookupVolumeGroup(s.vgname)
 	if err2 != nil {
@@ -212,10 +320,135 @@ func (s *Server) Setup() error {
 			log.Printf( "FAILED to start start VG lock for %v :: err=%v", s.vgname, err)
 		}
 	}
+	volumeGroups := make(map[string]*lvm.VolumeGroup)
+	if volumeGroup != nil {
+		volumeGroups[s.vgname] = volumeGroup
+	}
+	for _, vgname := range s.additionalVgnames {
+		log.Printf("Looking up volume group %v", vgname)
+		vg, err := lvm.LookupVolumeGroup(vgname)
+		if err != nil {
+			log.Printf("Cannot lookup volume group %v: err=%v", vgname, err)
+			continue
+		}
+		log.Printf("Found volume group %v. Starting Locks", vgname)
+		if err := virsh.VgActivate(vgname); err != nil {
+			log.Printf("FAILED to start start VG lock for %v :: err=%v", vgname, err)
+		}
+		volumeGroups[vgname] = vg
+	}
+	s.vgMu.Lock()
 	s.volumeGroup = volumeGroup
+	s.volumeGroups = volumeGroups
+	s.vgMu.Unlock()
+	s.setupQos()
 	return nil
 }
 
+// managedVolumeGroups returns the managed volume groups that were found
+// during Setup, starting with the primary volume group.
+func (s *Server) managedVolumeGroups() []*lvm.VolumeGroup {
+	s.vgMu.RLock()
+	defer s.vgMu.RUnlock()
+	var vgs []*lvm.VolumeGroup
+	for _, vgname := range append([]string{s.vgname}, s.additionalVgnames...) {
+		if vg, ok := s.volumeGroups[vgname]; ok {
+			vgs = append(vgs, vg)
+		}
+	}
+	return vgs
+}
+
+// volumeID returns the ID of the logical volume with the given name in the
+// given volume group. Volumes in the primary volume group are identified by
+// their name alone so that the IDs of existing volumes remain valid. Volumes
+// in additional volume groups are identified by "<vgname>/<lvname>".
+func (s *Server) volumeID(vgname, lvname string) string {
+	if vgname == s.vgname {
+		return lvname
+	}
+	return vgname + "/" + lvname
+}
+
+// splitVolumeID returns the volume group name and logical volume name of
+// the given volume or snapshot ID.
+func (s *Server) splitVolumeID(id string) (vgname, lvname string) {
+	if i := strings.Index(id, "/"); i >= 0 {
+		return id[:i], id[i+1:]
+	}
+	return s.vgname, id
+}
+
+// lookupVolumeGroup returns the managed volume group with the given name,
+// or nil if there is none. A managed volume group that was not found during
+// Setup is looked up again as it may since have become visible, e.g., after
+// an iSCSI login.
+func (s *Server) lookupVolumeGroup(vgname string) *lvm.VolumeGroup {
+	s.vgMu.RLock()
+	vg, ok := s.volumeGroups[vgname]
+	s.vgMu.RUnlock()
+	if ok {
+		return vg
+	}
+	managed := vgname == s.vgname
+	for _, name := range s.additionalVgnames {
+		managed = managed || vgname == name
+	}
+	if !managed {
+		return nil
+	}
+	vg, err := lvm.LookupVolumeGroup(vgname)
+	if err != nil {
+		return nil
+	}
+	s.vgMu.Lock()
+	defer s.vgMu.Unlock()
+	if s.volumeGroups == nil {
+		s.volumeGroups = make(map[string]*lvm.VolumeGroup)
+	}
+	s.volumeGroups[vgname] = vg
+	if vgname == s.vgname {
+		s.volumeGroup = vg
+	}
+	return vg
+}
+
+// lookupLogicalVolume returns the logical volume with the given volume or
+// snapshot ID.
+func (s *Server) lookupLogicalVolume(id string) (*lvm.LogicalVolume, error) {
+	vgname, lvname := s.splitVolumeID(id)
+	if !isVolumeName(lvname) {
+		// Thin pools and the other logical volumes of the volume
+		// group are not volumes.
+		return nil, lvm.ErrLogicalVolumeNotFound
+	}
+	vg := s.lookupVolumeGroup(vgname)
+	if vg == nil {
+		return nil, lvm.ErrLogicalVolumeNotFound
+	}
+	return vg.LookupLogicalVolume(lvname)
+}
+
+// isVolumeName returns true if the logical volume name is one allocated
+// for a volume or a snapshot by allocateLogicalVolumeName.
+func isVolumeName(lvname string) bool {
+	for _, prefix := range []string{lvPrefix, snapPrefix} {
+		if !strings.HasPrefix(lvname, prefix) {
+			continue
+		}
+		_, err := strconv.ParseUint(strings.TrimPrefix(lvname, prefix), 36, 64)
+		return err == nil
+	}
+	return false
+}
+
+// isSnapshotID returns true if the ID refers to a snapshot rather than a
+// volume.
+func (s *Server) isSnapshotID(id string) bool {
+	_, lvname := s.splitVolumeID(id)
+	return strings.HasPrefix(lvname, snapPrefix)
+}
+
 // IdentityService RPCs
 
 const (
@@ -235,10 +468,8 @@ func (s *Server) GetPluginInfo(
 	if v.BuildTime != "" {
 		m[manifestBuildTime] = v.BuildTime
 	}
-	tenant := s.vgname[5:len(s.vgname)]
-
 	response := &csi.GetPluginInfoResponse{
-		Name:          tenant + v.Product,
+		Name:          s.tenant() + v.Product,
 		VendorVersion: v.Version,
 		Manifest:      m,
 	}
@@ -262,8 +493,26 @@ func (s *Server) GetPluginCapabilities(
 					},
 				},
 			},
+			{
+				Type: &csi.PluginCapability_VolumeExpansion_{
+					VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
+						Type: csi.PluginCapability_VolumeExpansion_ONLINE,
+					},
+				},
+			},
 		},
 	}
+	if s.controllerMode {
+		// The controller also honours accessibility requirements
+		// when provisioning volumes.
+		response.Capabilities = append(response.Capabilities, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+				},
+			},
+		})
+	}
 	return response, nil
 }
 
@@ -324,6 +573,8 @@ func ErrNotMultipleOfExtentSize(extentSize uint64) error {
 var ErrVolumeAlreadyExists = status.Error(codes.AlreadyExists, "The volume already exists")
 var ErrInsufficientCapacity = status.Error(codes.OutOfRange, "Not enough free space")
 var ErrTooFewDisks = status.Error(codes.OutOfRange, "The volume group does not have enough underlying physical devices to support the requested RAID configuration")
+var ErrTooFewFailureDomains = status.Error(codes.OutOfRange, "The physical volumes of the volume group span too few failure domains to support the requested RAID configuration")
+var ErrFailureDomainsViolated = status.Error(codes.ResourceExhausted, "The RAID images could not be spread across failure domains")
 
 const attrTags = "tags"
 
@@ -339,25 +590,61 @@ func (s *Server) volumeAttributes(lv *lvm.LogicalVolume) (map[string]string, err
 	if err != nil {
 		return nil, err
 	}
-	return map[string]string{
+	attr := map[string]string{
 		attrTags: base64.RawURLEncoding.EncodeToString(buf),
-	}, nil
+	}
+	for _, tag := range t {
+		if tag == tagEncrypted {
+			attr[attrEncrypted] = "true"
+		}
+	}
+	return attr, nil
+}
+
+// createParameters returns the parameters of the CreateVolume request. The
+// mutable parameters, e.g. of a VolumeAttributesClass, take precedence over
+// the parameters of the storage class. As with ControllerModifyVolume, a
+// QoS parameter set to "0" removes the limit. The `rotatekey` parameter is
+// ignored. The request is left as is.
+func createParameters(request *csi.CreateVolumeRequest) map[string]string {
+	mutable := request.GetMutableParameters()
+	if len(mutable) == 0 {
+		return request.GetParameters()
+	}
+	params := make(map[string]string)
+	for key, value := range request.GetParameters() {
+		params[key] = value
+	}
+	for key, value := range mutable {
+		if key == "rotatekey" {
+			// A new volume has a new data key.
+			continue
+		}
+		if value == "0" && key != "cache" {
+			delete(params, key)
+			continue
+		}
+		params[key] = value
+	}
+	return params
 }
 
 func (s *Server) CreateVolume(
 	ctx context.Context,
 	request *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
 
+	parameters := createParameters(request)
+
 	// Record the original volume name as a tag.
 	encodedName := s.volumeNameToTag(request.GetName())
-	tags := make([]string, len(s.tags), len(s.tags)+1)
+	tags := make([]string, len(s.tags), len(s.tags)+2)
 	copy(tags, s.tags)
 	tags = append(tags, encodedName)
 
 	// Check whether a logical volume with the given name already
 	// exists in this volume group.
 	log.Printf("Determining whether volume %q with encoded name %v already exists", request.GetName(), encodedName)
-	if lv, err := s.volumeGroup.FindLogicalVolume(lvm.LVMatchTag(encodedName)); err == nil {
+	if lv, err := s.findLogicalVolumeByTag(encodedName); err == nil {
 		log.Printf("Volume %s already exists.", encodedName)
 		// The volume already exists. Determine whether or not the
 		// existing volume satisfies the request. If so, return a
@@ -371,42 +658,124 @@ func (s *Server) CreateVolume(
 		}
 		response := &csi.CreateVolumeResponse{
 			Volume: &csi.Volume{
-				CapacityBytes: int64(lv.SizeInBytes()),
-				VolumeId:      lv.Name(),
-				VolumeContext: attr,
+				CapacityBytes:      int64(lv.SizeInBytes()),
+				VolumeId:           s.volumeID(lv.VgName(), lv.Name()),
+				VolumeContext:      attr,
+				ContentSource:      request.GetVolumeContentSource(),
+				AccessibleTopology: s.volumeTopology(datapathFromParameters(parameters), lv.VgName()),
 			},
 		}
 		return response, nil
 	}
-	// Generate a random volume name and ensure that it doesn't already exist.
-	var volumeID string
-	const lvPrefix = "csilv"
-	for i := 0; i < 10 && volumeID == ""; i++ {
-		// prefix a random number to avoid stomping on reserved names.
-		tryID := lvPrefix + strconv.FormatUint(rand.Uint64(), 36)
-		log.Printf("Attempting to allocate id=%v for requested volume %q", tryID, request.GetName())
-		if _, err := s.volumeGroup.LookupLogicalVolume(tryID); err == nil {
-			log.Printf("Volume id %s already exists, trying again..", tryID)
-			continue
+	datapath := datapathFromParameters(parameters)
+	// Look up the snapshot or volume the new volume is to be populated from.
+	var sourceLV *lvm.LogicalVolume
+	var sourceSize uint64
+	var thinSource bool
+	if volume := request.GetVolumeContentSource().GetVolume(); volume != nil {
+		sourceID := volume.GetVolumeId()
+		log.Printf("Looking up source volume with id=%v", sourceID)
+		if s.isSnapshotID(sourceID) {
+			return nil, ErrVolumeNotFound
+		}
+		source, err := s.lookupLogicalVolume(sourceID)
+		if err != nil {
+			return nil, ErrVolumeNotFound
+		}
+		// A clone is always a full copy so that it gets the layout
+		// requested by its own parameters.
+		sourceLV = source
+		sourceSize = source.SizeInBytes()
+	}
+	if snapshot := request.GetVolumeContentSource().GetSnapshot(); snapshot != nil {
+		snapshotID := snapshot.GetSnapshotId()
+		log.Printf("Looking up source snapshot with id=%v", snapshotID)
+		if !s.isSnapshotID(snapshotID) {
+			return nil, ErrSnapshotNotFound
+		}
+		snap, err := s.lookupLogicalVolume(snapshotID)
+		if err != nil {
+			return nil, ErrSnapshotNotFound
+		}
+		info, err := s.snapshotFromLogicalVolume(snap)
+		if err != nil {
+			return nil, err
 		}
-		volumeID = tryID
+		thinSource, err = snap.IsThin()
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Cannot determine snapshot type: err=%v", err)
+		}
+		sourceLV = snap
+		sourceSize = uint64(info.GetSizeBytes())
 	}
-	if volumeID == "" {
-		return nil, status.Error(codes.Internal, "Failed to allocate volume ID")
+	if tag := s.contentSourceToTag(request.GetVolumeContentSource()); tag != "" {
+		tags = append(tags, tag)
 	}
-	log.Printf("Volume with id=%v does not already exist", volumeID)
-	params := dupParams(request.GetParameters())
+	if tag := pvcToTag(parameters); tag != "" {
+		tags = append(tags, tag)
+	}
+	qos, err := takeQosFromParameters(dupParams(parameters))
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid parameters: %v", err)
+	}
+	if !qos.isZero() {
+		tags = append(tags, qosToTag(qos))
+	}
+	encrypted, err := encryptedFromParameters(parameters)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid parameters: %v", err)
+	}
+	var cryptTags []string
+	if sourceLV != nil {
+		// A volume populated from an encrypted source holds
+		// encrypted data, too.
+		cryptTags, err = encryptionTags(sourceLV)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Cannot determine whether the content source is encrypted: err=%v", err)
+		}
+	}
+	if encrypted && len(cryptTags) == 0 {
+		cryptTags = []string{tagEncrypted}
+	}
+	tags = append(tags, cryptTags...)
+	params := dupParams(parameters)
 	layout, err := takeVolumeLayoutFromParameters(params)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Invalid volume layout: err=%v", err)
 	}
-	// Determine the capacity, default to maximum size.
+	if err := resolvePhysicalVolumes(&layout); err != nil {
+		return nil, err
+	}
+	cache, err := takeCacheFromParameters(dupParams(parameters))
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid parameters: %v", err)
+	}
+	// The volume must be accessible from at least one of the requisite
+	// topologies, if any.
+	requisite := request.GetAccessibilityRequirements().GetRequisite()
+	vg, err := s.selectVolumeGroup(parameters, sourceLV, layout, cache, requisite)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Creating volume in volume group %v", vg.Name())
+	// Generate a random volume name and ensure that it doesn't already exist.
+	lvname := s.allocateLogicalVolumeName(vg, lvPrefix, request.GetName())
+	if lvname == "" {
+		return nil, status.Error(codes.Internal, "Failed to allocate volume ID")
+	}
+	volumeID := s.volumeID(vg.Name(), lvname)
+	log.Printf("Volume with id=%v does not already exist", volumeID)
+	// Determine the capacity, default to maximum size. A volume that is
+	// populated from a content source defaults to the size of the source.
 	size := s.defaultVolumeSize
+	if sourceLV != nil {
+		size = sourceSize
+	}
 	if capacityRange := request.GetCapacityRange(); capacityRange != nil {
 		// Set the volume size to the minimum requested size.
 		size = uint64(capacityRange.GetRequiredBytes())
 		// Get the extentSize for this volume group. The LV size must be a multiple of the extent size.
-		extentSize, err := s.volumeGroup.ExtentSize()
+		extentSize, err := vg.ExtentSize()
 		if err != nil {
 			return nil, status.Errorf(
 				codes.Internal,
@@ -420,19 +789,32 @@ func (s *Server) CreateVolume(
 			size = ((size + extentSize) / extentSize) * extentSize
 			log.Printf("Rounding size up from required_bytes (about %dMiB) to nearest extent size (%dMiB) to get (%dMiB)", sizeBefore>>20, extentSize>>20, size>>20)
 		}
-		// Get bytesFree, it is a multiple of extentSize.
-		bytesFree, err := s.volumeGroup.BytesFree(layout)
-		if err != nil {
-			return nil, status.Errorf(
-				codes.Internal,
-				"Error in BytesFree: err=%v",
-				err)
+		// The new volume must be large enough to hold the content source.
+		if size < sourceSize {
+			log.Printf("Content source size %dMiB exceeds requested size %dMiB", sourceSize>>20, size>>20)
+			return nil, ErrContentSourceTooLarge
 		}
-		log.Printf("BytesFree: %v (%dMiB)", bytesFree, bytesFree>>20)
-		// Check whether there is enough free space available.
-		// bytesFree is a multiple of extentSize.
-		if bytesFree < size {
-			return nil, ErrInsufficientCapacity
+		// Thin volumes, including a thin copy of a thin source, are
+		// allocated from a thin pool rather than from the volume group.
+		if !thinSource && layout.Type != lvm.VolumeTypeThin {
+			if err := vg.CheckFailureDomains(layout); err != nil {
+				return nil, failureDomainsError(err)
+			}
+			// Get bytesFree, it is a multiple of extentSize. The
+			// cache volume, if any, is allocated as well.
+			bytesFree, err := vg.BytesFreeCached(layout, cache)
+			if err != nil {
+				return nil, status.Errorf(
+					codes.Internal,
+					"Error in BytesFree: err=%v",
+					err)
+			}
+			log.Printf("BytesFree: %v (%dMiB)", bytesFree, bytesFree>>20)
+			// Check whether there is enough free space available.
+			// bytesFree is a multiple of extentSize.
+			if bytesFree < size {
+				return nil, ErrInsufficientCapacity
+			}
 		}
 		if limit := capacityRange.GetLimitBytes(); limit != 0 && size > uint64(limit) {
 			// We've already checked that there is sufficient capacity. The only
@@ -442,13 +824,62 @@ func (s *Server) CreateVolume(
 			return nil, ErrNotMultipleOfExtentSize(extentSize)
 		}
 	}
-	lvopts, err := volumeOptsFromParameters(request.GetParameters())
+	lvopts, err := volumeOptsFromParameters(parameters)
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "Invalid parameters: %v", err)
 	}
+	// Create the volume with the layout whose drives were resolved.
+	lvopts = append(lvopts, lvm.VolumeLayoutOpt(layout))
+	if layout.Type == lvm.VolumeTypeThin && !thinSource {
+		strategy, err := takeAllocationFromParameters(dupParams(parameters), layout)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid parameters: %v", err)
+		}
+		if err := s.ensureThinPool(vg, layout, strategy); err != nil {
+			return nil, err
+		}
+		available, err := s.thinCapacity(vg, layout)
+		if err != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				"Cannot determine thin pool capacity: err=%v",
+				err)
+		}
+		log.Printf("Thin pool %v capacity: %v (%dMiB)", layout.ThinPool, available, available>>20)
+		if available < size {
+			return nil, ErrInsufficientCapacity
+		}
+	}
 
-	log.Printf("Creating logical volume id=%v, size=%v, tags=%v, params=%v", volumeID, size, tags, request.GetParameters())
-	lv, err := s.volumeGroup.CreateLogicalVolume(volumeID, size, tags, lvopts...)
+	var lv *lvm.LogicalVolume
+	switch {
+	case sourceLV != nil && thinSource:
+		// A thin snapshot of a thin snapshot shares all blocks
+		// with its source and is created instantly.
+		if size != sourceSize {
+			return nil, status.Errorf(
+				codes.OutOfRange,
+				"A volume restored from a thin snapshot must be %d bytes",
+				sourceSize)
+		}
+		log.Printf("Creating thin volume id=%v from %v, tags=%v", volumeID, sourceLV.Name(), tags)
+		lv, err = sourceLV.CreateSnapshot(lvname, 0, tags)
+	default:
+		log.Printf("Creating logical volume id=%v, size=%v, tags=%v, params=%v", volumeID, size, tags, parameters)
+		lv, err = vg.CreateLogicalVolume(lvname, size, tags, lvopts...)
+		if err == nil && sourceLV != nil {
+			log.Printf("Copying contents of %v to %v", sourceLV.Name(), volumeID)
+			if err := lv.CopyFrom(sourceLV); err != nil {
+				if err := lv.Remove(); err != nil {
+					log.Printf("Failed to remove volume %v after failed copy: err=%v", volumeID, err)
+				}
+				return nil, status.Errorf(
+					codes.Internal,
+					"Failed to copy content source: err=%v",
+					err)
+			}
+		}
+	}
 	if err != nil {
 		if err == lvm.ErrInvalidLVName {
 			return nil, status.Errorf(
@@ -464,32 +895,38 @@ func (s *Server) CreateVolume(
 		if err == lvm.ErrTooFewDisks {
 			return nil, ErrTooFewDisks
 		}
+		if err == lvm.ErrTooFewFailureDomains || err == lvm.ErrFailureDomainsViolated {
+			return nil, failureDomainsError(err)
+		}
 		return nil, status.Errorf(
 			codes.Internal,
 			"Error in CreateLogicalVolume: err=%v",
 			err)
 	}
+	if encrypted && sourceLV == nil && s.keyProvider != nil {
+		if err := s.createVolumeKey(ctx, lv); err != nil {
+			if err := lv.Remove(); err != nil {
+				log.Printf("Failed to remove volume %v after failed key creation: err=%v", volumeID, err)
+			}
+			return nil, status.Errorf(
+				codes.Internal,
+				"Failed to create data key: err=%v",
+				err)
+		}
+	}
 	attr, err := s.volumeAttributes(lv)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to get volume attributes: err=%v", err)
 	}
 
 	// Pass on QOS in Volume Context for ControllerPublish
-	iopspergb, ok := params["iopspergb"]
-	if ok {
-		attr["iopspergb"] = iopspergb
-	}
-	mbpspergb, okk := params["mbpspergb"]
-	if okk {
-		attr["mbpspergb"] = mbpspergb
+	for _, key := range qosParameters {
+		if value, ok := params[key]; ok {
+			attr[key] = value
+		}
 	}
 	// Pass on datapath mode for ControllerPublish
-	datapath, okkk := params["datapath"]
-	if okkk {
-		attr["datapath"] = strings.ToLower(datapath)
-	} else {
-		attr["datapath"] = "direct" 
-	}
+	attr["datapath"] = datapath
 	jbofs, ok4 := params["stolakejobfurls"]
 	if ok4 {
 		attr["stolakejobfurls"] = jbofs
@@ -498,14 +935,214 @@ func (s *Server) CreateVolume(
 	defer s.reportStorageMetrics()
 	response := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			CapacityBytes: int64(lv.SizeInBytes()),
-			VolumeId:      volumeID,
-			VolumeContext: attr,
+			CapacityBytes:      int64(lv.SizeInBytes()),
+			VolumeId:           volumeID,
+			VolumeContext:      attr,
+			ContentSource:      request.GetVolumeContentSource(),
+			AccessibleTopology: s.volumeTopology(datapath, vg.Name()),
 		},
 	}
 	return response, nil
 }
 
+var ErrTopologyUnreachable = status.Error(codes.ResourceExhausted, "The volume cannot be made accessible from the requisite topology.")
+
+// datapathFromParameters returns the datapath over which volumes with the
+// given parameters are published. It defaults to direct SAS access.
+func datapathFromParameters(params map[string]string) string {
+	if datapath, ok := params["datapath"]; ok {
+		return strings.ToLower(datapath)
+	}
+	return "direct"
+}
+
+// tenant returns the tenant the volume group belongs to. It prefixes the
+// topology keys and the plugin name.
+func (s *Server) tenant() string {
+	return s.vgname[5:len(s.vgname)]
+}
+
+// volumeGroupTopologySegment returns the topology segment reported by
+// nodes that see the given volume group.
+func (s *Server) volumeGroupTopologySegment(vgname string) (key, value string) {
+	return s.tenant() + topologyVolumeGroupKey + vgname, "true"
+}
+
+// volumeTopology returns the topology from which a volume in the given
+// volume group published over the given datapath is accessible. Direct SAS
+// volumes are only accessible from nodes that see the volume group. iSCSI
+// and NVMe-oF volumes are accessible from any node, which is expressed by
+// returning nil.
+func (s *Server) volumeTopology(datapath, vgname string) []*csi.Topology {
+	if datapath != "direct" {
+		return nil
+	}
+	key, value := s.volumeGroupTopologySegment(vgname)
+	return []*csi.Topology{
+		{Segments: map[string]string{key: value}},
+	}
+}
+
+// isAccessibleFrom returns true if a volume in the given volume group
+// published over the given datapath is accessible from at least one of the
+// given topologies. Any volume is accessible if no topologies are given.
+func (s *Server) isAccessibleFrom(datapath, vgname string, topologies []*csi.Topology) bool {
+	accessible := s.volumeTopology(datapath, vgname)
+	if accessible == nil || len(topologies) == 0 {
+		return true
+	}
+	for _, topology := range topologies {
+		for _, want := range accessible {
+			if topologyContains(topology, want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// topologyContains returns true if every segment of b is also a segment of a.
+func topologyContains(a, b *csi.Topology) bool {
+	for k, v := range b.GetSegments() {
+		if a.GetSegments()[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+var ErrSnapshotNotFound = status.Error(codes.NotFound, "The snapshot does not exist.")
+var ErrContentSourceTooLarge = status.Error(codes.OutOfRange, "The content source is larger than the requested capacity.")
+
+const (
+	tagFromSnapshotPrefix = "FROMSNAP." // records the snapshot a volume was restored from
+	tagFromVolumePrefix   = "FROMVOL."  // records the volume a volume was cloned from
+)
+
+// contentSourceToTag returns the tag that records the content source a
+// volume was populated from, or an empty string if there is none. The
+// content source is recorded by its logical volume name as a volume is
+// always created in the volume group of its content source.
+func (s *Server) contentSourceToTag(source *csi.VolumeContentSource) string {
+	if snapshot := source.GetSnapshot(); snapshot != nil {
+		_, lvname := s.splitVolumeID(snapshot.GetSnapshotId())
+		return tagFromSnapshotPrefix + lvname
+	}
+	if volume := source.GetVolume(); volume != nil {
+		_, lvname := s.splitVolumeID(volume.GetVolumeId())
+		return tagFromVolumePrefix + lvname
+	}
+	return ""
+}
+
+const (
+	lvPrefix   = "csilv"
+	snapPrefix = "csisnap"
+)
+
+// allocateLogicalVolumeName generates a random logical volume name with the
+// given prefix that does not already exist in the given volume group. It returns
+// an empty string if no unused name could be found.
+func (s *Server) allocateLogicalVolumeName(vg *lvm.VolumeGroup, prefix, requestedName string) string {
+	for i := 0; i < 10; i++ {
+		// prefix a random number to avoid stomping on reserved names.
+		tryID := prefix + strconv.FormatUint(rand.Uint64(), 36)
+		log.Printf("Attempting to allocate id=%v for requested name %q", tryID, requestedName)
+		if _, err := vg.LookupLogicalVolume(tryID); err == nil {
+			log.Printf("Volume id %s already exists, trying again..", tryID)
+			continue
+		}
+		return tryID
+	}
+	return ""
+}
+
+// findLogicalVolumeByTag returns the first logical volume in any of the
+// managed volume groups that carries the given tag.
+func (s *Server) findLogicalVolumeByTag(tag string) (*lvm.LogicalVolume, error) {
+	for _, vg := range s.managedVolumeGroups() {
+		lv, err := vg.FindLogicalVolume(lvm.LVMatchTag(tag))
+		if err == lvm.ErrLogicalVolumeNotFound {
+			continue
+		}
+		return lv, err
+	}
+	return nil, lvm.ErrLogicalVolumeNotFound
+}
+
+var ErrVolumeGroupNotFound = status.Error(codes.InvalidArgument, "The volume group is not managed by this plugin.")
+
+// selectVolumeGroup returns the volume group a new volume is created in. A
+// volume populated from a content source is created in the volume group of
+// the source. Otherwise the 'volumeGroup' parameter selects the volume
+// group, if set, or else the volume group policy chooses among the managed
+// volume groups. The volume must be accessible from at least one of the
+// requisite topologies, if any.
+func (s *Server) selectVolumeGroup(params map[string]string, source *lvm.LogicalVolume, layout lvm.VolumeLayout, cache lvm.Cache, requisite []*csi.Topology) (*lvm.VolumeGroup, error) {
+	datapath := datapathFromParameters(params)
+	vgname, ok := params["volumeGroup"]
+	if source != nil {
+		if ok && vgname != source.VgName() {
+			return nil, status.Errorf(
+				codes.InvalidArgument,
+				"The volume must be created in the volume group %v of its content source.",
+				source.VgName())
+		}
+		vgname, ok = source.VgName(), true
+	}
+	if ok {
+		vg := s.lookupVolumeGroup(vgname)
+		if vg == nil {
+			return nil, ErrVolumeGroupNotFound
+		}
+		if !s.isAccessibleFrom(datapath, vgname, requisite) {
+			log.Printf("Volume in %v with datapath %v is not accessible from %v", vgname, datapath, requisite)
+			return nil, ErrTopologyUnreachable
+		}
+		return vg, nil
+	}
+	if len(s.managedVolumeGroups()) == 0 {
+		return nil, ErrVolumeGroupNotFound
+	}
+	var vgs []*lvm.VolumeGroup
+	for _, vg := range s.managedVolumeGroups() {
+		if s.isAccessibleFrom(datapath, vg.Name(), requisite) {
+			vgs = append(vgs, vg)
+		}
+	}
+	if len(vgs) == 0 {
+		log.Printf("No volume group with datapath %v is accessible from %v", datapath, requisite)
+		return nil, ErrTopologyUnreachable
+	}
+	if s.volumeGroupPolicy != VolumeGroupPolicyMostFree {
+		return vgs[0], nil
+	}
+	var best *lvm.VolumeGroup
+	var bestFree uint64
+	for _, vg := range vgs {
+		bytesFree, err := s.bytesFree(vg, layout, cache)
+		if err != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				"Error in BytesFree: err=%v",
+				err)
+		}
+		if best == nil || bytesFree > bestFree {
+			best, bestFree = vg, bytesFree
+		}
+	}
+	return best, nil
+}
+
+// bytesFree returns the size of the largest volume with the given layout
+// and cache that can be created in the volume group.
+func (s *Server) bytesFree(vg *lvm.VolumeGroup, layout lvm.VolumeLayout, cache lvm.Cache) (uint64, error) {
+	if layout.Type == lvm.VolumeTypeThin {
+		return s.thinCapacity(vg, layout)
+	}
+	return vg.BytesFreeCached(layout, cache)
+}
+
 func (s *Server) validateExistingVolume(lv *lvm.LogicalVolume, request *csi.CreateVolumeRequest) error {
 	// Determine whether the existing volume satisfies the capacity_range
 	// of the current request.
@@ -530,10 +1167,32 @@ func (s *Server) validateExistingVolume(lv *lvm.LogicalVolume, request *csi.Crea
 		// specified, thanks to the specification and the request
 		// validation logic.
 	}
-	// The existing volume matches the requested capacity_range.  We
-	// determine whether the existing volume satisfies all requested
-	// volume_capabilities.
-	sourcePath, err := lv.Path()
+	// The existing volume must have been populated from the requested
+	// content source, if any.
+	if tag := s.contentSourceToTag(request.GetVolumeContentSource()); tag != "" {
+		tags, err := lv.Tags()
+		if err != nil {
+			return status.Errorf(
+				codes.Internal,
+				"Error in Tags(): err=%v",
+				err)
+		}
+		had := false
+		for _, t := range tags {
+			if t == tag {
+				had = true
+				break
+			}
+		}
+		if !had {
+			log.Printf("Existing volume does not satisfy request: content source %v not in %v", tag, tags)
+			return ErrVolumeAlreadyExists
+		}
+	}
+	// The existing volume matches the requested capacity_range.  We
+	// determine whether the existing volume satisfies all requested
+	// volume_capabilities.
+	sourcePath, err := lv.Path()
 	if err != nil {
 		return status.Errorf(
 			codes.Internal,
@@ -558,7 +1217,7 @@ func (s *Server) DeleteVolume(
 	request *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 	id := request.GetVolumeId()
 	log.Printf("Looking up volume with id=%v", id)
-	lv, err := s.volumeGroup.LookupLogicalVolume(id)
+	lv, err := s.lookupLogicalVolume(id)
 	if err != nil {
 		// It is idempotent to succeed if a volume is not found.
 		response := &csi.DeleteVolumeResponse{}
@@ -587,6 +1246,46 @@ func (s *Server) DeleteVolume(
 	//		"Cannot delete data from device: err=%v",
 	//		err)
 	//}
+	// Copy-on-write snapshots cannot outlive their origin volume. Thin
+	// snapshots are independent of their origin and are left alone.
+	vg := s.lookupVolumeGroup(lv.VgName())
+	snapshots, err := vg.FindLogicalVolumes(lvm.LVMatchTag(snapshotSourceToTag(lv.Name())))
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			"Cannot list snapshots: err=%v",
+			err)
+	}
+	for _, snap := range snapshots {
+		origin, err := snap.Origin()
+		if err != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				"Cannot determine snapshot origin: err=%v",
+				err)
+		}
+		thin, err := snap.IsThin()
+		if err != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				"Cannot determine snapshot type: err=%v",
+				err)
+		}
+		if origin == lv.Name() && !thin {
+			return nil, status.Errorf(
+				codes.FailedPrecondition,
+				"The volume has snapshot %v which must be deleted first.",
+				s.volumeID(snap.VgName(), snap.Name()))
+		}
+	}
+	// The data key is destroyed first so that the data cannot be
+	// recovered even if removing the volume fails.
+	if err := s.destroyVolumeKey(ctx, lv); err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			"Failed to destroy data key: err=%v",
+			err)
+	}
 	log.Printf("Removing volume")
 	if err := lv.Remove(); err != nil {
 		return nil, status.Errorf(
@@ -651,7 +1350,7 @@ func (s *Server) ControllerPublishVolume(
 	switch strings.ToLower(pubcontext["datapath"]) {
 		// Export LV as ISCSI Target on this controller node
 		case "iscsi": {
-			lv, err := s.volumeGroup.LookupLogicalVolume(volumeID)
+			lv, err := s.lookupLogicalVolume(volumeID)
 			if err != nil {
 				log.Printf("ControllerPublish could not find volume with id=%v", volumeID)
 				return nil, ErrVolumeNotFound
@@ -678,17 +1377,27 @@ func (s *Server) ControllerPublishVolume(
 			pubcontext["blockid"] = targetiqn
 			pubcontext["lun"] = lun
 			pubcontext["portal"] = targetportal
+			// The logical volume is not visible on the node.
+			passQos(pubcontext, lv)
+			if err := recordPublication(lv, publication{NodeID: nodeID, Datapath: "iscsi", Target: targetiqn}); err != nil {
+				return nil, err
+			}
 			return  &csi.ControllerPublishVolumeResponse{PublishContext: pubcontext}, nil
 		}
 		// JBOF ISCSI Mode: Controller agent creates iscsi targets and passes list of targets back in pubcontext 
 		case "jbofis": {
+			lv, err := s.lookupLogicalVolume(volumeID)
+			if err != nil {
+				log.Printf("ControllerPublish could not find volume with id=%v", volumeID)
+				return nil, ErrVolumeNotFound
+			}
 			// Validate list of 1 or more servers running stolake as a target builder service emulating a JBOF
 			stolakeURLs, ok := pubcontext["stolakejobfurls"]
 			if !ok  {
 				return nil, status.Error(codes.InvalidArgument, "Missing stolakejobfurls parameter in storage class")
 			}
-			log.Printf("Setting Up iSCSI Targets for % on  %s for %s ", s.vgname, stolakeURLs, nodeID)
-			targetlist, err2 := virsh.JbofStageIscsiTargets(s.vgname, stolakeURLs, nodeID)
+			log.Printf("Setting Up iSCSI Targets for % on  %s for %s ", lv.VgName(), stolakeURLs, nodeID)
+			targetlist, err2 := virsh.JbofStageIscsiTargets(lv.VgName(), stolakeURLs, nodeID)
 			if  err2 != nil {
 				log.Printf("SCSI Target Setup Error %v", err2)
 				return nil, ErrVolumeNotFound
@@ -696,6 +1405,11 @@ func (s *Server) ControllerPublishVolume(
 
 			pubcontext["blockid"] =  "unknown at CtrlPub phase"
 			pubcontext["targetlist"] = targetlist
+			// The target list covers every drive of the volume group
+			// and is too long to record in a tag.
+			if err := recordPublication(lv, publication{NodeID: nodeID, Datapath: "jbofis"}); err != nil {
+				return nil, err
+			}
 			return  &csi.ControllerPublishVolumeResponse{PublishContext: pubcontext}, nil
 		}
 		case "nvme":
@@ -705,7 +1419,15 @@ func (s *Server) ControllerPublishVolume(
 		case "direct":
 			fallthrough
 		default:
+			lv, err := s.lookupLogicalVolume(volumeID)
+			if err != nil {
+				log.Printf("ControllerPublish could not find volume with id=%v", volumeID)
+				return nil, ErrVolumeNotFound
+			}
 			pubcontext["blockid"] = "notneeded"
+			if err := recordPublication(lv, publication{NodeID: nodeID, Datapath: "direct"}); err != nil {
+				return nil, err
+			}
 			response := &csi.ControllerPublishVolumeResponse{PublishContext: pubcontext}
 			return response, nil
 	}
@@ -741,7 +1463,7 @@ func (s *Server) ControllerUnpublishVolume(
 	}
 
 	volumeID := request.GetVolumeId()
-	lv, err := s.volumeGroup.LookupLogicalVolume(volumeID)
+	lv, err := s.lookupLogicalVolume(volumeID)
 	if err != nil {
 		//NOTE: The CSI spec say to reply with error if the volume is  "is not assumed to be ControllerUnpublished"
 		// If the lv was not found we assume it has been unpublished
@@ -749,11 +1471,45 @@ func (s *Server) ControllerUnpublishVolume(
 		//return response, ErrVolumeNotFound
 	}
 
-	// FIXME: Need to discover how the volume is published to the node and undo it selectively 
-	//        but for now unstage and ignore errors
-	lvuuid, _ :=  lv.Uuid()
-	virsh.UnStageIscsiTarget(lvuuid,nodeid)
-	lv.Deactivate()
+	tags, err := lv.Tags()
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			"Error in Tags(): err=%v",
+			err)
+	}
+	pubs := parsePublicationTags(tags)
+	var found, iscsiRemaining bool
+	for _, pub := range pubs {
+		if pub.NodeID != nodeid {
+			if pub.Datapath == "iscsi" {
+				iscsiRemaining = true
+			}
+			continue
+		}
+		found = true
+		if pub.Datapath == "iscsi" {
+			lvuuid, _ := lv.Uuid()
+			virsh.UnStageIscsiTarget(lvuuid, nodeid)
+		}
+		if err := lv.DeleteTag(publicationToTag(pub)); err != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				"Failed to remove publication record: err=%v",
+				err)
+		}
+	}
+	if !found {
+		// The volume was published before publications were
+		// recorded, we don't know how, so unstage and ignore errors.
+		lvuuid, _ := lv.Uuid()
+		virsh.UnStageIscsiTarget(lvuuid, nodeid)
+	}
+	// The volume is only active on the controller while it is
+	// exported as an iSCSI target.
+	if !iscsiRemaining {
+		lv.Deactivate()
+	}
 
 	return  &csi.ControllerUnpublishVolumeResponse{}, nil
 
@@ -770,7 +1526,7 @@ func (s *Server) ControllerUnpublishVolume(
 	if !virsh.IsDomValid(nodeid) {
 		return nil, status.Error(codes.NotFound, "Unknown nodeid "+nodeid+" doesn't map to oVirt DOM.")
 	}
-	_, err = s.volumeGroup.LookupLogicalVolume(volumeID)
+	_, err = s.lookupLogicalVolume(volumeID)
 	if err != nil {
 		return nil, ErrVolumeNotFound
 	}
@@ -782,6 +1538,87 @@ func (s *Server) ControllerUnpublishVolume(
 	return response, nil
 }
 
+// publication records how a volume is published to a node.
+type publication struct {
+	NodeID   string `json:"n"`
+	Datapath string `json:"d"`
+	// Target is the iSCSI target IQN or NVMe-oF NQN, if any.
+	Target string `json:"t,omitempty"`
+}
+
+const tagPublicationPrefix = "PUB+" // records a publication, base64 encoded as node IDs are rarely tag-safe
+
+func publicationToTag(pub publication) string {
+	buf, err := json.Marshal(pub)
+	if err != nil {
+		panic(err)
+	}
+	return tagPublicationPrefix + base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func parsePublicationTags(tags []string) (pubs []publication) {
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, tagPublicationPrefix) {
+			continue
+		}
+		buf, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(tag, tagPublicationPrefix))
+		if err != nil {
+			log.Printf("Ignoring malformed publication tag %v: err=%v", tag, err)
+			continue
+		}
+		var pub publication
+		if err := json.Unmarshal(buf, &pub); err != nil {
+			log.Printf("Ignoring malformed publication tag %v: err=%v", tag, err)
+			continue
+		}
+		pubs = append(pubs, pub)
+	}
+	return pubs
+}
+
+// publishedNodeIDs returns the IDs of the nodes the volume is published to.
+func publishedNodeIDs(tags []string) (ids []string) {
+	for _, pub := range parsePublicationTags(tags) {
+		ids = append(ids, pub.NodeID)
+	}
+	return ids
+}
+
+// recordPublication records pub in a tag on lv, replacing any earlier
+// record for the same node.
+func recordPublication(lv *lvm.LogicalVolume, pub publication) error {
+	tags, err := lv.Tags()
+	if err != nil {
+		return status.Errorf(
+			codes.Internal,
+			"Error in Tags(): err=%v",
+			err)
+	}
+	tag := publicationToTag(pub)
+	for _, existing := range parsePublicationTags(tags) {
+		if existing.NodeID != pub.NodeID {
+			continue
+		}
+		if existing == pub {
+			return nil
+		}
+		if err := lv.DeleteTag(publicationToTag(existing)); err != nil {
+			return status.Errorf(
+				codes.Internal,
+				"Failed to remove publication record: err=%v",
+				err)
+		}
+	}
+	log.Printf("Recording publication of %v to %v over %v", lv.Name(), pub.NodeID, pub.Datapath)
+	if err := lv.AddTag(tag); err != nil {
+		return status.Errorf(
+			codes.Internal,
+			"Failed to record publication: err=%v",
+			err)
+	}
+	return nil
+}
+
 var ErrMismatchedFilesystemType = status.Error(
 	codes.InvalidArgument,
 	"The requeed fs_type does not match the existing filesystem on the volume.")
@@ -791,7 +1628,7 @@ func (s *Server) ValidateVolumeCapabilities(
 	request *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
 	id := request.GetVolumeId()
 	log.Printf("Looking up volume with id=%v", id)
-	lv, err := s.volumeGroup.LookupLogicalVolume(id)
+	lv, err := s.lookupLogicalVolume(id)
 	if err != nil {
 		return nil, ErrVolumeNotFound
 	}
@@ -847,14 +1684,121 @@ var tagSafeChars map[rune]struct{} = func() map[rune]struct{} {
 // volumeNameToTag attempts to preserve the suggested volume name as a suffix of the
 // returned string, unless it contains unsafe chars in which case it is encoded.
 func (s *Server) volumeNameToTag(volname string) string {
-	for _, r := range volname {
+	return nameToTag(tagVolumeNamePlainPrefix, tagVolumeNameEncodedPrefix, volname)
+}
+
+// snapshotNameToTag is the snapshot equivalent of volumeNameToTag.
+func (s *Server) snapshotNameToTag(snapname string) string {
+	return nameToTag(tagSnapshotNamePlainPrefix, tagSnapshotNameEncodedPrefix, snapname)
+}
+
+func nameToTag(plainPrefix, encodedPrefix, name string) string {
+	for _, r := range name {
 		if _, ok := tagSafeChars[r]; ok {
 			continue
 		}
-		return tagVolumeNameEncodedPrefix +
-			base64.RawURLEncoding.EncodeToString([]byte(volname))
+		return encodedPrefix +
+			base64.RawURLEncoding.EncodeToString([]byte(name))
+	}
+	return plainPrefix + name
+}
+
+// tagToName is the inverse of nameToTag. It returns false if the tag does
+// not carry either prefix or cannot be decoded.
+func tagToName(plainPrefix, encodedPrefix, tag string) (string, bool) {
+	switch {
+	case strings.HasPrefix(tag, plainPrefix):
+		return strings.TrimPrefix(tag, plainPrefix), true
+	case strings.HasPrefix(tag, encodedPrefix):
+		buf, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(tag, encodedPrefix))
+		if err != nil {
+			return "", false
+		}
+		return string(buf), true
+	}
+	return "", false
+}
+
+// The external-provisioner passes the persistent volume claim and volume
+// names as CreateVolume parameters if it runs with --extra-create-metadata.
+const (
+	paramPVCName      = "csi.storage.k8s.io/pvc/name"
+	paramPVCNamespace = "csi.storage.k8s.io/pvc/namespace"
+	paramPVName       = "csi.storage.k8s.io/pv/name"
+)
+
+const (
+	tagPVCEncodedPrefix = "PVC+" // used when the claim name is not tag-safe
+	tagPVCPlainPrefix   = "PVC." // used when the claim name is tag-safe
+)
+
+// pvcToTag returns the tag recording the persistent volume claim given in
+// the CreateVolume parameters, as "<namespace>/<name>", or "" if the
+// parameters do not name a claim.
+func pvcToTag(params map[string]string) string {
+	name := params[paramPVCName]
+	if name == "" {
+		return ""
+	}
+	if namespace := params[paramPVCNamespace]; namespace != "" {
+		name = namespace + "/" + name
+	}
+	return nameToTag(tagPVCPlainPrefix, tagPVCEncodedPrefix, name)
+}
+
+// pvcFromTags returns the persistent volume claim recorded by pvcToTag, or
+// "" if none was recorded.
+func pvcFromTags(tags []string) string {
+	for _, tag := range tags {
+		if pvc, ok := tagToName(tagPVCPlainPrefix, tagPVCEncodedPrefix, tag); ok {
+			return pvc
+		}
+	}
+	return ""
+}
+
+const (
+	tagSnapshotNameEncodedPrefix = "SN+"  // used when snapshot name is not tag-safe
+	tagSnapshotNamePlainPrefix   = "SN."  // used when snapshot name is tag-safe
+	tagSnapshotSourcePrefix      = "SRC." // records the source volume of a snapshot
+	tagSnapshotSizePrefix        = "SZ."  // records the size of the source volume
+	tagCreationTimePrefix        = "CT."  // records the creation time in ns since the epoch
+)
+
+// snapshotSourceToTag returns the tag recording that a snapshot was taken
+// of the volume with the given LV name. LV names are always tag-safe. A
+// snapshot is always in the volume group of its source, so the volume
+// group is not recorded.
+func snapshotSourceToTag(lvname string) string {
+	return tagSnapshotSourcePrefix + lvname
+}
+
+// snapshotInfo holds the snapshot attributes recorded in LV tags.
+type snapshotInfo struct {
+	sourceVolumeID string
+	sizeBytes      int64
+	creationTime   time.Time
+}
+
+func parseSnapshotTags(tags []string) (info snapshotInfo, ok bool) {
+	for _, tag := range tags {
+		switch {
+		case strings.HasPrefix(tag, tagSnapshotSourcePrefix):
+			info.sourceVolumeID = strings.TrimPrefix(tag, tagSnapshotSourcePrefix)
+			ok = true
+		case strings.HasPrefix(tag, tagSnapshotSizePrefix):
+			size, err := strconv.ParseInt(strings.TrimPrefix(tag, tagSnapshotSizePrefix), 10, 64)
+			if err == nil {
+				info.sizeBytes = size
+			}
+		case strings.HasPrefix(tag, tagCreationTimePrefix):
+			ns, err := strconv.ParseInt(strings.TrimPrefix(tag, tagCreationTimePrefix), 10, 64)
+			if err == nil {
+				info.creationTime = time.Unix(0, ns)
+			}
+		}
 	}
-	return tagVolumeNamePlainPrefix + volname
+	return info, ok
 }
 
 func (s *Server) ListVolumes(
@@ -865,21 +1809,58 @@ func (s *Server) ListVolumes(
 		response := &csi.ListVolumesResponse{}
 		return response, nil
 	}
-	//Error if starting token is offered - Needed to pass csi-sanity ListVolume with invalid start token
-	if request.GetStartingToken() != "" {
-		return nil, status.Errorf(codes.Aborted, "Starting_Token field not implemented.")
+	var volnames []string
+	for _, vg := range s.managedVolumeGroups() {
+		lvnames, err := vg.ListLogicalVolumeNames()
+		if err != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				"Cannot list volume names: err=%v",
+				err)
+		}
+		pools, err := vg.ListThinPools()
+		if err != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				"Cannot list thin pools: err=%v",
+				err)
+		}
+		vdoPools, err := vg.ListVDOPools()
+		if err != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				"Cannot list VDO pools: err=%v",
+				err)
+		}
+		isPool := make(map[string]bool)
+		for _, pool := range pools {
+			isPool[pool.Name] = true
+		}
+		for _, pool := range vdoPools {
+			isPool[pool.Name] = true
+		}
+		for _, lvname := range lvnames {
+			if strings.HasPrefix(lvname, snapPrefix) {
+				// Snapshots are reported by ListSnapshots.
+				continue
+			}
+			if isPool[lvname] || !isVolumeName(lvname) {
+				continue
+			}
+			volnames = append(volnames, s.volumeID(vg.Name(), lvname))
+		}
 	}
-	volnames, err := s.volumeGroup.ListLogicalVolumeNames()
+	volnames, nextToken, err := s.paginate(volnames, request.GetStartingToken(), request.GetMaxEntries())
 	if err != nil {
-		return nil, status.Errorf(
-			codes.Internal,
-			"Cannot list volume names: err=%v",
-			err)
+		return nil, err
 	}
 	var entries []*csi.ListVolumesResponse_Entry
+	// The health of the volumes is reported once per volume group
+	// rather than once per volume.
+	healths := make(map[string]map[string]lvm.Health)
 	for _, volname := range volnames {
 		log.Printf("Looking up volume '%v'", volname)
-		lv, err := s.volumeGroup.LookupLogicalVolume(volname)
+		lv, err := s.lookupLogicalVolume(volname)
 		if err != nil {
 			return nil, ErrVolumeNotFound
 		}
@@ -889,21 +1870,82 @@ func (s *Server) ListVolumes(
 		}
 		info := &csi.Volume{
 			CapacityBytes: int64(lv.SizeInBytes()),
-			VolumeId:      lv.Name(),
+			VolumeId:      volname,
 			VolumeContext: attr,
 		}
+		vghealth, ok := healths[lv.VgName()]
+		if !ok {
+			vghealth, err = s.lookupVolumeGroup(lv.VgName()).ListHealth()
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to get volume condition: err=%v", err)
+			}
+			healths[lv.VgName()] = vghealth
+		}
+		health, ok := vghealth[lv.Name()]
+		if !ok {
+			return nil, ErrVolumeNotFound
+		}
+		condition := conditionFromHealth(health)
+		tags, err := lv.Tags()
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Error in Tags(): err=%v", err)
+		}
 		log.Printf("Found volume %v (%v bytes)", volname, lv.SizeInBytes())
-		entry := &csi.ListVolumesResponse_Entry{Volume: info}
+		entry := &csi.ListVolumesResponse_Entry{
+			Volume: info,
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				PublishedNodeIds: publishedNodeIDs(tags),
+				VolumeCondition:  condition,
+			},
+		}
 		entries = append(entries, entry)
 	}
 	defer s.reportStorageMetrics()
 	response := &csi.ListVolumesResponse{
 		Entries:   entries,
-		NextToken: "",
+		NextToken: nextToken,
 	}
 	return response, nil
 }
 
+var ErrInvalidStartingToken = status.Error(codes.Aborted, "The starting_token is not valid.")
+
+// pageTokenPrefix guards against tokens that were not issued by paginate.
+const pageTokenPrefix = "csilvm.page:"
+
+// paginate sorts names and returns at most maxEntries of them, starting
+// with the first name not before the one encoded in startingToken. A
+// maxEntries of zero means no limit. The returned token encodes the
+// first name of the next page and is empty if there are no more names.
+//
+// As tokens encode a position in the ordering rather than an index,
+// pages remain stable when volumes are created or deleted between calls.
+func (s *Server) paginate(names []string, startingToken string, maxEntries int32) (page []string, nextToken string, err error) {
+	sort.Strings(names)
+	if startingToken != "" {
+		buf, err := base64.RawURLEncoding.DecodeString(startingToken)
+		if err != nil || !strings.HasPrefix(string(buf), pageTokenPrefix) {
+			return nil, "", ErrInvalidStartingToken
+		}
+		start := strings.TrimPrefix(string(buf), pageTokenPrefix)
+		// The IDs of volumes in additional volume groups are
+		// qualified with the volume group name.
+		vgname, lvname := s.splitVolumeID(start)
+		if err := lvm.ValidateVolumeGroupName(vgname); err != nil {
+			return nil, "", ErrInvalidStartingToken
+		}
+		if err := lvm.ValidateLogicalVolumeName(lvname); err != nil {
+			return nil, "", ErrInvalidStartingToken
+		}
+		names = names[sort.SearchStrings(names, start):]
+	}
+	if maxEntries > 0 && len(names) > int(maxEntries) {
+		nextToken = base64.RawURLEncoding.EncodeToString([]byte(pageTokenPrefix + names[maxEntries]))
+		names = names[:maxEntries]
+	}
+	return names, nextToken, nil
+}
+
 func (s *Server) GetCapacity(
 	ctx context.Context,
 	request *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
@@ -930,19 +1972,133 @@ func (s *Server) GetCapacity(
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Invalid volume layout: err=%v", err)
 	}
-	bytesFree, err := s.volumeGroup.BytesFree(layout)
+	if err := resolvePhysicalVolumes(&layout); err != nil {
+		return nil, err
+	}
+	cache, err := takeCacheFromParameters(dupParams(request.GetParameters()))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Invalid cache parameters: err=%v", err)
+	}
+	// Report the capacity of the volume group a new volume with these
+	// parameters would be created in.
+	var topologies []*csi.Topology
+	if topology := request.GetAccessibleTopology(); topology != nil {
+		topologies = append(topologies, topology)
+	}
+	vg, err := s.selectVolumeGroup(request.GetParameters(), nil, layout, cache, topologies)
+	if err == ErrVolumeGroupNotFound || err == ErrTopologyUnreachable {
+		// Zero capacity for volume groups that are not managed or
+		// that the volume would not be accessible from.
+		response := &csi.GetCapacityResponse{AvailableCapacity: 0}
+		return response, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	bytesFree, err := s.bytesFree(vg, layout, cache)
 	if err != nil {
 		return nil, status.Errorf(
 			codes.Internal,
 			"Error in BytesFree: err=%v",
 			err)
 	}
-	log.Printf("BytesFree: %v", bytesFree)
+	log.Printf("BytesFree in %v: %v", vg.Name(), bytesFree)
 	defer s.reportStorageMetrics()
+	if layout.Type == lvm.VolumeTypeVDO {
+		// The available capacity is the physical space a VDO pool
+		// can be allocated from. The largest volume is larger by
+		// the virtual ratio.
+		physicalFree, err := vg.BytesFree(lvm.VolumeLayout{Type: lvm.VolumeTypeLinear})
+		if err != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				"Error in BytesFree: err=%v",
+				err)
+		}
+		response := &csi.GetCapacityResponse{
+			AvailableCapacity: int64(physicalFree),
+			MaximumVolumeSize: wrapperspb.Int64(int64(bytesFree)),
+		}
+		return response, nil
+	}
 	response := &csi.GetCapacityResponse{AvailableCapacity: int64(bytesFree)}
 	return response, nil
 }
 
+// thinCapacity returns the virtual size in bytes that can still be
+// allocated from the thin pool of the layout, allowing for the overcommit
+// ratio. If the pool does not exist yet, the capacity it would have once
+// created is returned.
+func (s *Server) thinCapacity(vg *lvm.VolumeGroup, layout lvm.VolumeLayout) (uint64, error) {
+	pool, err := vg.LookupThinPool(layout.ThinPool)
+	if err == lvm.ErrThinPoolNotFound {
+		if layout.ThinPoolSize == 0 {
+			return 0, nil
+		}
+		bytesFree, err := vg.BytesFree(thinPoolLayout(layout))
+		if err != nil {
+			return 0, err
+		}
+		if bytesFree < layout.ThinPoolSize {
+			return 0, nil
+		}
+		return uint64(float64(layout.ThinPoolSize) * s.thinOvercommitRatio), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	virtual := uint64(float64(pool.SizeInBytes) * s.thinOvercommitRatio)
+	if pool.VirtualSizeInBytes >= virtual {
+		return 0, nil
+	}
+	return virtual - pool.VirtualSizeInBytes, nil
+}
+
+// ensureThinPool creates the thin pool of the layout in the volume group if
+// it does not exist. The pool is allocated using the strategy, if not nil.
+func (s *Server) ensureThinPool(vg *lvm.VolumeGroup, layout lvm.VolumeLayout, strategy lvm.AllocationStrategy) error {
+	_, err := vg.LookupThinPool(layout.ThinPool)
+	if err == nil {
+		return nil
+	}
+	if err != lvm.ErrThinPoolNotFound {
+		return status.Errorf(
+			codes.Internal,
+			"Cannot look up thin pool: err=%v",
+			err)
+	}
+	if layout.ThinPoolSize == 0 {
+		return status.Errorf(
+			codes.InvalidArgument,
+			"The thin pool %v does not exist and the 'thinpoolsize' parameter is not set.",
+			layout.ThinPool)
+	}
+	log.Printf("Creating thin pool %v, size=%v", layout.ThinPool, layout.ThinPoolSize)
+	if _, err := vg.CreateThinPool(layout.ThinPool, layout.ThinPoolSize, thinPoolLayout(layout), strategy); err != nil {
+		if err == lvm.ErrNoSpace {
+			return ErrInsufficientCapacity
+		}
+		if err == lvm.ErrTooFewDisks {
+			return ErrTooFewDisks
+		}
+		if err == lvm.ErrTooFewFailureDomains || err == lvm.ErrFailureDomainsViolated {
+			return failureDomainsError(err)
+		}
+		return status.Errorf(
+			codes.Internal,
+			"Error in CreateThinPool: err=%v",
+			err)
+	}
+	return nil
+}
+
+func thinPoolLayout(layout lvm.VolumeLayout) lvm.VolumeLayout {
+	if layout.ThinPoolLayout == nil {
+		return lvm.VolumeLayout{}
+	}
+	return *layout.ThinPoolLayout
+}
+
 func (s *Server) ControllerGetCapabilities(
 	ctx context.Context,
 	request *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
@@ -984,74 +2140,868 @@ func (s *Server) ControllerGetCapabilities(
 				},
 			},
 		},
-	}
-	response := &csi.ControllerGetCapabilitiesResponse{Capabilities: capabilities}
-	return response, nil
-}
-
-func (s *Server) CreateSnapshot(
-	ctx context.Context,
-	request *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	log.Printf("CreateSnapshot not supported")
-	return nil, ErrCallNotImplemented
-}
-
-func (s *Server) DeleteSnapshot(
-	ctx context.Context,
-	request *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	log.Printf("DeleteSnapshot not supported")
-	return nil, ErrCallNotImplemented
+		// CREATE_DELETE_SNAPSHOT
+		{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+				},
+			},
+		},
+		// LIST_SNAPSHOTS
+		{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+				},
+			},
+		},
+		// CLONE_VOLUME
+		{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+				},
+			},
+		},
+		// EXPAND_VOLUME
+		{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+				},
+			},
+		},
+		// GET_VOLUME
+		{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_GET_VOLUME,
+				},
+			},
+		},
+		// VOLUME_CONDITION
+		{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+				},
+			},
+		},
+		// LIST_VOLUMES_PUBLISHED_NODES
+		{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+				},
+			},
+		},
+		// MODIFY_VOLUME
+		{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
+				},
+			},
+		},
+	}
+	response := &csi.ControllerGetCapabilitiesResponse{Capabilities: capabilities}
+	return response, nil
+}
+
+var ErrSnapshotAlreadyExists = status.Error(codes.AlreadyExists, "A snapshot with that name already exists for a different source volume.")
+
+// CreateSnapshot takes an LVM snapshot of the source volume. Thin volumes
+// get a thin snapshot in the same thin pool. Thick volumes get a
+// copy-on-write snapshot whose exception store is as large as the origin.
+// The snapshot name, source volume, source size and creation time are
+// recorded as tags on the snapshot LV.
+func (s *Server) CreateSnapshot(
+	ctx context.Context,
+	request *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	sourceID := request.GetSourceVolumeId()
+	encodedName := s.snapshotNameToTag(request.GetName())
+	log.Printf("Determining whether snapshot %q with encoded name %v already exists", request.GetName(), encodedName)
+	if snap, err := s.findLogicalVolumeByTag(encodedName); err == nil {
+		log.Printf("Snapshot %s already exists.", encodedName)
+		snapshot, err := s.snapshotFromLogicalVolume(snap)
+		if err != nil {
+			return nil, err
+		}
+		if snapshot.GetSourceVolumeId() != sourceID {
+			return nil, ErrSnapshotAlreadyExists
+		}
+		return &csi.CreateSnapshotResponse{Snapshot: snapshot}, nil
+	}
+	log.Printf("Looking up source volume with id=%v", sourceID)
+	source, err := s.lookupLogicalVolume(sourceID)
+	if err != nil {
+		return nil, ErrVolumeNotFound
+	}
+	// A snapshot is always created in the volume group of its source.
+	snapname := s.allocateLogicalVolumeName(s.lookupVolumeGroup(source.VgName()), snapPrefix, request.GetName())
+	if snapname == "" {
+		return nil, status.Error(codes.Internal, "Failed to allocate snapshot ID")
+	}
+	snapshotID := s.volumeID(source.VgName(), snapname)
+	tags := make([]string, len(s.tags), len(s.tags)+4)
+	copy(tags, s.tags)
+	tags = append(tags,
+		encodedName,
+		snapshotSourceToTag(source.Name()),
+		tagSnapshotSizePrefix+strconv.FormatUint(source.SizeInBytes(), 10),
+		tagCreationTimePrefix+strconv.FormatInt(time.Now().UnixNano(), 10),
+	)
+	cryptTags, err := encryptionTags(source)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot determine whether the volume is encrypted: err=%v", err)
+	}
+	tags = append(tags, cryptTags...)
+	log.Printf("Creating snapshot id=%v of volume %v, tags=%v", snapshotID, sourceID, tags)
+	snap, err := source.CreateSnapshot(snapname, 0, tags)
+	if err != nil {
+		if err == lvm.ErrNoSpace {
+			return nil, ErrInsufficientCapacity
+		}
+		return nil, status.Errorf(
+			codes.Internal,
+			"Error in CreateSnapshot: err=%v",
+			err)
+	}
+	snapshot, err := s.snapshotFromLogicalVolume(snap)
+	if err != nil {
+		return nil, err
+	}
+	defer s.reportStorageMetrics()
+	return &csi.CreateSnapshotResponse{Snapshot: snapshot}, nil
+}
+
+// snapshotFromLogicalVolume builds the CSI representation of a snapshot LV
+// from the tags recorded on it by CreateSnapshot.
+func (s *Server) snapshotFromLogicalVolume(lv *lvm.LogicalVolume) (*csi.Snapshot, error) {
+	tags, err := lv.Tags()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get snapshot tags: err=%v", err)
+	}
+	info, ok := parseSnapshotTags(tags)
+	if !ok {
+		return nil, status.Errorf(codes.Internal, "volume %v is not a snapshot", lv.Name())
+	}
+	size := info.sizeBytes
+	if size == 0 {
+		size = int64(lv.SizeInBytes())
+	}
+	return &csi.Snapshot{
+		SizeBytes:      size,
+		SnapshotId:     s.volumeID(lv.VgName(), lv.Name()),
+		SourceVolumeId: s.volumeID(lv.VgName(), info.sourceVolumeID),
+		CreationTime:   timestamppb.New(info.creationTime),
+		ReadyToUse:     true,
+	}, nil
+}
+
+func (s *Server) DeleteSnapshot(
+	ctx context.Context,
+	request *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	id := request.GetSnapshotId()
+	log.Printf("Looking up snapshot with id=%v", id)
+	if !s.isSnapshotID(id) {
+		// Not one of our snapshots, so it cannot exist.
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+	snap, err := s.lookupLogicalVolume(id)
+	if err != nil {
+		// It is idempotent to succeed if a snapshot is not found.
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+	log.Printf("Removing snapshot")
+	if err := snap.Remove(); err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			"Failed to remove snapshot: err=%v",
+			err)
+	}
+	defer s.reportStorageMetrics()
+	return &csi.DeleteSnapshotResponse{}, nil
 }
 
 func (s *Server) ListSnapshots(
 	ctx context.Context,
 	request *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	log.Printf("ListSnapshots not supported")
-	return nil, ErrCallNotImplemented
+	if s.removingVolumeGroup {
+		log.Printf("Running with '-remove-volume-group', reporting no snapshots")
+		return &csi.ListSnapshotsResponse{}, nil
+	}
+	vgs := s.managedVolumeGroups()
+	match := lvm.LVMatchTagPrefix(tagSnapshotSourcePrefix)
+	if sourceID := request.GetSourceVolumeId(); sourceID != "" {
+		// Snapshots are in the volume group of their source.
+		vgname, lvname := s.splitVolumeID(sourceID)
+		vgs = nil
+		if vg := s.lookupVolumeGroup(vgname); vg != nil {
+			vgs = append(vgs, vg)
+		}
+		match = lvm.LVMatchTag(snapshotSourceToTag(lvname))
+	}
+	byName := make(map[string]*lvm.LogicalVolume)
+	var names []string
+	for _, vg := range vgs {
+		snaps, err := vg.FindLogicalVolumes(match)
+		if err != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				"Cannot list snapshots: err=%v",
+				err)
+		}
+		for _, snap := range snaps {
+			snapshotID := s.volumeID(vg.Name(), snap.Name())
+			if id := request.GetSnapshotId(); id != "" && snapshotID != id {
+				continue
+			}
+			byName[snapshotID] = snap
+			names = append(names, snapshotID)
+		}
+	}
+	names, nextToken, err := s.paginate(names, request.GetStartingToken(), request.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+	var entries []*csi.ListSnapshotsResponse_Entry
+	for _, name := range names {
+		snapshot, err := s.snapshotFromLogicalVolume(byName[name])
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{Snapshot: snapshot})
+	}
+	return &csi.ListSnapshotsResponse{Entries: entries, NextToken: nextToken}, nil
 }
 
 func (s *Server) ControllerExpandVolume(
 	ctx context.Context,
 	request *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	log.Printf("ControllerExpandVolume not supported")
-	return nil, ErrCallNotImplemented
+	id := request.GetVolumeId()
+	log.Printf("Looking up volume with id=%v", id)
+	if s.isSnapshotID(id) {
+		return nil, ErrVolumeNotFound
+	}
+	lv, err := s.lookupLogicalVolume(id)
+	if err != nil {
+		return nil, ErrVolumeNotFound
+	}
+	vg := s.lookupVolumeGroup(lv.VgName())
+	// The filesystem, the LV on other hosts of a shared volume group
+	// and iSCSI sessions all have to be refreshed on the node.
+	response := &csi.ControllerExpandVolumeResponse{NodeExpansionRequired: true}
+	capacityRange := request.GetCapacityRange()
+	size := uint64(capacityRange.GetRequiredBytes())
+	extentSize, err := vg.ExtentSize()
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			"Error in ExtentSize: err=%v",
+			err)
+	}
+	// If size is not already a multiple of extentSize, round it up to the
+	// nearest extentSize.
+	if size%extentSize != 0 {
+		sizeBefore := size
+		size = ((size + extentSize) / extentSize) * extentSize
+		log.Printf("Rounding size up from required_bytes (about %dMiB) to nearest extent size (%dMiB) to get (%dMiB)", sizeBefore>>20, extentSize>>20, size>>20)
+	}
+	if size <= lv.SizeInBytes() {
+		// Logical volumes are never shrunk. The volume is already
+		// large enough, to support idempotency we respond with success.
+		log.Printf("Volume %v is already %d bytes", id, lv.SizeInBytes())
+		response.CapacityBytes = int64(lv.SizeInBytes())
+		return response, nil
+	}
+	if limit := capacityRange.GetLimitBytes(); limit != 0 && size > uint64(limit) {
+		return nil, ErrNotMultipleOfExtentSize(extentSize)
+	}
+	thin, err := lv.IsThin()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot determine volume type: err=%v", err)
+	}
+	layout, err := lv.Layout()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot determine volume layout: err=%v", err)
+	}
+	if thin {
+		// The thin pool and the overcommit ratio limit the growth of
+		// a thin volume as they limit new thin volumes.
+		available, err := s.thinCapacity(vg, layout)
+		if err != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				"Cannot determine thin pool capacity: err=%v",
+				err)
+		}
+		log.Printf("Thin pool %v capacity: %v (%dMiB)", layout.ThinPool, available, available>>20)
+		if available < size-lv.SizeInBytes() {
+			return nil, ErrInsufficientCapacity
+		}
+	} else {
+		// The volume is extended within the physical volumes and
+		// failure domains it was created in.
+		if err := vg.CheckFailureDomains(layout); err != nil {
+			return nil, failureDomainsError(err)
+		}
+		// Get bytesFree, it is a multiple of extentSize.
+		bytesFree, err := vg.BytesFree(layout)
+		if err != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				"Error in BytesFree: err=%v",
+				err)
+		}
+		log.Printf("BytesFree: %v (%dMiB)", bytesFree, bytesFree>>20)
+		if bytesFree < size-lv.SizeInBytes() {
+			return nil, ErrInsufficientCapacity
+		}
+	}
+	log.Printf("Extending volume id=%v from %v to %v", id, lv.SizeInBytes(), size)
+	if err := lv.Extend(size); err != nil {
+		if err == lvm.ErrNoSpace {
+			return nil, ErrInsufficientCapacity
+		}
+		if err == lvm.ErrTooFewDisks || err == lvm.ErrTooFewFailureDomains {
+			return nil, failureDomainsError(err)
+		}
+		return nil, status.Errorf(
+			codes.Internal,
+			"Error in Extend: err=%v",
+			err)
+	}
+	defer s.reportStorageMetrics()
+	response.CapacityBytes = int64(lv.SizeInBytes())
+	return response, nil
+}
+
+var ErrCacheModeNotModifiable = status.Error(
+	codes.InvalidArgument,
+	"The 'cache' parameter of a volume can only be changed between 'writethrough' and 'writeback'.")
+
+// isMutableParameter returns whether the parameter can be changed by
+// ControllerModifyVolume.
+func isMutableParameter(key string) bool {
+	for _, mutable := range qosParameters {
+		if key == mutable {
+			return true
+		}
+	}
+	return key == "cache" || key == "rotatekey"
+}
+
+// immutableParametersError returns the error for the CreateVolume
+// parameters that ControllerModifyVolume cannot change.
+func immutableParametersError(params map[string]string) error {
+	var keys []string
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return status.Errorf(
+		codes.InvalidArgument,
+		"The %v parameters cannot be changed on an existing volume, only the QoS parameters %v, 'cache' and 'rotatekey' can.",
+		keys, qosParameters)
+}
+
+// ControllerModifyVolume changes the QoS limits and the cache mode of a
+// volume and rotates its data key. The QoS limits are recorded in the QoS
+// record of the volume and applied by the nodes the volume is attached to,
+// see RegulateQos. A QoS parameter set to "0" removes the limit. The
+// request is rejected without changing the volume if any parameter cannot
+// be changed.
+func (s *Server) ControllerModifyVolume(
+	ctx context.Context,
+	request *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
+	id := request.GetVolumeId()
+	log.Printf("Looking up volume with id=%v", id)
+	if s.isSnapshotID(id) {
+		return nil, ErrVolumeNotFound
+	}
+	lv, err := s.lookupLogicalVolume(id)
+	if err != nil {
+		return nil, ErrVolumeNotFound
+	}
+	params := dupParams(request.GetMutableParameters())
+	tags, err := lv.Tags()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Error in Tags(): err=%v", err)
+	}
+	current, _ := parseQosTag(tags)
+	qos, err := modifyQos(current, params)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid parameters: %v", err)
+	}
+	mode, modifyCache := params["cache"]
+	delete(params, "cache")
+	keyGeneration, err := rotateKeyFromParameters(params)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid parameters: %v", err)
+	}
+	if len(params) > 0 {
+		return nil, immutableParametersError(params)
+	}
+	var cacheMode lvm.CacheMode
+	if modifyCache {
+		cacheMode, err = lv.CacheMode()
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Cannot determine cache mode: err=%v", err)
+		}
+		modifyCache = mode != cacheMode.String()
+		switchable := func(mode string) bool {
+			return mode == lvm.CacheModeWritethrough.String() || mode == lvm.CacheModeWriteback.String()
+		}
+		if modifyCache && !(switchable(mode) && switchable(cacheMode.String())) {
+			return nil, ErrCacheModeNotModifiable
+		}
+	}
+	// A pending rotation is harmless if a later step fails and rotating
+	// for the same generation again does nothing, so the key is rotated
+	// first.
+	if keyGeneration != "" {
+		if err := s.rotateVolumeKey(ctx, lv, keyGeneration); err != nil {
+			return nil, err
+		}
+	}
+	if modifyCache {
+		log.Printf("Switching volume %v from cache mode %v to %v", id, cacheMode, mode)
+		newMode := lvm.CacheModeWritethrough
+		if mode == lvm.CacheModeWriteback.String() {
+			newMode = lvm.CacheModeWriteback
+		}
+		if err := lv.SetCacheMode(newMode); err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to switch cache mode: err=%v", err)
+		}
+	}
+	if qos != current {
+		log.Printf("Changing the QoS of volume %v from %+v to %+v", id, current, qos)
+		if err := recordQos(lv, qos); err != nil {
+			// Leave the volume as it was.
+			if modifyCache {
+				log.Printf("Switching volume %v back to cache mode %v", id, cacheMode)
+				if err := lv.SetCacheMode(cacheMode); err != nil {
+					log.Printf("Failed to switch volume %v back to cache mode %v: err=%v", id, cacheMode, err)
+				}
+			}
+			return nil, status.Errorf(codes.Internal, "Failed to record QoS: err=%v", err)
+		}
+		// Apply the limits at once if the volume is attached to
+		// this node.
+		s.refreshQos(id)
+	}
+	return &csi.ControllerModifyVolumeResponse{}, nil
 }
 
 func (s *Server) ControllerGetVolume(
 	ctx context.Context,
 	request *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	log.Printf("ControllerGetVolume not supported")
-	return nil, ErrCallNotImplemented
+	id := request.GetVolumeId()
+	log.Printf("Looking up volume with id=%v", id)
+	if s.isSnapshotID(id) {
+		return nil, ErrVolumeNotFound
+	}
+	lv, err := s.lookupLogicalVolume(id)
+	if err != nil {
+		return nil, ErrVolumeNotFound
+	}
+	attr, err := s.volumeAttributes(lv)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get volume attributes: err=%v", err)
+	}
+	condition, err := volumeCondition(lv)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get volume condition: err=%v", err)
+	}
+	tags, err := lv.Tags()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Error in Tags(): err=%v", err)
+	}
+	response := &csi.ControllerGetVolumeResponse{
+		Volume: &csi.Volume{
+			CapacityBytes: int64(lv.SizeInBytes()),
+			VolumeId:      id,
+			VolumeContext: attr,
+		},
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			PublishedNodeIds: publishedNodeIDs(tags),
+			VolumeCondition:  condition,
+		},
+	}
+	return response, nil
+}
+
+// volumeCondition reports the RAID health of the logical volume. The
+// volume is abnormal if it has lost redundancy, is rebuilding or has
+// inconsistent copies of its data.
+func volumeCondition(lv *lvm.LogicalVolume) (*csi.VolumeCondition, error) {
+	health, err := lv.Health()
+	if err != nil {
+		return nil, err
+	}
+	return conditionFromHealth(health), nil
+}
+
+func conditionFromHealth(health lvm.Health) *csi.VolumeCondition {
+	switch health.Status {
+	case "":
+	case "partial":
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  "The volume is degraded: one or more of its physical volumes are missing.",
+		}
+	case "refresh needed":
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  "The volume is degraded: one of its devices failed and must be refreshed or replaced.",
+		}
+	case "mismatches exist":
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("The volume has %d inconsistent regions and should be repaired.", health.MismatchCount),
+		}
+	default:
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("The volume health is %q.", health.Status),
+		}
+	}
+	if health.IntegrityMismatches > 0 {
+		// dm-integrity repairs corrupt blocks from the other
+		// images but the corruption points at a failing device.
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("The volume detected %d corrupt blocks on its physical volumes.", health.IntegrityMismatches),
+		}
+	}
+	if health.SyncPercent < 100 {
+		// A recovery means a device was replaced and the volume
+		// has no redundancy until it completes. An initial
+		// resync of a new volume is expected.
+		return &csi.VolumeCondition{
+			Abnormal: health.SyncAction == "recover",
+			Message:  fmt.Sprintf("The volume is synchronizing (%s): %.2f%% complete.", health.SyncAction, health.SyncPercent),
+		}
+	}
+	return &csi.VolumeCondition{Abnormal: false, Message: "The volume is healthy."}
 }
 
 // NodeService RPCs
 
+// stagedDeviceName is the name of the symlink to the device of a staged
+// block volume in its staging path.
+const stagedDeviceName = "device"
+
 func (s *Server) NodeStageVolume(
 	ctx context.Context,
 	request *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	log.Printf("NodeStageVolume not supported")
-	return nil, ErrCallNotImplemented
+	id := request.GetVolumeId()
+	stagingPath := request.GetStagingTargetPath()
+	pubcontext := request.GetPublishContext()
+	sourcePath, err := s.attachVolume(ctx, id, pubcontext, request.GetVolumeContext(), request.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	const staged = true
+	if err := s.applyQos(id, sourcePath, staged, pubcontext, request.GetVolumeContext()); err != nil {
+		return nil, err
+	}
+	log.Printf("Staging volume %v from %v at %v", id, sourcePath, stagingPath)
+	switch accessType := request.GetVolumeCapability().GetAccessType().(type) {
+	case *csi.VolumeCapability_Block:
+		// There is no filesystem to mount. The device is recorded
+		// for NodePublishVolume to bind mount it.
+		if err := stageBlockDevice(sourcePath, stagingPath); err != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				"Failed to stage block volume: err=%v",
+				err)
+		}
+	case *csi.VolumeCapability_Mount:
+		fstype := request.GetVolumeCapability().GetMount().GetFsType()
+		mountOptions := request.GetVolumeCapability().GetMount().GetMountFlags()
+		mountGroup := request.GetVolumeCapability().GetMount().GetVolumeMountGroup()
+		allusers := strings.ToLower(pubcontext["allusers"]) == "true"
+		// The filesystem is staged read-write, readonly publications
+		// are remounted readonly.
+		const readonly = false
+		if err := s.nodePublishVolume_Mount(sourcePath, stagingPath, readonly, fstype, mountOptions, mountGroup, allusers); err != nil {
+			return nil, err
+		}
+	default:
+		panic(fmt.Sprintf("lvm: unknown access_type: %+v", accessType))
+	}
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// stageBlockDevice records the device of a block volume in its staging
+// path.
+func stageBlockDevice(sourcePath, stagingPath string) error {
+	devicePath := filepath.Join(stagingPath, stagedDeviceName)
+	if existing, err := os.Readlink(devicePath); err == nil {
+		if existing == sourcePath {
+			return nil
+		}
+		if err := os.Remove(devicePath); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(stagingPath, 0750); err != nil {
+		return err
+	}
+	return os.Symlink(sourcePath, devicePath)
 }
 
 func (s *Server) NodeUnstageVolume(
 	ctx context.Context,
 	request *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	log.Printf("NodeUnstageVolume not supported")
-	return nil, ErrCallNotImplemented
+	id := request.GetVolumeId()
+	stagingPath := request.GetStagingTargetPath()
+	response := &csi.NodeUnstageVolumeResponse{}
+	devicePath := filepath.Join(stagingPath, stagedDeviceName)
+	if sourcePath, err := os.Readlink(devicePath); err == nil {
+		log.Printf("Unstaging block volume %v on %v", id, sourcePath)
+		if err := s.detachBlockVolume(id, sourcePath); err != nil {
+			return nil, err
+		}
+		if err := os.Remove(devicePath); err != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				"Cannot remove %v: err=%v",
+				devicePath, err)
+		}
+		return response, nil
+	}
+	mp, err := getMountAt(stagingPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot get mount info at %v: err=%v", stagingPath, err)
+	}
+	if mp == nil {
+		// To support idempotency we respond with success.
+		log.Printf("Volume %v is not staged at %v", id, stagingPath)
+		return response, nil
+	}
+	shared, err := isSharedMount(mp)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot list mounts: err=%v", err)
+	}
+	if shared {
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			"The volume %v is still published",
+			id)
+	}
+	log.Printf("Unstaging volume %v from %v", id, stagingPath)
+	if err := s.unmountVolume(id, stagingPath, mp); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// detachBlockVolume releases the device of a staged block volume, see
+// unmountVolume.
+func (s *Server) detachBlockVolume(id, sourcePath string) error {
+	s.clearQos(id, sourcePath)
+	if isCryptMapperPath(sourcePath) {
+		if err := closeEncrypted(s.cryptMappingName(id)); err != nil {
+			return status.Errorf(codes.Internal, "Failed to close encrypted volume: err=%v", err)
+		}
+	}
+	// The volume is only found if it is attached directly.
+	if lv, err := s.lookupLogicalVolume(id); err == nil {
+		if err := lv.Deactivate(); err != nil {
+			log.Printf("Failed to de-activate volume: err=%v", err)
+		}
+		return nil
+	}
+	if blockpath := getBlockPath(sourcePath); dataPathType(blockpath) == "iscsi" {
+		logoutIscsiBlockPath(blockpath)
+	}
+	return nil
+}
+
+// isSharedMount returns true if the device mounted at mp is mounted at
+// another path too, e.g., the staging path of a volume that is published
+// or the target path of another pod on this node.
+func isSharedMount(mp *mountpoint) (bool, error) {
+	mounts, err := listMounts()
+	if err != nil {
+		return false, err
+	}
+	for _, other := range mounts {
+		if other.mountsource == mp.mountsource && other.path != mp.path {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
 func (s *Server) NodeExpandVolume(
 	ctx context.Context,
 	request *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	log.Printf("NodeExpandVolume not supported")
-	return nil, ErrCallNotImplemented
+	id := request.GetVolumeId()
+	response := &csi.NodeExpandVolumeResponse{}
+	log.Printf("Looking up volume with id=%v", id)
+	if lv, err := s.lookupLogicalVolume(id); err == nil {
+		// The LV may have been extended by another host while it
+		// was active on this one.
+		log.Printf("Refreshing volume %v", id)
+		if err := lv.Refresh(); err != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				"Failed to refresh volume: err=%v",
+				err)
+		}
+		response.CapacityBytes = int64(lv.SizeInBytes())
+	} else {
+		// The volume group is not visible on this node, the volume
+		// is attached through an iSCSI target and the initiator
+		// must pick up the new size.
+		log.Printf("Volume %v not found, rescanning iSCSI sessions", id)
+		if _, err := runOnNode("iscsiadm", "-m", "session", "--rescan"); err != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				"Failed to rescan iSCSI sessions: err=%v",
+				err)
+		}
+	}
+	if request.GetVolumeCapability().GetBlock() != nil {
+		// There is no filesystem to grow.
+		return response, nil
+	}
+	volumePath := request.GetVolumePath()
+	log.Printf("Determining mount info at %v", volumePath)
+	mp, err := getMountAt(volumePath)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			"Cannot get mount info at %v: err=%v",
+			volumePath, err)
+	}
+	if mp == nil {
+		return nil, status.Errorf(
+			codes.NotFound,
+			"Nothing is mounted at %v",
+			volumePath)
+	}
+	devicePath := mp.mountsource
+	if isCryptMapperPath(devicePath) {
+		// The dm-crypt mapping must grow before the filesystem.
+		name := strings.TrimPrefix(devicePath, cryptMapperDir)
+		key, err := s.encryptionKey(ctx, request.GetVolumeId(), request.GetSecrets())
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Resizing encrypted volume %v", name)
+		if err := resizeEncrypted(name, key); err != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				"Failed to resize encrypted volume: err=%v",
+				err)
+		}
+	}
+	log.Printf("Growing %v filesystem on %v mounted at %v", mp.fstype, devicePath, volumePath)
+	if err := growFilesystem(mp.fstype, devicePath, volumePath); err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			"Failed to grow filesystem: err=%v",
+			err)
+	}
+	return response, nil
+}
+
+// growFilesystem grows the filesystem on devicePath, mounted at mountPath,
+// to fill the device.
+func growFilesystem(fstype, devicePath, mountPath string) error {
+	switch fstype {
+	case "xfs":
+		// xfs can only be grown while it is mounted.
+		_, err := runOnNode("xfs_growfs", mountPath)
+		return err
+	case "ext2", "ext3", "ext4":
+		_, err := runOnNode("resize2fs", devicePath)
+		return err
+	default:
+		return fmt.Errorf("cannot grow %v filesystem", fstype)
+	}
+}
+
+// runOnNode runs cmd on the node, through the StoLake agent in proxy mode.
+func runOnNode(cmd string, args ...string) ([]byte, error) {
+	if virsh.ProxyMode() {
+		return virsh.ProxyStoLakeRun(cmd, args...)
+	}
+	output, err := exec.Command(cmd, args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%v failed: err=%v: %s", cmd, err, output)
+	}
+	return output, nil
 }
 
 func (s *Server) NodeGetVolumeStats(
 	ctx context.Context,
 	request *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	log.Printf("NodeGetVolumeStats not supported")
-	return nil, ErrCallNotImplemented
+	id := request.GetVolumeId()
+	volumePath := request.GetVolumePath()
+	block, err := isBlockDevice(volumePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(
+				codes.NotFound,
+				"The volume path %v does not exist",
+				volumePath)
+		}
+		return nil, status.Errorf(
+			codes.Internal,
+			"Cannot stat %v: err=%v",
+			volumePath, err)
+	}
+	response := &csi.NodeGetVolumeStatsResponse{}
+	devicePath := volumePath
+	if block {
+		size, err := blockDeviceSize(volumePath)
+		if err != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				"Cannot determine the size of %v: err=%v",
+				volumePath, err)
+		}
+		response.Usage = []*csi.VolumeUsage{{
+			Unit:  csi.VolumeUsage_BYTES,
+			Total: int64(size),
+		}}
+	} else {
+		mp, err := getMountAt(volumePath)
+		if err != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				"Cannot get mount info at %v: err=%v",
+				volumePath, err)
+		}
+		if mp == nil {
+			response.VolumeCondition = &csi.VolumeCondition{
+				Abnormal: true,
+				Message:  fmt.Sprintf("Nothing is mounted at %v.", volumePath),
+			}
+			return response, nil
+		}
+		devicePath = mp.mountsource
+		stats, err := statfs(volumePath)
+		if err != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				"Cannot statfs %v: err=%v",
+				volumePath, err)
+		}
+		response.Usage = stats.usage()
+	}
+	response.VolumeCondition, err = s.nodeVolumeCondition(id, devicePath)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
 }
 
 var ErrTargetPathNotEmpty = status.Error(
@@ -1066,20 +3016,20 @@ var ErrTargetPathRW = status.Error(
 	codes.InvalidArgument,
 	"The targetPath is already mounted read-write.")
 
-func (s *Server) NodePublishVolume(
-	ctx context.Context,
-	request *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
-	pubcontext := request.GetPublishContext()
+// attachVolume makes the volume available on this node as described by the
+// publish context, i.e., it logs into its iSCSI targets or activates it,
+// and opens it if it is encrypted. It returns the path of the device.
+func (s *Server) attachVolume(ctx context.Context, id string, pubcontext, volumeContext, secrets map[string]string) (string, error) {
 	sourcePath := ""
 	if _, ok := pubcontext["datapath"]; !ok {
-		return nil, status.Errorf(codes.Internal,"Missing 'datapath' in PubContxt: %v", pubcontext)
+		return "", status.Errorf(codes.Internal, "Missing 'datapath' in PubContxt: %v", pubcontext)
 	}
 
 	if pubcontext["datapath"] == "jbofis" {
 		log.Printf("Logging into iSCSI Targets")
 		targetlist, ok := pubcontext["targetlist"]
 		if !ok {
-			return nil, status.Errorf(codes.Internal,"Missing targetlist in PubContxt: %v", pubcontext)
+			return "", status.Errorf(codes.Internal, "Missing targetlist in PubContxt: %v", pubcontext)
 		}
 		targets := strings.Split(targetlist, ",")
 		for _, target := range targets {
@@ -1089,34 +3039,34 @@ func (s *Server) NodePublishVolume(
 				blkdev, err := virsh.LoginIscsiTarget(chnks[0], chnks[2])
 				if err != nil {
 					//FIXME:  Need to clean up prior successful target setups
-					return nil, status.Errorf(codes.Internal,"ISCSI Login Failes %v :: %v", chnks,err)
+					return "", status.Errorf(codes.Internal, "ISCSI Login Failes %v :: %v", chnks, err)
 				}
-				log.Printf("Volume path for %s is %v",chnks[0], blkdev)
+				log.Printf("Volume path for %s is %v", chnks[0], blkdev)
 			}
 		}
-		err := virsh.VgActivate(s.vgname)
+		vgname, _ := s.splitVolumeID(id)
+		err := virsh.VgActivate(vgname)
 		if err != nil {
-			return nil, status.Errorf(codes.Internal,"FAILED to Find VG %s after ISCSI Login :: %v", s.vgname,err)
+			return "", status.Errorf(codes.Internal, "FAILED to Find VG %s after ISCSI Login :: %v", vgname, err)
 		}
 	}
 
-	id := request.GetVolumeId()
 	if pubcontext["datapath"] == "direct" || pubcontext["datapath"] == "jbofis" {
 		log.Printf("Looking up volume with id=%v", id)
-		lv, err := s.volumeGroup.LookupLogicalVolume(id)
+		lv, err := s.lookupLogicalVolume(id)
 		if err != nil {
-			return nil, ErrVolumeNotFound
+			return "", ErrVolumeNotFound
 		}
 		log.Printf("Determining volume path")
 		sourcePath, err = lv.Path()
 		if err != nil {
-			return nil, status.Errorf(
+			return "", status.Errorf(
 				codes.Internal,
 				"Error in Path(): err=%v",
 				err)
 		}
 		if err := lv.Activate(); err != nil {
-			return nil, status.Errorf(
+			return "", status.Errorf(
 				codes.Internal,
 				"Failed to activate volume: err=%v",
 				err)
@@ -1125,7 +3075,7 @@ func (s *Server) NodePublishVolume(
 	if pubcontext["datapath"] == "iscsi" {
 		targetiqn, ok := pubcontext["blockid"]
 		if !ok {
-			return nil, status.Errorf(codes.Internal,"Missing 'blockid' in PubContxt: %v", pubcontext)
+			return "", status.Errorf(codes.Internal, "Missing 'blockid' in PubContxt: %v", pubcontext)
 		}
 		//FIXME - Assuming always Lun0 for now
 		//lunstr, ok2 := pubcontext["lun"]
@@ -1138,17 +3088,57 @@ func (s *Server) NodePublishVolume(
 		//}
 		portal, ok3 := pubcontext["portal"]
 		if !ok3 {
-			return nil, status.Errorf(codes.Internal,"Missing 'portal' in PubContxt: %v", pubcontext)
+			return "", status.Errorf(codes.Internal, "Missing 'portal' in PubContxt: %v", pubcontext)
 		}
 
 		// Setup iscsi initiator
 		blkdev, err := virsh.LoginIscsiTarget(targetiqn, portal)
 		if err != nil {
-			return nil, status.Errorf(codes.Internal,"ISCSI Login Failes %v :: %v", pubcontext,err)
+			return "", status.Errorf(codes.Internal, "ISCSI Login Failes %v :: %v", pubcontext, err)
 		}
 		sourcePath = blkdev
 	}
-
+	if volumeContext[attrEncrypted] == "true" {
+		key, err := s.encryptionKey(ctx, id, secrets)
+		if err != nil {
+			return "", err
+		}
+		if key == "" {
+			return "", ErrMissingEncryptionKey
+		}
+		devicePath := sourcePath
+		sourcePath, err = openEncrypted(devicePath, s.cryptMappingName(id), key)
+		if err != nil {
+			return "", err
+		}
+		// A failed rotation is retried when the volume is next opened.
+		if err := s.completeKeyRotation(ctx, id, devicePath); err != nil {
+			log.Printf("Failed to rotate the data key of volume %v: err=%v", id, err)
+		}
+	}
+	return sourcePath, nil
+}
+func (s *Server) NodePublishVolume(
+	ctx context.Context,
+	request *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	pubcontext := request.GetPublishContext()
+	id := request.GetVolumeId()
+	if request.GetStagingTargetPath() != "" {
+		// The volume was attached and mounted once by NodeStageVolume.
+		// Its QoS limits were applied by NodeStageVolume.
+		if err := s.publishStagedVolume(request); err != nil {
+			return nil, err
+		}
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+	sourcePath, err := s.attachVolume(ctx, id, pubcontext, request.GetVolumeContext(), request.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	const staged = false
+	if err := s.applyQos(id, sourcePath, staged, pubcontext, request.GetVolumeContext()); err != nil {
+		return nil, err
+	}
 
 	log.Printf("Volume path is %v", sourcePath)
 	targetPath := request.GetTargetPath()
@@ -1164,38 +3154,148 @@ func (s *Server) NodePublishVolume(
 		if virsh.ProxyMode() {
 			return &csi.NodePublishVolumeResponse{}, virsh.MountVolume(sourcePath, targetPath, "block", mountGroup, "", readonly, allusers )
 		}
-		if err := s.nodePublishVolume_Block(sourcePath, targetPath, readonly); err != nil {
-			return nil, err
+		if err := s.nodePublishVolume_Block(sourcePath, targetPath, readonly); err != nil {
+			return nil, err
+		}
+	case *csi.VolumeCapability_Mount:
+		fstype := request.GetVolumeCapability().GetMount().GetFsType()
+		mountOptions := request.GetVolumeCapability().GetMount().GetMountFlags()
+		mountOptionsStr := strings.Join(mountOptions, ",")
+		if virsh.ProxyMode() {
+			return &csi.NodePublishVolumeResponse{}, virsh.MountVolume(sourcePath, targetPath, fstype, mountGroup, mountOptionsStr, readonly, allusers )
+		}
+		if err := s.nodePublishVolume_Mount(sourcePath, targetPath, readonly, fstype, mountOptions, mountGroup, allusers); err != nil {
+			return nil, err
+		}
+	default:
+		panic(fmt.Sprintf("lvm: unknown access_type: %+v", accessType))
+	}
+
+	response := &csi.NodePublishVolumeResponse{}
+	return response, nil
+}
+
+// publishStagedVolume publishes a volume staged by NodeStageVolume. A block
+// volume is bind mounted from its device, a filesystem from the staging
+// path.
+func (s *Server) publishStagedVolume(request *csi.NodePublishVolumeRequest) error {
+	stagingPath := request.GetStagingTargetPath()
+	targetPath := request.GetTargetPath()
+	readonly := request.GetVolumeCapability().GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY
+	readonly = readonly || request.GetReadonly()
+	log.Printf("Publishing volume %v staged at %v to %v, readonly: %v", request.GetVolumeId(), stagingPath, targetPath, readonly)
+	switch accessType := request.GetVolumeCapability().GetAccessType().(type) {
+	case *csi.VolumeCapability_Block:
+		sourcePath, err := os.Readlink(filepath.Join(stagingPath, stagedDeviceName))
+		if err != nil {
+			return status.Errorf(
+				codes.FailedPrecondition,
+				"The volume is not staged at %v: err=%v",
+				stagingPath, err)
+		}
+		if virsh.ProxyMode() {
+			allusers := strings.ToLower(request.GetPublishContext()["allusers"]) == "true"
+			return virsh.MountVolume(sourcePath, targetPath, "block", "", "", readonly, allusers)
+		}
+		return s.nodePublishVolume_Block(sourcePath, targetPath, readonly)
+	case *csi.VolumeCapability_Mount:
+		return bindMountStaged(stagingPath, targetPath, readonly)
+	default:
+		panic(fmt.Sprintf("lvm: unknown access_type: %+v", accessType))
+	}
+}
+
+// bindMountStaged bind mounts the filesystem mounted at stagingPath to
+// targetPath.
+func bindMountStaged(stagingPath, targetPath string, readonly bool) error {
+	staged, err := getMountAt(stagingPath)
+	if err != nil {
+		return status.Errorf(
+			codes.Internal,
+			"Cannot get mount info at %v: err=%v",
+			stagingPath, err)
+	}
+	if staged == nil {
+		return status.Errorf(
+			codes.FailedPrecondition,
+			"The volume is not staged at %v",
+			stagingPath)
+	}
+	mp, err := getMountAt(targetPath)
+	if err != nil {
+		return status.Errorf(
+			codes.Internal,
+			"Cannot get mount info at %v: err=%v",
+			targetPath, err)
+	}
+	if mp != nil {
+		if mp.mountsource != staged.mountsource {
+			return ErrTargetPathNotEmpty
+		}
+		if mp.isReadonly() != readonly {
+			if mp.isReadonly() {
+				return ErrTargetPathRO
+			}
+			return ErrTargetPathRW
 		}
-	case *csi.VolumeCapability_Mount:
-		fstype := request.GetVolumeCapability().GetMount().GetFsType()
-		mountOptions := request.GetVolumeCapability().GetMount().GetMountFlags()
-		mountOptionsStr := strings.Join(mountOptions, ",")
-		if virsh.ProxyMode() {
-			return &csi.NodePublishVolumeResponse{}, virsh.MountVolume(sourcePath, targetPath, fstype, mountGroup, mountOptionsStr, readonly, allusers )
+		// The staged filesystem is already bind mounted at
+		// targetPath, to support idempotency we return success.
+		return nil
+	}
+	if virsh.ProxyMode() {
+		if _, err := runOnNode("mkdir", "-p", targetPath); err != nil {
+			return status.Errorf(
+				codes.Internal,
+				"Cannot create mount target %v: err=%v",
+				targetPath, err)
 		}
-		if err := s.nodePublishVolume_Mount(sourcePath, targetPath, readonly, fstype, mountOptions, mountGroup, allusers); err != nil {
-			return nil, err
+		if _, err := runOnNode("mount", "--bind", stagingPath, targetPath); err != nil {
+			return status.Errorf(
+				codes.Internal,
+				"Failed to perform bind mount: err=%v",
+				err)
 		}
-	default:
-		panic(fmt.Sprintf("lvm: unknown access_type: %+v", accessType))
-	}
-
-	// Set QOS
-	iopspergb, ok := pubcontext["iopspergb"]
-	if ok {
-		mbpspergb, ok := pubcontext["mbpspergb"]
-		if ok {
-			lv, _ := s.volumeGroup.LookupLogicalVolume(id)
-			err := lv.AddTag("qos-" + iopspergb + "-" + mbpspergb)
-			if err != nil {
-				log.Printf("ERROR setting QOS tag %+v \n", err)
+		if readonly {
+			if _, err := runOnNode("mount", "-o", "remount,bind,ro", targetPath); err != nil {
+				return status.Errorf(
+					codes.Internal,
+					"Failed to remount readonly: err=%v",
+					err)
 			}
 		}
+		return nil
+	}
+	if _, err := os.Stat(targetPath); err != nil {
+		log.Printf("Creating Mount Target  %v ", targetPath)
+		if err := os.Mkdir(targetPath, 0770); err != nil {
+			return status.Errorf(
+				codes.Internal,
+				"Cannot create mount target %v: err=%v",
+				targetPath, err)
+		}
+	}
+	log.Printf("Performing bind mount of %s -> %s", stagingPath, targetPath)
+	if err := syscall.Mount(stagingPath, targetPath, "", syscall.MS_BIND, ""); err != nil {
+		return mountError("Failed to perform bind mount", err)
+	}
+	if readonly {
+		// The readonly flag of a bind mount can only be set by
+		// remounting it.
+		flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+		if err := syscall.Mount("", targetPath, "", flags, ""); err != nil {
+			syscall.Unmount(targetPath, 0)
+			return mountError("Failed to remount readonly", err)
+		}
 	}
+	return nil
+}
 
-	response := &csi.NodePublishVolumeResponse{}
-	return response, nil
+// mountError returns the gRPC error for a failed mount(2) or umount(2).
+func mountError(msg string, err error) error {
+	if _, ok := err.(syscall.Errno); !ok {
+		return status.Errorf(codes.Internal, "%s: err=%v", msg, err)
+	}
+	return status.Errorf(codes.FailedPrecondition, "%s: err=%v", msg, err)
 }
 
 func (s *Server) nodePublishVolume_Block(sourcePath, targetPath string, readonly bool) error {
@@ -1479,91 +3579,184 @@ func (s *Server) NodeUnpublishVolume(
 
 	response := &csi.NodeUnpublishVolumeResponse{}
 	if mp == nil {
+		// A block volume published from its staging path is a
+		// bind mount of a device node, which has no block path.
+		// The device remains attached until it is unstaged.
+		mounted, err := isMountPoint(targetPath)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Cannot list mounts: err=%v", err)
+		}
+		if mounted {
+			log.Printf("Unmounting block device at %v", targetPath)
+			if virsh.ProxyMode() {
+				if err := virsh.UnMountVolume(targetPath, id); err != nil {
+					return nil, status.Errorf(codes.Internal, "Failed to perform unmount: err=%v", err)
+				}
+			} else {
+				if err := syscall.Unmount(targetPath, 0); err != nil {
+					return nil, mountError("Failed to perform unmount", err)
+				}
+				os.Remove(targetPath)
+			}
+			s.clearPublishedQos(id)
+			return response, nil
+		}
 		// FIXME: If the targetPath doesn't exist there may be iscsi session that should be logged out.
 		log.Printf("TargetPath not found %s", targetPath)
 		return response, nil
 	}
-	var lv  *lvm.LogicalVolume
+	shared, err := isSharedMount(mp)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot list mounts: err=%v", err)
+	}
+	if shared {
+		// The volume is staged or published to another pod on this
+		// node, it must remain attached.
+		log.Printf("Unmounting %v, the volume %v remains mounted elsewhere", targetPath, id)
+		if virsh.ProxyMode() {
+			return response, virsh.UnMountVolume(targetPath, id)
+		}
+		if err := syscall.Unmount(targetPath, 0); err != nil {
+			return nil, mountError("Failed to perform unmount", err)
+		}
+		if err := os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
+			log.Printf("Cannot remove target path %v: err=%v", targetPath, err)
+		}
+		return response, nil
+	}
+	return response, s.unmountVolume(id, targetPath, mp)
+}
+
+// unmountVolume unmounts the volume mounted at targetPath and releases the
+// device according to its datapath: iSCSI sessions are logged out,
+// encrypted volumes are closed and directly attached volumes are
+// deactivated.
+func (s *Server) unmountVolume(id, targetPath string, mp *mountpoint) error {
+	// The block path is a name in /dev/disk/by-path for some
+	// datapaths, the mount source is the device itself.
+	s.clearQos(id, mp.mountsource)
 	switch strings.ToLower(mp.datapath) {
-		case "iscsi":
-			log.Printf("Unmounting iscsi device %+v", mp)
-			err :=  virsh.UnMountVolume(targetPath,id)
-			chunks := strings.SplitN(mp.blockpath, "-",4)
-			log.Printf("CHUNKS %+v", chunks)
-			if len(chunks) > 3{
-				// Trim off lun-0 from end of path
-				itarget := chunks[3][0:len(chunks[3])-6]
-				err:= virsh.LogoutIscsiTarget(itarget,chunks[1])
-				log.Printf("TARGET %s  PORTAL %s", itarget, chunks[1])
-				if err != nil {
-					log.Printf("ISCSI Logout failed %v", err)
-				}
-			}
-			return response, err
+	case "iscsi":
+		log.Printf("Unmounting iscsi device %+v", mp)
+		err := virsh.UnMountVolume(targetPath, id)
+		logoutIscsiBlockPath(mp.blockpath)
+		return err
 
-		case "nvme":
-			log.Printf("Unmounting nvme device %s", mp.blockpath)
-			err :=  virsh.UnMountVolume(targetPath,id)
-			return response, err
+	case "nvme":
+		log.Printf("Unmounting nvme device %s", mp.blockpath)
+		err := virsh.UnMountVolume(targetPath, id)
+		return err
 
-		case "qemu":
-			log.Printf("Unmounting qemu device %s : %s", mp.blockpath,id)
-			err :=  virsh.UnMountVolume(targetPath,id)
-			return response, err
-
-		case "sas":
-			log.Printf("Unmounting SAS device %s : %s", mp.blockpath,id)
-			//var err  error
-			lv, err = s.volumeGroup.LookupLogicalVolume(id)
-			// Clear QOS
-			virsh.SetQos(lv.VgName(), lv.Name(), "0", "0")
-			if virsh.ProxyMode() {
-				err :=  virsh.UnMountVolume(targetPath,id)
-				return response, err
-			} else {
-				// Unmount not containerized
-				const umountFlags = 0
-				log.Printf("Unmounting %v", targetPath)
-				if err := syscall.Unmount(targetPath, umountFlags); err != nil {
-					_, ok := err.(syscall.Errno)
-					if !ok {
-						return nil, status.Errorf(codes.Internal, "Failed to perform unmount: err=%v", err)
-					}
-					return nil, status.Errorf(
-						codes.FailedPrecondition, "Failed to perform unmount: err=%v", err)
+	case "qemu":
+		log.Printf("Unmounting qemu device %s : %s", mp.blockpath, id)
+		err := virsh.UnMountVolume(targetPath, id)
+		return err
+
+	case "crypt":
+		log.Printf("Unmounting encrypted device %s : %s", mp.blockpath, id)
+		if virsh.ProxyMode() {
+			if err := virsh.UnMountVolume(targetPath, id); err != nil {
+				return err
+			}
+		} else {
+			const umountFlags = 0
+			log.Printf("Unmounting %v", targetPath)
+			if err := syscall.Unmount(targetPath, umountFlags); err != nil {
+				_, ok := err.(syscall.Errno)
+				if !ok {
+					return status.Errorf(codes.Internal, "Failed to perform unmount: err=%v", err)
 				}
+				return status.Errorf(
+					codes.FailedPrecondition, "Failed to perform unmount: err=%v", err)
 			}
+		}
+		if err := closeEncrypted(s.cryptMappingName(id)); err != nil {
+			return status.Errorf(codes.Internal, "Failed to close encrypted volume: err=%v", err)
+		}
+		// The volume is only found if it is attached directly.
+		if lv, err := s.lookupLogicalVolume(id); err == nil {
 			if err := lv.Deactivate(); err != nil {
 				log.Printf("Failed to de-activate volume: err=%v", err)
 			}
-			return response, nil
+		}
+		return nil
 
-		default:
-			log.Printf("Unmounting Unknown datapath device %s :: %v", mp.datapath,mp)
+	case "sas":
+		log.Printf("Unmounting SAS device %s : %s", mp.blockpath, id)
+		lv, err := s.lookupLogicalVolume(id)
+		if err != nil {
+			return ErrVolumeNotFound
+		}
+		if virsh.ProxyMode() {
+			err := virsh.UnMountVolume(targetPath, id)
+			return err
+		} else {
+			// Unmount not containerized
 			const umountFlags = 0
-			log.Printf("Unmounting %v target", targetPath)
+			log.Printf("Unmounting %v", targetPath)
 			if err := syscall.Unmount(targetPath, umountFlags); err != nil {
 				_, ok := err.(syscall.Errno)
 				if !ok {
-					return nil, status.Errorf(codes.Internal, "Failed to calling unmount: err=%v", err)
+					return status.Errorf(codes.Internal, "Failed to perform unmount: err=%v", err)
 				}
-				return nil, status.Errorf(codes.FailedPrecondition, "Failed to perform unmount: err=%v", err)
+				return status.Errorf(
+					codes.FailedPrecondition, "Failed to perform unmount: err=%v", err)
 			}
-			log.Printf("Deleting Target Path  %s", targetPath)
-			os.RemoveAll(targetPath)
-			return response, nil
+		}
+		if err := lv.Deactivate(); err != nil {
+			log.Printf("Failed to de-activate volume: err=%v", err)
+		}
+		return nil
+
+	default:
+		log.Printf("Unmounting Unknown datapath device %s :: %v", mp.datapath, mp)
+		const umountFlags = 0
+		log.Printf("Unmounting %v target", targetPath)
+		if err := syscall.Unmount(targetPath, umountFlags); err != nil {
+			_, ok := err.(syscall.Errno)
+			if !ok {
+				return status.Errorf(codes.Internal, "Failed to calling unmount: err=%v", err)
+			}
+			return status.Errorf(codes.FailedPrecondition, "Failed to perform unmount: err=%v", err)
+		}
+		log.Printf("Deleting Target Path  %s", targetPath)
+		os.RemoveAll(targetPath)
+		return nil
 	}
 	// Can't Happen
-	return nil, status.Errorf(codes.Internal,"ERROR with Unpublish handling")
+	return status.Errorf(codes.Internal, "ERROR with Unpublish handling")
+}
+
+// logoutIscsiBlockPath logs out of the iSCSI target of the device with the
+// given disk-by-path, e.g.,
+// ip-10.0.0.1:3260-iscsi-iqn.2020-01.com.seagate:target-lun-0.
+func logoutIscsiBlockPath(blockpath string) {
+	chunks := strings.SplitN(blockpath, "-", 4)
+	log.Printf("CHUNKS %+v", chunks)
+	if len(chunks) > 3 {
+		// Trim off lun-0 from end of path
+		itarget := chunks[3][0 : len(chunks[3])-6]
+		err := virsh.LogoutIscsiTarget(itarget, chunks[1])
+		log.Printf("TARGET %s  PORTAL %s", itarget, chunks[1])
+		if err != nil {
+			log.Printf("ISCSI Logout failed %v", err)
+		}
+	}
 }
 
 func (s *Server) NodeGetInfo(
 	ctx context.Context,
 	request *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
-	tenant := s.vgname[5:len(s.vgname)]
+	tenant := s.tenant()
 	topology := &csi.Topology{
 		Segments: map[string]string{tenant + topologyKey: s.nodeID},
 	}
+	// Only nodes that see a volume group can access its direct SAS
+	// volumes.
+	for _, vg := range s.managedVolumeGroups() {
+		key, value := s.volumeGroupTopologySegment(vg.Name())
+		topology.Segments[key] = value
+	}
 
 	// Valid iscsi IQN overrides nodeID
 	initiatorName, err := readInitiatorName()
@@ -1652,7 +3845,10 @@ func (s *Server) NodeGetCapabilities(
 	request *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
 	var csc []*csi.NodeServiceCapability
 	cl := []csi.NodeServiceCapability_RPC_Type{
-		//TODO://csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
 		csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
 	}
 
@@ -1679,80 +3875,472 @@ func takeVolumeLayoutFromParameters(params map[string]string) (layout lvm.Volume
 		switch voltype {
 		case "linear":
 			layout.Type = lvm.VolumeTypeLinear
-			strps, ok := params["stripes"]
-			if ok {
-				delete(params, "stripes")
-				stripes, err := strconv.ParseUint(strps, 10, 64)
-				if err != nil || stripes < 1 {
-					return layout, fmt.Errorf("The 'stripes' parameter must be a positive integer: err=%v", err)
-				}
-				layout.Stripes = stripes
+			if layout.Stripes, err = takeCountParameter(params, "stripes"); err != nil {
+				return layout, err
+			}
+			if layout.StripeSize, err = takeSizeParameter(params, "stripesize"); err != nil {
+				return layout, err
+			}
+		case "striped", "raid0", "raid0_meta":
+			switch voltype {
+			case "striped":
+				layout.Type = lvm.VolumeTypeStriped
+			case "raid0":
+				layout.Type = lvm.VolumeTypeRAID0
+			case "raid0_meta":
+				layout.Type = lvm.VolumeTypeRAID0Meta
 			}
+			if layout.Stripes, err = takeCountParameter(params, "stripes"); err != nil {
+				return layout, err
+			}
+			if layout.StripeSize, err = takeSizeParameter(params, "stripesize"); err != nil {
+				return layout, err
+			}
+			// There is no redundancy to synchronize so we accept
+			// and ignore the 'nosync' parameter.
+			delete(params, "nosync")
 		case "raid1":
 			layout.Type = lvm.VolumeTypeRAID1
-			smirrors, ok := params["mirrors"]
-			if ok {
-				delete(params, "mirrors")
-				mirrors, err := strconv.ParseUint(smirrors, 10, 64)
-				if err != nil || mirrors < 1 {
-					return layout, fmt.Errorf("The 'mirrors' parameter must be a positive integer: err=%v", err)
-				}
-				layout.Mirrors = mirrors
+			if layout.Mirrors, err = takeCountParameter(params, "mirrors"); err != nil {
+				return layout, err
 			}
-			nosync, okns := params["nosync"]
-			if okns {
-				delete(params, "nosync")
-				if strings.ToLower(nosync) == "yes" || strings.ToLower(nosync) == "y" {
-					layout.Nosync = 1
-				}
+			if layout.RegionSize, err = takeSizeParameter(params, "regionsize"); err != nil {
+				return layout, err
 			}
-		case "raid5":
-			layout.Type = lvm.VolumeTypeRAID5
-			strps, ok := params["stripes"]
-			if ok {
-				delete(params, "stripes")
-				stripes, err := strconv.ParseUint(strps, 10, 64)
-				if err != nil || stripes < 1 {
-					return layout, fmt.Errorf("The 'stripes' parameter must be a positive integer: err=%v", err)
+			layout.Nosync = takeNosyncParameter(params)
+			if err := takeIntegrityFromParameters(params, &layout); err != nil {
+				return layout, err
+			}
+			if layout.FailureDomain, err = takeFailureDomainParameter(params); err != nil {
+				return layout, err
+			}
+		case "raid4", "raid5", "raid6":
+			switch voltype {
+			case "raid4":
+				layout.Type = lvm.VolumeTypeRAID4
+			case "raid5":
+				layout.Type = lvm.VolumeTypeRAID5
+			case "raid6":
+				layout.Type = lvm.VolumeTypeRAID6
+			}
+			if layout.Stripes, err = takeCountParameter(params, "stripes"); err != nil {
+				return layout, err
+			}
+			if layout.StripeSize, err = takeSizeParameter(params, "stripesize"); err != nil {
+				return layout, err
+			}
+			if layout.RegionSize, err = takeSizeParameter(params, "regionsize"); err != nil {
+				return layout, err
+			}
+			layout.Nosync = takeNosyncParameter(params)
+			if err := takeIntegrityFromParameters(params, &layout); err != nil {
+				return layout, err
+			}
+			if layout.FailureDomain, err = takeFailureDomainParameter(params); err != nil {
+				return layout, err
+			}
+		case "raid10":
+			layout.Type = lvm.VolumeTypeRAID10
+			if layout.Stripes, err = takeCountParameter(params, "stripes"); err != nil {
+				return layout, err
+			}
+			if layout.Mirrors, err = takeCountParameter(params, "mirrors"); err != nil {
+				return layout, err
+			}
+			if layout.StripeSize, err = takeSizeParameter(params, "stripesize"); err != nil {
+				return layout, err
+			}
+			if layout.RegionSize, err = takeSizeParameter(params, "regionsize"); err != nil {
+				return layout, err
+			}
+			layout.Nosync = takeNosyncParameter(params)
+			if err := takeIntegrityFromParameters(params, &layout); err != nil {
+				return layout, err
+			}
+			if layout.FailureDomain, err = takeFailureDomainParameter(params); err != nil {
+				return layout, err
+			}
+		case "thin":
+			layout.Type = lvm.VolumeTypeThin
+			layout.ThinPool = defaultThinPool
+			if pool, ok := params["thinpool"]; ok {
+				delete(params, "thinpool")
+				if err := lvm.ValidateLogicalVolumeName(pool); err != nil {
+					return layout, fmt.Errorf("The 'thinpool' parameter must be a valid volume name: err=%v", err)
 				}
-				layout.Stripes = stripes
+				if strings.HasPrefix(pool, lvPrefix) || strings.HasPrefix(pool, snapPrefix) {
+					return layout, fmt.Errorf("The 'thinpool' parameter must not start with %q or %q, which are reserved for volumes.", lvPrefix, snapPrefix)
+				}
+				layout.ThinPool = pool
 			}
-		case "raid6":
-			layout.Type = lvm.VolumeTypeRAID6
-			strps, ok := params["stripes"]
+			spoolsize, ok := params["thinpoolsize"]
 			if ok {
-				delete(params, "stripes")
-				stripes, err := strconv.ParseUint(strps, 10, 64)
-				if err != nil || stripes < 1 {
-					return layout, fmt.Errorf("The 'stripes' parameter must be a positive integer: err=%v", err)
+				delete(params, "thinpoolsize")
+				poolsize, err := strconv.ParseUint(spoolsize, 10, 64)
+				if err != nil || poolsize < 1 {
+					return layout, fmt.Errorf("The 'thinpoolsize' parameter must be a positive integer: err=%v", err)
 				}
-				layout.Stripes = stripes
+				layout.ThinPoolSize = poolsize
 			}
-		case "raid10":
-			layout.Type = lvm.VolumeTypeRAID10
-			strps, ok := params["stripes"]
+			// The remaining layout parameters describe the thin pool
+			// in case it has to be created.
+			pooltype, ok := params["thinpooltype"]
 			if ok {
-				delete(params, "stripes")
-				stripes, err := strconv.ParseUint(strps, 10, 64)
-				if err != nil || stripes < 1 {
-					return layout, fmt.Errorf("The 'stripes' parameter must be a positive integer: err=%v", err)
+				delete(params, "thinpooltype")
+				if pooltype == "thin" || pooltype == "vdo" {
+					return layout, fmt.Errorf("The 'thinpooltype' parameter cannot be '%s'.", pooltype)
+				}
+				params["type"] = pooltype
+				poolLayout, err := takeVolumeLayoutFromParameters(params)
+				if err != nil {
+					return layout, err
 				}
-				layout.Stripes = stripes
+				layout.ThinPoolLayout = &poolLayout
 			}
-			nosync, okns := params["nosync"]
-			if okns {
-				delete(params, "nosync")
-				if strings.ToLower(nosync) == "yes" || strings.ToLower(nosync) == "y" {
-					layout.Nosync = 1
+		case "vdo":
+			layout.Type = lvm.VolumeTypeVDO
+			if sratio, ok := params["vdovirtualratio"]; ok {
+				delete(params, "vdovirtualratio")
+				ratio, err := strconv.ParseFloat(sratio, 64)
+				if err != nil || ratio < 1 {
+					return layout, fmt.Errorf("The 'vdovirtualratio' parameter must be a number no smaller than 1: err=%v", err)
 				}
+				layout.VirtualRatio = ratio
+			}
+			// Compression and deduplication are enabled unless
+			// disabled explicitly.
+			if layout.Compression, err = takeYesNoParameter(params, "vdocompression", true); err != nil {
+				return layout, err
+			}
+			if layout.Deduplication, err = takeYesNoParameter(params, "vdodeduplication", true); err != nil {
+				return layout, err
 			}
 		default:
-			return layout, errors.New("The 'type' parameter must be one of 'linear', 'raid1', 'raid5', 'raid6' or 'raid10'.")
+			return layout, errors.New("The 'type' parameter must be one of 'linear', 'striped', 'raid0', 'raid0_meta', 'raid1', 'raid4', 'raid5', 'raid6', 'raid10', 'thin' or 'vdo'.")
+		}
+	}
+	if _, ok := params["failuredomain"]; ok {
+		return layout, errors.New("The 'failuredomain' parameter requires a 'type' of 'raid1', 'raid4', 'raid5', 'raid6' or 'raid10'.")
+	}
+	pvs, err := takePhysicalVolumesFromParameters(params)
+	if err != nil {
+		return layout, err
+	}
+	if len(pvs) > 0 {
+		if layout.Type == lvm.VolumeTypeThin {
+			// Thin volumes are allocated from the thin pool so the
+			// selection applies to the pool.
+			if layout.ThinPoolLayout == nil {
+				layout.ThinPoolLayout = &lvm.VolumeLayout{}
+			}
+			layout.ThinPoolLayout.PhysicalVolumes = append(layout.ThinPoolLayout.PhysicalVolumes, pvs...)
+		} else {
+			layout.PhysicalVolumes = pvs
 		}
 	}
 	return layout, nil
 }
 
+// serialSelectorPrefix marks the physical volume selectors that name a
+// drive by its serial number until resolvePhysicalVolumes replaces them
+// with the path of the drive.
+const serialSelectorPrefix = "serial:"
+
+// takePhysicalVolumesFromParameters consumes the 'pvtags' and 'SsdSerials'
+// parameters and returns the physical volumes they select in the form
+// accepted by lvcreate. Both are lists separated by commas or spaces.
+// Tags may be given with or without the leading '@'. Serial numbers are
+// returned with serialSelectorPrefix, see resolvePhysicalVolumes.
+func takePhysicalVolumesFromParameters(params map[string]string) (pvs []string, err error) {
+	split := func(s string) []string {
+		return strings.FieldsFunc(s, func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		})
+	}
+	if stags, ok := params["pvtags"]; ok {
+		delete(params, "pvtags")
+		for _, tag := range split(stags) {
+			tag = strings.TrimPrefix(tag, "@")
+			if err := lvm.ValidateTag(tag); err != nil {
+				return nil, fmt.Errorf("The 'pvtags' parameter must list valid tags: err=%v", err)
+			}
+			pvs = append(pvs, "@"+tag)
+		}
+	}
+	if sserials, ok := params["SsdSerials"]; ok {
+		delete(params, "SsdSerials")
+		for _, serial := range split(sserials) {
+			pvs = append(pvs, serialSelectorPrefix+serial)
+		}
+	}
+	return pvs, nil
+}
+
+// resolvePhysicalVolumes replaces the serial numbers selected by the
+// 'SsdSerials' parameter in the layout and its thin pool layout with the
+// paths of the drives. The drives are looked up through the StoLake agent
+// once per request.
+func resolvePhysicalVolumes(layout *lvm.VolumeLayout) error {
+	layouts := []*lvm.VolumeLayout{layout}
+	if layout.ThinPoolLayout != nil {
+		layouts = append(layouts, layout.ThinPoolLayout)
+	}
+	var serials []string
+	for _, l := range layouts {
+		for _, sel := range l.PhysicalVolumes {
+			if strings.HasPrefix(sel, serialSelectorPrefix) {
+				serials = append(serials, strings.TrimPrefix(sel, serialSelectorPrefix))
+			}
+		}
+	}
+	if len(serials) == 0 {
+		return nil
+	}
+	devices, err := virsh.DevicesBySerial(serials)
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "Cannot resolve the 'SsdSerials' parameter: err=%v", err)
+	}
+	for _, l := range layouts {
+		var pvs []string
+		for _, sel := range l.PhysicalVolumes {
+			if strings.HasPrefix(sel, serialSelectorPrefix) {
+				serial := strings.TrimPrefix(sel, serialSelectorPrefix)
+				dev, ok := devices[serial]
+				if !ok {
+					return status.Errorf(codes.InvalidArgument, "No drive with serial %v was found.", serial)
+				}
+				sel = dev
+			}
+			pvs = append(pvs, sel)
+		}
+		l.PhysicalVolumes = pvs
+	}
+	return nil
+}
+
+// takeCountParameter consumes the named parameter and parses it as a
+// positive integer. It returns 0 if the parameter is not set.
+func takeCountParameter(params map[string]string, key string) (uint64, error) {
+	sval, ok := params[key]
+	if !ok {
+		return 0, nil
+	}
+	delete(params, key)
+	val, err := strconv.ParseUint(sval, 10, 64)
+	if err != nil || val < 1 {
+		return 0, fmt.Errorf("The '%s' parameter must be a positive integer: err=%v", key, err)
+	}
+	return val, nil
+}
+
+// byteUnits are the binary suffixes of Kubernetes quantities accepted by
+// takeBytesParameter.
+var byteUnits = map[string]uint64{
+	"Ki": 1 << 10,
+	"Mi": 1 << 20,
+	"Gi": 1 << 30,
+	"Ti": 1 << 40,
+}
+
+// takeBytesParameter consumes the named parameter and parses it as a
+// positive number of bytes, optionally with a binary suffix such as "Gi".
+// It returns 0 if the parameter is not set.
+func takeBytesParameter(params map[string]string, key string) (uint64, error) {
+	sval, ok := params[key]
+	if !ok {
+		return 0, nil
+	}
+	delete(params, key)
+	unit := uint64(1)
+	if len(sval) > 2 {
+		if u, ok := byteUnits[sval[len(sval)-2:]]; ok {
+			sval, unit = sval[:len(sval)-2], u
+		}
+	}
+	val, err := strconv.ParseUint(sval, 10, 64)
+	if err != nil || val < 1 || val > math.MaxUint64/unit {
+		return 0, fmt.Errorf("The '%s' parameter must be a positive number of bytes, optionally with a Ki, Mi, Gi or Ti suffix: err=%v", key, err)
+	}
+	return val * unit, nil
+}
+
+// minLayoutSize is the smallest stripe or region size in bytes accepted by
+// lvcreate, a 4KiB page.
+const minLayoutSize = 4 << 10
+
+// takeSizeParameter consumes the named parameter and parses it as a size in
+// bytes. The size must be a power of two of at least 4KiB as lvcreate
+// requires for stripe and region sizes. It returns 0 if the parameter is
+// not set.
+func takeSizeParameter(params map[string]string, key string) (uint64, error) {
+	sval, ok := params[key]
+	if !ok {
+		return 0, nil
+	}
+	delete(params, key)
+	val, err := strconv.ParseUint(sval, 10, 64)
+	if err != nil || val < minLayoutSize || val&(val-1) != 0 {
+		return 0, fmt.Errorf("The '%s' parameter must be a power of two number of bytes no smaller than %d: err=%v", key, minLayoutSize, err)
+	}
+	return val, nil
+}
+
+// takeYesNoParameter consumes the named parameter and parses it as 'yes' or
+// 'no'. It returns def if the parameter is not set.
+func takeYesNoParameter(params map[string]string, key string, def bool) (bool, error) {
+	sval, ok := params[key]
+	if !ok {
+		return def, nil
+	}
+	delete(params, key)
+	switch strings.ToLower(sval) {
+	case "yes", "y":
+		return true, nil
+	case "no", "n":
+		return false, nil
+	default:
+		return def, fmt.Errorf("The '%s' parameter must be 'yes' or 'no'.", key)
+	}
+}
+
+// takeIntegrityFromParameters consumes the 'integrity' and 'integritymode'
+// parameters and sets the corresponding fields of the RAID layout.
+func takeIntegrityFromParameters(params map[string]string, layout *lvm.VolumeLayout) (err error) {
+	if layout.Integrity, err = takeYesNoParameter(params, "integrity", false); err != nil {
+		return err
+	}
+	mode, ok := params["integritymode"]
+	if !ok {
+		return nil
+	}
+	delete(params, "integritymode")
+	if !layout.Integrity {
+		return errors.New("The 'integritymode' parameter requires the 'integrity' parameter.")
+	}
+	switch mode {
+	case "journal", "bitmap":
+		layout.IntegrityMode = mode
+	default:
+		return errors.New("The 'integritymode' parameter must be one of 'journal' or 'bitmap'.")
+	}
+	return nil
+}
+
+// failureDomainsError returns the gRPC error for an error placing the
+// images of a RAID volume in failure domains.
+func failureDomainsError(err error) error {
+	switch err {
+	case lvm.ErrTooFewFailureDomains:
+		return ErrTooFewFailureDomains
+	case lvm.ErrTooFewDisks:
+		return ErrTooFewDisks
+	case lvm.ErrFailureDomainsViolated:
+		return ErrFailureDomainsViolated
+	default:
+		return status.Errorf(
+			codes.Internal,
+			"Cannot place volume in failure domains: err=%v",
+			err)
+	}
+}
+
+// takeFailureDomainParameter consumes the 'failuredomain' parameter, the
+// prefix of the physical volume tags that name failure domains.
+func takeFailureDomainParameter(params map[string]string) (string, error) {
+	prefix, ok := params["failuredomain"]
+	if !ok {
+		return "", nil
+	}
+	delete(params, "failuredomain")
+	prefix = strings.TrimPrefix(prefix, "@")
+	if err := lvm.ValidateFailureDomain(prefix); err != nil {
+		return "", fmt.Errorf("The 'failuredomain' parameter must be a valid tag prefix ending in '-', '_', '.' or '+': err=%v", err)
+	}
+	return prefix, nil
+}
+
+// takeNosyncParameter consumes the 'nosync' parameter and returns 1 if it
+// is set to 'yes'.
+func takeNosyncParameter(params map[string]string) uint64 {
+	nosync, ok := params["nosync"]
+	if !ok {
+		return 0
+	}
+	delete(params, "nosync")
+	if strings.ToLower(nosync) == "yes" || strings.ToLower(nosync) == "y" {
+		return 1
+	}
+	return 0
+}
+
+// takeCacheFromParameters removes and returns the cache-related parameters
+// from the input.
+func takeCacheFromParameters(params map[string]string) (cache lvm.Cache, err error) {
+	mode, ok := params["cache"]
+	if ok {
+		delete(params, "cache")
+		switch mode {
+		case "none":
+			cache.Mode = lvm.CacheModeNone
+		case "writethrough":
+			cache.Mode = lvm.CacheModeWritethrough
+		case "writeback":
+			cache.Mode = lvm.CacheModeWriteback
+		case "writecache":
+			cache.Mode = lvm.CacheModeWritecache
+		default:
+			return cache, errors.New("The 'cache' parameter must be one of 'none', 'writethrough', 'writeback' or 'writecache'.")
+		}
+	}
+	if cache.SizeInBytes, err = takeBytesParameter(params, "cachesize"); err != nil {
+		return cache, err
+	}
+	if pvtag, ok := params["cachepvtag"]; ok {
+		delete(params, "cachepvtag")
+		if err := lvm.ValidateTag(pvtag); err != nil {
+			return cache, fmt.Errorf("The 'cachepvtag' parameter must be a valid tag: err=%v", err)
+		}
+		cache.PVTag = pvtag
+	}
+	if cache.Mode == lvm.CacheModeNone {
+		if cache.SizeInBytes != 0 || cache.PVTag != "" {
+			return cache, errors.New("The 'cachesize' and 'cachepvtag' parameters require the 'cache' parameter.")
+		}
+		return cache, nil
+	}
+	if cache.SizeInBytes == 0 {
+		return cache, errors.New("The 'cachesize' parameter is required with the 'cache' parameter.")
+	}
+	return cache, nil
+}
+
+// takeAllocationFromParameters removes and returns the allocation strategy
+// of a volume with the layout from the input, or nil if the 'allocation'
+// parameter is not set. The strategy of a thin volume applies to its thin
+// pool when the pool is created.
+func takeAllocationFromParameters(params map[string]string, layout lvm.VolumeLayout) (lvm.AllocationStrategy, error) {
+	name, ok := params["allocation"]
+	if !ok {
+		return nil, nil
+	}
+	delete(params, "allocation")
+	strategy, err := lvm.LookupAllocationStrategy(name)
+	if err != nil {
+		return nil, fmt.Errorf("The 'allocation' parameter must name an allocation strategy such as 'least-used', 'spread', 'contiguous' or 'cling': err=%v", err)
+	}
+	if layout.Type == lvm.VolumeTypeThin {
+		layout = thinPoolLayout(layout)
+	}
+	if strategy.Policy() == "anywhere" && layout.IsRAID() {
+		return nil, errors.New("The 'anywhere' allocation strategy would let the images of a RAID volume share physical volumes.")
+	}
+	return strategy, nil
+}
+
+// defaultThinPool is the thin pool thin volumes are allocated from if the
+// 'thinpool' parameter is not set.
+const defaultThinPool = "csithinpool"
+
 func dupParams(in map[string]string) map[string]string {
 	if in == nil {
 		return nil
@@ -1778,6 +4366,25 @@ func volumeOptsFromParameters(in map[string]string) (opts []lvm.CreateLogicalVol
 		return nil, err
 	}
 	opts = append(opts, lvm.VolumeLayoutOpt(layout))
+	// Transform any cache parameters into an opt.
+	cache, err := takeCacheFromParameters(params)
+	if err != nil {
+		return nil, err
+	}
+	if cache.Mode != lvm.CacheModeNone {
+		if layout.Type == lvm.VolumeTypeThin || layout.Type == lvm.VolumeTypeVDO {
+			return nil, errors.New("The 'cache' parameter is not supported for thin or VDO volumes.")
+		}
+		opts = append(opts, lvm.CacheOpt(cache))
+	}
+	// Transform any 'allocation' parameter into an opt.
+	strategy, err := takeAllocationFromParameters(params, layout)
+	if err != nil {
+		return nil, err
+	}
+	if strategy != nil {
+		opts = append(opts, lvm.AllocationOpt(strategy))
+	}
 	// Ignore Datapath volume parameters.
 	_, ok := params["datapath"]
 	if ok {
@@ -1788,15 +4395,18 @@ func volumeOptsFromParameters(in map[string]string) (opts []lvm.CreateLogicalVol
 	if ok {
 		delete(params, "stolakejobfurls")
 	}
-
-	// Ignore QOS settings
-	_, ok = params["iopspergb"]
-	if ok {
-		delete(params, "iopspergb")
-	}
-	_, ok = params["mbpspergb"]
-	if ok {
-		delete(params, "mbpspergb")
+	// The volume group is selected by selectVolumeGroup.
+	delete(params, "volumeGroup")
+	// Encryption is recorded in a tag and applied by the node.
+	delete(params, "encrypted")
+	// The claim is recorded in a tag by CreateVolume.
+	delete(params, paramPVCName)
+	delete(params, paramPVCNamespace)
+	delete(params, paramPVName)
+
+	// QOS settings are recorded in a tag and applied by the node.
+	if _, err := takeQosFromParameters(params); err != nil {
+		return nil, err
 	}
 	if len(params) > 0 {
 		var keys []string
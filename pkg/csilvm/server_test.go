@@ -2,13 +2,18 @@ package csilvm
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
+	"reflect"
 	"runtime"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/Seagate/csiclvm/pkg/lvm"
+	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
@@ -245,3 +250,1143 @@ func TestRequestQueuingWithInterceptors(t *testing.T) {
 		t.Fatalf("unexpected error: %v", err)
 	}
 }
+
+func TestParseSnapshotTags(t *testing.T) {
+	tags := []string{
+		"some-tag",
+		tagSnapshotNamePlainPrefix + "test-snapshot",
+		snapshotSourceToTag("csilv123"),
+		tagSnapshotSizePrefix + "83886080",
+		tagCreationTimePrefix + "1600000000000000000",
+	}
+	info, ok := parseSnapshotTags(tags)
+	if !ok {
+		t.Fatal("Expected tags to describe a snapshot")
+	}
+	if info.sourceVolumeID != "csilv123" {
+		t.Fatalf("Expected source volume csilv123 but got %v", info.sourceVolumeID)
+	}
+	if info.sizeBytes != 83886080 {
+		t.Fatalf("Expected size 83886080 but got %v", info.sizeBytes)
+	}
+	if exp := time.Unix(0, 1600000000000000000); !info.creationTime.Equal(exp) {
+		t.Fatalf("Expected creation time %v but got %v", exp, info.creationTime)
+	}
+	if _, ok := parseSnapshotTags([]string{tagVolumeNamePlainPrefix + "test-volume"}); ok {
+		t.Fatal("Expected volume tags not to describe a snapshot")
+	}
+}
+
+func TestConditionFromHealth(t *testing.T) {
+	cases := []struct {
+		health   lvm.Health
+		abnormal bool
+	}{
+		{lvm.Health{SyncPercent: 100, SyncAction: "idle"}, false},
+		{lvm.Health{SyncPercent: 40, SyncAction: "resync"}, false},
+		{lvm.Health{SyncPercent: 40, SyncAction: "recover"}, true},
+		{lvm.Health{Status: "partial", SyncPercent: 100}, true},
+		{lvm.Health{Status: "refresh needed", SyncPercent: 100}, true},
+		{lvm.Health{Status: "mismatches exist", SyncPercent: 100, MismatchCount: 8}, true},
+		{lvm.Health{SyncPercent: 100, SyncAction: "idle", IntegrityMismatches: 3}, true},
+	}
+	for _, tc := range cases {
+		condition := conditionFromHealth(tc.health)
+		if condition.GetAbnormal() != tc.abnormal {
+			t.Fatalf("Expected abnormal=%v for %+v but got %v", tc.abnormal, tc.health, condition)
+		}
+		if condition.GetMessage() == "" {
+			t.Fatalf("Expected a message for %+v", tc.health)
+		}
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	s := &Server{vgname: "vgcsitenant1"}
+	names := []string{"csilvd", "csilva", "csilvc", "csilvb", "csilve"}
+	var got []string
+	token := ""
+	for {
+		page, next, err := s.paginate(append([]string(nil), names...), token, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) > 2 {
+			t.Fatalf("Expected at most 2 entries but got %v", page)
+		}
+		got = append(got, page...)
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	exp := []string{"csilva", "csilvb", "csilvc", "csilvd", "csilve"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("Expected %v but got %v", exp, got)
+	}
+	// Pages are stable when the next entry is removed between calls.
+	_, next, err := s.paginate(append([]string(nil), names...), "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _, err := s.paginate([]string{"csilva", "csilvb", "csilvd", "csilve"}, next, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"csilvd", "csilve"}; !reflect.DeepEqual(page, exp) {
+		t.Fatalf("Expected %v but got %v", exp, page)
+	}
+	// Unlimited.
+	page, next, err = s.paginate(append([]string(nil), names...), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != len(names) || next != "" {
+		t.Fatalf("Expected all entries and no token but got %v, %q", page, next)
+	}
+	for _, token := range []string{"not-a-token", base64.RawURLEncoding.EncodeToString([]byte("csilva"))} {
+		if _, _, err := s.paginate(names, token, 2); err != ErrInvalidStartingToken {
+			t.Fatalf("Expected ErrInvalidStartingToken for %q but got %v", token, err)
+		}
+	}
+}
+
+func TestPaginateVolumeGroups(t *testing.T) {
+	s := &Server{vgname: "vgcsitenant1", additionalVgnames: []string{"vgcsitenant2"}}
+	names := []string{"vgcsitenant2/csilvb", "csilvb", "vgcsitenant2/csilva", "csilva"}
+	var got []string
+	token := ""
+	for {
+		page, next, err := s.paginate(append([]string(nil), names...), token, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, page...)
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	exp := []string{"csilva", "csilvb", "vgcsitenant2/csilva", "vgcsitenant2/csilvb"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("Expected %v but got %v", exp, got)
+	}
+	for _, start := range []string{"vgcsitenant2/", "/csilva", "vgcsitenant2/csilva/x"} {
+		token := base64.RawURLEncoding.EncodeToString([]byte(pageTokenPrefix + start))
+		if _, _, err := s.paginate(names, token, 1); err != ErrInvalidStartingToken {
+			t.Fatalf("Expected ErrInvalidStartingToken for %q but got %v", start, err)
+		}
+	}
+}
+
+func TestPublicationTags(t *testing.T) {
+	pubs := []publication{
+		{NodeID: "iqn.1994-05.com.redhat:node-1", Datapath: "iscsi", Target: "iqn.2003-01.org.linux-iscsi.controller:sn.1234"},
+		{NodeID: "node-2", Datapath: "direct"},
+	}
+	tags := []string{"some-tag", tagVolumeNamePlainPrefix + "test-volume"}
+	for _, pub := range pubs {
+		tag := publicationToTag(pub)
+		if err := lvm.ValidateTag(tag); err != nil {
+			t.Fatalf("Expected tag %v to be valid: err=%v", tag, err)
+		}
+		tags = append(tags, tag)
+	}
+	if got := parsePublicationTags(tags); !reflect.DeepEqual(got, pubs) {
+		t.Fatalf("Expected %v but got %v", pubs, got)
+	}
+	exp := []string{pubs[0].NodeID, pubs[1].NodeID}
+	if got := publishedNodeIDs(tags); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("Expected %v but got %v", exp, got)
+	}
+}
+
+func TestTakeVolumeLayoutFromParameters_Thin(t *testing.T) {
+	params := map[string]string{
+		"type":         "thin",
+		"thinpool":     "pool1",
+		"thinpoolsize": "1073741824",
+		"thinpooltype": "raid1",
+		"mirrors":      "2",
+	}
+	layout, err := takeVolumeLayoutFromParameters(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layout.Type != lvm.VolumeTypeThin || layout.ThinPool != "pool1" || layout.ThinPoolSize != 1<<30 {
+		t.Fatalf("Unexpected layout %+v", layout)
+	}
+	if pool := layout.ThinPoolLayout; pool == nil || pool.Type != lvm.VolumeTypeRAID1 || pool.Mirrors != 2 {
+		t.Fatalf("Unexpected thin pool layout %+v", pool)
+	}
+	if len(params) != 0 {
+		t.Fatalf("Expected all parameters to be taken but got %v", params)
+	}
+	layout, err = takeVolumeLayoutFromParameters(map[string]string{"type": "thin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layout.ThinPool != defaultThinPool {
+		t.Fatalf("Expected the default thin pool but got %v", layout.ThinPool)
+	}
+	for _, params := range []map[string]string{
+		{"type": "thin", "thinpool": "bad/name"},
+		{"type": "thin", "thinpool": "csilvpool"},
+		{"type": "thin", "thinpool": "csisnappool"},
+		{"type": "thin", "thinpoolsize": "0"},
+		{"type": "thin", "thinpooltype": "thin"},
+	} {
+		if _, err := takeVolumeLayoutFromParameters(params); err == nil {
+			t.Fatalf("Expected an error for %v", params)
+		}
+	}
+}
+
+func TestIsVolumeName(t *testing.T) {
+	for _, tc := range []struct {
+		lvname string
+		volume bool
+	}{
+		{"csilv1dm4etd9qk3pf", true},
+		{"csisnap1dm4etd9qk3pf", true},
+		{defaultThinPool, false},
+		{"csilv1dm4etd9qk3pf_vdopool", false},
+		{"csilv1dm4etd9qk3pf_rimage_0", false},
+		{"csilv", false},
+		{"lvol0", false},
+	} {
+		if volume := isVolumeName(tc.lvname); volume != tc.volume {
+			t.Fatalf("Expected isVolumeName(%q) to be %v", tc.lvname, tc.volume)
+		}
+	}
+}
+
+func TestTakeVolumeLayoutFromParameters_RAID(t *testing.T) {
+	for _, tc := range []struct {
+		params map[string]string
+		layout lvm.VolumeLayout
+	}{
+		{
+			map[string]string{"type": "striped", "stripes": "4", "stripesize": "65536"},
+			lvm.VolumeLayout{Type: lvm.VolumeTypeStriped, Stripes: 4, StripeSize: 64 << 10},
+		},
+		{
+			map[string]string{"type": "raid0", "stripes": "3", "nosync": "yes"},
+			lvm.VolumeLayout{Type: lvm.VolumeTypeRAID0, Stripes: 3},
+		},
+		{
+			map[string]string{"type": "raid0_meta"},
+			lvm.VolumeLayout{Type: lvm.VolumeTypeRAID0Meta},
+		},
+		{
+			map[string]string{"type": "raid1", "mirrors": "2", "regionsize": "2097152", "nosync": "y"},
+			lvm.VolumeLayout{Type: lvm.VolumeTypeRAID1, Mirrors: 2, RegionSize: 2 << 20, Nosync: 1},
+		},
+		{
+			map[string]string{"type": "raid4", "stripes": "2", "stripesize": "4096"},
+			lvm.VolumeLayout{Type: lvm.VolumeTypeRAID4, Stripes: 2, StripeSize: 4 << 10},
+		},
+		{
+			map[string]string{"type": "raid10", "stripes": "2", "mirrors": "2", "stripesize": "131072", "regionsize": "524288"},
+			lvm.VolumeLayout{Type: lvm.VolumeTypeRAID10, Stripes: 2, Mirrors: 2, StripeSize: 128 << 10, RegionSize: 512 << 10},
+		},
+	} {
+		params := dupParams(tc.params)
+		layout, err := takeVolumeLayoutFromParameters(params)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.params, err)
+		}
+		if !reflect.DeepEqual(layout, tc.layout) {
+			t.Fatalf("%v: expected layout %+v but got %+v", tc.params, tc.layout, layout)
+		}
+		if len(params) != 0 {
+			t.Fatalf("Expected all parameters to be taken but got %v", params)
+		}
+	}
+	for _, params := range []map[string]string{
+		{"type": "raid5", "regionsize": "1000"},
+		{"type": "raid10", "stripesize": "2048"},
+		{"type": "raid10", "mirrors": "0"},
+		{"type": "raid4", "stripes": "x"},
+		{"type": "raid3"},
+	} {
+		if _, err := takeVolumeLayoutFromParameters(params); err == nil {
+			t.Fatalf("Expected an error for %v", params)
+		}
+	}
+}
+
+func TestTakeVolumeLayoutFromParameters_VDO(t *testing.T) {
+	params := map[string]string{
+		"type":             "vdo",
+		"vdovirtualratio":  "2.5",
+		"vdocompression":   "no",
+		"vdodeduplication": "yes",
+	}
+	layout, err := takeVolumeLayoutFromParameters(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := lvm.VolumeLayout{Type: lvm.VolumeTypeVDO, VirtualRatio: 2.5, Deduplication: true}
+	if !reflect.DeepEqual(layout, exp) {
+		t.Fatalf("Expected layout %+v but got %+v", exp, layout)
+	}
+	if len(params) != 0 {
+		t.Fatalf("Expected all parameters to be taken but got %v", params)
+	}
+	layout, err = takeVolumeLayoutFromParameters(map[string]string{"type": "vdo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !layout.Compression || !layout.Deduplication {
+		t.Fatalf("Expected compression and deduplication by default but got %+v", layout)
+	}
+	for _, params := range []map[string]string{
+		{"type": "vdo", "vdovirtualratio": "0.5"},
+		{"type": "vdo", "vdocompression": "maybe"},
+		{"type": "thin", "thinpooltype": "vdo"},
+	} {
+		if _, err := takeVolumeLayoutFromParameters(params); err == nil {
+			t.Fatalf("Expected an error for %v", params)
+		}
+	}
+}
+
+func TestTakeVolumeLayoutFromParameters_PhysicalVolumes(t *testing.T) {
+	params := map[string]string{
+		"type":   "raid1",
+		"pvtags": "nvme, @enclosure1",
+	}
+	layout, err := takeVolumeLayoutFromParameters(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := lvm.VolumeLayout{Type: lvm.VolumeTypeRAID1, PhysicalVolumes: []string{"@nvme", "@enclosure1"}}
+	if !reflect.DeepEqual(layout, exp) {
+		t.Fatalf("Expected layout %+v but got %+v", exp, layout)
+	}
+	if len(params) != 0 {
+		t.Fatalf("Expected all parameters to be taken but got %v", params)
+	}
+	// The selection of a thin volume applies to its thin pool.
+	layout, err = takeVolumeLayoutFromParameters(map[string]string{
+		"type":   "thin",
+		"pvtags": "nvme",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layout.PhysicalVolumes != nil || layout.ThinPoolLayout == nil ||
+		!reflect.DeepEqual(layout.ThinPoolLayout.PhysicalVolumes, []string{"@nvme"}) {
+		t.Fatalf("Expected the thin pool to be restricted to @nvme but got %+v", layout)
+	}
+	if _, err := takeVolumeLayoutFromParameters(map[string]string{"pvtags": "bad/tag"}); err == nil {
+		t.Fatalf("Expected an error for an invalid tag")
+	}
+	// Serial numbers are resolved to drives by resolvePhysicalVolumes
+	// rather than while parsing.
+	layout, err = takeVolumeLayoutFromParameters(map[string]string{
+		"pvtags":     "nvme",
+		"SsdSerials": "SN1 SN2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"@nvme", "serial:SN1", "serial:SN2"}; !reflect.DeepEqual(layout.PhysicalVolumes, exp) {
+		t.Fatalf("Expected %v but got %v", exp, layout.PhysicalVolumes)
+	}
+	layout = lvm.VolumeLayout{PhysicalVolumes: []string{"@nvme"}}
+	if err := resolvePhysicalVolumes(&layout); err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"@nvme"}; !reflect.DeepEqual(layout.PhysicalVolumes, exp) {
+		t.Fatalf("Expected %v but got %v", exp, layout.PhysicalVolumes)
+	}
+}
+
+func TestTakeVolumeLayoutFromParameters_FailureDomain(t *testing.T) {
+	params := map[string]string{
+		"type":          "raid10",
+		"stripes":       "2",
+		"failuredomain": "@enclosure-",
+	}
+	layout, err := takeVolumeLayoutFromParameters(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := lvm.VolumeLayout{Type: lvm.VolumeTypeRAID10, Stripes: 2, FailureDomain: "enclosure-"}
+	if !reflect.DeepEqual(layout, exp) {
+		t.Fatalf("Expected layout %+v but got %+v", exp, layout)
+	}
+	if len(params) != 0 {
+		t.Fatalf("Expected all parameters to be taken but got %v", params)
+	}
+	// The failure domain of a thin volume applies to its thin pool.
+	layout, err = takeVolumeLayoutFromParameters(map[string]string{
+		"type":          "thin",
+		"thinpooltype":  "raid1",
+		"failuredomain": "enclosure-",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layout.FailureDomain != "" || layout.ThinPoolLayout == nil || layout.ThinPoolLayout.FailureDomain != "enclosure-" {
+		t.Fatalf("Expected the thin pool to be spread across enclosures but got %+v", layout)
+	}
+	for _, params := range []map[string]string{
+		{"type": "linear", "failuredomain": "enclosure-"},
+		{"type": "thin", "failuredomain": "enclosure-"},
+		{"type": "raid1", "failuredomain": "bad/tag-"},
+		// The prefix must end in a separator.
+		{"type": "raid1", "failuredomain": "enclosure"},
+	} {
+		if _, err := takeVolumeLayoutFromParameters(params); err == nil {
+			t.Fatalf("Expected an error for parameters %v", params)
+		}
+	}
+}
+
+func TestTakeVolumeLayoutFromParameters_Integrity(t *testing.T) {
+	params := map[string]string{
+		"type":          "raid5",
+		"integrity":     "yes",
+		"integritymode": "bitmap",
+	}
+	layout, err := takeVolumeLayoutFromParameters(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := lvm.VolumeLayout{Type: lvm.VolumeTypeRAID5, Integrity: true, IntegrityMode: "bitmap"}
+	if !reflect.DeepEqual(layout, exp) {
+		t.Fatalf("Expected layout %+v but got %+v", exp, layout)
+	}
+	if len(params) != 0 {
+		t.Fatalf("Expected all parameters to be taken but got %v", params)
+	}
+	for _, params := range []map[string]string{
+		{"type": "raid1", "integritymode": "journal"},
+		{"type": "raid10", "integrity": "yes", "integritymode": "none"},
+		{"type": "raid6", "integrity": "sometimes"},
+	} {
+		if _, err := takeVolumeLayoutFromParameters(params); err == nil {
+			t.Fatalf("Expected an error for %v", params)
+		}
+	}
+	// Integrity is only supported for RAID volumes with redundancy.
+	if _, err := volumeOptsFromParameters(map[string]string{"type": "raid0", "integrity": "yes"}); err == nil {
+		t.Fatalf("Expected an error for integrity on raid0")
+	}
+}
+
+func TestTakeCacheFromParameters(t *testing.T) {
+	params := map[string]string{
+		"cache":      "writeback",
+		"cachesize":  "1073741824",
+		"cachepvtag": "nvme",
+	}
+	cache, err := takeCacheFromParameters(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := lvm.Cache{Mode: lvm.CacheModeWriteback, SizeInBytes: 1 << 30, PVTag: "nvme"}
+	if cache != exp {
+		t.Fatalf("Expected cache %+v but got %+v", exp, cache)
+	}
+	if len(params) != 0 {
+		t.Fatalf("Expected all parameters to be taken but got %v", params)
+	}
+	// The size may have a binary suffix.
+	cache, err = takeCacheFromParameters(map[string]string{"cache": "writecache", "cachesize": "2Gi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache.SizeInBytes != 2<<30 {
+		t.Fatalf("Expected a cache of %d bytes but got %d", 2<<30, cache.SizeInBytes)
+	}
+	cache, err = takeCacheFromParameters(map[string]string{"cache": "none"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache.Mode != lvm.CacheModeNone {
+		t.Fatalf("Expected no cache but got %+v", cache)
+	}
+	for _, params := range []map[string]string{
+		{"cache": "writearound", "cachesize": "1024"},
+		{"cache": "writecache"},
+		{"cache": "writethrough", "cachesize": "0"},
+		{"cache": "writethrough", "cachesize": "0Gi"},
+		{"cache": "writethrough", "cachesize": "1GB"},
+		{"cache": "writethrough", "cachesize": "16777216Ti"},
+		{"cache": "writethrough", "cachesize": "1024", "cachepvtag": "bad/tag"},
+		{"cachesize": "1024"},
+	} {
+		if _, err := takeCacheFromParameters(params); err == nil {
+			t.Fatalf("Expected an error for %v", params)
+		}
+	}
+	if _, err := volumeOptsFromParameters(map[string]string{"type": "thin", "cache": "writeback", "cachesize": "1024"}); err == nil {
+		t.Fatalf("Expected an error for a cached thin volume")
+	}
+}
+
+func TestVolumeOptsFromParameters_Allocation(t *testing.T) {
+	opts, err := volumeOptsFromParameters(map[string]string{"type": "linear", "allocation": "least-used"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(opts) != 2 {
+		t.Fatalf("Expected a layout and an allocation opt but got %d opts", len(opts))
+	}
+	if _, err := volumeOptsFromParameters(map[string]string{"allocation": "bogus"}); err == nil {
+		t.Fatalf("Expected an error for an unknown allocation strategy")
+	}
+	if _, err := volumeOptsFromParameters(map[string]string{"type": "linear", "allocation": "anywhere"}); err != nil {
+		t.Fatal(err)
+	}
+	// The images of a RAID volume, or of the RAID thin pool of a thin
+	// volume, must not share physical volumes.
+	for _, params := range []map[string]string{
+		{"type": "raid1", "allocation": "anywhere"},
+		{"type": "thin", "thinpooltype": "raid1", "allocation": "anywhere"},
+	} {
+		if _, err := volumeOptsFromParameters(params); err == nil {
+			t.Fatalf("Expected an error for %v", params)
+		}
+	}
+}
+
+func TestEncryptedFromParameters(t *testing.T) {
+	for _, tc := range []struct {
+		params    map[string]string
+		encrypted bool
+	}{
+		{nil, false},
+		{map[string]string{"encrypted": "true"}, true},
+		{map[string]string{"encrypted": "False"}, false},
+	} {
+		encrypted, err := encryptedFromParameters(tc.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encrypted != tc.encrypted {
+			t.Fatalf("Expected encrypted=%v for %v", tc.encrypted, tc.params)
+		}
+	}
+	if _, err := encryptedFromParameters(map[string]string{"encrypted": "yes"}); err == nil {
+		t.Fatalf("Expected an error")
+	}
+}
+
+func TestCryptMappingName(t *testing.T) {
+	s := &Server{vgname: "sbvg_datalake"}
+	for _, tc := range []struct {
+		id   string
+		name string
+	}{
+		{"csilv123", "csicrypt-sbvg_datalake-csilv123"},
+		{"sbvg_archive/csilv123", "csicrypt-sbvg_archive-csilv123"},
+	} {
+		name := s.cryptMappingName(tc.id)
+		if name != tc.name {
+			t.Fatalf("Expected mapping %q for %q but got %q", tc.name, tc.id, name)
+		}
+		if !isCryptMapperPath("/dev/mapper/" + name) {
+			t.Fatalf("Expected %q to be a mapper path", name)
+		}
+		if got := dataPathType("/dev/mapper/" + name); got != "crypt" {
+			t.Fatalf("Expected the crypt datapath but got %q", got)
+		}
+	}
+	if isCryptMapperPath("/dev/mapper/sbvg_datalake-csilv123") {
+		t.Fatalf("Expected a logical volume not to be a crypt mapper path")
+	}
+}
+
+func TestCryptStatusActive(t *testing.T) {
+	for _, tc := range []struct {
+		output string
+		active bool
+	}{
+		{"/dev/mapper/csicrypt-vg-lv is active.\n  type:    LUKS2\n", true},
+		{"/dev/mapper/csicrypt-vg-lv is active and is in use.\n", true},
+		{"/dev/mapper/csicrypt-vg-lv is inactive.\n", false},
+		// The StoLake agent returns no output if the command fails.
+		{"", false},
+	} {
+		if got := cryptStatusActive(tc.output); got != tc.active {
+			t.Fatalf("Expected active=%v for %q", tc.active, tc.output)
+		}
+	}
+}
+
+func TestRotateKeyFromParameters(t *testing.T) {
+	for _, tc := range []struct {
+		params     map[string]string
+		generation string
+	}{
+		{map[string]string{"cache": "writeback"}, ""},
+		{map[string]string{"rotatekey": "2026-10"}, "2026-10"},
+	} {
+		generation, err := rotateKeyFromParameters(tc.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if generation != tc.generation {
+			t.Fatalf("Expected generation %q for %v but got %q", tc.generation, tc.params, generation)
+		}
+		if _, ok := tc.params["rotatekey"]; ok {
+			t.Fatalf("Expected the rotatekey parameter to be consumed: %v", tc.params)
+		}
+	}
+	if _, err := rotateKeyFromParameters(map[string]string{"rotatekey": ""}); err == nil {
+		t.Fatalf("Expected an error")
+	}
+}
+
+func TestKeyGenerationFromTags(t *testing.T) {
+	if generation := keyGenerationFromTags([]string{tagEncrypted}); generation != "" {
+		t.Fatalf("Expected no generation but got %q", generation)
+	}
+	// Generations need not be tag-safe.
+	tags := []string{tagEncrypted, keyGenerationTag("rotate 2026/10")}
+	if generation := keyGenerationFromTags(tags); generation != "rotate 2026/10" {
+		t.Fatalf("Expected the recorded generation but got %q", generation)
+	}
+}
+
+func TestNextKeyIDFromTags(t *testing.T) {
+	tags := []string{tagEncrypted, tagKeyIDPrefix + "old", tagNextKeyIDPrefix + "new"}
+	if keyID := keyIDFromTags(tags); keyID != "old" {
+		t.Fatalf("Expected key ID old but got %q", keyID)
+	}
+	if keyID := nextKeyIDFromTags(tags); keyID != "new" {
+		t.Fatalf("Expected next key ID new but got %q", keyID)
+	}
+	if keyID := nextKeyIDFromTags(tags[:2]); keyID != "" {
+		t.Fatalf("Expected no next key ID but got %q", keyID)
+	}
+}
+
+func TestCryptKeyUnlocked(t *testing.T) {
+	for _, tc := range []struct {
+		output   string
+		unlocked bool
+	}{
+		{"Key slot 1 unlocked.\nCommand successful.\n", true},
+		{"No key available with this passphrase.\nCommand failed with code -2 (no permission or bad passphrase).\n", false},
+		// The StoLake agent returns no output if the command fails.
+		{"", false},
+	} {
+		if got := cryptKeyUnlocked(tc.output); got != tc.unlocked {
+			t.Fatalf("Expected unlocked=%v for %q", tc.unlocked, tc.output)
+		}
+	}
+}
+
+func TestSelectSedDrives(t *testing.T) {
+	seds := []string{"/dev/sdb", "/dev/sdc"}
+	for _, tc := range []struct {
+		devices  []string
+		expected []string
+	}{
+		// No devices given, e.g. -devices unset.
+		{[]string{""}, seds},
+		{[]string{"/dev/sdb", "/dev/sdd"}, []string{"/dev/sdb"}},
+		{[]string{"/dev/sdd"}, nil},
+	} {
+		selected := selectSedDrives(tc.devices, seds)
+		if !reflect.DeepEqual(selected, tc.expected) {
+			t.Fatalf("Expected %v for %v but got %v", tc.expected, tc.devices, selected)
+		}
+	}
+}
+
+// fakeSedAgent records the operations on self-encrypting drives.
+type fakeSedAgent struct {
+	drives []string
+	owned  map[string]bool
+	err    error
+	calls  []string
+}
+
+func (f *fakeSedAgent) record(op, dev string) error {
+	f.calls = append(f.calls, op+" "+dev)
+	return f.err
+}
+
+func (f *fakeSedAgent) Drives() ([]string, error)      { return f.drives, nil }
+func (f *fakeSedAgent) Owned(dev string) (bool, error) { return f.owned[dev], nil }
+func (f *fakeSedAgent) TakeOwnership(dev string) error { return f.record("takeownership", dev) }
+func (f *fakeSedAgent) Unlock(dev string) error        { return f.record("unlock", dev) }
+func (f *fakeSedAgent) Lock(dev string) error          { return f.record("lock", dev) }
+func (f *fakeSedAgent) ResetGlobalBand(dev string) error {
+	return f.record("resetglobalband", dev)
+}
+
+func TestUnlockDrives(t *testing.T) {
+	sed := &fakeSedAgent{
+		drives: []string{"/dev/sdb", "/dev/sdc", "/dev/sdd"},
+		owned:  map[string]bool{"/dev/sdb": true},
+	}
+	s := &Server{pvnames: []string{"/dev/sdb", "/dev/sdc"}, sed: sed}
+	if err := s.unlockDrives(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"unlock /dev/sdb", "takeownership /dev/sdc", "unlock /dev/sdc"}
+	if !reflect.DeepEqual(sed.calls, expected) {
+		t.Fatalf("Expected %v but got %v", expected, sed.calls)
+	}
+}
+
+func TestLockDrives(t *testing.T) {
+	if err := (&Server{}).LockDrives(); err != nil {
+		t.Fatalf("Expected no error without managed drives but got %v", err)
+	}
+	sed := &fakeSedAgent{drives: []string{"/dev/sdb", "/dev/sdc"}}
+	s := &Server{pvnames: []string{""}, sed: sed}
+	if err := s.LockDrives(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"lock /dev/sdb", "lock /dev/sdc"}
+	if !reflect.DeepEqual(sed.calls, expected) {
+		t.Fatalf("Expected %v but got %v", expected, sed.calls)
+	}
+	sed = &fakeSedAgent{drives: []string{"/dev/sdb"}, err: errors.New("locked out")}
+	s = &Server{pvnames: []string{""}, sed: sed}
+	if err := s.LockDrives(); err == nil {
+		t.Fatal("Expected the lock error")
+	}
+}
+
+func TestRetireDrive(t *testing.T) {
+	if err := (&Server{}).retireDrive("/dev/sdb"); err != nil {
+		t.Fatalf("Expected no error without managed drives but got %v", err)
+	}
+	sed := &fakeSedAgent{drives: []string{"/dev/sdb", "/dev/sdc"}}
+	s := &Server{sed: sed}
+	if err := s.retireDrive("/dev/sdc"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"resetglobalband /dev/sdc"}
+	if !reflect.DeepEqual(sed.calls, expected) {
+		t.Fatalf("Expected %v but got %v", expected, sed.calls)
+	}
+	// A device that is not a self-encrypting drive is left alone.
+	sed.calls = nil
+	if err := s.retireDrive("/dev/sdd"); err != nil {
+		t.Fatal(err)
+	}
+	if len(sed.calls) != 0 {
+		t.Fatalf("Expected no operations but got %v", sed.calls)
+	}
+	sed.err = errors.New("band busy")
+	if err := s.retireDrive("/dev/sdb"); err == nil {
+		t.Fatal("Expected the reset error")
+	}
+}
+
+func TestIsAccessibleFrom(t *testing.T) {
+	s := &Server{vgname: "vgcsitenant1"}
+	node := func(segments map[string]string) []*csi.Topology {
+		return []*csi.Topology{{Segments: segments}}
+	}
+	seesVG := node(map[string]string{
+		"tenant1" + topologyKey:                             "node-1",
+		"tenant1" + topologyVolumeGroupKey + "vgcsitenant1": "true",
+	})
+	blind := node(map[string]string{"tenant1" + topologyKey: "node-2"})
+	otherVG := node(map[string]string{"tenant1" + topologyVolumeGroupKey + "vgcsitenant2": "true"})
+	cases := []struct {
+		datapath   string
+		vgname     string
+		topologies []*csi.Topology
+		accessible bool
+	}{
+		{"direct", "vgcsitenant1", seesVG, true},
+		{"direct", "vgcsitenant1", blind, false},
+		{"direct", "vgcsitenant1", otherVG, false},
+		{"direct", "vgcsitenant2", otherVG, true},
+		{"direct", "vgcsitenant1", append(blind, seesVG...), true},
+		{"direct", "vgcsitenant1", nil, true},
+		{"iscsi", "vgcsitenant1", blind, true},
+		{"jbofis", "vgcsitenant1", otherVG, true},
+		{"nvme", "vgcsitenant1", blind, true},
+	}
+	for _, tc := range cases {
+		if got := s.isAccessibleFrom(tc.datapath, tc.vgname, tc.topologies); got != tc.accessible {
+			t.Fatalf("Expected accessible=%v for %v in %v from %v but got %v", tc.accessible, tc.datapath, tc.vgname, tc.topologies, got)
+		}
+	}
+}
+
+func TestVolumeID(t *testing.T) {
+	s := &Server{vgname: "vgcsitenant1", additionalVgnames: []string{"vgcsitenant2"}}
+	cases := []struct {
+		vgname, lvname, id string
+	}{
+		// IDs of volumes in the primary volume group are unchanged.
+		{"vgcsitenant1", "csilv123", "csilv123"},
+		{"vgcsitenant2", "csilv123", "vgcsitenant2/csilv123"},
+		{"vgcsitenant2", "csisnap456", "vgcsitenant2/csisnap456"},
+	}
+	for _, tc := range cases {
+		id := s.volumeID(tc.vgname, tc.lvname)
+		if id != tc.id {
+			t.Fatalf("Expected id %v but got %v", tc.id, id)
+		}
+		vgname, lvname := s.splitVolumeID(id)
+		if vgname != tc.vgname || lvname != tc.lvname {
+			t.Fatalf("Expected %v/%v but got %v/%v", tc.vgname, tc.lvname, vgname, lvname)
+		}
+	}
+	if !s.isSnapshotID("vgcsitenant2/csisnap456") || s.isSnapshotID("vgcsitenant2/csilv123") {
+		t.Fatal("Expected snapshot IDs to be recognized by their LV name")
+	}
+	if _, err := s.lookupLogicalVolume("unmanaged/csilv123"); err != lvm.ErrLogicalVolumeNotFound {
+		t.Fatalf("Expected ErrLogicalVolumeNotFound but got %v", err)
+	}
+}
+
+func TestParseStatfs(t *testing.T) {
+	stats, err := parseStatfs("4096 1000 400 300 500 450\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage := stats.usage()
+	bytes, inodes := usage[0], usage[1]
+	if bytes.GetTotal() != 4096000 || bytes.GetAvailable() != 1228800 || bytes.GetUsed() != 2457600 {
+		t.Fatalf("Unexpected byte usage %+v", bytes)
+	}
+	if inodes.GetTotal() != 500 || inodes.GetAvailable() != 450 || inodes.GetUsed() != 50 {
+		t.Fatalf("Unexpected inode usage %+v", inodes)
+	}
+	for _, output := range []string{"", "4096 1000 400 300 500", "4096 x 400 300 500 450"} {
+		if _, err := parseStatfs(output); err == nil {
+			t.Fatalf("Expected an error for %q", output)
+		}
+	}
+}
+
+func TestParseDiskStats(t *testing.T) {
+	prev, err := parseDiskStats("    100 0 800 50 200 0 1600 400 3 90 450 0 0 0 0\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := parseDiskStats("    300 5 2400 250 600 7 5600 1200 1 290 1450\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.inFlight != 1 {
+		t.Fatalf("Unexpected in-flight count %v", stats.inFlight)
+	}
+	rates, ok := stats.ratesSince(prev, 2*time.Second)
+	if !ok {
+		t.Fatal("Expected rates")
+	}
+	exp := ioRates{
+		readIOPS:            100,
+		writeIOPS:           200,
+		readBytesPerSecond:  1600 * 512 / 2,
+		writeBytesPerSecond: 4000 * 512 / 2,
+		readLatency:         1,
+		writeLatency:        2,
+	}
+	if rates != exp {
+		t.Fatalf("Expected rates %+v, got %+v", exp, rates)
+	}
+	if _, ok := prev.ratesSince(stats, time.Second); ok {
+		t.Fatal("Expected no rates for counters that went backwards")
+	}
+	for _, output := range []string{"", "1 2 3 4 5 6 7 8 9 10", "1 2 3 x 5 6 7 8 9 10 11"} {
+		if _, err := parseDiskStats(output); err == nil {
+			t.Fatalf("Expected an error for %q", output)
+		}
+	}
+}
+
+func TestParseDeviceMapperName(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		vgname string
+		lvname string
+		ok     bool
+	}{
+		{"vg-csilv1", "vg", "csilv1", true},
+		{"my--vg-csilv1", "my-vg", "csilv1", true},
+		{"vg-csilv1_rimage_0", "vg", "csilv1_rimage_0", true},
+		{"vg-csilv1-real", "", "", false},
+		{"sda", "", "", false},
+	} {
+		vgname, lvname, ok := parseDeviceMapperName(tt.name)
+		if vgname != tt.vgname || lvname != tt.lvname || ok != tt.ok {
+			t.Fatalf("%q: expected (%q, %q, %v), got (%q, %q, %v)", tt.name, tt.vgname, tt.lvname, tt.ok, vgname, lvname, ok)
+		}
+	}
+}
+
+func TestParseDeviceMapperDevices(t *testing.T) {
+	devices := parseDeviceMapperDevices("vg-csilv1 dm-3\nvg-csilv2 dm-4\n\n")
+	if len(devices) != 2 || devices["vg-csilv1"] != "dm-3" || devices["vg-csilv2"] != "dm-4" {
+		t.Fatalf("Unexpected devices %v", devices)
+	}
+}
+
+func TestParseRaidStatus(t *testing.T) {
+	statuses := parseRaidStatus("vg-csilv1: 0 2097152 raid raid1 2 AA 2097152/2097152 idle 0 0 -\n" +
+		"vg-csilv2: 0 4194304 raid raid5_ls 3 AAA 1048576/2097152 check 12 0 -\n" +
+		"vg-csilv3: 0 2097152 linear\n")
+	exp := map[string]raidStatus{
+		"vg-csilv1": {syncAction: "idle", mismatches: 0},
+		"vg-csilv2": {syncAction: "check", mismatches: 12},
+	}
+	if !reflect.DeepEqual(statuses, exp) {
+		t.Fatalf("Expected %v, got %v", exp, statuses)
+	}
+}
+
+func TestSyncActionGauges(t *testing.T) {
+	gauges := syncActionGauges("check")
+	if len(gauges) != len(raidSyncActions) {
+		t.Fatalf("Expected a gauge for every sync action, got %v", gauges)
+	}
+	for action, value := range gauges {
+		exp := 0.0
+		if action == "check" {
+			exp = 1
+		}
+		if value != exp {
+			t.Fatalf("Expected %v for sync action %v, got %v", exp, action, value)
+		}
+	}
+	// An unknown sync action is reported as well.
+	if gauges := syncActionGauges("unknown"); gauges["unknown"] != 1 || gauges["idle"] != 0 {
+		t.Fatalf("Unexpected gauges %v", gauges)
+	}
+}
+
+func TestPVCTag(t *testing.T) {
+	tag := pvcToTag(map[string]string{
+		paramPVCName:      "data",
+		paramPVCNamespace: "default",
+	})
+	if !strings.HasPrefix(tag, tagPVCEncodedPrefix) {
+		t.Fatalf("Expected an encoded tag, got %q", tag)
+	}
+	if pvc := pvcFromTags([]string{"VN.pvc-1", tag}); pvc != "default/data" {
+		t.Fatalf("Expected default/data, got %q", pvc)
+	}
+	if tag := pvcToTag(map[string]string{paramPVCName: "data"}); tag != tagPVCPlainPrefix+"data" {
+		t.Fatalf("Unexpected tag %q", tag)
+	}
+	if tag := pvcToTag(map[string]string{"type": "linear"}); tag != "" {
+		t.Fatalf("Expected no tag, got %q", tag)
+	}
+	if pvc := pvcFromTags([]string{"VN.pvc-1"}); pvc != "" {
+		t.Fatalf("Expected no claim, got %q", pvc)
+	}
+	if _, err := volumeOptsFromParameters(map[string]string{
+		paramPVCName:      "data",
+		paramPVCNamespace: "default",
+		paramPVName:       "pvc-1",
+	}); err != nil {
+		t.Fatalf("Expected the claim metadata to be accepted, got %v", err)
+	}
+}
+
+func TestTakeQosFromParameters(t *testing.T) {
+	params := map[string]string{
+		"type":      "linear",
+		"iopspergb": "6",
+		"mbpspergb": "0.5",
+		"iops":      "100",
+		"burstiops": "500",
+	}
+	spec, err := takeQosFromParameters(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := qosSpec{IOPSPerGB: 6, MBpsPerGB: 0.5, IOPS: 100, BurstIOPS: 500, BurstSeconds: defaultBurstSeconds}
+	if spec != exp {
+		t.Fatalf("Expected %+v, got %+v", exp, spec)
+	}
+	if !reflect.DeepEqual(params, map[string]string{"type": "linear"}) {
+		t.Fatalf("Expected the QoS parameters to be taken, got %v", params)
+	}
+	for _, params := range []map[string]string{
+		{"iopspergb": "0"},
+		{"iopspergb": "fast"},
+		{"mbps": "-1"},
+		{"iops": "1.5"},
+		{"burstiops": "500"},
+		{"mbpspergb": "1", "burstiops": "500"},
+		{"iops": "100", "burstseconds": "10"},
+	} {
+		if _, err := takeQosFromParameters(params); err == nil {
+			t.Fatalf("Expected an error for %v", params)
+		}
+	}
+	if _, err := volumeOptsFromParameters(map[string]string{"iopspergb": "fast"}); err == nil {
+		t.Fatal("Expected an error for an invalid QoS parameter")
+	}
+}
+
+func TestQosLimits(t *testing.T) {
+	const size = 10 << 30
+	for _, tt := range []struct {
+		spec qosSpec
+		exp  qosLimits
+	}{
+		{qosSpec{}, qosLimits{}},
+		{qosSpec{IOPSPerGB: 6, MBpsPerGB: 0.48}, qosLimits{iops: 60, bps: 5 << 20}},
+		{qosSpec{IOPSPerGB: 6, IOPS: 50}, qosLimits{iops: 50}},
+		{qosSpec{IOPSPerGB: 6, IOPS: 100}, qosLimits{iops: 60}},
+		{qosSpec{MBps: 20}, qosLimits{bps: 20 << 20}},
+		{qosSpec{IOPS: 100, BurstIOPS: 300, BurstSeconds: 60}, qosLimits{iops: 100, burstIOPS: 300}},
+		{qosSpec{IOPS: 100, BurstIOPS: 80, BurstSeconds: 60}, qosLimits{iops: 100}},
+	} {
+		if got := tt.spec.limits(size); got != tt.exp {
+			t.Fatalf("%+v: expected %+v, got %+v", tt.spec, tt.exp, got)
+		}
+	}
+}
+
+func TestQosTag(t *testing.T) {
+	spec := qosSpec{IOPSPerGB: 6, MBpsPerGB: 0.48, BurstIOPS: 500, BurstSeconds: 60}
+	tag := qosToTag(spec)
+	if err := lvm.ValidateTag(tag); err != nil {
+		t.Fatalf("Invalid tag %q: err=%v", tag, err)
+	}
+	got, ok := parseQosTag([]string{"VN.pvc-1", "qos-6-0.48", tag})
+	if !ok || got != spec {
+		t.Fatalf("Expected %+v, got %+v", spec, got)
+	}
+	if _, ok := parseQosTag([]string{"qos-6-0.48"}); ok {
+		t.Fatal("Expected no QoS record")
+	}
+}
+
+func TestIoMaxLine(t *testing.T) {
+	if line := ioMaxLine("253:3", 60, 5<<20); line != "253:3 riops=60 wiops=60 rbps=5242880 wbps=5242880" {
+		t.Fatalf("Unexpected line %q", line)
+	}
+	if line := ioMaxLine("253:3", 0, 0); line != "253:3 riops=max wiops=max rbps=max wbps=max" {
+		t.Fatalf("Unexpected line %q", line)
+	}
+}
+
+func TestQosBurstCredits(t *testing.T) {
+	spec := qosSpec{IOPS: 100, BurstIOPS: 300, BurstSeconds: 10}
+	q := &appliedQos{spec: spec, limits: spec.limits(1 << 30)}
+	q.iopsCredits, q.burstingIOPS = q.iopsCreditLimit(), true
+	if q.iopsCredits != 2000 {
+		t.Fatalf("Expected 2000 credits, got %v", q.iopsCredits)
+	}
+	// Bursting at 300 IOPS uses up 200 credits per second.
+	for i := 0; i < 9; i++ {
+		if q.updateCredits(ioRates{readIOPS: 300}, time.Second) {
+			t.Fatalf("Expected the burst to last, %v credits left", q.iopsCredits)
+		}
+	}
+	if !q.updateCredits(ioRates{readIOPS: 300}, time.Second) || q.burstingIOPS {
+		t.Fatal("Expected the burst to end")
+	}
+	if iops, _ := q.current(); iops != 100 {
+		t.Fatalf("Expected the baseline limit, got %v", iops)
+	}
+	// Running at the baseline earns no credits.
+	if q.updateCredits(ioRates{readIOPS: 100, writeIOPS: 100}, time.Second) {
+		t.Fatal("Expected no burst at the baseline")
+	}
+	// Running below the baseline earns credits back.
+	if !q.updateCredits(ioRates{readIOPS: 50}, time.Second) || q.iopsCredits != 50 {
+		t.Fatalf("Expected to burst again with 50 credits, got %v", q.iopsCredits)
+	}
+	if iops, _ := q.current(); iops != 300 {
+		t.Fatalf("Expected the burst limit, got %v", iops)
+	}
+	if q.updateCredits(ioRates{}, time.Hour) || q.iopsCredits != 2000 {
+		t.Fatalf("Expected the credits to be capped at 2000, got %v", q.iopsCredits)
+	}
+}
+
+func TestRegulateQosBurst(t *testing.T) {
+	s := &Server{}
+	spec := qosSpec{IOPS: 100, BurstIOPS: 300, BurstSeconds: 10}
+	q := &appliedQos{device: "253:3"}
+	q.update(spec, 1<<30)
+	now := time.Now()
+	s.regulateQosBurst("csilv1", q, diskStats{}, now)
+	if !q.sampled || q.iopsCredits != 2000 {
+		t.Fatalf("Expected the first sample to be recorded without charging credits, got %v", q.iopsCredits)
+	}
+	// 300 reads in the last second use up 200 credits.
+	s.regulateQosBurst("csilv1", q, diskStats{readIOs: 300}, now.Add(time.Second))
+	if q.iopsCredits != 1800 {
+		t.Fatalf("Expected 1800 credits, got %v", q.iopsCredits)
+	}
+}
+
+func TestModifyQos(t *testing.T) {
+	spec := qosSpec{IOPSPerGB: 6, IOPS: 100, BurstIOPS: 500, BurstSeconds: defaultBurstSeconds}
+	if got, err := takeQosFromParameters(spec.parameters()); err != nil || got != spec {
+		t.Fatalf("Expected %+v to round-trip, got %+v, err=%v", spec, got, err)
+	}
+	params := map[string]string{
+		"iopspergb": "10",
+		"iops":      "0",
+		"cache":     "writeback",
+	}
+	modified, err := modifyQos(spec, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := qosSpec{IOPSPerGB: 10, BurstIOPS: 500, BurstSeconds: defaultBurstSeconds}
+	if modified != exp {
+		t.Fatalf("Expected %+v, got %+v", exp, modified)
+	}
+	if !reflect.DeepEqual(params, map[string]string{"cache": "writeback"}) {
+		t.Fatalf("Expected the QoS parameters to be taken, got %v", params)
+	}
+	for _, params := range []map[string]string{
+		{"iopspergb": "fast"},
+		{"iopspergb": "0", "iops": "0"},
+		{"burstiops": "0", "burstseconds": "10"},
+	} {
+		if _, err := modifyQos(spec, params); err == nil {
+			t.Fatalf("Expected an error for %v", params)
+		}
+	}
+}
+
+func TestCreateParameters(t *testing.T) {
+	request := &csi.CreateVolumeRequest{
+		Parameters:        map[string]string{"type": "linear", "iopspergb": "6", "iops": "100"},
+		MutableParameters: map[string]string{"iopspergb": "10", "iops": "0"},
+	}
+	exp := map[string]string{"type": "linear", "iopspergb": "10"}
+	if params := createParameters(request); !reflect.DeepEqual(params, exp) {
+		t.Fatalf("Expected %v, got %v", exp, params)
+	}
+	// A new volume has a new data key, rotatekey is ignored.
+	request.MutableParameters["rotatekey"] = "1"
+	if params := createParameters(request); !reflect.DeepEqual(params, exp) {
+		t.Fatalf("Expected %v, got %v", exp, params)
+	}
+	// The request is left as is, e.g. for a retry.
+	if exp := map[string]string{"type": "linear", "iopspergb": "6", "iops": "100"}; !reflect.DeepEqual(request.Parameters, exp) {
+		t.Fatalf("Expected the request parameters %v to be kept, got %v", exp, request.Parameters)
+	}
+}
+
+func TestValidateMutableParameters(t *testing.T) {
+	if err := validateMutableParameters(map[string]string{"iopspergb": "6", "cache": "writeback", "rotatekey": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	err := validateMutableParameters(map[string]string{"iops": "100", "type": "raid1", "encrypt": "true"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "[encrypt type]") {
+		t.Fatalf("Expected the immutable parameters in the error, got %v", err)
+	}
+}
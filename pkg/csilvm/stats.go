@@ -0,0 +1,202 @@
+package csilvm
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/Seagate/csiclvm/pkg/virsh"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fsStats is the subset of statfs(2) reported by NodeGetVolumeStats.
+type fsStats struct {
+	blockSize   uint64
+	blocks      uint64
+	blocksFree  uint64
+	blocksAvail uint64
+	inodes      uint64
+	inodesFree  uint64
+}
+
+// statfsFormat is the `stat --file-system` format parsed by parseStatfs.
+const statfsFormat = "%S %b %f %a %c %d"
+
+// parseStatfs parses the output of `stat --file-system --format` with
+// statfsFormat.
+func parseStatfs(output string) (fsStats, error) {
+	fields := strings.Fields(output)
+	if len(fields) != 6 {
+		return fsStats{}, fmt.Errorf("cannot parse statfs output %q", output)
+	}
+	var values [6]uint64
+	for i, field := range fields {
+		value, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return fsStats{}, fmt.Errorf("cannot parse statfs output %q: %v", output, err)
+		}
+		values[i] = value
+	}
+	return fsStats{values[0], values[1], values[2], values[3], values[4], values[5]}, nil
+}
+
+// statfs returns the statistics of the filesystem mounted at path, through
+// the StoLake agent in proxy mode.
+func statfs(path string) (fsStats, error) {
+	if virsh.ProxyMode() {
+		output, err := runOnNode("stat", "--file-system", "--format="+statfsFormat, path)
+		if err != nil {
+			return fsStats{}, err
+		}
+		return parseStatfs(string(output))
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return fsStats{}, err
+	}
+	return fsStats{
+		blockSize:   uint64(st.Bsize),
+		blocks:      st.Blocks,
+		blocksFree:  st.Bfree,
+		blocksAvail: st.Bavail,
+		inodes:      st.Files,
+		inodesFree:  st.Ffree,
+	}, nil
+}
+
+// usage returns the byte and inode usage of the filesystem.
+func (st fsStats) usage() []*csi.VolumeUsage {
+	return []*csi.VolumeUsage{
+		{
+			Unit:      csi.VolumeUsage_BYTES,
+			Total:     int64(st.blocks * st.blockSize),
+			Available: int64(st.blocksAvail * st.blockSize),
+			Used:      int64((st.blocks - st.blocksFree) * st.blockSize),
+		},
+		{
+			Unit:      csi.VolumeUsage_INODES,
+			Total:     int64(st.inodes),
+			Available: int64(st.inodesFree),
+			Used:      int64(st.inodes - st.inodesFree),
+		},
+	}
+}
+
+// blockDeviceSize returns the size in bytes of the block device at path.
+func blockDeviceSize(path string) (uint64, error) {
+	if virsh.ProxyMode() {
+		output, err := runOnNode("blockdev", "--getsize64", path)
+		if err != nil {
+			return 0, err
+		}
+		return strconv.ParseUint(strings.TrimSpace(string(output)), 10, 64)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(size), nil
+}
+
+// isBlockDevice returns whether path is a block device rather than a
+// directory. It returns an error for which os.IsNotExist is true if there
+// is nothing at path.
+func isBlockDevice(path string) (bool, error) {
+	if virsh.ProxyMode() {
+		output, err := runOnNode("stat", "--dereference", "--format=%F", path)
+		if err != nil {
+			if strings.Contains(err.Error(), "No such file") {
+				return false, os.ErrNotExist
+			}
+			return false, err
+		}
+		// The StoLake agent does not report the exit status, stat
+		// prints nothing to stdout if there is nothing at path.
+		fileType := strings.TrimSpace(string(output))
+		if fileType == "" {
+			return false, os.ErrNotExist
+		}
+		return fileType == "block special file", nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	return info.Mode()&os.ModeDevice != 0, nil
+}
+
+// deviceNumber returns the major:minor device number of the device node at
+// path, following symlinks.
+func deviceNumber(path string) (string, error) {
+	if virsh.ProxyMode() {
+		output, err := runOnNode("stat", "--dereference", "--format=%t:%T", path)
+		if err != nil {
+			return "", err
+		}
+		number := strings.TrimSpace(string(output))
+		if number == "" {
+			return "", fmt.Errorf("cannot stat %v", path)
+		}
+		return number, nil
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return "", err
+	}
+	// Decode the device number as glibc does and format it as
+	// stat(1) does.
+	dev := uint64(st.Rdev)
+	major := ((dev >> 8) & 0xfff) | ((dev >> 32) &^ 0xfff)
+	minor := (dev & 0xff) | ((dev >> 12) &^ 0xff)
+	return fmt.Sprintf("%x:%x", major, minor), nil
+}
+
+// nodeVolumeCondition reports whether the volume published or staged at a
+// path is backed by its device. devicePath is the device mounted at the
+// path or the device node at the path of a block volume. A volume whose
+// logical volume is visible on this node must also be active and healthy.
+func (s *Server) nodeVolumeCondition(id, devicePath string) (*csi.VolumeCondition, error) {
+	lv, err := s.lookupLogicalVolume(id)
+	if err != nil {
+		// The volume is attached through an iSCSI target, the
+		// volume group is not visible on this node.
+		return &csi.VolumeCondition{Abnormal: false, Message: "The volume is mounted."}, nil
+	}
+	active, err := lv.IsActive()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot determine whether the volume is active: err=%v", err)
+	}
+	if !active {
+		return &csi.VolumeCondition{Abnormal: true, Message: "The logical volume is not active."}, nil
+	}
+	expected, err := lv.Path()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Error in Path(): err=%v", err)
+	}
+	cryptPath := cryptMapperDir + s.cryptMappingName(id)
+	if _, err := deviceNumber(cryptPath); err == nil {
+		expected = cryptPath
+	}
+	want, err := deviceNumber(expected)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot stat %v: err=%v", expected, err)
+	}
+	got, err := deviceNumber(devicePath)
+	if err != nil || got != want {
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("The volume path is backed by %v rather than %v.", devicePath, expected),
+		}, nil
+	}
+	return volumeCondition(lv)
+}
@@ -106,6 +106,24 @@ func validateCreateVolumeRequest(request *csi.CreateVolumeRequest, removingVolum
 	if err := validateVolumeCapabilities(request.GetVolumeCapabilities(), supportedFilesystems); err != nil {
 		return err
 	}
+	if err := validateMutableParameters(request.GetMutableParameters()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validateMutableParameters checks that the mutable parameters of a
+// CreateVolume request can be changed by ControllerModifyVolume.
+func validateMutableParameters(params map[string]string) error {
+	immutable := make(map[string]string)
+	for key, value := range params {
+		if !isMutableParameter(key) {
+			immutable[key] = value
+		}
+	}
+	if len(immutable) > 0 {
+		return immutableParametersError(immutable)
+	}
 	return nil
 }
 
@@ -287,7 +305,12 @@ func (v *controllerServerValidator) ListVolumes(
 	return v.inner.ListVolumes(ctx, request)
 }
 
+var ErrInvalidMaxEntries = status.Error(codes.InvalidArgument, "The max_entries field must not be negative.")
+
 func validateListVolumesRequest(request *csi.ListVolumesRequest) error {
+	if request.GetMaxEntries() < 0 {
+		return ErrInvalidMaxEntries
+	}
 	return nil
 }
 
@@ -329,33 +352,135 @@ func validateControllerGetCapabilitiesRequest(request *csi.ControllerGetCapabili
 func (v *controllerServerValidator) CreateSnapshot(
 	ctx context.Context,
 	request *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	if err := validateCreateSnapshotRequest(request, v.removingVolumeGroup); err != nil {
+		return nil, err
+	}
 	return v.inner.CreateSnapshot(ctx, request)
 }
 
+var ErrMissingSourceVolumeId = status.Error(codes.InvalidArgument, "The source_volume_id field must be specified.")
+
+func validateCreateSnapshotRequest(request *csi.CreateSnapshotRequest, removingVolumeGroup bool) error {
+	if err := validateRemoving(removingVolumeGroup); err != nil {
+		return err
+	}
+	if request.GetName() == "" {
+		return ErrMissingName
+	}
+	if request.GetSourceVolumeId() == "" {
+		return ErrMissingSourceVolumeId
+	}
+	return nil
+}
+
 func (v *controllerServerValidator) DeleteSnapshot(
 	ctx context.Context,
 	request *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	if err := validateDeleteSnapshotRequest(request, v.removingVolumeGroup); err != nil {
+		return nil, err
+	}
 	return v.inner.DeleteSnapshot(ctx, request)
 }
 
+var ErrMissingSnapshotId = status.Error(codes.InvalidArgument, "The snapshot_id field must be specified.")
+
+func validateDeleteSnapshotRequest(request *csi.DeleteSnapshotRequest, removingVolumeGroup bool) error {
+	if err := validateRemoving(removingVolumeGroup); err != nil {
+		return err
+	}
+	if request.GetSnapshotId() == "" {
+		return ErrMissingSnapshotId
+	}
+	return nil
+}
+
 func (v *controllerServerValidator) ListSnapshots(
 	ctx context.Context,
 	request *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	if err := validateListSnapshotsRequest(request); err != nil {
+		return nil, err
+	}
 	return v.inner.ListSnapshots(ctx, request)
 }
 
+func validateListSnapshotsRequest(request *csi.ListSnapshotsRequest) error {
+	if request.GetMaxEntries() < 0 {
+		return ErrInvalidMaxEntries
+	}
+	return nil
+}
+
 func (v *controllerServerValidator) ControllerExpandVolume(
 	ctx context.Context,
 	request *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	if err := validateControllerExpandVolumeRequest(request, v.removingVolumeGroup); err != nil {
+		return nil, err
+	}
 	return v.inner.ControllerExpandVolume(ctx, request)
 }
 
+var ErrMissingCapacityRange = status.Error(codes.InvalidArgument, "The capacity_range field must be specified.")
+
+func validateControllerExpandVolumeRequest(request *csi.ControllerExpandVolumeRequest, removingVolumeGroup bool) error {
+	if err := validateRemoving(removingVolumeGroup); err != nil {
+		return err
+	}
+	if request.GetVolumeId() == "" {
+		return ErrMissingVolumeId
+	}
+	capacityRange := request.GetCapacityRange()
+	if capacityRange == nil {
+		return ErrMissingCapacityRange
+	}
+	if err := validateCapacityRange(capacityRange); err != nil {
+		return err
+	}
+	return nil
+}
+
 func (v *controllerServerValidator) ControllerGetVolume(
 	ctx context.Context,
 	request *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	if err := validateControllerGetVolumeRequest(request, v.removingVolumeGroup); err != nil {
+		return nil, err
+	}
 	return v.inner.ControllerGetVolume(ctx, request)
 }
 
+func validateControllerGetVolumeRequest(request *csi.ControllerGetVolumeRequest, removingVolumeGroup bool) error {
+	if err := validateRemoving(removingVolumeGroup); err != nil {
+		return err
+	}
+	if request.GetVolumeId() == "" {
+		return ErrMissingVolumeId
+	}
+	return nil
+}
+
+func (v *controllerServerValidator) ControllerModifyVolume(
+	ctx context.Context,
+	request *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
+	if err := validateControllerModifyVolumeRequest(request, v.removingVolumeGroup); err != nil {
+		return nil, err
+	}
+	return v.inner.ControllerModifyVolume(ctx, request)
+}
+
+var ErrMissingMutableParameters = status.Error(codes.InvalidArgument, "The mutable_parameters field must be specified.")
+
+func validateControllerModifyVolumeRequest(request *csi.ControllerModifyVolumeRequest, removingVolumeGroup bool) error {
+	if err := validateRemoving(removingVolumeGroup); err != nil {
+		return err
+	}
+	if request.GetVolumeId() == "" {
+		return ErrMissingVolumeId
+	}
+	if len(request.GetMutableParameters()) == 0 {
+		return ErrMissingMutableParameters
+	}
+	return nil
+}
+
 // NodeService RPCs
 
 type nodeServerValidator struct {
@@ -459,23 +584,104 @@ func (v *nodeServerValidator) NodeGetInfo(
 func (v *nodeServerValidator) NodeStageVolume(
 	ctx context.Context,
 	request *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	if err := validateNodeStageVolumeRequest(request, v.removingVolumeGroup, v.supportedFilesystems); err != nil {
+		return nil, err
+	}
 	return v.inner.NodeStageVolume(ctx, request)
 }
 
+var ErrMissingStagingTargetPath = status.Error(codes.InvalidArgument, "The staging_target_path field must be specified.")
+
+func validateNodeStageVolumeRequest(request *csi.NodeStageVolumeRequest, removingVolumeGroup bool, supportedFilesystems map[string]string) error {
+	if err := validateRemoving(removingVolumeGroup); err != nil {
+		return err
+	}
+	if request.GetVolumeId() == "" {
+		return ErrMissingVolumeId
+	}
+	if virsh.ProxyMode() {
+		if request.GetPublishContext() == nil {
+			return ErrSpecifiedPublishNoContext
+		}
+	}
+	if request.GetStagingTargetPath() == "" {
+		return ErrMissingStagingTargetPath
+	}
+	volumeCapability := request.GetVolumeCapability()
+	if volumeCapability == nil {
+		return ErrMissingVolumeCapability
+	}
+	const treatUnsupportedFsAsError = false
+	const readonly = false
+	return validateVolumeCapability(volumeCapability, supportedFilesystems, treatUnsupportedFsAsError, readonly)
+}
+
 func (v *nodeServerValidator) NodeUnstageVolume(
 	ctx context.Context,
 	request *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	if err := validateNodeUnstageVolumeRequest(request, v.removingVolumeGroup); err != nil {
+		return nil, err
+	}
 	return v.inner.NodeUnstageVolume(ctx, request)
 }
 
+func validateNodeUnstageVolumeRequest(request *csi.NodeUnstageVolumeRequest, removingVolumeGroup bool) error {
+	if err := validateRemoving(removingVolumeGroup); err != nil {
+		return err
+	}
+	if request.GetVolumeId() == "" {
+		return ErrMissingVolumeId
+	}
+	if request.GetStagingTargetPath() == "" {
+		return ErrMissingStagingTargetPath
+	}
+	return nil
+}
+
 func (v *nodeServerValidator) NodeExpandVolume(
 	ctx context.Context,
 	request *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	if err := validateNodeExpandVolumeRequest(request, v.removingVolumeGroup); err != nil {
+		return nil, err
+	}
 	return v.inner.NodeExpandVolume(ctx, request)
 }
 
+var ErrMissingVolumePath = status.Error(codes.InvalidArgument, "The volume_path field must be specified.")
+
+func validateNodeExpandVolumeRequest(request *csi.NodeExpandVolumeRequest, removingVolumeGroup bool) error {
+	if err := validateRemoving(removingVolumeGroup); err != nil {
+		return err
+	}
+	if request.GetVolumeId() == "" {
+		return ErrMissingVolumeId
+	}
+	if request.GetVolumePath() == "" {
+		return ErrMissingVolumePath
+	}
+	if capacityRange := request.GetCapacityRange(); capacityRange != nil {
+		if err := validateCapacityRange(capacityRange); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (v *nodeServerValidator) NodeGetVolumeStats(
 	ctx context.Context,
 	request *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	if err := validateNodeGetVolumeStatsRequest(request); err != nil {
+		return nil, err
+	}
 	return v.inner.NodeGetVolumeStats(ctx, request)
 }
+
+func validateNodeGetVolumeStatsRequest(request *csi.NodeGetVolumeStatsRequest) error {
+	if request.GetVolumeId() == "" {
+		return ErrMissingVolumeId
+	}
+	if request.GetVolumePath() == "" {
+		return ErrMissingVolumePath
+	}
+	return nil
+}
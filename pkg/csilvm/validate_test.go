@@ -167,6 +167,111 @@ func TestDeleteVolumeMissingVolumeId(t *testing.T) {
 	}
 }
 
+func TestCreateSnapshotRemoveVolumeGroup(t *testing.T) {
+	client, cleanup := startTestValidate(RemoveVolumeGroup())
+	defer cleanup()
+	req := testCreateSnapshotRequest("test-volume")
+	_, err := client.CreateSnapshot(context.Background(), req)
+	if !grpcErrorEqual(err, ErrRemovingMode) {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateSnapshotMissingName(t *testing.T) {
+	client, cleanup := startTestValidate()
+	defer cleanup()
+	req := testCreateSnapshotRequest("test-volume")
+	req.Name = ""
+	_, err := client.CreateSnapshot(context.Background(), req)
+	if !grpcErrorEqual(err, ErrMissingName) {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateSnapshotMissingSourceVolumeId(t *testing.T) {
+	client, cleanup := startTestValidate()
+	defer cleanup()
+	req := testCreateSnapshotRequest("")
+	_, err := client.CreateSnapshot(context.Background(), req)
+	if !grpcErrorEqual(err, ErrMissingSourceVolumeId) {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteSnapshotMissingSnapshotId(t *testing.T) {
+	client, cleanup := startTestValidate()
+	defer cleanup()
+	req := &csi.DeleteSnapshotRequest{}
+	_, err := client.DeleteSnapshot(context.Background(), req)
+	if !grpcErrorEqual(err, ErrMissingSnapshotId) {
+		t.Fatal(err)
+	}
+}
+
+func TestControllerExpandVolumeMissingVolumeId(t *testing.T) {
+	client, cleanup := startTestValidate()
+	defer cleanup()
+	req := testControllerExpandVolumeRequest("", 100<<20)
+	_, err := client.ControllerExpandVolume(context.Background(), req)
+	if !grpcErrorEqual(err, ErrMissingVolumeId) {
+		t.Fatal(err)
+	}
+}
+
+func TestControllerExpandVolumeMissingCapacityRange(t *testing.T) {
+	client, cleanup := startTestValidate()
+	defer cleanup()
+	req := testControllerExpandVolumeRequest("test-volume", 100<<20)
+	req.CapacityRange = nil
+	_, err := client.ControllerExpandVolume(context.Background(), req)
+	if !grpcErrorEqual(err, ErrMissingCapacityRange) {
+		t.Fatal(err)
+	}
+}
+
+func TestControllerGetVolumeMissingVolumeId(t *testing.T) {
+	client, cleanup := startTestValidate()
+	defer cleanup()
+	req := &csi.ControllerGetVolumeRequest{}
+	_, err := client.ControllerGetVolume(context.Background(), req)
+	if !grpcErrorEqual(err, ErrMissingVolumeId) {
+		t.Fatal(err)
+	}
+}
+
+func TestControllerModifyVolumeMissingVolumeId(t *testing.T) {
+	client, cleanup := startTestValidate()
+	defer cleanup()
+	req := &csi.ControllerModifyVolumeRequest{
+		MutableParameters: map[string]string{"iopspergb": "6"},
+	}
+	_, err := client.ControllerModifyVolume(context.Background(), req)
+	if !grpcErrorEqual(err, ErrMissingVolumeId) {
+		t.Fatal(err)
+	}
+}
+
+func TestControllerModifyVolumeMissingMutableParameters(t *testing.T) {
+	client, cleanup := startTestValidate()
+	defer cleanup()
+	req := &csi.ControllerModifyVolumeRequest{VolumeId: "test-volume"}
+	_, err := client.ControllerModifyVolume(context.Background(), req)
+	if !grpcErrorEqual(err, ErrMissingMutableParameters) {
+		t.Fatal(err)
+	}
+}
+
+func TestListVolumesNegativeMaxEntries(t *testing.T) {
+	client, cleanup := startTestValidate()
+	defer cleanup()
+	req := testListVolumesRequest()
+	req.MaxEntries = -1
+	_, err := client.ListVolumes(context.Background(), req)
+	if !grpcErrorEqual(err, ErrInvalidMaxEntries) {
+		t.Fatal(err)
+	}
+}
+
 func TestValidateVolumeCapabilitiesRemoveVolumeGroup(t *testing.T) {
 	client, cleanup := startTestValidate(RemoveVolumeGroup())
 	defer cleanup()
@@ -436,6 +541,57 @@ func TestNodeUnpublishVolumeMissingTargetPath(t *testing.T) {
 	}
 }
 
+func TestNodeStageVolumeMissingStagingTargetPath(t *testing.T) {
+	client, cleanup := startTestValidate()
+	defer cleanup()
+	req := testNodeStageVolumeRequest("fake_volume_id", "", "xfs")
+	_, err := client.NodeStageVolume(context.Background(), req)
+	if !grpcErrorEqual(err, ErrMissingStagingTargetPath) {
+		t.Fatal(err)
+	}
+}
+
+func TestNodeStageVolumeMissingVolumeCapability(t *testing.T) {
+	client, cleanup := startTestValidate()
+	defer cleanup()
+	req := testNodeStageVolumeRequest("fake_volume_id", fakeMountDir, "xfs")
+	req.VolumeCapability = nil
+	_, err := client.NodeStageVolume(context.Background(), req)
+	if !grpcErrorEqual(err, ErrMissingVolumeCapability) {
+		t.Fatal(err)
+	}
+}
+
+func TestNodeUnstageVolumeMissingStagingTargetPath(t *testing.T) {
+	client, cleanup := startTestValidate()
+	defer cleanup()
+	req := &csi.NodeUnstageVolumeRequest{VolumeId: "fake_volume_id"}
+	_, err := client.NodeUnstageVolume(context.Background(), req)
+	if !grpcErrorEqual(err, ErrMissingStagingTargetPath) {
+		t.Fatal(err)
+	}
+}
+
+func TestNodeExpandVolumeMissingVolumePath(t *testing.T) {
+	client, cleanup := startTestValidate()
+	defer cleanup()
+	req := &csi.NodeExpandVolumeRequest{VolumeId: "fake_volume_id"}
+	_, err := client.NodeExpandVolume(context.Background(), req)
+	if !grpcErrorEqual(err, ErrMissingVolumePath) {
+		t.Fatal(err)
+	}
+}
+
+func TestNodeGetVolumeStatsMissingVolumePath(t *testing.T) {
+	client, cleanup := startTestValidate()
+	defer cleanup()
+	req := &csi.NodeGetVolumeStatsRequest{VolumeId: "fake_volume_id"}
+	_, err := client.NodeGetVolumeStats(context.Background(), req)
+	if !grpcErrorEqual(err, ErrMissingVolumePath) {
+		t.Fatal(err)
+	}
+}
+
 func grpcErrorEqual(gotErr, expErr error) bool {
 	got, ok := status.FromError(gotErr)
 	if !ok {
@@ -0,0 +1,169 @@
+package lvm
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// AllocationStrategy chooses where lvcreate allocates the extents of a new
+// logical volume. Without one, lvcreate fills the physical volumes of the
+// volume group in order, which concentrates I/O on the first few drives of
+// a large volume group.
+type AllocationStrategy interface {
+	// Policy returns the lvm allocation policy passed to lvcreate with
+	// --alloc, or "" for the policy of the volume group.
+	Policy() string
+	// Order returns the names of the physical volumes to allocate
+	// from, in order of preference, or nil to let lvcreate choose.
+	Order(pvs []PhysicalVolumeUsage) []string
+}
+
+// PhysicalVolumeUsage describes the extents of a physical volume a new
+// logical volume may be allocated on.
+type PhysicalVolumeUsage struct {
+	Name        string
+	Extents     uint64
+	FreeExtents uint64
+}
+
+// policyStrategy only selects an lvm allocation policy.
+type policyStrategy string
+
+func (p policyStrategy) Policy() string                           { return string(p) }
+func (p policyStrategy) Order(pvs []PhysicalVolumeUsage) []string { return nil }
+
+// leastUsedStrategy prefers the physical volumes with the smallest share of
+// allocated extents.
+type leastUsedStrategy struct{}
+
+func (leastUsedStrategy) Policy() string { return "" }
+
+func (leastUsedStrategy) Order(pvs []PhysicalVolumeUsage) []string {
+	used := func(pv PhysicalVolumeUsage) float64 {
+		if pv.Extents == 0 {
+			return 1
+		}
+		return float64(pv.Extents-pv.FreeExtents) / float64(pv.Extents)
+	}
+	return orderPhysicalVolumes(pvs, func(a, b PhysicalVolumeUsage) bool {
+		return used(a) < used(b)
+	})
+}
+
+// spreadStrategy prefers the physical volumes with the most free extents.
+type spreadStrategy struct{}
+
+func (spreadStrategy) Policy() string { return "" }
+
+func (spreadStrategy) Order(pvs []PhysicalVolumeUsage) []string {
+	return orderPhysicalVolumes(pvs, func(a, b PhysicalVolumeUsage) bool {
+		return a.FreeExtents > b.FreeExtents
+	})
+}
+
+// orderPhysicalVolumes returns the names of the physical volumes with free
+// extents sorted by less. Ties are broken by name so that the order is
+// stable.
+func orderPhysicalVolumes(pvs []PhysicalVolumeUsage, less func(a, b PhysicalVolumeUsage) bool) []string {
+	var sorted []PhysicalVolumeUsage
+	for _, pv := range pvs {
+		if pv.FreeExtents > 0 {
+			sorted = append(sorted, pv)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if less(sorted[i], sorted[j]) {
+			return true
+		}
+		if less(sorted[j], sorted[i]) {
+			return false
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	names := make([]string, 0, len(sorted))
+	for _, pv := range sorted {
+		names = append(names, pv.Name)
+	}
+	return names
+}
+
+var (
+	allocationStrategiesMu sync.RWMutex
+	allocationStrategies   = map[string]AllocationStrategy{
+		"least-used": leastUsedStrategy{},
+		"spread":     spreadStrategy{},
+		"contiguous": policyStrategy("contiguous"),
+		"cling":      policyStrategy("cling"),
+		"normal":     policyStrategy("normal"),
+		"anywhere":   policyStrategy("anywhere"),
+	}
+)
+
+// RegisterAllocationStrategy makes an allocation strategy available under
+// the given name, replacing any strategy of the same name.
+func RegisterAllocationStrategy(name string, strategy AllocationStrategy) {
+	allocationStrategiesMu.Lock()
+	defer allocationStrategiesMu.Unlock()
+	allocationStrategies[name] = strategy
+}
+
+// LookupAllocationStrategy returns the allocation strategy registered
+// under the given name. The built-in strategies are:
+//
+//	least-used  prefer the physical volumes with the smallest share of allocated extents
+//	spread      prefer the physical volumes with the most free extents
+//	contiguous  allocate each image contiguously (--alloc=contiguous)
+//	cling       extend on the physical volumes already in use (--alloc=cling)
+//	normal      the default lvm policy (--alloc=normal)
+//	anywhere    allocate anywhere, even on physical volumes shared by images (--alloc=anywhere); not allowed for RAID layouts
+func LookupAllocationStrategy(name string) (AllocationStrategy, error) {
+	allocationStrategiesMu.RLock()
+	defer allocationStrategiesMu.RUnlock()
+	strategy, ok := allocationStrategies[name]
+	if !ok {
+		return nil, fmt.Errorf("lvm: unknown allocation strategy %q", name)
+	}
+	return strategy, nil
+}
+
+// AllocationOpt allocates the new logical volume using the given strategy.
+// It is applied in addition to any VolumeLayoutOpt. The physical volumes
+// selected by the layout are ordered by the strategy; a layout with a
+// failure domain keeps its placement.
+func AllocationOpt(strategy AllocationStrategy) CreateLogicalVolumeOpt {
+	return func(o *LVOpts) {
+		o.allocation = strategy
+	}
+}
+
+const ErrAllocationAnywhereRAID = simpleError("lvm: the anywhere allocation policy would let the images of a RAID volume share physical volumes")
+
+// allocationArgs returns the lvcreate flags and the ordered physical
+// volumes for a new logical volume with the layout allocated using the
+// strategy.
+func (vg *VolumeGroup) allocationArgs(strategy AllocationStrategy, raid VolumeLayout) (flags, pvs []string, err error) {
+	if strategy.Policy() == "anywhere" && raid.IsRAID() {
+		return nil, nil, ErrAllocationAnywhereRAID
+	}
+	if policy := strategy.Policy(); policy != "" {
+		flags = append(flags, "--alloc="+policy)
+	}
+	extentSize, err := vg.ExtentSize()
+	if err != nil {
+		return nil, nil, err
+	}
+	allocatable, err := vg.allocatablePhysicalVolumes(raid, extentSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	var usage []PhysicalVolumeUsage
+	for _, pv := range allocatable {
+		usage = append(usage, PhysicalVolumeUsage{
+			Name:        pv.name,
+			Extents:     pv.extents,
+			FreeExtents: pv.free,
+		})
+	}
+	return flags, strategy.Order(usage), nil
+}
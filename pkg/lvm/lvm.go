@@ -2,11 +2,15 @@ package lvm
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"os/exec"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/Seagate/csiclvm/pkg/virsh"
@@ -63,6 +67,17 @@ func (pv *PhysicalVolume) Remove() error {
 	return nil
 }
 
+// AddTag adds the tag to the physical volume.
+func (pv *PhysicalVolume) AddTag(tag string) error {
+	if err := ValidateTag(tag); err != nil {
+		return err
+	}
+	if err := run("pvchange", nil, "--addtag", tag, pv.dev); err != nil {
+		return err
+	}
+	return nil
+}
+
 // Check runs the pvck command on the physical volume.
 func (pv *PhysicalVolume) Check() error {
 	if err := run("pvck", nil, pv.dev); err != nil {
@@ -104,45 +119,548 @@ func (vg *VolumeGroup) BytesTotal() (uint64, error) {
 	return 0, ErrVolumeGroupNotFound
 }
 
-// BytesFree returns the unallocated space in bytes of the volume group.
+// BytesFree returns the unallocated space in bytes of the volume group. If
+// the layout restricts the physical volumes, only their space is counted.
 func (vg *VolumeGroup) BytesFree(raid VolumeLayout) (uint64, error) {
-	pvnames, err := vg.ListPhysicalVolumeNames()
+	devices, count, extentSize, err := vg.freeExtents(raid)
 	if err != nil {
 		return 0, err
 	}
-	if len(pvnames) < int(raid.MinNumberOfDevices()) {
+	if devices < raid.MinNumberOfDevices() {
 		// There aren't any bytes free given that the number of
 		// underlying devices is too few to create logical volumes with
 		// this VolumeLayout.
 		return 0, nil
 	}
+	return raid.usableExtents(count, extentSize) * extentSize, nil
+}
+
+// BytesFreeCached returns the size of the largest logical volume with the
+// given layout that can be created together with the cache volume. The
+// extents of the cache volume are not available to the logical volume if
+// both may be allocated on the same physical volumes. It returns 0 if the
+// cache volume does not fit.
+func (vg *VolumeGroup) BytesFreeCached(raid VolumeLayout, cache Cache) (uint64, error) {
+	if cache.Mode == CacheModeNone {
+		return vg.BytesFree(raid)
+	}
+	devices, count, extentSize, err := vg.freeExtents(raid)
+	if err != nil {
+		return 0, err
+	}
+	cacheLayout := cache.layout()
+	_, cacheCount, _, err := vg.freeExtents(cacheLayout)
+	if err != nil {
+		return 0, err
+	}
+	cacheExtents := (cache.SizeInBytes + extentSize - 1) / extentSize
+	if cacheCount < cacheExtents {
+		return 0, nil
+	}
+	shared, err := vg.sharePhysicalVolumes(raid, cacheLayout, extentSize)
+	if err != nil {
+		return 0, err
+	}
+	if shared {
+		if count < cacheExtents {
+			return 0, nil
+		}
+		count -= cacheExtents
+	}
+	if devices < raid.MinNumberOfDevices() {
+		return 0, nil
+	}
+	return raid.usableExtents(count, extentSize) * extentSize, nil
+}
+
+// sharePhysicalVolumes returns true if logical volumes with either layout
+// may be allocated on the same physical volume.
+func (vg *VolumeGroup) sharePhysicalVolumes(a, b VolumeLayout, extentSize uint64) (bool, error) {
+	apvs, err := vg.allocatablePhysicalVolumes(a, extentSize)
+	if err != nil {
+		return false, err
+	}
+	bpvs, err := vg.allocatablePhysicalVolumes(b, extentSize)
+	if err != nil {
+		return false, err
+	}
+	for _, apv := range apvs {
+		for _, bpv := range bpvs {
+			if apv.name == bpv.name {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// freeExtents returns the number of physical volumes a logical volume with
+// the layout may be allocated on, the number of free extents on them and
+// the extent size.
+func (vg *VolumeGroup) freeExtents(raid VolumeLayout) (devices, count, extentSize uint64, err error) {
 	result := new(vgsOutput)
-	if err := run("vgs", result, "--options=vg_free,vg_free_count,vg_extent_size", vg.name); err != nil {
+	if err := run("vgs", result, "--options=vg_free_count,vg_extent_size", vg.name); err != nil {
 		if IsVolumeGroupNotFound(err) {
-			return 0, ErrVolumeGroupNotFound
+			return 0, 0, 0, ErrVolumeGroupNotFound
 		}
-		return 0, err
+		return 0, 0, 0, err
 	}
+	found := false
 	for _, report := range result.Report {
 		for _, vg := range report.Vg {
-			return raid.extentsFree(vg.VgFreeExtentCount) * vg.VgExtentSize, nil
+			count, extentSize = vg.VgFreeExtentCount, vg.VgExtentSize
+			found = true
 		}
 	}
-	return 0, ErrVolumeGroupNotFound
+	if !found {
+		return 0, 0, 0, ErrVolumeGroupNotFound
+	}
+	pvs, err := vg.allocatablePhysicalVolumes(raid, extentSize)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if raid.FailureDomain != "" {
+		// Every image is placed on a physical volume of its own so
+		// the smallest of them limits the size of all images.
+		placement, err := placeImages(pvs, raid)
+		if err == ErrTooFewFailureDomains || err == ErrTooFewDisks {
+			return 0, 0, extentSize, nil
+		}
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		min := placement[0].free
+		for _, pv := range placement {
+			if pv.free < min {
+				min = pv.free
+			}
+		}
+		devices = uint64(len(placement))
+		return devices, min * devices, extentSize, nil
+	}
+	var selectedCount uint64
+	for _, pv := range pvs {
+		selectedCount += pv.free
+	}
+	if len(raid.PhysicalVolumes) > 0 {
+		count = selectedCount
+	}
+	return uint64(len(pvs)), count, extentSize, nil
+}
+
+// allocatablePV is a physical volume a logical volume may be allocated on.
+type allocatablePV struct {
+	name string
+	// free is the number of free extents.
+	free uint64
+	// extents is the total number of extents.
+	extents uint64
+	// domain is the failure domain of the physical volume, if any.
+	domain string
+}
+
+// allocatablePhysicalVolumes returns the physical volumes of the volume
+// group a logical volume with the layout may be allocated on.
+func (vg *VolumeGroup) allocatablePhysicalVolumes(raid VolumeLayout, extentSize uint64) ([]allocatablePV, error) {
+	result := new(pvsOutput)
+	if err := run("pvs", result, "--options=pv_name,vg_name,pv_size,pv_free,pv_tags"); err != nil {
+		return nil, err
+	}
+	var pvs []allocatablePV
+	for _, report := range result.Report {
+		for _, pv := range report.Pv {
+			tags := splitTags(pv.PvTags)
+			if pv.VgName != vg.name || !raid.selectsPhysicalVolume(pv.Name, tags) {
+				continue
+			}
+			pvs = append(pvs, allocatablePV{
+				name:    pv.Name,
+				free:    pv.PvFree / extentSize,
+				extents: pv.PvSize / extentSize,
+				domain:  raid.failureDomain(tags),
+			})
+		}
+	}
+	return pvs, nil
+}
+
+// selectsPhysicalVolume returns true if a logical volume with this layout
+// may be allocated on the physical volume with the given name and tags.
+func (r VolumeLayout) selectsPhysicalVolume(name string, tags []string) bool {
+	if len(r.PhysicalVolumes) == 0 {
+		return true
+	}
+	for _, sel := range r.PhysicalVolumes {
+		if strings.HasPrefix(sel, "@") {
+			for _, tag := range tags {
+				if tag == sel[1:] {
+					return true
+				}
+			}
+		} else if sel == name {
+			return true
+		}
+	}
+	return false
+}
+
+const ErrTooFewFailureDomains = simpleError("lvm: the physical volumes span too few failure domains for the volume layout")
+const ErrFailureDomainsViolated = simpleError("lvm: the RAID images could not be spread across failure domains")
+
+const ErrInvalidFailureDomain = simpleError("lvm: FailureDomain must be a valid tag ending in one of the separators '-', '_', '.' or '+'")
+
+// ValidateFailureDomain checks that the failure domain tag prefix ends in a
+// separator. The prefix "enc-" matches the tag "enc-a" but not the tags
+// "encrypted" or "enclosure_meta", which the prefix "enc" would.
+func ValidateFailureDomain(prefix string) error {
+	if err := ValidateTag(prefix); err != nil {
+		return err
+	}
+	if !strings.ContainsAny(prefix[len(prefix)-1:], "-_.+") {
+		return ErrInvalidFailureDomain
+	}
+	return nil
+}
+
+// failureDomain returns the failure domain of a physical volume with the
+// given tags, or "" if it belongs to none. The tag must name a failure
+// domain after the prefix.
+func (r VolumeLayout) failureDomain(tags []string) string {
+	if r.FailureDomain == "" {
+		return ""
+	}
+	for _, tag := range tags {
+		if len(tag) > len(r.FailureDomain) && strings.HasPrefix(tag, r.FailureDomain) {
+			return tag
+		}
+	}
+	return ""
+}
+
+// IsRAID returns true if the layout is one of the RAID types, whose images
+// must be placed on distinct physical volumes.
+func (r VolumeLayout) IsRAID() bool {
+	switch r.Type {
+	case VolumeTypeRAID0, VolumeTypeRAID0Meta, VolumeTypeRAID1, VolumeTypeRAID4,
+		VolumeTypeRAID5, VolumeTypeRAID6, VolumeTypeRAID10:
+		return true
+	}
+	return false
+}
+
+// imageSetSize returns the number of RAID images that hold copies of the
+// same data, or data and parity of the same stripe, and must therefore be
+// placed in distinct failure domains. The images of a raid10 volume form
+// consecutive mirror sets.
+func (r VolumeLayout) imageSetSize() uint64 {
+	if r.Type == VolumeTypeRAID10 {
+		return r.mirrors() + 1
+	}
+	return r.MinNumberOfDevices()
+}
+
+// placeImages assigns a physical volume to every image of a RAID volume
+// with the layout such that the images of each image set are in distinct
+// failure domains. It returns the physical volumes in image order. The
+// physical volumes with the most free extents are preferred so that the
+// smallest of them, which limits the volume size, is as large as possible.
+func placeImages(pvs []allocatablePV, raid VolumeLayout) ([]allocatablePV, error) {
+	var candidates []allocatablePV
+	domains := make(map[string]struct{})
+	for _, pv := range pvs {
+		if pv.domain == "" {
+			continue
+		}
+		candidates = append(candidates, pv)
+		domains[pv.domain] = struct{}{}
+	}
+	setSize := raid.imageSetSize()
+	if uint64(len(domains)) < setSize {
+		return nil, ErrTooFewFailureDomains
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].free != candidates[j].free {
+			return candidates[i].free > candidates[j].free
+		}
+		return candidates[i].name < candidates[j].name
+	})
+	used := make([]bool, len(candidates))
+	var placement []allocatablePV
+	for set := uint64(0); set < raid.MinNumberOfDevices()/setSize; set++ {
+		inSet := make(map[string]struct{})
+		for slot := uint64(0); slot < setSize; slot++ {
+			found := false
+			for i, pv := range candidates {
+				if _, ok := inSet[pv.domain]; used[i] || ok {
+					continue
+				}
+				used[i] = true
+				inSet[pv.domain] = struct{}{}
+				placement = append(placement, pv)
+				found = true
+				break
+			}
+			if !found {
+				return nil, ErrTooFewDisks
+			}
+		}
+	}
+	return placement, nil
+}
+
+// placeImages returns the physical volumes the images of a new RAID volume
+// with the layout are placed on, in image order.
+func (vg *VolumeGroup) placeImages(raid VolumeLayout) ([]allocatablePV, error) {
+	extentSize, err := vg.ExtentSize()
+	if err != nil {
+		return nil, err
+	}
+	pvs, err := vg.allocatablePhysicalVolumes(raid, extentSize)
+	if err != nil {
+		return nil, err
+	}
+	return placeImages(pvs, raid)
+}
+
+// CheckFailureDomains returns ErrTooFewFailureDomains or ErrTooFewDisks if
+// the images of a RAID volume with the layout cannot be spread across the
+// failure domains of the volume group.
+func (vg *VolumeGroup) CheckFailureDomains(raid VolumeLayout) error {
+	if raid.FailureDomain == "" {
+		return nil
+	}
+	_, err := vg.placeImages(raid)
+	return err
+}
+
+// verifyFailureDomains checks that the images of the named RAID volume
+// were allocated in distinct failure domains as the layout requires.
+// lvcreate is passed one physical volume per image but does not always
+// allocate the images in the order given.
+func (vg *VolumeGroup) verifyFailureDomains(name string, raid VolumeLayout, placement []allocatablePV) error {
+	domains := make(map[string]string)
+	for _, pv := range placement {
+		domains[pv.name] = pv.domain
+	}
+	result := new(lvsOutput)
+	if err := run("lvs", result, "--all", "--options=lv_name,vg_name,devices", vg.name); err != nil {
+		return err
+	}
+	devices := make(map[string][]string)
+	for _, report := range result.Report {
+		for _, lv := range report.Lv {
+			lvname := strings.Trim(lv.Name, "[]")
+			for _, dev := range strings.Split(lv.Devices, ",") {
+				if i := strings.Index(dev, "("); i >= 0 {
+					dev = dev[:i]
+				}
+				if dev = strings.TrimSpace(dev); dev != "" {
+					devices[lvname] = append(devices[lvname], dev)
+				}
+			}
+		}
+	}
+	// The devices of an image are logical volumes themselves if the
+	// image has dm-integrity.
+	var physicalVolumes func(string) []string
+	physicalVolumes = func(dev string) (pvs []string) {
+		if strings.HasPrefix(dev, "/") {
+			return []string{dev}
+		}
+		for _, d := range devices[dev] {
+			pvs = append(pvs, physicalVolumes(d)...)
+		}
+		return pvs
+	}
+	setSize := raid.imageSetSize()
+	for set := uint64(0); set < raid.MinNumberOfDevices()/setSize; set++ {
+		seen := make(map[string]struct{})
+		for slot := uint64(0); slot < setSize; slot++ {
+			image := fmt.Sprintf("%s_rimage_%d", name, set*setSize+slot)
+			imageDomains := make(map[string]struct{})
+			for _, pv := range physicalVolumes(image) {
+				imageDomains[domains[pv]] = struct{}{}
+			}
+			for domain := range imageDomains {
+				if _, ok := seen[domain]; ok {
+					log.Printf("Image %v shares failure domain %q with another copy", image, domain)
+					return ErrFailureDomainsViolated
+				}
+			}
+			for domain := range imageDomains {
+				seen[domain] = struct{}{}
+			}
+		}
+	}
+	return nil
+}
+
+// validatePhysicalVolumes validates the physical volume selection of the
+// layout.
+func (r VolumeLayout) validatePhysicalVolumes() error {
+	for _, sel := range r.PhysicalVolumes {
+		if strings.HasPrefix(sel, "@") {
+			if err := ValidateTag(sel[1:]); err != nil {
+				return err
+			}
+			continue
+		}
+		if !strings.HasPrefix(sel, "/") {
+			return fmt.Errorf("lvm: physical volume %q is neither a path nor a tag", sel)
+		}
+	}
+	return nil
+}
+
+// physicalVolumeArgs returns the physical volumes to pass to lvcreate for a
+// new logical volume with the layout. If the layout has a failure domain
+// it also returns the placement of the images.
+func (vg *VolumeGroup) physicalVolumeArgs(raid VolumeLayout) ([]string, []allocatablePV, error) {
+	if raid.FailureDomain == "" {
+		return raid.PhysicalVolumes, nil, nil
+	}
+	placement, err := vg.placeImages(raid)
+	if err != nil {
+		return nil, nil, err
+	}
+	var args []string
+	for _, pv := range placement {
+		args = append(args, pv.name)
+	}
+	return args, placement, nil
+}
+
+// placementTagPrefix marks the tag that records the physical volume
+// selection and failure domain of a logical volume, which lvs does not
+// report, so that it is extended within them.
+const placementTagPrefix = "PLACE+"
+
+// placement is the part of a VolumeLayout recorded in the placement tag.
+type placement struct {
+	PhysicalVolumes []string `json:"pvs,omitempty"`
+	FailureDomain   string   `json:"fd,omitempty"`
+}
+
+// placementTag returns the placement tag of a logical volume with the
+// layout, or "" if the layout does not restrict its placement.
+func (r VolumeLayout) placementTag() string {
+	if len(r.PhysicalVolumes) == 0 && r.FailureDomain == "" {
+		return ""
+	}
+	buf, err := json.Marshal(placement{r.PhysicalVolumes, r.FailureDomain})
+	if err != nil {
+		panic(err)
+	}
+	return placementTagPrefix + base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// withPlacement returns the layout with the placement recorded in the
+// given tags, if any.
+func (r VolumeLayout) withPlacement(tags []string) VolumeLayout {
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, placementTagPrefix) {
+			continue
+		}
+		buf, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(tag, placementTagPrefix))
+		if err != nil {
+			log.Printf("Ignoring invalid placement tag %q: %v", tag, err)
+			continue
+		}
+		var p placement
+		if err := json.Unmarshal(buf, &p); err != nil {
+			log.Printf("Ignoring invalid placement tag %q: %v", tag, err)
+			continue
+		}
+		r.PhysicalVolumes = p.PhysicalVolumes
+		r.FailureDomain = p.FailureDomain
+		return r
+	}
+	return r
+}
+
+func splitTags(s string) (tags []string) {
+	for _, tag := range strings.Split(s, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// usableExtents returns the number of extents of a logical volume with
+// this layout that can be allocated from count free extents of the given
+// size, allowing for the dm-integrity metadata of the RAID images.
+func (r VolumeLayout) usableExtents(count, extentSize uint64) uint64 {
+	if r.Integrity {
+		// The metadata of the largest possible volume is an upper
+		// bound for the metadata of the volume that fits.
+		imageSize := r.extentsFree(count) * extentSize / r.dataStripes()
+		metaSize := r.MinNumberOfDevices() * integrityMetadataBytes(imageSize)
+		metaExtents := (metaSize + extentSize - 1) / extentSize
+		if metaExtents >= count {
+			return 0
+		}
+		count -= metaExtents
+	}
+	return r.extentsFree(count)
+}
+
+// integrityMetadataBytes returns an upper bound of the size of the
+// dm-integrity metadata lvm2 allocates for a RAID image of the given size:
+// 4MiB for every started 500MiB of data plus 4MiB for the superblock and
+// journal.
+func integrityMetadataBytes(imageSize uint64) uint64 {
+	return (imageSize/(500<<20)+1)*(4<<20) + 4<<20
+}
+
+// dataStripes returns the number of RAID images a logical volume's data
+// is spread across, disregarding mirrors and parity.
+func (r VolumeLayout) dataStripes() uint64 {
+	switch r.Type {
+	case VolumeTypeRAID1:
+		return 1
+	default:
+		return r.stripes()
+	}
 }
 
 func (r VolumeLayout) extentsFree(count uint64) uint64 {
 	switch r.Type {
-	case VolumeTypeDefault, VolumeTypeLinear, VolumeTypeRAID5, VolumeTypeRAID6:
+	case VolumeTypeDefault, VolumeTypeLinear, VolumeTypeThin:
 		return count
-	case VolumeTypeRAID1, VolumeTypeRAID10:
-		mirrors := r.Mirrors
-		if mirrors == 0 {
-			// Mirrors is unspecified, so we set it to the default value of 1.
-			mirrors = 1
+	case VolumeTypeVDO:
+		// The free extents back a VDO pool whose virtual size is
+		// larger by the virtual ratio.
+		return uint64(float64(count) * r.vdoVirtualRatio())
+	case VolumeTypeStriped, VolumeTypeRAID0:
+		// The data is spread evenly across the stripes.
+		stripes := r.stripes()
+		return count - count%stripes
+	case VolumeTypeRAID0Meta:
+		// Every stripe requires one metadata extent.
+		stripes := r.stripes()
+		if count < stripes {
+			return 0
+		}
+		count -= stripes
+		return count - count%stripes
+	case VolumeTypeRAID4, VolumeTypeRAID5, VolumeTypeRAID6:
+		// Every data or parity subvolume requires one metadata
+		// extent. The remaining extents are spread evenly across
+		// the subvolumes and only the data subvolumes hold data.
+		stripes := r.stripes()
+		devices := r.MinNumberOfDevices()
+		if count < devices {
+			return 0
 		}
-		copies := mirrors + 1
-		// Every copy of the data requires at least one extent.
+		count -= devices
+		return count / devices * stripes
+	case VolumeTypeRAID1, VolumeTypeRAID10:
+		copies := r.mirrors() + 1
+		// Every data subvolume requires one metadata extent. For
+		// RAID1 there is one data subvolume per copy, for RAID10
+		// one per copy of every stripe.
 		//
 		// Note that RAID volumes require extra space:
 		//
@@ -156,15 +674,41 @@ func (r VolumeLayout) extentsFree(count uint64) uint64 {
 		// lv_rimage_2, and lv_rimage_3).
 		//
 		// ~ https://access.redhat.com/documentation/en-us/red_hat_enterprise_linux/6/html/logical_volume_manager_administration/raid_volumes#create-raid
-		count -= copies
+		devices := r.MinNumberOfDevices()
+		if count < devices {
+			return 0
+		}
+		count -= devices
 		// Divide the remaining extents by the number of copies.
 		count /= copies
+		if r.Type == VolumeTypeRAID10 {
+			stripes := r.stripes()
+			count -= count % stripes
+		}
 		return count
 	default:
 		panic(fmt.Sprintf("unsupported volume type: %v", r.Type))
 	}
 }
 
+// IsShared returns true if the volume group is shared between hosts
+// using lvmlockd.
+func (vg *VolumeGroup) IsShared() (bool, error) {
+	result := new(vgsOutput)
+	if err := run("vgs", result, "--options=vg_lock_type", vg.name); err != nil {
+		if IsVolumeGroupNotFound(err) {
+			return false, ErrVolumeGroupNotFound
+		}
+		return false, err
+	}
+	for _, report := range result.Report {
+		for _, vg := range report.Vg {
+			return vg.VgLockType != "" && vg.VgLockType != "none", nil
+		}
+	}
+	return false, ErrVolumeGroupNotFound
+}
+
 // ExtentSize returns the size in bytes of a single extent.
 func (vg *VolumeGroup) ExtentSize() (uint64, error) {
 	result := new(vgsOutput)
@@ -201,29 +745,17 @@ func (vg *VolumeGroup) ExtentCount() (uint64, error) {
 
 // ExtentFreeCount returns the number of free extents.
 func (vg *VolumeGroup) ExtentFreeCount(raid VolumeLayout) (uint64, error) {
-	pvnames, err := vg.ListPhysicalVolumeNames()
+	devices, count, extentSize, err := vg.freeExtents(raid)
 	if err != nil {
 		return 0, err
 	}
-	if len(pvnames) < int(raid.MinNumberOfDevices()) {
+	if devices < raid.MinNumberOfDevices() {
 		// There aren't any extents free given that the number of
 		// underlying devices is too few to create logical volumes with
 		// this VolumeLayout.
 		return 0, nil
 	}
-	result := new(vgsOutput)
-	if err := run("vgs", result, "--options=vg_free_count,vg_extent_size", vg.name); err != nil {
-		if IsVolumeGroupNotFound(err) {
-			return 0, ErrVolumeGroupNotFound
-		}
-		return 0, err
-	}
-	for _, report := range result.Report {
-		for _, vg := range report.Vg {
-			return raid.extentsFree(vg.VgFreeExtentCount), nil
-		}
-	}
-	return 0, ErrVolumeGroupNotFound
+	return raid.usableExtents(count, extentSize), nil
 }
 
 type LinearConfig struct{}
@@ -241,12 +773,18 @@ type VolumeType struct{ name string }
 var (
 	// VolumeTypeDefault is the zero-value of VolumeType and is used to
 	// specify no --type= flag if an empty VolumeLayout is provided.
-	VolumeTypeDefault VolumeType
-	VolumeTypeLinear  = VolumeType{""}
-	VolumeTypeRAID1   = VolumeType{"raid1"}
-	VolumeTypeRAID5   = VolumeType{"raid5"}
-	VolumeTypeRAID6   = VolumeType{"raid6"}
-	VolumeTypeRAID10  = VolumeType{"raid10"}
+	VolumeTypeDefault   VolumeType
+	VolumeTypeLinear    = VolumeType{""}
+	VolumeTypeStriped   = VolumeType{"striped"}
+	VolumeTypeRAID0     = VolumeType{"raid0"}
+	VolumeTypeRAID0Meta = VolumeType{"raid0_meta"}
+	VolumeTypeRAID1     = VolumeType{"raid1"}
+	VolumeTypeRAID4     = VolumeType{"raid4"}
+	VolumeTypeRAID5     = VolumeType{"raid5"}
+	VolumeTypeRAID6     = VolumeType{"raid6"}
+	VolumeTypeRAID10    = VolumeType{"raid10"}
+	VolumeTypeThin      = VolumeType{"thin"}
+	VolumeTypeVDO       = VolumeType{"vdo"}
 )
 
 // VolumeLayout controls the RAID-related CLI options passed to lvcreate. See the
@@ -259,60 +797,156 @@ type VolumeLayout struct {
 	Mirrors uint64
 	// Stripes corresponds to the --stripes= option to lvcreate.
 	Stripes uint64
-	// StripeSize corresponds to the --stripesize= option to lvcreate.
+	// StripeSize is the stripe size in bytes. It corresponds to the
+	// --stripesize= option to lvcreate.
 	StripeSize uint64
+	// RegionSize is the size in bytes of the regions RAID
+	// synchronization is tracked in. It corresponds to the --regionsize=
+	// option to lvcreate.
+	RegionSize uint64
 	// Nosync corresponds to the --nosync option to lvcreate.
 	Nosync uint64
-}
-
+	// ThinPool corresponds to the --thinpool= option to lvcreate. It
+	// names the pool thin volumes are allocated from.
+	ThinPool string
+	// ThinPoolSize is the size in bytes the thin pool is created with
+	// if it does not exist yet. Zero means it must already exist.
+	ThinPoolSize uint64
+	// ThinPoolLayout is the layout the thin pool is created with if it
+	// does not exist yet.
+	ThinPoolLayout *VolumeLayout
+	// Integrity adds dm-integrity to every image of a RAID volume. It
+	// corresponds to the --raidintegrity option to lvcreate.
+	Integrity bool
+	// IntegrityMode is either "journal" or "bitmap". It corresponds to
+	// the --raidintegritymode option to lvcreate. Empty means the lvm2
+	// default of "journal".
+	IntegrityMode string
+	// VirtualRatio is the ratio of the virtual size of a VDO volume to
+	// the physical size of the VDO pool backing it. Zero means 1.
+	VirtualRatio float64
+	// Compression enables compression of the data in a VDO pool.
+	Compression bool
+	// Deduplication enables deduplication of the data in a VDO pool.
+	Deduplication bool
+	// FailureDomain is the tag prefix that assigns physical volumes to
+	// failure domains, such as enclosures. It ends in a separator, see
+	// ValidateFailureDomain. A physical volume belongs to the failure
+	// domain named by its first tag with this prefix. If
+	// set, the copies of the data of a RAID volume are placed in
+	// distinct failure domains: every image of a raid1, raid4, raid5 or
+	// raid6 volume and every image of a mirror set of a raid10 volume.
+	// Physical volumes without such a tag are not used.
+	FailureDomain string
+	// PhysicalVolumes restricts the allocation to the listed physical
+	// volumes. Each entry is either the path of a physical volume or a
+	// tag prefixed with '@' that selects the physical volumes carrying
+	// it, as accepted by lvcreate. Empty means any physical volume in
+	// the volume group.
+	PhysicalVolumes []string
+}
+
+// MinNumberOfDevices returns the number of physical volumes a logical
+// volume with this layout is spread across.
 func (c VolumeLayout) MinNumberOfDevices() uint64 {
 	switch c.Type {
-	case VolumeTypeDefault, VolumeTypeLinear:
+	case VolumeTypeDefault, VolumeTypeLinear, VolumeTypeThin, VolumeTypeVDO:
 		// Linear volumes require no extra metadata extent.
 		return 1
+	case VolumeTypeStriped, VolumeTypeRAID0, VolumeTypeRAID0Meta:
+		return c.stripes()
 	case VolumeTypeRAID1:
-		mirrors := c.Mirrors
-		if mirrors == 0 {
-			// The number of mirrors was unspecified. We assume the
-			// default value of 1.
-			mirrors = 1
-		}
-		return 2 * mirrors
-	case VolumeTypeRAID5:
-		stripes := c.Stripes
-		return stripes + 1
+		return c.mirrors() + 1
+	case VolumeTypeRAID4, VolumeTypeRAID5:
+		// One parity device.
+		return c.stripes() + 1
 	case VolumeTypeRAID6:
-		stripes := c.Stripes
-		return stripes + 2
+		// Two parity devices.
+		return c.stripes() + 2
 	case VolumeTypeRAID10:
-		mirrors := c.Mirrors
-		if mirrors == 0 {
-			mirrors = 1
-		}
-		stripes := c.Stripes
-		if stripes == 0 {
-			stripes = 2
-		}
-		return 2 * mirrors * stripes
+		return c.stripes() * (c.mirrors() + 1)
 	default:
 		panic(fmt.Sprintf("unsupported volume type: %v", c.Type))
 	}
 }
 
+// vdoVirtualRatio returns the ratio of the virtual size of a VDO volume to
+// the physical size of its VDO pool, applying the default of 1 if
+// unspecified.
+func (c VolumeLayout) vdoVirtualRatio() float64 {
+	if c.VirtualRatio == 0 {
+		return 1
+	}
+	return c.VirtualRatio
+}
+
+// vdoPoolSize returns the physical size in bytes of the VDO pool backing a
+// VDO volume of the given virtual size.
+func (c VolumeLayout) vdoPoolSize(sizeInBytes uint64) uint64 {
+	return uint64(math.Ceil(float64(sizeInBytes) / c.vdoVirtualRatio()))
+}
+
+// mirrors returns the number of mirrors, applying the lvcreate default of 1
+// if unspecified.
+func (c VolumeLayout) mirrors() uint64 {
+	if c.Mirrors == 0 {
+		return 1
+	}
+	return c.Mirrors
+}
+
+// stripes returns the number of data stripes, applying the lvcreate
+// default for the volume type if unspecified.
+func (c VolumeLayout) stripes() uint64 {
+	if c.Stripes != 0 {
+		return c.Stripes
+	}
+	switch c.Type {
+	case VolumeTypeRAID0, VolumeTypeRAID0Meta, VolumeTypeRAID4, VolumeTypeRAID5, VolumeTypeRAID10:
+		return 2
+	case VolumeTypeRAID6:
+		return 3
+	default:
+		return 1
+	}
+}
+
 func (c VolumeLayout) Flags() (fs []string) {
 	switch c.Type {
 	case VolumeTypeDefault:
 		// We return no --type flag if no config was specified.
 	case VolumeTypeLinear:
 		fs = append(fs, "")   // This no-op is to remind me that linear is without type parameter.
+	case VolumeTypeStriped:
+		fs = append(fs, "--type=striped")
+	case VolumeTypeRAID0:
+		fs = append(fs, "--type=raid0")
+	case VolumeTypeRAID0Meta:
+		fs = append(fs, "--type=raid0_meta")
 	case VolumeTypeRAID1:
 		fs = append(fs, "--type=raid1")
+	case VolumeTypeRAID4:
+		fs = append(fs, "--type=raid4")
 	case VolumeTypeRAID5:
 		fs = append(fs, "--type=raid5")
 	case VolumeTypeRAID6:
 		fs = append(fs, "--type=raid6")
 	case VolumeTypeRAID10:
 		fs = append(fs, "--type=raid10")
+	case VolumeTypeThin:
+		// The thin pool determines the RAID layout of thin volumes.
+		return append(fs, "--type=thin", "--thinpool="+c.ThinPool)
+	case VolumeTypeVDO:
+		yesno := func(b bool) string {
+			if b {
+				return "y"
+			}
+			return "n"
+		}
+		return append(fs,
+			"--type=vdo",
+			"--compression="+yesno(c.Compression),
+			"--deduplication="+yesno(c.Deduplication))
 	default:
 		panic(fmt.Sprintf("lvm: unexpected volume type: %v", c.Type))
 	}
@@ -338,7 +972,14 @@ func (c VolumeLayout) Flags() (fs []string) {
 		// 0 value is an impossible value. Instead, the default value
 		// of 0 for this field type is treated as 'unspecified'.
 	default:
-		fs = append(fs, fmt.Sprintf("--stripesize=%d", c.StripeSize))
+		fs = append(fs, fmt.Sprintf("--stripesize=%dk", c.StripeSize>>10))
+	}
+	switch c.RegionSize {
+	case 0:
+		// We return no --regionsize flag if 0 was specified, which
+		// lets lvcreate pick a region size.
+	default:
+		fs = append(fs, fmt.Sprintf("--regionsize=%dk", c.RegionSize>>10))
 	}
 	switch c.Nosync {
 	case 1:
@@ -346,6 +987,12 @@ func (c VolumeLayout) Flags() (fs []string) {
 	default:
 		// Default behavior of lvmcreate is to synchronize the mirror
 	}
+	if c.Integrity {
+		fs = append(fs, "--raidintegrity=y")
+		if c.IntegrityMode != "" {
+			fs = append(fs, "--raidintegritymode="+c.IntegrityMode)
+		}
+	}
 	return fs
 }
 
@@ -359,6 +1006,76 @@ type CreateLogicalVolumeOpt func(opts *LVOpts)
 
 type LVOpts struct {
 	volumeLayout VolumeLayout
+	cache        Cache
+	allocation   AllocationStrategy
+}
+
+// CacheMode is the caching policy of a cached logical volume.
+type CacheMode struct {
+	name string
+}
+
+var (
+	CacheModeNone         = CacheMode{""}
+	CacheModeWritethrough = CacheMode{"writethrough"}
+	CacheModeWriteback    = CacheMode{"writeback"}
+	CacheModeWritecache   = CacheMode{"writecache"}
+)
+
+// String returns the name of the cache mode as used by lvm2.
+func (m CacheMode) String() string {
+	if m == CacheModeNone {
+		return "none"
+	}
+	return m.name
+}
+
+// Cache describes a cache volume attached to a logical volume. The cache
+// volume is usually placed on faster physical volumes than the volume it
+// caches.
+type Cache struct {
+	Mode CacheMode
+	// SizeInBytes is the size of the cache volume.
+	SizeInBytes uint64
+	// PVTag restricts the cache volume to the physical volumes carrying
+	// this tag. If empty, the cache volume may be placed on any physical
+	// volume in the volume group.
+	PVTag string
+}
+
+// layout returns the layout of the cache volume, which is linear and
+// placed on the physical volumes with the PV tag, if any.
+func (c Cache) layout() VolumeLayout {
+	layout := VolumeLayout{Type: VolumeTypeLinear}
+	if c.PVTag != "" {
+		layout.PhysicalVolumes = []string{"@" + c.PVTag}
+	}
+	return layout
+}
+
+// cacheVolumeSuffix is appended to the name of a logical volume to name
+// its cache volume.
+const cacheVolumeSuffix = "_cache"
+
+// Flags returns the lvconvert flags that attach a cache volume with this
+// configuration.
+func (c Cache) Flags() (fs []string) {
+	switch c.Mode {
+	case CacheModeNone:
+	case CacheModeWritecache:
+		fs = append(fs, "--type=writecache")
+	default:
+		fs = append(fs, "--type=cache", "--cachemode="+c.Mode.name)
+	}
+	return fs
+}
+
+// CacheOpt attaches a cache volume with the given configuration to the new
+// logical volume. It is applied in addition to any VolumeLayoutOpt.
+func CacheOpt(c Cache) CreateLogicalVolumeOpt {
+	return func(o *LVOpts) {
+		o.cache = c
+	}
 }
 
 func (o LVOpts) Flags() (opts []string) {
@@ -389,15 +1106,58 @@ func (vg *VolumeGroup) CreateLogicalVolume(name string, sizeInBytes uint64, tags
 			args = append(args, "--add-tag="+tag)
 		}
 	}
-	args = append(args, fmt.Sprintf("--size=%db", sizeInBytes))
-	args = append(args, "--name="+name)
-	args = append(args, vg.name)
 	opts := new(LVOpts)
 	for _, fn := range optFns {
 		if fn != nil {
 			fn(opts)
 		}
 	}
+	if opts.cache.PVTag != "" {
+		if err := ValidateTag(opts.cache.PVTag); err != nil {
+			return nil, err
+		}
+	}
+	if err := opts.volumeLayout.validatePhysicalVolumes(); err != nil {
+		return nil, err
+	}
+	pvArgs, placement, err := vg.physicalVolumeArgs(opts.volumeLayout)
+	if err != nil {
+		return nil, err
+	}
+	if tag := opts.volumeLayout.placementTag(); tag != "" {
+		args = append(args, "--add-tag="+tag)
+	}
+	// Thin volumes are allocated from their thin pool.
+	if opts.allocation != nil && opts.volumeLayout.Type != VolumeTypeThin {
+		flags, ordered, err := vg.allocationArgs(opts.allocation, opts.volumeLayout)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, flags...)
+		if placement == nil && len(ordered) > 0 {
+			pvArgs = ordered
+		}
+	}
+	thinPool := ""
+	target := vg.name
+	switch opts.volumeLayout.Type {
+	case VolumeTypeThin:
+		thinPool = opts.volumeLayout.ThinPool
+		args = append(args, fmt.Sprintf("--virtualsize=%db", sizeInBytes))
+		// Thin volumes skip activation by default.
+		args = append(args, "--setactivationskip=n")
+	case VolumeTypeVDO:
+		// Every VDO volume is backed by a VDO pool of its own.
+		poolSize := opts.volumeLayout.vdoPoolSize(sizeInBytes)
+		args = append(args, fmt.Sprintf("--size=%db", poolSize))
+		args = append(args, fmt.Sprintf("--virtualsize=%db", sizeInBytes))
+		target = vg.name + "/" + name + vdoPoolSuffix
+	default:
+		args = append(args, fmt.Sprintf("--size=%db", sizeInBytes))
+	}
+	args = append(args, "--name="+name)
+	args = append(args, target)
+	args = append(args, pvArgs...)
 	args = append(args, opts.Flags()...)
 	args = append(args, "-ay")
 	args = append(args, "-y") // Option to answer yes to wipe if LVM detects xfs signature at block 0
@@ -410,14 +1170,398 @@ func (vg *VolumeGroup) CreateLogicalVolume(name string, sizeInBytes uint64, tags
 		}
 		return nil, err
 	}
-	// Clear out residual partition info
-	if err := run("wipefs", nil, "--all", "/dev/"+vg.name+"/"+name); err != nil {
-		log.Printf("Error wiping signature block: %v", err)
+	if placement != nil {
+		if err := vg.verifyFailureDomains(name, opts.volumeLayout, placement); err != nil {
+			if err := run("lvremove", nil, "-f", vg.name+"/"+name); err != nil {
+				log.Printf("Failed to remove %v after failing to spread it across failure domains: %v", name, err)
+			}
+			return nil, err
+		}
+	}
+	// Clear out residual partition info
+	if err := run("wipefs", nil, "--all", "/dev/"+vg.name+"/"+name); err != nil {
+		log.Printf("Error wiping signature block: %v", err)
+	}
+	if opts.cache.Mode != CacheModeNone {
+		if err := vg.attachCache(name, opts.cache); err != nil {
+			if err := run("lvremove", nil, "-f", vg.name+"/"+name); err != nil {
+				log.Printf("Failed to remove %v after failing to attach its cache: %v", name, err)
+			}
+			return nil, err
+		}
+	}
+	// If new LV is not activated the --nosyn will be ignored
+	newlv := &LogicalVolume{name, sizeInBytes, vg}
+	newlv.Deactivate() // Don't activate new LVs.  Let Node Publish do it
+	if thinPool != "" {
+		// Release the exclusive lock on the pool so that a node
+		// can activate the new thin volume.
+		vg.deactivateThinPool(thinPool)
+	}
+	return newlv, nil
+}
+
+// attachCache creates a cache volume for the named logical volume and
+// attaches it. The cache volume is hidden once it is attached and is
+// removed together with the logical volume.
+func (vg *VolumeGroup) attachCache(name string, cache Cache) error {
+	cachename := name + cacheVolumeSuffix
+	args := []string{
+		fmt.Sprintf("--size=%db", cache.SizeInBytes),
+		"--name=" + cachename,
+		// The cache volume must not be in use when it is attached.
+		"--activate=n",
+		"--zero=n",
+		vg.name,
+	}
+	if cache.PVTag != "" {
+		// Restrict the allocation to the tagged physical volumes.
+		args = append(args, "@"+cache.PVTag)
+	}
+	if err := run("lvcreate", nil, args...); err != nil {
+		if isInsufficientSpace(err) {
+			return ErrNoSpace
+		}
+		return err
+	}
+	args = []string{"--yes", "--cachevol=" + cachename}
+	args = append(args, cache.Flags()...)
+	args = append(args, vg.name+"/"+name)
+	if err := run("lvconvert", nil, args...); err != nil {
+		if err := run("lvremove", nil, "-f", vg.name+"/"+cachename); err != nil {
+			log.Printf("Failed to remove cache volume %v after failed conversion: %v", cachename, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// CacheStats describes the usage of the cache of a cached logical volume.
+// The hit and miss counters are only reported for dm-cache caches and are
+// cumulative since the volume was activated.
+type CacheStats struct {
+	// Name is the name of the cached logical volume.
+	Name        string
+	Mode        CacheMode
+	ReadHits    uint64
+	ReadMisses  uint64
+	WriteHits   uint64
+	WriteMisses uint64
+	// DirtyBlocks is the number of cache blocks not yet written back.
+	DirtyBlocks uint64
+	UsedBlocks  uint64
+	TotalBlocks uint64
+}
+
+// ListCacheStats returns the cache statistics of the cached logical
+// volumes in the volume group. lvm2 only reports statistics for active
+// volumes so inactive volumes are omitted.
+func (vg *VolumeGroup) ListCacheStats() ([]*CacheStats, error) {
+	result := new(lvsOutput)
+	if err := run("lvs", result, "--options=lv_name,segtype,cache_mode,cache_read_hits,cache_read_misses,cache_write_hits,cache_write_misses,cache_dirty_blocks,cache_used_blocks,cache_total_blocks,writecache_total_blocks,writecache_free_blocks,writecache_writeback_blocks", vg.name); err != nil {
+		return nil, err
+	}
+	parse := func(s string) uint64 {
+		v, _ := strconv.ParseUint(s, 10, 64)
+		return v
+	}
+	var stats []*CacheStats
+	for _, report := range result.Report {
+		for _, item := range report.Lv {
+			switch item.SegType {
+			case "cache":
+				if item.CacheTotalBlocks == "" {
+					continue
+				}
+				stats = append(stats, &CacheStats{
+					Name:        item.Name,
+					Mode:        CacheMode{item.CacheMode},
+					ReadHits:    parse(item.CacheReadHits),
+					ReadMisses:  parse(item.CacheReadMisses),
+					WriteHits:   parse(item.CacheWriteHits),
+					WriteMisses: parse(item.CacheWriteMisses),
+					DirtyBlocks: parse(item.CacheDirtyBlocks),
+					UsedBlocks:  parse(item.CacheUsedBlocks),
+					TotalBlocks: parse(item.CacheTotalBlocks),
+				})
+			case "writecache":
+				if item.WritecacheTotalBlocks == "" {
+					continue
+				}
+				total := parse(item.WritecacheTotalBlocks)
+				stats = append(stats, &CacheStats{
+					Name:        item.Name,
+					Mode:        CacheModeWritecache,
+					DirtyBlocks: parse(item.WritecacheWritebackBlocks),
+					UsedBlocks:  total - parse(item.WritecacheFreeBlocks),
+					TotalBlocks: total,
+				})
+			}
+		}
+	}
+	return stats, nil
+}
+
+// CacheMode returns the cache mode of the logical volume, or CacheModeNone
+// if it is not cached.
+func (lv *LogicalVolume) CacheMode() (CacheMode, error) {
+	result := new(lvsOutput)
+	if err := run("lvs", result, "--options=segtype,cache_mode", lv.vg.name+"/"+lv.name); err != nil {
+		if IsLogicalVolumeNotFound(err) {
+			return CacheModeNone, ErrLogicalVolumeNotFound
+		}
+		return CacheModeNone, err
+	}
+	for _, report := range result.Report {
+		for _, item := range report.Lv {
+			switch item.SegType {
+			case "cache":
+				return CacheMode{item.CacheMode}, nil
+			case "writecache":
+				return CacheModeWritecache, nil
+			}
+		}
+	}
+	return CacheModeNone, nil
+}
+
+// SetCacheMode switches a dm-cache volume between the writethrough and
+// writeback cache modes. The volume may be in use. Switching to
+// writethrough first writes back the dirty blocks.
+func (lv *LogicalVolume) SetCacheMode(mode CacheMode) error {
+	if mode != CacheModeWritethrough && mode != CacheModeWriteback {
+		return fmt.Errorf("lvm: cannot switch to cache mode %v", mode)
+	}
+	return run("lvchange", nil, "--cachemode="+mode.name, lv.vg.name+"/"+lv.name)
+}
+
+// vdoPoolSuffix is appended to the name of a VDO volume to name its VDO
+// pool.
+const vdoPoolSuffix = "_vdopool"
+
+// VDOPool describes a VDO pool and the space savings it achieves.
+type VDOPool struct {
+	Name string
+	// SizeInBytes is the physical size of the pool.
+	SizeInBytes uint64
+	// VirtualSizeInBytes is the size of the VDO volume backed by the pool.
+	VirtualSizeInBytes uint64
+	// UsedSizeInBytes is the physical space used by the pool, including
+	// its index and metadata.
+	UsedSizeInBytes uint64
+	// SavingPercent is the percentage of the data written to the pool
+	// that compression and deduplication saved storing.
+	SavingPercent float64
+}
+
+// SavingsRatio returns the ratio of the logical data written to the pool to
+// the physical space it occupies. It returns 1 if nothing was saved.
+func (p *VDOPool) SavingsRatio() float64 {
+	if p.SavingPercent <= 0 || p.SavingPercent >= 100 {
+		return 1
+	}
+	return 100 / (100 - p.SavingPercent)
+}
+
+// ListVDOPools returns the VDO pools in the volume group. The usage of a
+// pool is only reported while it is active.
+func (vg *VolumeGroup) ListVDOPools() ([]*VDOPool, error) {
+	result := new(lvsOutput)
+	if err := run("lvs", result, "--options=lv_name,lv_size,segtype,pool_lv,vdo_used_size,vdo_saving_percent", vg.name); err != nil {
+		return nil, err
+	}
+	var pools []*VDOPool
+	byName := make(map[string]*VDOPool)
+	var vdos []lvsItem
+	for _, report := range result.Report {
+		for _, item := range report.Lv {
+			switch item.SegType {
+			case "vdo-pool":
+				pool := &VDOPool{
+					Name:        item.Name,
+					SizeInBytes: item.LvSize,
+				}
+				pool.UsedSizeInBytes, _ = strconv.ParseUint(item.VdoUsedSize, 10, 64)
+				pool.SavingPercent, _ = strconv.ParseFloat(item.VdoSavingPercent, 64)
+				pools = append(pools, pool)
+				byName[pool.Name] = pool
+			case "vdo":
+				vdos = append(vdos, item)
+			}
+		}
+	}
+	for _, vdo := range vdos {
+		if pool, ok := byName[vdo.PoolLv]; ok {
+			pool.VirtualSizeInBytes += vdo.LvSize
+		}
+	}
+	return pools, nil
+}
+
+// vdoPool returns the VDO pool backing the logical volume or nil if the
+// logical volume is not a VDO volume.
+func (lv *LogicalVolume) vdoPool() (*LogicalVolume, error) {
+	result := new(lvsOutput)
+	if err := run("lvs", result, "--options=segtype,pool_lv", lv.vg.name+"/"+lv.name); err != nil {
+		if IsLogicalVolumeNotFound(err) {
+			return nil, ErrLogicalVolumeNotFound
+		}
+		return nil, err
+	}
+	for _, report := range result.Report {
+		for _, item := range report.Lv {
+			if item.SegType != "vdo" {
+				return nil, nil
+			}
+			return lv.vg.LookupLogicalVolume(item.PoolLv)
+		}
+	}
+	return nil, ErrLogicalVolumeNotFound
+}
+
+// ThinPool describes a thin pool and the space allocated from it.
+type ThinPool struct {
+	Name        string
+	SizeInBytes uint64
+	// DataPercent is the percentage of the pool's data space in use.
+	DataPercent float64
+	// MetadataSizeInBytes is the size of the pool's metadata volume.
+	MetadataSizeInBytes uint64
+	// MetadataPercent is the percentage of the pool's metadata space in use.
+	MetadataPercent float64
+	// VirtualSizeInBytes is the sum of the sizes of the thin volumes
+	// allocated from the pool.
+	VirtualSizeInBytes uint64
+}
+
+const ErrThinPoolNotFound = simpleError("lvm: thin pool not found")
+
+// ListThinPools returns the thin pools in the volume group.
+func (vg *VolumeGroup) ListThinPools() ([]*ThinPool, error) {
+	result := new(lvsOutput)
+	if err := run("lvs", result, "--options=lv_name,lv_size,segtype,pool_lv,data_percent,metadata_percent,lv_metadata_size", vg.name); err != nil {
+		return nil, err
+	}
+	var pools []*ThinPool
+	byName := make(map[string]*ThinPool)
+	var thins []lvsItem
+	for _, report := range result.Report {
+		for _, item := range report.Lv {
+			switch item.SegType {
+			case "thin-pool":
+				pool := &ThinPool{
+					Name:        item.Name,
+					SizeInBytes: item.LvSize,
+				}
+				pool.MetadataSizeInBytes, _ = strconv.ParseUint(item.LvMetadataSize, 10, 64)
+				// The usage is only reported for active pools.
+				if item.DataPercent != "" {
+					pool.DataPercent, _ = strconv.ParseFloat(item.DataPercent, 64)
+				}
+				if item.MetadataPercent != "" {
+					pool.MetadataPercent, _ = strconv.ParseFloat(item.MetadataPercent, 64)
+				}
+				pools = append(pools, pool)
+				byName[pool.Name] = pool
+			case "thin":
+				thins = append(thins, item)
+			}
+		}
+	}
+	for _, thin := range thins {
+		if pool, ok := byName[thin.PoolLv]; ok {
+			pool.VirtualSizeInBytes += thin.LvSize
+		}
+	}
+	return pools, nil
+}
+
+// LookupThinPool returns the thin pool with the given name.
+func (vg *VolumeGroup) LookupThinPool(name string) (*ThinPool, error) {
+	pools, err := vg.ListThinPools()
+	if err != nil {
+		return nil, err
+	}
+	for _, pool := range pools {
+		if pool.Name == name {
+			return pool, nil
+		}
+	}
+	return nil, ErrThinPoolNotFound
+}
+
+// CreateThinPool creates a thin pool of the given size. The pool's data
+// volume is created with the given layout, which may be RAID, and
+// allocated using the strategy, if not nil. It is then converted into a
+// thin pool with a metadata volume sized by lvm2.
+func (vg *VolumeGroup) CreateThinPool(name string, sizeInBytes uint64, layout VolumeLayout, strategy AllocationStrategy) (*ThinPool, error) {
+	if err := ValidateLogicalVolumeName(name); err != nil {
+		return nil, err
+	}
+	if layout.Type == VolumeTypeThin {
+		return nil, errors.New("lvm: a thin pool cannot be allocated from a thin pool")
+	}
+	if err := layout.validatePhysicalVolumes(); err != nil {
+		return nil, err
+	}
+	pvArgs, placement, err := vg.physicalVolumeArgs(layout)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{
+		fmt.Sprintf("--size=%db", sizeInBytes),
+		"--name=" + name,
+		vg.name,
+	}
+	if strategy != nil {
+		flags, ordered, err := vg.allocationArgs(strategy, layout)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, flags...)
+		if placement == nil && len(ordered) > 0 {
+			pvArgs = ordered
+		}
+	}
+	args = append(args, pvArgs...)
+	args = append(args, layout.Flags()...)
+	args = append(args, "-y")
+	if err := run("lvcreate", nil, args...); err != nil {
+		if isInsufficientSpace(err) {
+			return nil, ErrNoSpace
+		}
+		if isInsufficientDevices(err) {
+			return nil, ErrTooFewDisks
+		}
+		return nil, err
+	}
+	if placement != nil {
+		if err := vg.verifyFailureDomains(name, layout, placement); err != nil {
+			if err := run("lvremove", nil, "-f", vg.name+"/"+name); err != nil {
+				log.Printf("Failed to remove %v after failing to spread it across failure domains: %v", name, err)
+			}
+			return nil, err
+		}
+	}
+	if err := run("lvconvert", nil, "--type=thin-pool", "--yes", vg.name+"/"+name); err != nil {
+		if err := run("lvremove", nil, "-f", vg.name+"/"+name); err != nil {
+			log.Printf("Failed to remove %v after failed conversion to thin pool: %v", name, err)
+		}
+		if isInsufficientSpace(err) {
+			return nil, ErrNoSpace
+		}
+		return nil, err
+	}
+	vg.deactivateThinPool(name)
+	return vg.LookupThinPool(name)
+}
+
+// deactivateThinPool deactivates the pool if none of its thin volumes are
+// active. With lvmlockd a thin pool can only be active on one host.
+func (vg *VolumeGroup) deactivateThinPool(name string) {
+	if err := run("lvchange", nil, "-an", vg.name+"/"+name); err != nil {
+		log.Printf("Leaving thin pool %v active: %v", name, err)
 	}
-	// If new LV is not activated the --nosyn will be ignored
-	newlv := &LogicalVolume{name, sizeInBytes, vg}
-	newlv.Deactivate() // Don't activate new LVs.  Let Node Publish do it
-	return newlv, nil
 }
 
 // ValidateLogicalVolumeName validates a volume group name. A valid volume
@@ -439,6 +1583,47 @@ type lvsItem struct {
 	LvSize uint64 `json:"lv_size,string"`
 	LvTags string `json:"lv_tags"`
 	LvUuid string `json:"lv_uuid"`
+	Origin string `json:"origin"`
+	PoolLv string `json:"pool_lv"`
+	// Devices lists the devices of the segment, e.g.
+	// "/dev/sdb(0),/dev/sdc(0)".
+	Devices string `json:"devices"`
+	// LvActive is "active" for volumes that are active on this host.
+	LvActive string `json:"lv_active"`
+	// RAID health fields. These are empty for non-RAID volumes and
+	// the sync fields are empty for inactive volumes.
+	HealthStatus      string `json:"lv_health_status"`
+	SyncPercent       string `json:"sync_percent"`
+	RaidSyncAction    string `json:"raid_sync_action"`
+	RaidMismatchCount string `json:"raid_mismatch_count"`
+	// IntegrityMismatches is empty for volumes without integrity.
+	IntegrityMismatches string `json:"integritymismatches"`
+	// RaidIntegrityMode is "journal" or "bitmap" for RAID volumes with
+	// integrity and empty otherwise.
+	RaidIntegrityMode string `json:"raidintegritymode"`
+	// Thin pool fields.
+	DataPercent     string `json:"data_percent"`
+	MetadataPercent string `json:"metadata_percent"`
+	LvMetadataSize  string `json:"lv_metadata_size"`
+	// Cache fields. These are empty for uncached or inactive volumes.
+	CacheMode                 string `json:"cache_mode"`
+	CacheReadHits             string `json:"cache_read_hits"`
+	CacheReadMisses           string `json:"cache_read_misses"`
+	CacheWriteHits            string `json:"cache_write_hits"`
+	CacheWriteMisses          string `json:"cache_write_misses"`
+	CacheDirtyBlocks          string `json:"cache_dirty_blocks"`
+	CacheUsedBlocks           string `json:"cache_used_blocks"`
+	CacheTotalBlocks          string `json:"cache_total_blocks"`
+	WritecacheTotalBlocks     string `json:"writecache_total_blocks"`
+	WritecacheFreeBlocks      string `json:"writecache_free_blocks"`
+	WritecacheWritebackBlocks string `json:"writecache_writeback_blocks"`
+	// VDO pool fields. These are empty for inactive pools.
+	VdoUsedSize      string `json:"vdo_used_size"`
+	VdoSavingPercent string `json:"vdo_saving_percent"`
+	// Segment fields, reported for the first segment of the volume.
+	SegType     string `json:"segtype"`
+	Stripes     uint64 `json:"stripes,string"`
+	DataStripes uint64 `json:"data_stripes,string"`
 }
 
 func (lv lvsItem) tagList() (tags []string) {
@@ -496,6 +1681,19 @@ func LVMatchTag(tag string) func(lvsItem) bool {
 	}
 }
 
+// LVMatchTagPrefix returns a matcher for logical volumes that carry at
+// least one tag starting with the given prefix.
+func LVMatchTagPrefix(prefix string) func(lvsItem) bool {
+	return func(lv lvsItem) bool {
+		for _, tag := range lv.tagList() {
+			if strings.HasPrefix(tag, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
 // FindLogicalVolume looks up the logical volume in the volume group
 // with the given name.
 func (vg *VolumeGroup) FindLogicalVolume(matchFirst func(lvsItem) bool) (*LogicalVolume, error) {
@@ -525,6 +1723,29 @@ func (vg *VolumeGroup) FindLogicalVolume(matchFirst func(lvsItem) bool) (*Logica
 	return nil, ErrLogicalVolumeNotFound
 }
 
+// FindLogicalVolumes returns all logical volumes in the volume group that
+// are accepted by the match function. If match is nil every logical
+// volume is returned.
+func (vg *VolumeGroup) FindLogicalVolumes(match func(lvsItem) bool) ([]*LogicalVolume, error) {
+	result := new(lvsOutput)
+	if err := run("lvs", result, "--options=lv_name,lv_size,vg_name,lv_tags", vg.Name()); err != nil {
+		return nil, err
+	}
+	var lvs []*LogicalVolume
+	for _, report := range result.Report {
+		for _, lv := range report.Lv {
+			if lv.VgName != vg.Name() {
+				continue
+			}
+			if match != nil && !match(lv) {
+				continue
+			}
+			lvs = append(lvs, &LogicalVolume{lv.Name, lv.LvSize, vg})
+		}
+	}
+	return lvs, nil
+}
+
 func RefreshMetaData() {
 	c := exec.Command("partprobe")
 	log.Printf("Executing: partprobe")
@@ -556,6 +1777,41 @@ func (vg *VolumeGroup) ListLogicalVolumeNames() ([]string, error) {
 	return names, nil
 }
 
+// ListActiveLogicalVolumeNames returns the names of the logical volumes in
+// this volume group that are active on this host.
+func (vg *VolumeGroup) ListActiveLogicalVolumeNames() ([]string, error) {
+	var names []string
+	result := new(lvsOutput)
+	if err := run("lvs", result, "--options=lv_name,vg_name,lv_active", vg.name); err != nil {
+		return nil, err
+	}
+	for _, report := range result.Report {
+		for _, lv := range report.Lv {
+			if lv.VgName == vg.name && lv.LvActive == "active" {
+				names = append(names, lv.Name)
+			}
+		}
+	}
+	return names, nil
+}
+
+// IsActive returns true if the logical volume is active on this host.
+func (lv *LogicalVolume) IsActive() (bool, error) {
+	result := new(lvsOutput)
+	if err := run("lvs", result, "--options=lv_active", lv.vg.name+"/"+lv.name); err != nil {
+		if IsLogicalVolumeNotFound(err) {
+			return false, ErrLogicalVolumeNotFound
+		}
+		return false, err
+	}
+	for _, report := range result.Report {
+		for _, item := range report.Lv {
+			return item.LvActive == "active", nil
+		}
+	}
+	return false, ErrLogicalVolumeNotFound
+}
+
 func IsPhysicalVolumeNotFound(err error) bool {
 	return isPhysicalVolumeNotFound(err) ||
 		isNoPhysicalVolumeLabel(err)
@@ -646,6 +1902,15 @@ func (vg *VolumeGroup) Tags() ([]string, error) {
 	return nil, ErrVolumeGroupNotFound
 }
 
+// ReducePhysicalVolume removes the physical volume from the volume group.
+// It fails if any extents of the physical volume are allocated.
+func (vg *VolumeGroup) ReducePhysicalVolume(pvname string) error {
+	if err := run("vgreduce", nil, vg.name, pvname); err != nil {
+		return err
+	}
+	return nil
+}
+
 // Remove removes the volume group from disk.
 func (vg *VolumeGroup) Remove() error {
 	if err := run("vgremove", nil, "-f", vg.name); err != nil {
@@ -726,7 +1991,456 @@ func (lv *LogicalVolume) Uuid() (string, error) {
 
 
 
+// IsThin returns true if the logical volume is a thin volume allocated
+// from a thin pool.
+func (lv *LogicalVolume) IsThin() (bool, error) {
+	result := new(lvsOutput)
+	if err := run("lvs", result, "--options=segtype", lv.vg.name+"/"+lv.name); err != nil {
+		if IsLogicalVolumeNotFound(err) {
+			return false, ErrLogicalVolumeNotFound
+		}
+		return false, err
+	}
+	for _, report := range result.Report {
+		for _, lv := range report.Lv {
+			// VDO volumes have a pool too, so we check the
+			// segment type rather than the pool.
+			return lv.SegType == "thin", nil
+		}
+	}
+	return false, ErrLogicalVolumeNotFound
+}
+
+// Origin returns the name of the logical volume this volume is a
+// snapshot of. It returns an empty string if the volume is not a
+// snapshot or if the origin of a thin snapshot has since been removed.
+func (lv *LogicalVolume) Origin() (string, error) {
+	result := new(lvsOutput)
+	if err := run("lvs", result, "--options=origin", lv.vg.name+"/"+lv.name); err != nil {
+		if IsLogicalVolumeNotFound(err) {
+			return "", ErrLogicalVolumeNotFound
+		}
+		return "", err
+	}
+	for _, report := range result.Report {
+		for _, lv := range report.Lv {
+			return lv.Origin, nil
+		}
+	}
+	return "", ErrLogicalVolumeNotFound
+}
+
+// CreateSnapshot creates a snapshot of the logical volume with the given
+// name and tags.
+//
+// If the logical volume is a thin volume a thin snapshot is created in
+// the same thin pool and sizeInBytes is ignored. Otherwise a
+// copy-on-write snapshot is created whose exception store is
+// sizeInBytes large. If sizeInBytes is zero the exception store is made
+// as large as the origin so that the snapshot cannot overflow.
+func (lv *LogicalVolume) CreateSnapshot(name string, sizeInBytes uint64, tags []string) (*LogicalVolume, error) {
+	if err := ValidateLogicalVolumeName(name); err != nil {
+		return nil, err
+	}
+	thin, err := lv.IsThin()
+	if err != nil {
+		return nil, err
+	}
+	var args []string
+	for _, tag := range tags {
+		if tag != "" {
+			if err := ValidateTag(tag); err != nil {
+				return nil, err
+			}
+			args = append(args, "--add-tag="+tag)
+		}
+	}
+	args = append(args, "--snapshot")
+	args = append(args, "--name="+name)
+	if thin {
+		// Thin snapshots are flagged to skip activation by default.
+		// Clear that flag so that the snapshot can be activated
+		// like any other logical volume.
+		args = append(args, "--setactivationskip=n")
+	} else {
+		if sizeInBytes == 0 {
+			sizeInBytes = lv.sizeInBytes
+		}
+		args = append(args, fmt.Sprintf("--size=%db", sizeInBytes))
+	}
+	args = append(args, lv.vg.name+"/"+lv.name)
+	args = append(args, "-y")
+	if err := run("lvcreate", nil, args...); err != nil {
+		if isInsufficientSpace(err) {
+			return nil, ErrNoSpace
+		}
+		return nil, err
+	}
+	// The snapshot has the virtual size of its origin.
+	snap := &LogicalVolume{name, lv.sizeInBytes, lv.vg}
+	if thin {
+		// Don't activate new LVs.  Let Node Publish do it. A COW
+		// snapshot is left as it is as it shares the activation of
+		// its origin, which may be published.
+		if err := snap.Deactivate(); err != nil {
+			log.Printf("Failed to deactivate snapshot %v: err=%v", name, err)
+		}
+	}
+	return snap, nil
+}
+
+// CopyFrom performs a full block copy of src onto the logical volume. Both
+// volumes are activated for the duration of the copy and deactivated
+// afterwards. A source that was already active, e.g., as it is published,
+// is left active. The logical volume must be at least as large as src.
+func (lv *LogicalVolume) CopyFrom(src *LogicalVolume) error {
+	if lv.sizeInBytes < src.sizeInBytes {
+		return fmt.Errorf("lvm: cannot copy %d bytes onto %d byte volume", src.sizeInBytes, lv.sizeInBytes)
+	}
+	active, err := src.IsActive()
+	if err != nil {
+		return err
+	}
+	if !active {
+		if err := src.Activate(); err != nil {
+			return err
+		}
+		defer src.Deactivate()
+	}
+	if err := lv.Activate(); err != nil {
+		return err
+	}
+	defer lv.Deactivate()
+	srcPath, err := src.Path()
+	if err != nil {
+		return err
+	}
+	dstPath, err := lv.Path()
+	if err != nil {
+		return err
+	}
+	// Zero blocks must be written too as the destination may hold stale
+	// data from a previously removed logical volume.
+	return run("dd", nil, "if="+srcPath, "of="+dstPath, "bs=4M", "iflag=direct", "oflag=direct", "conv=fsync")
+}
+
+// Health describes the health and synchronization state of a logical
+// volume as reported by lvs. See the lvmraid man page for details.
+type Health struct {
+	// Status is the lv_health_status field. It is empty for healthy
+	// volumes and one of "partial", "refresh needed" or
+	// "mismatches exist" otherwise.
+	Status string
+	// SyncPercent is the percentage of a RAID volume that is in
+	// sync. It is 100 for volumes that are not RAID or not active.
+	SyncPercent float64
+	// SyncAction is the current RAID sync action, for example
+	// "idle", "resync", "recover", "check" or "repair".
+	SyncAction string
+	// MismatchCount is the number of discrepancies found during
+	// the last scrub of a RAID volume.
+	MismatchCount uint64
+	// IntegrityMismatches is the number of corrupt blocks dm-integrity
+	// detected in the images of a RAID volume since it was activated.
+	IntegrityMismatches uint64
+}
+
+// Health returns the health of the logical volume.
+func (lv *LogicalVolume) Health() (Health, error) {
+	healths, err := reportHealth(lv.vg.name + "/" + lv.name)
+	if err != nil {
+		if IsLogicalVolumeNotFound(err) {
+			return Health{}, ErrLogicalVolumeNotFound
+		}
+		return Health{}, err
+	}
+	health, ok := healths[lv.name]
+	if !ok {
+		return Health{}, ErrLogicalVolumeNotFound
+	}
+	return health, nil
+}
+
+// ListHealth returns the health of the logical volumes in the volume group
+// keyed by their names. It runs a single lvs for the whole volume group.
+func (vg *VolumeGroup) ListHealth() (map[string]Health, error) {
+	healths, err := reportHealth(vg.name)
+	if err != nil {
+		if IsVolumeGroupNotFound(err) {
+			return nil, ErrVolumeGroupNotFound
+		}
+		return nil, err
+	}
+	return healths, nil
+}
+
+// healthOptions are the lvs fields a Health is parsed from.
+const healthOptions = "--options=lv_name,lv_health_status,sync_percent,raid_sync_action,raid_mismatch_count"
+
+// reportHealth returns the health of the logical volumes that lvs reports
+// for the target, a volume group or a single logical volume, keyed by
+// their names. The integritymismatches field is only reported by lvm2
+// 2.03.07 and newer, older releases report no integrity mismatches.
+func reportHealth(target string) (map[string]Health, error) {
+	result := new(lvsOutput)
+	err := run("lvs", result, healthOptions+",integritymismatches", target)
+	if err != nil && isUnrecognisedField(err) {
+		result = new(lvsOutput)
+		err = run("lvs", result, healthOptions, target)
+	}
+	if err != nil {
+		return nil, err
+	}
+	healths := make(map[string]Health)
+	for _, report := range result.Report {
+		for _, item := range report.Lv {
+			health, err := item.health()
+			if err != nil {
+				return nil, err
+			}
+			healths[item.Name] = health
+		}
+	}
+	return healths, nil
+}
+
+// health parses the health fields of the lvs item.
+func (item lvsItem) health() (Health, error) {
+	health := Health{
+		Status:      item.HealthStatus,
+		SyncPercent: 100,
+		SyncAction:  item.RaidSyncAction,
+	}
+	if item.SyncPercent != "" {
+		pct, err := strconv.ParseFloat(item.SyncPercent, 64)
+		if err != nil {
+			return Health{}, fmt.Errorf("lvm: cannot parse sync_percent %q: %v", item.SyncPercent, err)
+		}
+		health.SyncPercent = pct
+	}
+	if item.RaidMismatchCount != "" {
+		count, err := strconv.ParseUint(item.RaidMismatchCount, 10, 64)
+		if err != nil {
+			return Health{}, fmt.Errorf("lvm: cannot parse raid_mismatch_count %q: %v", item.RaidMismatchCount, err)
+		}
+		health.MismatchCount = count
+	}
+	if item.IntegrityMismatches != "" {
+		count, err := strconv.ParseUint(item.IntegrityMismatches, 10, 64)
+		if err != nil {
+			return Health{}, fmt.Errorf("lvm: cannot parse integritymismatches %q: %v", item.IntegrityMismatches, err)
+		}
+		health.IntegrityMismatches = count
+	}
+	return health, nil
+}
+
+// isUnrecognisedField returns true if lvm2 rejected a report field as
+// unknown, which happens for fields added by newer lvm2 releases.
+func isUnrecognisedField(err error) bool {
+	return strings.Contains(err.Error(), "Unrecognised field")
+}
+
+// Layout returns the VolumeLayout the logical volume was created with,
+// including the physical volume selection and failure domain it is
+// restricted to.
+func (lv *LogicalVolume) Layout() (VolumeLayout, error) {
+	layout, err := lv.segmentLayout()
+	if err != nil {
+		return VolumeLayout{}, err
+	}
+	tags, err := lv.Tags()
+	if err != nil {
+		return VolumeLayout{}, err
+	}
+	return layout.withPlacement(tags), nil
+}
+
+// segmentLayout returns the VolumeLayout described by the segment of the
+// logical volume.
+func (lv *LogicalVolume) segmentLayout() (VolumeLayout, error) {
+	result := new(lvsOutput)
+	if err := run("lvs", result, "--options=segtype,stripes,data_stripes,pool_lv,origin", lv.vg.name+"/"+lv.name); err != nil {
+		if IsLogicalVolumeNotFound(err) {
+			return VolumeLayout{}, ErrLogicalVolumeNotFound
+		}
+		return VolumeLayout{}, err
+	}
+	for _, report := range result.Report {
+		for _, item := range report.Lv {
+			switch {
+			case item.SegType == "cache" || item.SegType == "writecache":
+				// The layout of a cached volume is that of its
+				// hidden origin volume.
+				origin := &LogicalVolume{strings.Trim(item.Origin, "[]"), 0, lv.vg}
+				return origin.segmentLayout()
+			case item.SegType == "thin":
+				return VolumeLayout{Type: VolumeTypeThin, ThinPool: item.PoolLv}, nil
+			case item.SegType == "vdo":
+				pool, err := lv.vg.LookupLogicalVolume(item.PoolLv)
+				if err != nil {
+					return VolumeLayout{}, err
+				}
+				return VolumeLayout{
+					Type:         VolumeTypeVDO,
+					VirtualRatio: float64(lv.sizeInBytes) / float64(pool.sizeInBytes),
+				}, nil
+			case item.SegType == "linear":
+				return VolumeLayout{Type: VolumeTypeLinear}, nil
+			case item.SegType == "striped":
+				return VolumeLayout{Type: VolumeTypeStriped, Stripes: item.Stripes}, nil
+			case item.SegType == "raid0":
+				return VolumeLayout{Type: VolumeTypeRAID0, Stripes: item.Stripes}, nil
+			case item.SegType == "raid0_meta":
+				return VolumeLayout{Type: VolumeTypeRAID0Meta, Stripes: item.Stripes}, nil
+			case item.SegType == "raid1":
+				return lv.withIntegrity(VolumeLayout{Type: VolumeTypeRAID1, Mirrors: item.Stripes - 1})
+			case strings.HasPrefix(item.SegType, "raid4"):
+				return lv.withIntegrity(VolumeLayout{Type: VolumeTypeRAID4, Stripes: item.DataStripes})
+			case strings.HasPrefix(item.SegType, "raid5"):
+				return lv.withIntegrity(VolumeLayout{Type: VolumeTypeRAID5, Stripes: item.DataStripes})
+			case strings.HasPrefix(item.SegType, "raid6"):
+				return lv.withIntegrity(VolumeLayout{Type: VolumeTypeRAID6, Stripes: item.DataStripes})
+			case item.SegType == "raid10" && item.DataStripes != 0:
+				return lv.withIntegrity(VolumeLayout{
+					Type:    VolumeTypeRAID10,
+					Mirrors: item.Stripes/item.DataStripes - 1,
+					Stripes: item.DataStripes,
+				})
+			default:
+				return VolumeLayout{}, fmt.Errorf("lvm: unsupported segment type %q", item.SegType)
+			}
+		}
+	}
+	return VolumeLayout{}, ErrLogicalVolumeNotFound
+}
+
+// withIntegrity returns the RAID layout with the dm-integrity settings of
+// the logical volume. lvm2 releases without dm-integrity support do not
+// know the raidintegritymode field.
+func (lv *LogicalVolume) withIntegrity(layout VolumeLayout) (VolumeLayout, error) {
+	result := new(lvsOutput)
+	if err := run("lvs", result, "--options=raidintegritymode", lv.vg.name+"/"+lv.name); err != nil {
+		if isUnrecognisedField(err) {
+			return layout, nil
+		}
+		if IsLogicalVolumeNotFound(err) {
+			return VolumeLayout{}, ErrLogicalVolumeNotFound
+		}
+		return VolumeLayout{}, err
+	}
+	for _, report := range result.Report {
+		for _, item := range report.Lv {
+			if item.RaidIntegrityMode != "" {
+				layout.Integrity = true
+				layout.IntegrityMode = item.RaidIntegrityMode
+			}
+			return layout, nil
+		}
+	}
+	return VolumeLayout{}, ErrLogicalVolumeNotFound
+}
+
+// Extend grows the logical volume to the given size. The new extents are
+// allocated with the layout the volume was created with, on the physical
+// volumes it was restricted to. The images of a RAID volume spread across
+// failure domains are extended on the physical volumes they already use.
+//
+// The actual size may be larger than asked for as the smallest
+// increment is the size of an extent on the volume group in question.
+//
+// In a shared volume group the volume may be active on other hosts. Those
+// hosts must call Refresh before they see the new size.
+func (lv *LogicalVolume) Extend(sizeInBytes uint64) error {
+	if sizeInBytes <= lv.sizeInBytes {
+		return nil
+	}
+	args := []string{fmt.Sprintf("--size=%db", sizeInBytes)}
+	shared, err := lv.vg.IsShared()
+	if err != nil {
+		return err
+	}
+	if shared {
+		// Do not require an exclusive lock on the logical volume
+		// so that volumes that are active on other hosts can
+		// be extended.
+		args = append(args, "--lockopt", "skiplv")
+	}
+	pool, err := lv.vdoPool()
+	if err != nil {
+		return err
+	}
+	if pool != nil {
+		// Grow the VDO pool to keep the ratio of the virtual size
+		// to the physical size.
+		layout := VolumeLayout{
+			Type:         VolumeTypeVDO,
+			VirtualRatio: float64(lv.sizeInBytes) / float64(pool.sizeInBytes),
+		}
+		if poolSize := layout.vdoPoolSize(sizeInBytes); poolSize > pool.sizeInBytes {
+			poolArgs := append([]string{fmt.Sprintf("--size=%db", poolSize)}, args[1:]...)
+			if err := pool.extend(poolArgs); err != nil {
+				return err
+			}
+		}
+	}
+	tags, err := lv.Tags()
+	if err != nil {
+		return err
+	}
+	var pvs []string
+	if layout := (VolumeLayout{}).withPlacement(tags); layout.FailureDomain != "" {
+		layout, err := lv.Layout()
+		if err != nil {
+			return err
+		}
+		if err := lv.vg.CheckFailureDomains(layout); err != nil {
+			return err
+		}
+		args = append(args, "--alloc=cling")
+	} else {
+		pvs = layout.PhysicalVolumes
+	}
+	if err := lv.extend(args, pvs...); err != nil {
+		return err
+	}
+	lv.sizeInBytes = sizeInBytes
+	return nil
+}
+
+func (lv *LogicalVolume) extend(args []string, pvs ...string) error {
+	args = append(args, lv.vg.name+"/"+lv.name)
+	args = append(args, pvs...)
+	if err := run("lvextend", nil, args...); err != nil {
+		if isInsufficientSpace(err) {
+			return ErrNoSpace
+		}
+		if isInsufficientDevices(err) {
+			return ErrTooFewDisks
+		}
+		return err
+	}
+	return nil
+}
+
+// Refresh reloads the device-mapper table of an active logical volume
+// from the volume group metadata. It has no effect on inactive volumes.
+func (lv *LogicalVolume) Refresh() error {
+	if err := run("lvchange", nil, "--refresh", lv.vg.name+"/"+lv.name); err != nil {
+		return err
+	}
+	return nil
+}
+
 func (lv *LogicalVolume) Remove() error {
+	pool, err := lv.vdoPool()
+	if err != nil {
+		return err
+	}
+	if pool != nil {
+		// Removing the VDO pool removes the VDO volume, too.
+		lv = pool
+	}
 	if err := run("lvremove", nil, "-f", lv.vg.name+"/"+lv.name); err != nil {
 		return err
 	}
@@ -755,12 +2469,30 @@ func (lv *LogicalVolume) AddTag(tag string) error {
 }
 
 func (lv *LogicalVolume) DeleteTag(tag string) error {
-	if err := run("lvchange", nil, "--addtag", tag, lv.vg.name+"/"+lv.name); err != nil {
+	if err := run("lvchange", nil, "--deltag", tag, lv.vg.name+"/"+lv.name); err != nil {
 		return err
 	}
 	return nil
 }
 
+// ReplaceTags removes and adds the given tags in a single lvchange
+// invocation so that the tags of the logical volume are never observed
+// half updated.
+func (lv *LogicalVolume) ReplaceTags(remove, add []string) error {
+	var args []string
+	for _, tag := range remove {
+		args = append(args, "--deltag", tag)
+	}
+	for _, tag := range add {
+		args = append(args, "--addtag", tag)
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	args = append(args, lv.vg.name+"/"+lv.name)
+	return run("lvchange", nil, args...)
+}
+
 // PVScan runs the `pvscan --cache <dev>` command. It scans for the
 // device at `dev` and adds it to the LVM metadata cache if `lvmetad`
 // is running. If `dev` is an empty string, it scans all devices.
@@ -858,6 +2590,7 @@ type vgsOutput struct {
 			VgExtentCount     uint64 `json:"vg_extent_count,string"`
 			VgFreeExtentCount uint64 `json:"vg_free_count,string"`
 			VgTags            string `json:"vg_tags"`
+			VgLockType        string `json:"vg_lock_type"`
 		} `json:"vg"`
 	} `json:"report"`
 }
@@ -926,6 +2659,9 @@ type pvsOutput struct {
 		Pv []struct {
 			Name   string `json:"pv_name"`
 			VgName string `json:"vg_name"`
+			PvSize uint64 `json:"pv_size,string"`
+			PvFree uint64 `json:"pv_free,string"`
+			PvTags string `json:"pv_tags"`
 		} `json:"pv"`
 	} `json:"report"`
 }
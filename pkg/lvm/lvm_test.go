@@ -461,6 +461,35 @@ func TestCreateLogicalVolume_Tagged(t *testing.T) {
 	}
 }
 
+func TestLogicalVolumeReplaceTags(t *testing.T) {
+	loop, err := CreateLoopDevice(pvsize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loop.Close()
+	vg, cleanup, err := createVolumeGroup([]*LoopDevice{loop}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	name := "test-lv-" + uuid.New().String()
+	lv, err := vg.CreateLogicalVolume(name, 4<<20, []string{"keep", "old-1", "old-2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer check(lv.Remove)
+	if err := lv.ReplaceTags([]string{"old-1", "old-2"}, []string{"new"}); err != nil {
+		t.Fatal(err)
+	}
+	tags, err := lv.Tags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]string{"keep", "new"}, tags) {
+		t.Fatalf("Expected tags %v but got %v", []string{"keep", "new"}, tags)
+	}
+}
+
 func TestCreateLogicalVolume_BadTag(t *testing.T) {
 	loop, err := CreateLoopDevice(pvsize)
 	if err != nil {
@@ -788,204 +817,429 @@ func TestCreateLogicalVolume_VolumeLayout_RAID1_TooFewDisks(t *testing.T) {
 	}
 }
 
-func TestLookupLogicalVolume(t *testing.T) {
-	loop, err := CreateLoopDevice(pvsize)
-	if err != nil {
-		t.Fatal(err)
+func TestCreateLogicalVolume_VolumeLayout_RAID10(t *testing.T) {
+	var loops []*LoopDevice
+	for ii := 0; ii < 4; ii++ {
+		loop, err := CreateLoopDevice(pvsize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer loop.Close()
+		loops = append(loops, loop)
 	}
-	defer loop.Close()
-	vg, cleanup, err := createVolumeGroup([]*LoopDevice{loop}, nil)
+	vg, cleanup, err := createVolumeGroup(loops, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer cleanup()
-	size, err := vg.BytesFree(VolumeLayout{})
+	raid := VolumeLayout{Type: VolumeTypeRAID10, Stripes: 2, Mirrors: 1, StripeSize: 64 << 10, RegionSize: 1 << 20}
+	size, err := vg.BytesFree(raid)
 	if err != nil {
 		t.Fatal(err)
 	}
 	name := "test-lv-" + uuid.New().String()
-	lv, err := vg.CreateLogicalVolume(name, size, nil)
+	lv, err := vg.CreateLogicalVolume(name, size, nil, VolumeLayoutOpt(raid))
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer check(lv.Remove)
-	lv2, err := vg.LookupLogicalVolume(lv.name)
+	layout, err := lv.Layout()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if lv2 == nil {
-		t.Fatal("Expected to find logical volume but did not.")
+	if layout.Type != VolumeTypeRAID10 || layout.Stripes != 2 || layout.Mirrors != 1 {
+		t.Fatalf("Unexpected layout %+v", layout)
 	}
 }
 
-func TestLookupLogicalVolumeNonExistent(t *testing.T) {
-	loop, err := CreateLoopDevice(pvsize)
-	if err != nil {
-		t.Fatal(err)
+func TestCreateLogicalVolume_VolumeLayout_Striped(t *testing.T) {
+	var loops []*LoopDevice
+	for ii := 0; ii < 2; ii++ {
+		loop, err := CreateLoopDevice(pvsize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer loop.Close()
+		loops = append(loops, loop)
 	}
-	defer loop.Close()
-	vg, cleanup, err := createVolumeGroup([]*LoopDevice{loop}, nil)
+	vg, cleanup, err := createVolumeGroup(loops, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer cleanup()
-	size, err := vg.BytesFree(VolumeLayout{})
+	raid := VolumeLayout{Type: VolumeTypeStriped, Stripes: 2}
+	name := "test-lv-" + uuid.New().String()
+	lv, err := vg.CreateLogicalVolume(name, pvsize/2, nil, VolumeLayoutOpt(raid))
 	if err != nil {
 		t.Fatal(err)
 	}
-	name := "test-lv-" + uuid.New().String()
-	lv, err := vg.CreateLogicalVolume(name, size, nil)
+	defer check(lv.Remove)
+	layout, err := lv.Layout()
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer check(lv.Remove)
-	lv2, err := vg.LookupLogicalVolume(lv.name + "a")
-	if err != ErrLogicalVolumeNotFound {
-		t.Fatalf("Expected 'not found' error got %s", err)
+	if layout.Type != VolumeTypeStriped || layout.Stripes != 2 {
+		t.Fatalf("Unexpected layout %+v", layout)
 	}
-	if lv2 != nil {
-		t.Fatal("Expected result to be nil.")
+}
+
+func TestVolumeLayoutSelectsPhysicalVolume(t *testing.T) {
+	layout := VolumeLayout{PhysicalVolumes: []string{"@nvme", "/dev/sdc"}}
+	for _, tc := range []struct {
+		name     string
+		tags     []string
+		selected bool
+	}{
+		{"/dev/sdb", []string{"nvme"}, true},
+		{"/dev/sdb", []string{"hdd", "enclosure1"}, false},
+		{"/dev/sdc", nil, true},
+		{"/dev/sdd", nil, false},
+	} {
+		if got := layout.selectsPhysicalVolume(tc.name, tc.tags); got != tc.selected {
+			t.Fatalf("Expected selected=%v for %v %v", tc.selected, tc.name, tc.tags)
+		}
+	}
+	if !(VolumeLayout{}).selectsPhysicalVolume("/dev/sdd", nil) {
+		t.Fatalf("Expected every physical volume to be selected without restriction")
 	}
 }
 
-func TestLogicalVolumeName(t *testing.T) {
-	loop, err := CreateLoopDevice(pvsize)
-	if err != nil {
+func TestVolumeLayoutFailureDomain(t *testing.T) {
+	layout := VolumeLayout{Type: VolumeTypeRAID1, Mirrors: 1, FailureDomain: "enc-"}
+	for _, tc := range []struct {
+		tags   []string
+		domain string
+	}{
+		{[]string{"hdd", "enc-a"}, "enc-a"},
+		{[]string{"encrypted", "enclosure_meta"}, ""},
+		// The tag must name a failure domain.
+		{[]string{"enc-"}, ""},
+	} {
+		if domain := layout.failureDomain(tc.tags); domain != tc.domain {
+			t.Fatalf("Expected failure domain %q for %v but got %q", tc.domain, tc.tags, domain)
+		}
+	}
+	for _, prefix := range []string{"enc-", "enc_", "enc.", "enc+"} {
+		if err := ValidateFailureDomain(prefix); err != nil {
+			t.Fatalf("Expected %q to be valid but got %v", prefix, err)
+		}
+	}
+	if err := ValidateFailureDomain("enc"); err != ErrInvalidFailureDomain {
+		t.Fatalf("Expected ErrInvalidFailureDomain but got %v", err)
+	}
+	if err := ValidateFailureDomain(""); err == nil {
+		t.Fatal("Expected an error for an empty prefix")
+	}
+}
+
+func TestVolumeLayoutPlacementTag(t *testing.T) {
+	if tag := (VolumeLayout{Type: VolumeTypeRAID1}).placementTag(); tag != "" {
+		t.Fatalf("Expected no placement tag without a restriction but got %q", tag)
+	}
+	layout := VolumeLayout{
+		Type:            VolumeTypeRAID1,
+		PhysicalVolumes: []string{"@nvme", "/dev/sdc"},
+		FailureDomain:   "enclosure-",
+	}
+	tag := layout.placementTag()
+	if err := ValidateTag(tag); err != nil {
 		t.Fatal(err)
 	}
-	defer loop.Close()
-	vg, cleanup, err := createVolumeGroup([]*LoopDevice{loop}, nil)
+	got := VolumeLayout{Type: VolumeTypeRAID1}.withPlacement([]string{"other-tag", tag})
+	if !reflect.DeepEqual(got, layout) {
+		t.Fatalf("Expected %+v but got %+v", layout, got)
+	}
+}
+
+func TestPlaceImages(t *testing.T) {
+	pvs := []allocatablePV{
+		{name: "/dev/sdb", free: 100, domain: "enc-a"},
+		{name: "/dev/sdc", free: 100, domain: "enc-a"},
+		{name: "/dev/sdd", free: 80, domain: "enc-b"},
+		{name: "/dev/sde", free: 90, domain: "enc-b"},
+		{name: "/dev/sdf", free: 500, domain: ""},
+	}
+	raid10 := VolumeLayout{Type: VolumeTypeRAID10, Stripes: 2, Mirrors: 1, FailureDomain: "enc-"}
+	placement, err := placeImages(pvs, raid10)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer cleanup()
-	size, err := vg.BytesFree(VolumeLayout{})
+	var names []string
+	for _, pv := range placement {
+		names = append(names, pv.name)
+	}
+	// Each mirror set of two images spans both enclosures and the
+	// physical volume without a failure domain is not used.
+	exp := []string{"/dev/sdb", "/dev/sde", "/dev/sdc", "/dev/sdd"}
+	if !reflect.DeepEqual(names, exp) {
+		t.Fatalf("Expected placement %v but got %v", exp, names)
+	}
+	raid5 := VolumeLayout{Type: VolumeTypeRAID5, Stripes: 2, FailureDomain: "enc-"}
+	if _, err := placeImages(pvs, raid5); err != ErrTooFewFailureDomains {
+		t.Fatalf("Expected ErrTooFewFailureDomains but got %v", err)
+	}
+	raid1 := VolumeLayout{Type: VolumeTypeRAID1, Mirrors: 1, FailureDomain: "enc-"}
+	if _, err := placeImages(pvs[:3], raid1); err != nil {
+		t.Fatal(err)
+	}
+	raid10.Stripes = 3
+	if _, err := placeImages(pvs, raid10); err != ErrTooFewDisks {
+		t.Fatalf("Expected ErrTooFewDisks but got %v", err)
+	}
+}
+
+func TestAllocationStrategyOrder(t *testing.T) {
+	pvs := []PhysicalVolumeUsage{
+		{Name: "/dev/sdb", Extents: 100, FreeExtents: 10},
+		{Name: "/dev/sdc", Extents: 1000, FreeExtents: 200},
+		{Name: "/dev/sdd", Extents: 100, FreeExtents: 60},
+		{Name: "/dev/sde", Extents: 100, FreeExtents: 0},
+	}
+	for _, tc := range []struct {
+		name  string
+		order []string
+	}{
+		{"least-used", []string{"/dev/sdd", "/dev/sdc", "/dev/sdb"}},
+		{"spread", []string{"/dev/sdc", "/dev/sdd", "/dev/sdb"}},
+		{"contiguous", nil},
+	} {
+		strategy, err := LookupAllocationStrategy(tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if order := strategy.Order(pvs); !reflect.DeepEqual(order, tc.order) {
+			t.Fatalf("Expected %v order %v but got %v", tc.name, tc.order, order)
+		}
+	}
+	strategy, err := LookupAllocationStrategy("cling")
 	if err != nil {
 		t.Fatal(err)
 	}
-	name := "test-lv-" + uuid.New().String()
-	lv, err := vg.CreateLogicalVolume(name, size, nil)
+	if strategy.Policy() != "cling" {
+		t.Fatalf("Expected the cling policy but got %q", strategy.Policy())
+	}
+	if _, err := LookupAllocationStrategy("bogus"); err == nil {
+		t.Fatalf("Expected an error for an unknown strategy")
+	}
+	// The images of a RAID volume must not share physical volumes.
+	anywhere, err := LookupAllocationStrategy("anywhere")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer check(lv.Remove)
-	if lv.Name() != name {
-		t.Fatalf("Expected name %v but got %v.", name, lv.Name())
+	vg := &VolumeGroup{name: "vg"}
+	if _, _, err := vg.allocationArgs(anywhere, VolumeLayout{Type: VolumeTypeRAID1}); err != ErrAllocationAnywhereRAID {
+		t.Fatalf("Expected ErrAllocationAnywhereRAID but got %v", err)
 	}
 }
 
-func TestLogicalVolumeSizeInBytes(t *testing.T) {
-	loop, err := CreateLoopDevice(pvsize)
+func TestCreateLogicalVolume_Spread(t *testing.T) {
+	loop1, err := CreateLoopDevice(pvsize)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer loop.Close()
-	vg, cleanup, err := createVolumeGroup([]*LoopDevice{loop}, nil)
+	defer loop1.Close()
+	loop2, err := CreateLoopDevice(pvsize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loop2.Close()
+	vg, cleanup, err := createVolumeGroup([]*LoopDevice{loop1, loop2}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer cleanup()
-	size, err := vg.BytesFree(VolumeLayout{})
+	pv, err := LookupPhysicalVolume(loop2.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pv.AddTag("second"); err != nil {
+		t.Fatal(err)
+	}
+	second := VolumeLayout{PhysicalVolumes: []string{"@second"}}
+	free, err := vg.BytesFree(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spread, err := LookupAllocationStrategy("spread")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without a strategy lvcreate would use the first physical volume
+	// for both volumes.
+	for i := 0; i < 2; i++ {
+		name := "test-lv-" + uuid.New().String()
+		lv, err := vg.CreateLogicalVolume(name, free/4, nil, AllocationOpt(spread))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer check(lv.Remove)
+	}
+	left, err := vg.BytesFree(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left != free-free/4 {
+		t.Fatalf("Expected one volume on each physical volume but %d of %d bytes are left on the second", left, free)
+	}
+}
+
+func TestCreateLogicalVolume_VolumeLayout_Integrity(t *testing.T) {
+	var loops []*LoopDevice
+	for ii := 0; ii < 2; ii++ {
+		loop, err := CreateLoopDevice(pvsize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer loop.Close()
+		loops = append(loops, loop)
+	}
+	vg, cleanup, err := createVolumeGroup(loops, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer cleanup()
+	raid := VolumeLayout{Type: VolumeTypeRAID1, Mirrors: 1, Integrity: true, IntegrityMode: "bitmap"}
 	name := "test-lv-" + uuid.New().String()
-	lv, err := vg.CreateLogicalVolume(name, size, nil)
+	lv, err := vg.CreateLogicalVolume(name, 20<<20, nil, VolumeLayoutOpt(raid))
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer check(lv.Remove)
-	if lv.SizeInBytes() != size {
-		t.Fatalf("Expected size %v but got %v.", size, lv.SizeInBytes())
-	}
-	lv2, err := vg.LookupLogicalVolume(lv.Name())
+	// The integrity metadata is accounted for when the volume is
+	// extended.
+	layout, err := lv.Layout()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if lv2.SizeInBytes() != lv.SizeInBytes() {
-		t.Fatalf("Expected size %v but got %v.", lv.SizeInBytes(), lv2.SizeInBytes())
+	if !reflect.DeepEqual(layout, raid) {
+		t.Fatalf("Expected layout %+v but got %+v", raid, layout)
 	}
 }
 
-func TestLogicalVolumePath(t *testing.T) {
-	loop, err := CreateLoopDevice(pvsize)
+func TestVolumeGroupBytesFree_PhysicalVolumes(t *testing.T) {
+	loop1, err := CreateLoopDevice(pvsize)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer loop.Close()
-	vg, cleanup, err := createVolumeGroup([]*LoopDevice{loop}, nil)
+	defer loop1.Close()
+	loop2, err := CreateLoopDevice(pvsize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loop2.Close()
+	vg, cleanup, err := createVolumeGroup([]*LoopDevice{loop1, loop2}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer cleanup()
-	size, err := vg.BytesFree(VolumeLayout{})
+	pv, err := LookupPhysicalVolume(loop2.Path())
 	if err != nil {
 		t.Fatal(err)
 	}
+	if err := pv.AddTag("nvme"); err != nil {
+		t.Fatal(err)
+	}
+	total, err := vg.BytesFree(VolumeLayout{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raid := VolumeLayout{PhysicalVolumes: []string{"@nvme"}}
+	size, err := vg.BytesFree(raid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != total/2 {
+		t.Fatalf("Expected only the tagged physical volume to be counted: %d of %d bytes", size, total)
+	}
+	// A RAID1 volume requires two physical volumes, only one is tagged.
+	size, err = vg.BytesFree(VolumeLayout{Type: VolumeTypeRAID1, PhysicalVolumes: []string{"@nvme"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 0 {
+		t.Fatalf("Expected no space for RAID1 on a single physical volume but got %d", size)
+	}
 	name := "test-lv-" + uuid.New().String()
-	lv, err := vg.CreateLogicalVolume(name, size, nil)
+	lv, err := vg.CreateLogicalVolume(name, total/2, nil, VolumeLayoutOpt(raid))
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer check(lv.Remove)
-	path, err := lv.Path()
+	size, err = vg.BytesFree(raid)
 	if err != nil {
 		t.Fatal(err)
 	}
-	exp := fmt.Sprintf("/dev/%s/%s", vg.Name(), lv.Name())
-	if path != exp {
-		t.Fatalf("Expected path %v but got %v.", exp, path)
+	if size != 0 {
+		t.Fatalf("Expected the volume to be allocated on the tagged physical volume but %d bytes are left", size)
 	}
 }
 
-func TestVolumeGroupListLogicalVolumeNames(t *testing.T) {
-	loop, err := CreateLoopDevice(pvsize)
+func TestVolumeGroupBytesFreeCached(t *testing.T) {
+	loop1, err := CreateLoopDevice(pvsize)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer loop.Close()
-	vg, cleanup, err := createVolumeGroup([]*LoopDevice{loop}, nil)
+	defer loop1.Close()
+	loop2, err := CreateLoopDevice(pvsize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loop2.Close()
+	vg, cleanup, err := createVolumeGroup([]*LoopDevice{loop1, loop2}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer cleanup()
-	size, err := vg.BytesFree(VolumeLayout{})
+	pv, err := LookupPhysicalVolume(loop2.Path())
 	if err != nil {
 		t.Fatal(err)
 	}
-	name1 := "test-lv-" + uuid.New().String()
-	lv1, err := vg.CreateLogicalVolume(name1, size/2, nil)
+	if err := pv.AddTag("nvme"); err != nil {
+		t.Fatal(err)
+	}
+	extentSize, err := vg.ExtentSize()
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer check(lv1.Remove)
-	name2 := "test-lv-" + uuid.New().String()
-	lv2, err := vg.CreateLogicalVolume(name2, size/2, nil)
+	total, err := vg.BytesFree(VolumeLayout{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer check(lv2.Remove)
-	lvnames, err := vg.ListLogicalVolumeNames()
+	cache := Cache{Mode: CacheModeWriteback, SizeInBytes: 4 * extentSize}
+	// Without a PV tag the cache volume takes space from the volume.
+	size, err := vg.BytesFreeCached(VolumeLayout{}, cache)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(lvnames) != 2 {
-		t.Fatalf("Expected 2 logical volume but got %d.", len(lvnames))
+	if size != total-cache.SizeInBytes {
+		t.Fatalf("Expected %d bytes but got %d", total-cache.SizeInBytes, size)
 	}
-	for _, name := range []string{name1, name2} {
-		had := false
-		for _, lvname := range lvnames {
-			if name == lvname {
-				had = true
-			}
-		}
-		if !had {
-			t.Fatalf("Expected to find logical volume %v but did not.", name)
-		}
+	// A cache volume on other physical volumes does not.
+	cache.PVTag = "nvme"
+	sas := VolumeLayout{PhysicalVolumes: []string{loop1.Path()}}
+	sasTotal, err := vg.BytesFree(sas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err = vg.BytesFreeCached(sas, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != sasTotal {
+		t.Fatalf("Expected %d bytes but got %d", sasTotal, size)
+	}
+	// A cache volume larger than its physical volumes does not fit.
+	cache.SizeInBytes = total
+	size, err = vg.BytesFreeCached(sas, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 0 {
+		t.Fatalf("Expected no space but got %d bytes", size)
 	}
 }
 
-func TestVolumeGroupListPhysicalVolumeNames(t *testing.T) {
+func TestLogicalVolumeExtend_PhysicalVolumes(t *testing.T) {
 	loop1, err := CreateLoopDevice(pvsize)
 	if err != nil {
 		t.Fatal(err)
@@ -1001,15 +1255,664 @@ func TestVolumeGroupListPhysicalVolumeNames(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer cleanup()
-	exp := []string{loop1.Path(), loop2.Path()}
-	sort.Strings(exp)
-	pvnames, err := vg.ListPhysicalVolumeNames()
+	pv, err := LookupPhysicalVolume(loop2.Path())
 	if err != nil {
 		t.Fatal(err)
 	}
-	sort.Strings(pvnames)
-	if !reflect.DeepEqual(exp, pvnames) {
-		t.Fatalf("Expected pvs %+v but got %+v.", exp, pvnames)
+	if err := pv.AddTag("nvme"); err != nil {
+		t.Fatal(err)
+	}
+	total, err := vg.BytesFree(VolumeLayout{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raid := VolumeLayout{PhysicalVolumes: []string{"@nvme"}}
+	name := "test-lv-" + uuid.New().String()
+	lv, err := vg.CreateLogicalVolume(name, total/4, nil, VolumeLayoutOpt(raid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer check(lv.Remove)
+	layout, err := lv.Layout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(layout.PhysicalVolumes, raid.PhysicalVolumes) {
+		t.Fatalf("Expected the layout to be restricted to %v but got %+v", raid.PhysicalVolumes, layout)
+	}
+	// The new extents are allocated on the tagged physical volume.
+	if err := lv.Extend(total / 2); err != nil {
+		t.Fatal(err)
+	}
+	size, err := vg.BytesFree(raid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 0 {
+		t.Fatalf("Expected the volume to be extended on the tagged physical volume but %d bytes are left", size)
+	}
+	if err := lv.Extend(total); err != ErrNoSpace {
+		t.Fatalf("Expected ErrNoSpace beyond the tagged physical volume but got %v", err)
+	}
+}
+
+func TestCreateLogicalVolume_Cache(t *testing.T) {
+	loop1, err := CreateLoopDevice(pvsize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loop1.Close()
+	loop2, err := CreateLoopDevice(pvsize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loop2.Close()
+	vg, cleanup, err := createVolumeGroup([]*LoopDevice{loop1, loop2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	name := "test-lv-" + uuid.New().String()
+	raid := VolumeLayout{Type: VolumeTypeRAID1}
+	cache := Cache{Mode: CacheModeWriteback, SizeInBytes: 8 << 20}
+	lv, err := vg.CreateLogicalVolume(name, 20<<20, nil, VolumeLayoutOpt(raid), CacheOpt(cache))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer check(lv.Remove)
+	// The layout of a cached volume is that of the volume it caches.
+	layout, err := lv.Layout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layout.Type != VolumeTypeRAID1 {
+		t.Fatalf("Unexpected layout %+v", layout)
+	}
+	// The attached cache volume is not listed.
+	names, err := vg.ListLogicalVolumeNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{name}) {
+		t.Fatalf("Expected volumes %v but got %v", []string{name}, names)
+	}
+}
+
+func TestLogicalVolumeSetCacheMode(t *testing.T) {
+	loop1, err := CreateLoopDevice(pvsize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loop1.Close()
+	loop2, err := CreateLoopDevice(pvsize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loop2.Close()
+	vg, cleanup, err := createVolumeGroup([]*LoopDevice{loop1, loop2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	name := "test-lv-" + uuid.New().String()
+	cache := Cache{Mode: CacheModeWriteback, SizeInBytes: 8 << 20}
+	lv, err := vg.CreateLogicalVolume(name, 20<<20, nil, CacheOpt(cache))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer check(lv.Remove)
+	if mode, err := lv.CacheMode(); err != nil || mode != CacheModeWriteback {
+		t.Fatalf("Expected cache mode %v but got %v (err=%v)", CacheModeWriteback, mode, err)
+	}
+	if err := lv.SetCacheMode(CacheModeWritethrough); err != nil {
+		t.Fatal(err)
+	}
+	if mode, err := lv.CacheMode(); err != nil || mode != CacheModeWritethrough {
+		t.Fatalf("Expected cache mode %v but got %v (err=%v)", CacheModeWritethrough, mode, err)
+	}
+	if err := lv.SetCacheMode(CacheModeWritecache); err == nil {
+		t.Fatal("Expected an error switching to writecache")
+	}
+}
+
+func TestVolumeLayoutUsableExtents_Integrity(t *testing.T) {
+	const extentSize = 4 << 20
+	raid := VolumeLayout{Type: VolumeTypeRAID1}
+	// 1000 free extents hold a RAID1 volume of 499 extents (about
+	// 2GiB) per image. The integrity metadata of each image takes 4
+	// times 4MiB for the data plus 4MiB, that is 5 extents.
+	if got := raid.usableExtents(1000, extentSize); got != 499 {
+		t.Fatalf("Expected 499 extents but got %d", got)
+	}
+	raid.Integrity = true
+	if got, exp := raid.usableExtents(1000, extentSize), uint64((1000-10-2)/2); got != exp {
+		t.Fatalf("Expected %d extents but got %d", exp, got)
+	}
+	// The metadata does not fit.
+	if got := raid.usableExtents(4, extentSize); got != 0 {
+		t.Fatalf("Expected 0 extents but got %d", got)
+	}
+	if flags := raid.Flags(); flags[len(flags)-1] != "--raidintegrity=y" {
+		t.Fatalf("Expected the --raidintegrity flag but got %v", flags)
+	}
+}
+
+func TestVolumeLayoutMinNumberOfDevices(t *testing.T) {
+	for _, tc := range []struct {
+		layout  VolumeLayout
+		devices uint64
+		// extents is the number of usable extents out of 100 free.
+		extents uint64
+	}{
+		{VolumeLayout{Type: VolumeTypeLinear}, 1, 100},
+		{VolumeLayout{Type: VolumeTypeStriped, Stripes: 3}, 3, 99},
+		{VolumeLayout{Type: VolumeTypeRAID0}, 2, 100},
+		{VolumeLayout{Type: VolumeTypeRAID0Meta, Stripes: 3}, 3, 96},
+		{VolumeLayout{Type: VolumeTypeRAID1}, 2, 49},
+		{VolumeLayout{Type: VolumeTypeRAID1, Mirrors: 2}, 3, 32},
+		{VolumeLayout{Type: VolumeTypeRAID4}, 3, 64},
+		{VolumeLayout{Type: VolumeTypeRAID5, Stripes: 4}, 5, 76},
+		{VolumeLayout{Type: VolumeTypeRAID6}, 5, 57},
+		{VolumeLayout{Type: VolumeTypeRAID10}, 4, 48},
+		{VolumeLayout{Type: VolumeTypeRAID10, Stripes: 3, Mirrors: 2}, 9, 30},
+		{VolumeLayout{Type: VolumeTypeVDO}, 1, 100},
+		{VolumeLayout{Type: VolumeTypeVDO, VirtualRatio: 2.5}, 1, 250},
+	} {
+		if got := tc.layout.MinNumberOfDevices(); got != tc.devices {
+			t.Fatalf("%+v: expected %d devices but got %d", tc.layout, tc.devices, got)
+		}
+		if got := tc.layout.extentsFree(100); got != tc.extents {
+			t.Fatalf("%+v: expected %d free extents but got %d", tc.layout, tc.extents, got)
+		}
+	}
+}
+
+func TestLookupLogicalVolume(t *testing.T) {
+	loop, err := CreateLoopDevice(pvsize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loop.Close()
+	vg, cleanup, err := createVolumeGroup([]*LoopDevice{loop}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	size, err := vg.BytesFree(VolumeLayout{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := "test-lv-" + uuid.New().String()
+	lv, err := vg.CreateLogicalVolume(name, size, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer check(lv.Remove)
+	lv2, err := vg.LookupLogicalVolume(lv.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lv2 == nil {
+		t.Fatal("Expected to find logical volume but did not.")
+	}
+}
+
+func TestLookupLogicalVolumeNonExistent(t *testing.T) {
+	loop, err := CreateLoopDevice(pvsize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loop.Close()
+	vg, cleanup, err := createVolumeGroup([]*LoopDevice{loop}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	size, err := vg.BytesFree(VolumeLayout{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := "test-lv-" + uuid.New().String()
+	lv, err := vg.CreateLogicalVolume(name, size, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer check(lv.Remove)
+	lv2, err := vg.LookupLogicalVolume(lv.name + "a")
+	if err != ErrLogicalVolumeNotFound {
+		t.Fatalf("Expected 'not found' error got %s", err)
+	}
+	if lv2 != nil {
+		t.Fatal("Expected result to be nil.")
+	}
+}
+
+func TestLogicalVolumeName(t *testing.T) {
+	loop, err := CreateLoopDevice(pvsize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loop.Close()
+	vg, cleanup, err := createVolumeGroup([]*LoopDevice{loop}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	size, err := vg.BytesFree(VolumeLayout{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := "test-lv-" + uuid.New().String()
+	lv, err := vg.CreateLogicalVolume(name, size, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer check(lv.Remove)
+	if lv.Name() != name {
+		t.Fatalf("Expected name %v but got %v.", name, lv.Name())
+	}
+}
+
+func TestLogicalVolumeSizeInBytes(t *testing.T) {
+	loop, err := CreateLoopDevice(pvsize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loop.Close()
+	vg, cleanup, err := createVolumeGroup([]*LoopDevice{loop}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	size, err := vg.BytesFree(VolumeLayout{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := "test-lv-" + uuid.New().String()
+	lv, err := vg.CreateLogicalVolume(name, size, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer check(lv.Remove)
+	if lv.SizeInBytes() != size {
+		t.Fatalf("Expected size %v but got %v.", size, lv.SizeInBytes())
+	}
+	lv2, err := vg.LookupLogicalVolume(lv.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lv2.SizeInBytes() != lv.SizeInBytes() {
+		t.Fatalf("Expected size %v but got %v.", lv.SizeInBytes(), lv2.SizeInBytes())
+	}
+}
+
+func TestLogicalVolumePath(t *testing.T) {
+	loop, err := CreateLoopDevice(pvsize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loop.Close()
+	vg, cleanup, err := createVolumeGroup([]*LoopDevice{loop}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	size, err := vg.BytesFree(VolumeLayout{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := "test-lv-" + uuid.New().String()
+	lv, err := vg.CreateLogicalVolume(name, size, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer check(lv.Remove)
+	path, err := lv.Path()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := fmt.Sprintf("/dev/%s/%s", vg.Name(), lv.Name())
+	if path != exp {
+		t.Fatalf("Expected path %v but got %v.", exp, path)
+	}
+}
+
+func TestVolumeGroupListLogicalVolumeNames(t *testing.T) {
+	loop, err := CreateLoopDevice(pvsize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loop.Close()
+	vg, cleanup, err := createVolumeGroup([]*LoopDevice{loop}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	size, err := vg.BytesFree(VolumeLayout{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	name1 := "test-lv-" + uuid.New().String()
+	lv1, err := vg.CreateLogicalVolume(name1, size/2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer check(lv1.Remove)
+	name2 := "test-lv-" + uuid.New().String()
+	lv2, err := vg.CreateLogicalVolume(name2, size/2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer check(lv2.Remove)
+	lvnames, err := vg.ListLogicalVolumeNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lvnames) != 2 {
+		t.Fatalf("Expected 2 logical volume but got %d.", len(lvnames))
+	}
+	for _, name := range []string{name1, name2} {
+		had := false
+		for _, lvname := range lvnames {
+			if name == lvname {
+				had = true
+			}
+		}
+		if !had {
+			t.Fatalf("Expected to find logical volume %v but did not.", name)
+		}
+	}
+}
+
+func TestVolumeGroupListPhysicalVolumeNames(t *testing.T) {
+	loop1, err := CreateLoopDevice(pvsize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loop1.Close()
+	loop2, err := CreateLoopDevice(pvsize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loop2.Close()
+	vg, cleanup, err := createVolumeGroup([]*LoopDevice{loop1, loop2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	exp := []string{loop1.Path(), loop2.Path()}
+	sort.Strings(exp)
+	pvnames, err := vg.ListPhysicalVolumeNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(pvnames)
+	if !reflect.DeepEqual(exp, pvnames) {
+		t.Fatalf("Expected pvs %+v but got %+v.", exp, pvnames)
+	}
+}
+
+func TestLogicalVolumeCreateSnapshot(t *testing.T) {
+	loop, err := CreateLoopDevice(pvsize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loop.Close()
+	vg, cleanup, err := createVolumeGroup([]*LoopDevice{loop}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	name := "test-lv-" + uuid.New().String()
+	lv, err := vg.CreateLogicalVolume(name, pvsize/4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer check(lv.Remove)
+	// The origin is active, e.g., as it is published.
+	if err := lv.Activate(); err != nil {
+		t.Fatal(err)
+	}
+	snapname := "test-snap-" + uuid.New().String()
+	tags := []string{"SRC." + name}
+	snap, err := lv.CreateSnapshot(snapname, 0, tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer check(snap.Remove)
+	active, err := lv.IsActive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !active {
+		t.Fatal("Expected the origin to remain active")
+	}
+	origin, err := snap.Origin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if origin != name {
+		t.Fatalf("Expected origin %v but got %v", name, origin)
+	}
+	thin, err := snap.IsThin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thin {
+		t.Fatal("Expected a copy-on-write snapshot")
+	}
+	snaps, err := vg.FindLogicalVolumes(LVMatchTagPrefix("SRC."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snaps) != 1 || snaps[0].Name() != snapname {
+		t.Fatalf("Expected to find snapshot %v but got %v", snapname, snaps)
+	}
+}
+
+func TestLogicalVolumeCopyFrom(t *testing.T) {
+	loop, err := CreateLoopDevice(pvsize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loop.Close()
+	vg, cleanup, err := createVolumeGroup([]*LoopDevice{loop}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	src, err := vg.CreateLogicalVolume("test-lv-"+uuid.New().String(), pvsize/4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer check(src.Remove)
+	dst, err := vg.CreateLogicalVolume("test-lv-"+uuid.New().String(), pvsize/4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer check(dst.Remove)
+	if err := dst.CopyFrom(src); err != nil {
+		t.Fatal(err)
+	}
+	if active, err := src.IsActive(); err != nil || active {
+		t.Fatalf("Expected the source to be deactivated after the copy: active=%v, err=%v", active, err)
+	}
+	// A source that was already active is left active.
+	if err := src.Activate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.CopyFrom(src); err != nil {
+		t.Fatal(err)
+	}
+	if active, err := src.IsActive(); err != nil || !active {
+		t.Fatalf("Expected the source to remain active after the copy: active=%v, err=%v", active, err)
+	}
+	if err := src.Deactivate(); err != nil {
+		t.Fatal(err)
+	}
+	small, err := vg.CreateLogicalVolume("test-lv-"+uuid.New().String(), pvsize/8, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer check(small.Remove)
+	if err := small.CopyFrom(src); err == nil {
+		t.Fatal("Expected copy onto a smaller volume to fail")
+	}
+}
+
+func TestLogicalVolumeExtend(t *testing.T) {
+	loop, err := CreateLoopDevice(pvsize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loop.Close()
+	vg, cleanup, err := createVolumeGroup([]*LoopDevice{loop}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	name := "test-lv-" + uuid.New().String()
+	lv, err := vg.CreateLogicalVolume(name, pvsize/4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer check(lv.Remove)
+	layout, err := lv.Layout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layout.Type != VolumeTypeLinear {
+		t.Fatalf("Expected a linear layout but got %+v", layout)
+	}
+	if err := lv.Extend(pvsize / 2); err != nil {
+		t.Fatal(err)
+	}
+	lv2, err := vg.LookupLogicalVolume(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lv2.SizeInBytes() != pvsize/2 {
+		t.Fatalf("Expected size %v but got %v", pvsize/2, lv2.SizeInBytes())
+	}
+	if err := lv.Extend(pvsize * 2); err != ErrNoSpace {
+		t.Fatalf("Expected ErrNoSpace but got %v", err)
+	}
+}
+
+func TestCreateThinPool(t *testing.T) {
+	loop, err := CreateLoopDevice(pvsize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loop.Close()
+	vg, cleanup, err := createVolumeGroup([]*LoopDevice{loop}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	poolname := "test-pool-" + uuid.New().String()
+	pool, err := vg.CreateThinPool(poolname, pvsize/4, VolumeLayout{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pool.Name != poolname || pool.SizeInBytes != pvsize/4 {
+		t.Fatalf("Unexpected thin pool %+v", pool)
+	}
+	poollv, err := vg.LookupLogicalVolume(poolname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer check(poollv.Remove)
+	// Thin volumes may be larger than their pool.
+	name := "test-lv-" + uuid.New().String()
+	layout := VolumeLayout{Type: VolumeTypeThin, ThinPool: poolname}
+	lv, err := vg.CreateLogicalVolume(name, pvsize/2, nil, VolumeLayoutOpt(layout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer check(lv.Remove)
+	if lv.SizeInBytes() != pvsize/2 {
+		t.Fatalf("Expected size %v but got %v", pvsize/2, lv.SizeInBytes())
+	}
+	got, err := lv.Layout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != VolumeTypeThin || got.ThinPool != poolname {
+		t.Fatalf("Expected a thin layout in pool %v but got %+v", poolname, got)
+	}
+	pool, err = vg.LookupThinPool(poolname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pool.VirtualSizeInBytes != pvsize/2 {
+		t.Fatalf("Expected virtual size %v but got %v", pvsize/2, pool.VirtualSizeInBytes)
+	}
+	if _, err := vg.LookupThinPool("missing-pool"); err != ErrThinPoolNotFound {
+		t.Fatalf("Expected ErrThinPoolNotFound but got %v", err)
+	}
+}
+
+func TestLogicalVolumeHealth(t *testing.T) {
+	loop, err := CreateLoopDevice(pvsize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loop.Close()
+	vg, cleanup, err := createVolumeGroup([]*LoopDevice{loop}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	lv, err := vg.CreateLogicalVolume("test-lv-"+uuid.New().String(), pvsize/4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer check(lv.Remove)
+	health, err := lv.Health()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health.Status != "" || health.SyncPercent != 100 || health.MismatchCount != 0 {
+		t.Fatalf("Expected a healthy volume but got %+v", health)
+	}
+}
+
+func TestVolumeGroupListHealth(t *testing.T) {
+	loop, err := CreateLoopDevice(pvsize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loop.Close()
+	vg, cleanup, err := createVolumeGroup([]*LoopDevice{loop}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	var names []string
+	for i := 0; i < 2; i++ {
+		lv, err := vg.CreateLogicalVolume("test-lv-"+uuid.New().String(), pvsize/4, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer check(lv.Remove)
+		names = append(names, lv.Name())
+	}
+	healths, err := vg.ListHealth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(healths) != len(names) {
+		t.Fatalf("Expected the health of %d volumes but got %+v", len(names), healths)
+	}
+	for _, name := range names {
+		health, ok := healths[name]
+		if !ok {
+			t.Fatalf("Expected the health of %v but got %+v", name, healths)
+		}
+		if health.Status != "" || health.SyncPercent != 100 || health.MismatchCount != 0 {
+			t.Fatalf("Expected a healthy volume but got %+v", health)
+		}
 	}
 }
 
@@ -897,6 +897,186 @@ func BlkID(blkdev string) (string, error) {
 	return "", errors.New("Can't find blockid device on host")
 }
 
+// DevicesBySerial returns the device paths of the drives on the host with
+// the given serial numbers, keyed by serial number. Serials of drives that
+// are not found are missing from the result.
+func DevicesBySerial(serials []string) (map[string]string, error) {
+	sc, connErr := connect()
+	if connErr != nil {
+		return nil, connErr
+	}
+	defer sc.ClientConn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), TIMEOUT)
+	defer cancel()
+	res, err := sc.Client.RetrieveUDev(ctx, &pb.GetUdevReq{})
+	if err != nil {
+		return nil, err
+	}
+	devices := make(map[string]string)
+	for _, serial := range serials {
+		for _, dev := range res.GetDevList() {
+			if strings.TrimSpace(dev.GetSerial()) == serial {
+				devices[serial] = dev.GetHandle()
+				break
+			}
+		}
+	}
+	return devices, nil
+}
+
+// Self-encrypting drive (SED) management. The StoLake agent holds the
+// credentials of the drives it has taken ownership of, so none are passed.
+
+// sedResult converts the result of an SED RPC to an error.
+func sedResult(op, devpath string, res *pb.Res, err error) error {
+	if err != nil {
+		log.Printf("%s %s failed: %v", op, devpath, err)
+		return err
+	}
+	if !res.GetIsTrue() {
+		return fmt.Errorf("virsh: %s %s failed", op, devpath)
+	}
+	return nil
+}
+
+// RetrieveSedDrives returns the device paths of the self-encrypting drives
+// on the host.
+func RetrieveSedDrives() ([]string, error) {
+	sc, connErr := connect()
+	if connErr != nil {
+		return nil, connErr
+	}
+	defer sc.ClientConn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), TIMEOUT)
+	defer cancel()
+	res, err := sc.Client.RetrieveSed(ctx, &pb.GetUdevReq{})
+	if err != nil {
+		return nil, err
+	}
+	var seds []string
+	for _, dev := range res.GetSedList() {
+		seds = append(seds, dev.GetHandle())
+	}
+	return seds, nil
+}
+
+// CheckSed returns true if the agent owns the self-encrypting drive.
+func CheckSed(devpath string) (bool, error) {
+	sc, connErr := connect()
+	if connErr != nil {
+		return false, connErr
+	}
+	defer sc.ClientConn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), TIMEOUT)
+	defer cancel()
+	res, err := sc.Client.CheckSed(ctx, &pb.GetPartReq{DevPath: devpath})
+	return res.GetIsTrue(), err
+}
+
+// TakeOwnershipSed makes the agent take ownership of the self-encrypting
+// drive.
+func TakeOwnershipSed(devpath string) error {
+	sc, connErr := connect()
+	if connErr != nil {
+		return connErr
+	}
+	defer sc.ClientConn.Close()
+	// Taking ownership generates new drive credentials which takes longer
+	// than the regular calls.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	res, err := sc.Client.Takeownership(ctx, &pb.GetPartReq{DevPath: devpath})
+	return sedResult("Takeownership", devpath, res, err)
+}
+
+func LockSed(devpath string) error {
+	sc, connErr := connect()
+	if connErr != nil {
+		return connErr
+	}
+	defer sc.ClientConn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), TIMEOUT)
+	defer cancel()
+	res, err := sc.Client.LockSed(ctx, &pb.GetPartReq{DevPath: devpath})
+	return sedResult("LockSed", devpath, res, err)
+}
+
+func UnlockSed(devpath string) error {
+	sc, connErr := connect()
+	if connErr != nil {
+		return connErr
+	}
+	defer sc.ClientConn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), TIMEOUT)
+	defer cancel()
+	res, err := sc.Client.UnlockSed(ctx, &pb.GetPartReq{DevPath: devpath})
+	return sedResult("UnlockSed", devpath, res, err)
+}
+
+// ConfigureBand configures the locking band of the drive covering the
+// given range.
+func ConfigureBand(devpath string, band, start, end uint64) error {
+	sc, connErr := connect()
+	if connErr != nil {
+		return connErr
+	}
+	defer sc.ClientConn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), TIMEOUT)
+	defer cancel()
+	req := &pb.ConfigBandReq{
+		DevPath: devpath,
+		PartNum: band,
+		PStart:  start,
+		PEnd:    end,
+	}
+	res, err := sc.Client.ConfigureBand(ctx, req)
+	return sedResult("ConfigureBand", devpath, res, err)
+}
+
+func LockBand(devpath string, band uint64) error {
+	sc, connErr := connect()
+	if connErr != nil {
+		return connErr
+	}
+	defer sc.ClientConn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), TIMEOUT)
+	defer cancel()
+	res, err := sc.Client.LockBand(ctx, &pb.PartRmReq{DevPath: devpath, PartNum: band})
+	return sedResult("LockBand", devpath, res, err)
+}
+
+func UnlockBand(devpath string, band uint64) error {
+	sc, connErr := connect()
+	if connErr != nil {
+		return connErr
+	}
+	defer sc.ClientConn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), TIMEOUT)
+	defer cancel()
+	res, err := sc.Client.UnlockBand(ctx, &pb.PartRmReq{DevPath: devpath, PartNum: band})
+	return sedResult("UnlockBand", devpath, res, err)
+}
+
+// GlobalBand is the locking band covering the whole drive.
+const GlobalBand = 0
+
+// ResetSedGlobalBand reconfigures the global band of the self-encrypting
+// drive and leaves the drive locked. The global band always covers the
+// whole drive so its range is left zero. The StoLake agent offers no erase
+// or revert RPC, so this is not a guaranteed crypto-erase: whether the
+// media encryption key is regenerated depends on how the agent configures
+// the band. Drives that must be sanitized need a PSID revert or the
+// drive vendor's erase tool.
+func ResetSedGlobalBand(devpath string) error {
+	if err := UnlockBand(devpath, GlobalBand); err != nil {
+		return err
+	}
+	if err := ConfigureBand(devpath, GlobalBand, 0, 0); err != nil {
+		return err
+	}
+	return LockSed(devpath)
+}
+
 func connect() (*Stolakeclient, error) {
         return stolakeConnect("unix://"+StolakeURL)
 }